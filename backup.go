@@ -59,6 +59,15 @@ func (db *DB) Backup(w io.Writer, since uint64) (uint64, error) {
 //
 // This can be used to backup the data in a database at a given point in time.
 func (stream *Stream) Backup(w io.Writer, since uint64) (uint64, error) {
+	return stream.backup(context.Background(), since, func(list *pb.KVList) error {
+		return writeTo(list, w)
+	})
+}
+
+// backup streams the versions newer than or equal to since, and passes them to write, which is
+// called by a single goroutine. It returns the highest version streamed.
+func (stream *Stream) backup(ctx context.Context, since uint64,
+	write func(list *pb.KVList) error) (uint64, error) {
 	stream.KeyToList = func(key []byte, itr *Iterator) (*pb.KVList, error) {
 		list := &pb.KVList{}
 		for ; itr.Valid(); itr.Next() {
@@ -127,10 +136,10 @@ func (stream *Stream) Backup(w io.Writer, since uint64) (uint64, error) {
 			}
 		}
 		list.Kv = out
-		return writeTo(list, w)
+		return write(list)
 	}
 
-	if err := stream.Orchestrate(context.Background()); err != nil {
+	if err := stream.Orchestrate(ctx); err != nil {
 		return 0, err
 	}
 	return maxVersion, nil
@@ -231,15 +240,24 @@ func (l *KVLoader) Finish() error {
 // DB.Load() should be called on a database that is not running any other
 // concurrent transactions while it is running.
 func (db *DB) Load(r io.Reader, maxPendingWrites int) error {
+	ldr := db.NewKVLoader(maxPendingWrites)
+	if err := db.loadLists(r, ldr); err != nil {
+		return err
+	}
+	return db.finishLoad(ldr)
+}
+
+// loadLists reads the protobuf-encoded lists of entries written by Backup from r, and passes their
+// entries to the loader.
+func (db *DB) loadLists(r io.Reader, ldr *KVLoader) error {
 	br := bufio.NewReaderSize(r, 16<<10)
 	unmarshalBuf := make([]byte, 1<<10)
 
-	ldr := db.NewKVLoader(maxPendingWrites)
 	for {
 		var sz uint64
 		err := binary.Read(br, binary.LittleEndian, &sz)
 		if err == io.EOF {
-			break
+			return nil
 		} else if err != nil {
 			return err
 		}
@@ -269,7 +287,10 @@ func (db *DB) Load(r io.Reader, maxPendingWrites int) error {
 			}
 		}
 	}
+}
 
+// finishLoad waits for the writes of the loader, and marks the loaded versions as committed.
+func (db *DB) finishLoad(ldr *KVLoader) error {
 	if err := ldr.Finish(); err != nil {
 		return err
 	}
@@ -0,0 +1,261 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// BackupTarget stores the objects of backups, like an object store. The names of the objects are
+// made of components separated by slashes. The objstore package provides a target backed by a
+// local directory, and one backed by an S3-compatible object store.
+//
+// The methods can be called concurrently.
+type BackupTarget interface {
+	// Put stores the object, replacing any object with the same name.
+	Put(ctx context.Context, name string, data []byte) error
+	// Get returns the content of the object.
+	Get(ctx context.Context, name string) ([]byte, error)
+	// List returns the names of the objects starting with prefix, in sorted order.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// BackupTargetOptions are the options of the backups to a BackupTarget.
+type BackupTargetOptions struct {
+	// PartSize is the size above which the backup is split into a new part. Each part is a
+	// separate object. Defaults to 64 MB.
+	PartSize int
+	// Concurrency is the number of parts uploaded or downloaded concurrently. Defaults to 4.
+	Concurrency int
+}
+
+// DefaultBackupTargetOptions are the options used for the zero fields of BackupTargetOptions.
+var DefaultBackupTargetOptions = BackupTargetOptions{
+	PartSize:    64 << 20,
+	Concurrency: 4,
+}
+
+func (opt BackupTargetOptions) withDefaults() BackupTargetOptions {
+	if opt.PartSize <= 0 {
+		opt.PartSize = DefaultBackupTargetOptions.PartSize
+	}
+	if opt.Concurrency <= 0 {
+		opt.Concurrency = DefaultBackupTargetOptions.Concurrency
+	}
+	return opt
+}
+
+// backupManifestName is the name of the object, under the name of a backup, listing its parts.
+// It is written last, so a backup without a manifest is incomplete.
+const backupManifestName = "MANIFEST"
+
+type backupManifest struct {
+	Since      uint64       `json:"since"`
+	MaxVersion uint64       `json:"max_version"`
+	Parts      []backupPart `json:"parts"`
+}
+
+type backupPart struct {
+	Name     string `json:"name"`
+	Size     int    `json:"size"`
+	Checksum uint32 `json:"checksum"`
+}
+
+func backupObject(name, object string) string {
+	return strings.TrimSuffix(name, "/") + "/" + object
+}
+
+// BackupTo is like DB.Backup, but it writes the backup to the target, under the given name. See
+// Stream.BackupTo.
+func (db *DB) BackupTo(ctx context.Context, t BackupTarget, name string, since uint64,
+	opt BackupTargetOptions) (uint64, error) {
+	stream := db.NewStream()
+	stream.LogPrefix = "DB.BackupTo"
+	return stream.BackupTo(ctx, t, name, since, opt)
+}
+
+// BackupTo is like Stream.Backup, but it writes the backup to the target, under the given name.
+// The backup is split into parts of about opt.PartSize bytes, uploaded concurrently, and a
+// manifest listing the parts with their checksums is written once all of them have been
+// uploaded. A backup can be restored with DB.LoadFrom.
+func (stream *Stream) BackupTo(ctx context.Context, t BackupTarget, name string, since uint64,
+	opt BackupTargetOptions) (uint64, error) {
+	opt = opt.withDefaults()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	manifest := backupManifest{Since: since}
+	throttle := y.NewThrottle(opt.Concurrency)
+	var buf bytes.Buffer
+	upload := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		data := append([]byte{}, buf.Bytes()...)
+		buf.Reset()
+		part := backupPart{
+			Name:     fmt.Sprintf("part-%06d", len(manifest.Parts)+1),
+			Size:     len(data),
+			Checksum: crc32.Checksum(data, y.CastagnoliCrcTable),
+		}
+		manifest.Parts = append(manifest.Parts, part)
+		if err := throttle.Do(); err != nil {
+			return err
+		}
+		go func() {
+			err := t.Put(ctx, backupObject(name, part.Name), data)
+			throttle.Done(errors.Wrapf(err, "while uploading %s", part.Name))
+		}()
+		return nil
+	}
+
+	// Each part holds whole lists, so that it can be decoded on its own. The lists sent by the
+	// Stream can be several MBs, so they are split to keep the parts close to opt.PartSize.
+	maxVersion, err := stream.backup(ctx, since, func(list *pb.KVList) error {
+		var start, size int
+		for i, kv := range list.Kv {
+			size += proto.Size(kv)
+			if buf.Len()+size < opt.PartSize {
+				continue
+			}
+			if err := writeTo(&pb.KVList{Kv: list.Kv[start : i+1]}, &buf); err != nil {
+				return err
+			}
+			if err := upload(); err != nil {
+				return err
+			}
+			start, size = i+1, 0
+		}
+		if start == len(list.Kv) {
+			return nil
+		}
+		return writeTo(&pb.KVList{Kv: list.Kv[start:]}, &buf)
+	})
+	if err == nil {
+		err = upload()
+	}
+	if ferr := throttle.Finish(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	manifest.MaxVersion = maxVersion
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return 0, err
+	}
+	if err := t.Put(ctx, backupObject(name, backupManifestName), data); err != nil {
+		return 0, errors.Wrap(err, "while uploading the backup manifest")
+	}
+	return maxVersion, nil
+}
+
+// ListBackups returns the names of the complete backups written to the target by BackupTo, in
+// sorted order.
+func ListBackups(ctx context.Context, t BackupTarget) ([]string, error) {
+	names, err := t.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, name := range names {
+		if strings.HasSuffix(name, "/"+backupManifestName) {
+			backups = append(backups, strings.TrimSuffix(name, "/"+backupManifestName))
+		}
+	}
+	return backups, nil
+}
+
+// LoadFrom is like DB.Load, but it restores the backup written to the target by BackupTo under
+// the given name. The parts are downloaded concurrently, opt.Concurrency at a time, and loaded in
+// order. It returns ErrCorruptBackup if a part doesn't match the manifest.
+func (db *DB) LoadFrom(ctx context.Context, t BackupTarget, name string, maxPendingWrites int,
+	opt BackupTargetOptions) error {
+	opt = opt.withDefaults()
+	data, err := t.Get(ctx, backupObject(name, backupManifestName))
+	if err != nil {
+		return errors.Wrapf(err, "while reading the manifest of backup %s", name)
+	}
+	var manifest backupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return errors.Wrapf(err, "while decoding the manifest of backup %s", name)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make([]chan result, len(manifest.Parts))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	// At most opt.Concurrency parts are downloaded, or waiting to be loaded, at any time.
+	slots := make(chan struct{}, opt.Concurrency)
+	go func() {
+		for i, part := range manifest.Parts {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(i int, part backupPart) {
+				data, err := t.Get(ctx, backupObject(name, part.Name))
+				switch {
+				case err != nil:
+					err = errors.Wrapf(err, "while downloading %s", part.Name)
+				case len(data) != part.Size ||
+					crc32.Checksum(data, y.CastagnoliCrcTable) != part.Checksum:
+					err = errors.Wrapf(ErrCorruptBackup, "part %s", part.Name)
+				}
+				results[i] <- result{data: data, err: err}
+			}(i, part)
+		}
+	}()
+
+	ldr := db.NewKVLoader(maxPendingWrites)
+	for i := range manifest.Parts {
+		var res result
+		select {
+		case res = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if res.err != nil {
+			return res.err
+		}
+		if err := db.loadLists(bytes.NewReader(res.data), ldr); err != nil {
+			return err
+		}
+		<-slots
+	}
+	return db.finishLoad(ldr)
+}
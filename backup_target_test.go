@@ -0,0 +1,135 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/badger/v2/objstore"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func testBackupTarget(t *testing.T, target BackupTarget) {
+	ctx := context.Background()
+	opt := BackupTargetOptions{PartSize: 4 << 10, Concurrency: 3}
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for i := 0; i < 3; i++ {
+			wb := db.NewWriteBatch()
+			for j := 0; j < 500; j++ {
+				key := fmt.Sprintf("key-%04d", j)
+				require.NoError(t, wb.Set([]byte(key), []byte(fmt.Sprintf("%s-%d", key, i))))
+			}
+			require.NoError(t, wb.Flush())
+		}
+		want := db.MaxVersion()
+		maxVersion, err := db.BackupTo(ctx, target, "full", 0, opt)
+		require.NoError(t, err)
+		require.Equal(t, want, maxVersion)
+
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("key-0000"), []byte("new"))
+		}))
+		since, err := db.BackupTo(ctx, target, "incremental", maxVersion+1, opt)
+		require.NoError(t, err)
+		require.Equal(t, maxVersion+1, since)
+
+		names, err := target.List(ctx, "full/")
+		require.NoError(t, err)
+		require.True(t, len(names) > 3, "want several parts, got %v", names)
+		backups, err := ListBackups(ctx, target)
+		require.NoError(t, err)
+		require.Equal(t, []string{"full", "incremental"}, backups)
+
+		runBadgerTest(t, nil, func(t *testing.T, out *DB) {
+			require.NoError(t, out.LoadFrom(ctx, target, "full", 16, opt))
+			require.NoError(t, out.LoadFrom(ctx, target, "incremental", 16, opt))
+			require.NoError(t, out.View(func(txn *Txn) error {
+				iopt := DefaultIteratorOptions
+				iopt.AllVersions = true
+				itr := txn.NewIterator(iopt)
+				defer itr.Close()
+				count := 0
+				for itr.Rewind(); itr.Valid(); itr.Next() {
+					count++
+				}
+				require.Equal(t, 1501, count)
+
+				item, err := txn.Get([]byte("key-0000"))
+				require.NoError(t, err)
+				val, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, "new", string(val))
+				item, err = txn.Get([]byte("key-0499"))
+				require.NoError(t, err)
+				val, err = item.ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, "key-0499-2", string(val))
+				return nil
+			}))
+		})
+
+		// A part which doesn't match the manifest fails the load.
+		require.NoError(t, target.Put(ctx, names[len(names)-1], []byte("corrupt")))
+		runBadgerTest(t, nil, func(t *testing.T, out *DB) {
+			err := out.LoadFrom(ctx, target, "full", 16, opt)
+			require.Equal(t, ErrCorruptBackup, errors.Cause(err))
+		})
+	})
+}
+
+func TestBackupToDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	testBackupTarget(t, objstore.NewDir(dir))
+}
+
+func TestBackupToS3(t *testing.T) {
+	srv := objstore.NewS3Server("access", "secret")
+	srv.CreateBucket("backups")
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	testBackupTarget(t, objstore.NewS3(objstore.S3Options{
+		Endpoint:  ts.URL,
+		Bucket:    "backups",
+		AccessKey: "access",
+		SecretKey: "secret",
+	}))
+}
+
+func TestLoadFromIncompleteBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	target := objstore.NewDir(dir)
+	require.NoError(t, target.Put(context.Background(), "partial/part-000001", []byte("data")))
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		backups, err := ListBackups(context.Background(), target)
+		require.NoError(t, err)
+		require.Empty(t, backups)
+		err = db.LoadFrom(context.Background(), target, "partial", 16, BackupTargetOptions{})
+		require.Equal(t, objstore.ErrNotFound, errors.Cause(err))
+		require.True(t, strings.Contains(err.Error(), "manifest"))
+	})
+}
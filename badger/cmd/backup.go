@@ -18,15 +18,27 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"math"
+	"net/url"
 	"os"
+	"strings"
 
 	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/objstore"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 var backupFile string
 
+var targetOpt struct {
+	spec        string
+	name        string
+	partSize    int
+	concurrency int
+}
+
 // backupCmd represents the backup command
 var backupCmd = &cobra.Command{
 	Use:   "backup",
@@ -36,7 +48,14 @@ var backupCmd = &cobra.Command{
 Iterates over each key-value pair, encodes it along with its metadata and
 version in protocol buffers and writes them to a file. This file can later be
 used by the restore command to create an identical copy of the
-database.`,
+database.
+
+With --target, the backup is written to an object store instead, split into
+parts uploaded concurrently, under the name given by --name. The target is
+either dir:<path>, for a local directory, or s3:<endpoint>/<bucket>[/<prefix>],
+for an S3-compatible object store. The S3 credentials are read from the
+AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables, and the
+region from AWS_REGION.`,
 	RunE: doBackup,
 }
 
@@ -46,6 +65,52 @@ func init() {
 		"badger.bak", "File to backup to")
 	backupCmd.Flags().IntVarP(&numVersions, "num-versions", "n",
 		0, "Number of versions to keep. A value <= 0 means keep all versions.")
+	addTargetFlags(backupCmd)
+	backupCmd.Flags().IntVar(&targetOpt.partSize, "part-size",
+		badger.DefaultBackupTargetOptions.PartSize, "Size of the parts of a backup to a target")
+}
+
+func addTargetFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&targetOpt.spec, "target", "",
+		"Object store holding the backup: dir:<path> or s3:<endpoint>/<bucket>[/<prefix>]")
+	cmd.Flags().StringVar(&targetOpt.name, "name", "badger", "Name of the backup in the target")
+	cmd.Flags().IntVar(&targetOpt.concurrency, "concurrency",
+		badger.DefaultBackupTargetOptions.Concurrency,
+		"Number of parts transferred concurrently with a target")
+}
+
+// getBackupTarget returns the backup target described by spec.
+func getBackupTarget(spec string) (badger.BackupTarget, error) {
+	kind := strings.SplitN(spec, ":", 2)
+	if len(kind) != 2 || kind[1] == "" {
+		return nil, errors.Errorf("Invalid target %q, want dir:<path> or s3:<url>", spec)
+	}
+	switch kind[0] {
+	case "dir":
+		return objstore.NewDir(kind[1]), nil
+	case "s3":
+		u, err := url.Parse(kind[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "while parsing target %q", spec)
+		}
+		path := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+		if path[0] == "" {
+			return nil, errors.Errorf("Target %q has no bucket", spec)
+		}
+		opt := objstore.S3Options{
+			Endpoint:  u.Scheme + "://" + u.Host,
+			Bucket:    path[0],
+			Region:    os.Getenv("AWS_REGION"),
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}
+		if len(path) == 2 {
+			opt.Prefix = strings.TrimSuffix(path[1], "/") + "/"
+		}
+		return objstore.NewS3(opt), nil
+	default:
+		return nil, errors.Errorf("Unknown target %q, want dir or s3", kind[0])
+	}
 }
 
 func doBackup(cmd *cobra.Command, args []string) error {
@@ -64,6 +129,19 @@ func doBackup(cmd *cobra.Command, args []string) error {
 	}
 	defer db.Close()
 
+	if targetOpt.spec != "" {
+		target, err := getBackupTarget(targetOpt.spec)
+		if err != nil {
+			return err
+		}
+		_, err = db.BackupTo(context.Background(), target, targetOpt.name, 0,
+			badger.BackupTargetOptions{
+				PartSize:    targetOpt.partSize,
+				Concurrency: targetOpt.concurrency,
+			})
+		return err
+	}
+
 	// Create File
 	f, err := os.Create(backupFile)
 	if err != nil {
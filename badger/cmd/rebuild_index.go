@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var rebuildIndexCmd = &cobra.Command{
+	Use:   "rebuild-index",
+	Short: "Rebuild a secondary index.",
+	Long: `
+This command drops all the entries of a secondary index, and recreates them from the keys under
+its prefix. The index values of a key are its whole value, or with --field, the given field of the
+value split by --separator. The DB must not be in use while the index is rebuilt.
+`,
+	RunE: rebuildIndex,
+}
+
+var rebuildIndexOpt = struct {
+	name      string
+	prefix    string
+	separator string
+	field     int
+	keyPath   string
+}{}
+
+func init() {
+	RootCmd.AddCommand(rebuildIndexCmd)
+	rebuildIndexCmd.Flags().StringVar(&rebuildIndexOpt.name, "name", "", "Name of the index.")
+	rebuildIndexCmd.Flags().StringVar(&rebuildIndexOpt.prefix, "prefix", "",
+		"Prefix of the indexed keys.")
+	rebuildIndexCmd.Flags().StringVar(&rebuildIndexOpt.separator, "separator", ",",
+		"Separator of the fields of the values.")
+	rebuildIndexCmd.Flags().IntVar(&rebuildIndexOpt.field, "field", -1,
+		"Index of the field to index, starting at 0. The whole value is indexed if negative.")
+	rebuildIndexCmd.Flags().StringVar(&rebuildIndexOpt.keyPath, "encryption-key-file", "",
+		"Path of the encryption key file.")
+}
+
+// fieldIndex returns an IndexFunc indexing the given field of the values, or the whole value if
+// field is negative. Values without that field aren't indexed.
+func fieldIndex(sep []byte, field int) badger.IndexFunc {
+	return func(key, value []byte) [][]byte {
+		if field < 0 {
+			return [][]byte{value}
+		}
+		fields := bytes.Split(value, sep)
+		if field >= len(fields) {
+			return nil
+		}
+		return [][]byte{fields[field]}
+	}
+}
+
+func rebuildIndex(cmd *cobra.Command, args []string) error {
+	if rebuildIndexOpt.name == "" {
+		return errors.New("--name is required")
+	}
+	if rebuildIndexOpt.field >= 0 && rebuildIndexOpt.separator == "" {
+		return errors.New("--separator can't be empty with --field")
+	}
+	encKey, err := getKey(rebuildIndexOpt.keyPath)
+	if err != nil {
+		return err
+	}
+	opt := badger.DefaultOptions(sstDir).
+		WithValueDir(vlogDir).
+		WithEncryptionKey(encKey)
+	if len(encKey) > 0 {
+		opt = opt.WithIndexCacheSize(100 << 20)
+	}
+	db, err := badger.Open(opt)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	fn := fieldIndex([]byte(rebuildIndexOpt.separator), rebuildIndexOpt.field)
+	if err := db.RegisterIndex(rebuildIndexOpt.name, []byte(rebuildIndexOpt.prefix), fn); err != nil {
+		return err
+	}
+	return db.RebuildIndex(rebuildIndexOpt.name)
+}
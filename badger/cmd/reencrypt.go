@@ -0,0 +1,84 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/options"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var reencryptCmd = &cobra.Command{
+	Use:   "reencrypt",
+	Short: "Rewrite all the data under a new data key.",
+	Long: `
+This command would rewrite all the tables and value log files under a new data key, and then
+remove the data keys it replaced from the key registry. It should be run after a data key has been
+compromised, or to move the data encrypted with AES-CTR to AES-GCM with --encryption-algo=gcm.
+`,
+	RunE: reencrypt,
+}
+
+var reencryptKeyPath string
+var reencryptKeyProvider string
+var reencryptAlgo string
+
+func init() {
+	RootCmd.AddCommand(reencryptCmd)
+	reencryptCmd.Flags().StringVar(&reencryptKeyPath, "encryption-key-file", "",
+		"Path of the encryption key file.")
+	reencryptCmd.Flags().StringVar(&reencryptKeyProvider, "key-provider", "",
+		"Key provider, as file:<path> or socket:<path>, instead of the encryption key file.")
+	reencryptCmd.Flags().StringVar(&reencryptAlgo, "encryption-algo", "ctr",
+		"AES mode of the rewritten data, ctr or gcm.")
+}
+
+func reencrypt(cmd *cobra.Command, args []string) error {
+	encKey, err := getKey(reencryptKeyPath)
+	if err != nil {
+		return err
+	}
+	kp, err := getKeyProvider(reencryptKeyProvider)
+	if err != nil {
+		return err
+	}
+	var algo options.EncryptionAlgo
+	switch reencryptAlgo {
+	case "ctr":
+		algo = options.AESCTR
+	case "gcm":
+		algo = options.AESGCM
+	default:
+		return errors.Errorf("Invalid encryption algo: %s", reencryptAlgo)
+	}
+	opt := badger.DefaultOptions(sstDir).
+		WithValueDir(vlogDir).
+		WithNumCompactors(0).
+		WithBlockCacheSize(100 << 20).
+		WithIndexCacheSize(200 << 20).
+		WithEncryptionKey(encKey).
+		WithKeyProvider(kp).
+		WithEncryptionAlgo(algo)
+	db, err := badger.Open(opt)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.ReencryptAll()
+}
@@ -17,6 +17,7 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"math"
 	"os"
@@ -39,6 +40,10 @@ It reads a file generated using the backup command (or by calling the
 DB.Backup() API method) and writes each key-value pair found in the file to
 the Badger database.
 
+With --target, the backup written by the backup command to that object store,
+under the name given by --name, is restored instead. See the backup command for
+the format of the target.
+
 Restore creates a new database, and currently does not work on an already
 existing database.`,
 	RunE: doRestore,
@@ -52,6 +57,7 @@ func init() {
 	// and overall finish time.
 	restoreCmd.Flags().IntVarP(&maxPendingWrites, "max-pending-writes", "w",
 		256, "Max number of pending writes at any time while restore")
+	addTargetFlags(restoreCmd)
 }
 
 func doRestore(cmd *cobra.Command, args []string) error {
@@ -74,6 +80,15 @@ func doRestore(cmd *cobra.Command, args []string) error {
 	}
 	defer db.Close()
 
+	if targetOpt.spec != "" {
+		target, err := getBackupTarget(targetOpt.spec)
+		if err != nil {
+			return err
+		}
+		return db.LoadFrom(context.Background(), target, targetOpt.name, maxPendingWrites,
+			badger.BackupTargetOptions{Concurrency: targetOpt.concurrency})
+	}
+
 	// Open File
 	f, err := os.Open(restoreFile)
 	if err != nil {
@@ -19,20 +19,27 @@ package cmd
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/kms"
+	"github.com/pkg/errors"
 
 	"github.com/spf13/cobra"
 )
 
 var oldKeyPath string
 var newKeyPath string
+var oldKeyProvider string
+var newKeyProvider string
 var rotateCmd = &cobra.Command{
 	Use:   "rotate",
 	Short: "Rotate encryption key.",
-	Long:  "Rotate will rotate the old key with new encryption key.",
-	RunE:  doRotate,
+	Long: "Rotate will rotate the old key with new encryption key. The keys can also be " +
+		"held by key providers, given as file:<path of the master key> or " +
+		"socket:<path of the KMS socket>.",
+	RunE: doRotate,
 }
 
 func init() {
@@ -41,6 +48,10 @@ func init() {
 		"", "Path of the old key")
 	rotateCmd.Flags().StringVarP(&newKeyPath, "new-key-path", "n",
 		"", "Path of the new key")
+	rotateCmd.Flags().StringVar(&oldKeyProvider, "old-key-provider",
+		"", "Old key provider, as file:<path> or socket:<path>")
+	rotateCmd.Flags().StringVar(&newKeyProvider, "new-key-provider",
+		"", "New key provider, as file:<path> or socket:<path>")
 }
 
 func doRotate(cmd *cobra.Command, args []string) error {
@@ -48,11 +59,16 @@ func doRotate(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	oldProvider, err := getKeyProvider(oldKeyProvider)
+	if err != nil {
+		return err
+	}
 	opt := badger.KeyRegistryOptions{
 		Dir:                           sstDir,
 		ReadOnly:                      true,
 		EncryptionKey:                 oldKey,
 		EncryptionKeyRotationDuration: 10 * 24 * time.Hour,
+		KeyProvider:                   oldProvider,
 	}
 	kr, err := badger.OpenKeyRegistry(opt)
 	if err != nil {
@@ -62,7 +78,12 @@ func doRotate(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	newProvider, err := getKeyProvider(newKeyProvider)
+	if err != nil {
+		return err
+	}
 	opt.EncryptionKey = newKey
+	opt.KeyProvider = newProvider
 	err = badger.WriteKeyRegistry(kr, opt)
 	if err != nil {
 		return err
@@ -81,3 +102,22 @@ func getKey(path string) ([]byte, error) {
 	}
 	return ioutil.ReadAll(fp)
 }
+
+// getKeyProvider returns the key provider described by spec, or nil if spec is empty.
+func getKeyProvider(spec string) (badger.KeyProvider, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	kind := strings.SplitN(spec, ":", 2)
+	if len(kind) != 2 || kind[1] == "" {
+		return nil, errors.Errorf("Invalid key provider %q, want file:<path> or socket:<path>", spec)
+	}
+	switch kind[0] {
+	case "file":
+		return kms.NewFileProvider(kind[1])
+	case "socket":
+		return kms.NewSocketProvider(kind[1]), nil
+	default:
+		return nil, errors.Errorf("Unknown key provider %q, want file or socket", kind[0])
+	}
+}
@@ -20,9 +20,11 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/kms"
 	"github.com/dgraph-io/badger/v2/y"
 	"github.com/stretchr/testify/require"
 )
@@ -152,3 +154,76 @@ func TestRotatePlainTextToEncrypted(t *testing.T) {
 	})
 	require.NoError(t, db.Close())
 }
+
+// This test shows that rotate tool can move the data keys under a key provider, and back.
+func TestRotateKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key := make([]byte, 32)
+	y.Check2(rand.Read(key))
+	keyPath := filepath.Join(dir, "raw.key")
+	require.NoError(t, ioutil.WriteFile(keyPath, key, 0600))
+	masterKey := make([]byte, 32)
+	y.Check2(rand.Read(masterKey))
+	masterKeyPath := filepath.Join(dir, "master.key")
+	require.NoError(t, ioutil.WriteFile(masterKeyPath, masterKey, 0600))
+
+	dbDir := filepath.Join(dir, "db")
+	opts := badger.DefaultOptions(dbDir).WithEncryptionKey(key).WithBlockCacheSize(1 << 20).
+		WithIndexCacheSize(1 << 20)
+	db, err := badger.Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("foo"), []byte("bar"))
+	}))
+	require.NoError(t, db.Close())
+
+	// Move the data keys from the raw key to the file key provider.
+	sstDir = dbDir
+	oldKeyPath, newKeyPath = keyPath, ""
+	oldKeyProvider, newKeyProvider = "", "file:"+masterKeyPath
+	defer func() { oldKeyProvider, newKeyProvider = "", "" }()
+	require.NoError(t, doRotate(nil, []string{}))
+
+	_, err = badger.Open(opts)
+	require.EqualError(t, err, badger.ErrEncryptionKeyMismatch.Error())
+
+	kp, err := kms.NewFileProvider(masterKeyPath)
+	require.NoError(t, err)
+	popts := badger.DefaultOptions(dbDir).WithKeyProvider(kp).WithBlockCacheSize(1 << 20).
+		WithIndexCacheSize(1 << 20)
+	db, err = badger.Open(popts)
+	require.NoError(t, err)
+	require.NoError(t, db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("foo"))
+		require.NoError(t, err)
+		val, err := item.ValueCopy(nil)
+		require.NoError(t, err)
+		require.Equal(t, []byte("bar"), val)
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	// The master key can be moved to the socket KMS.
+	s, err := kms.NewServer(masterKey)
+	require.NoError(t, err)
+	sock := filepath.Join(dir, "kms.sock")
+	require.NoError(t, s.ListenAndServe(sock))
+	defer s.Close()
+	db, err = badger.Open(popts.WithKeyProvider(kms.NewSocketProvider(sock)))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// And back to the raw key.
+	oldKeyPath, newKeyPath = "", keyPath
+	oldKeyProvider, newKeyProvider = "socket:"+sock, ""
+	require.NoError(t, doRotate(nil, []string{}))
+	db, err = badger.Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	oldKeyProvider = "vault:addr"
+	require.Error(t, doRotate(nil, []string{}))
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/options"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var sstCmd = &cobra.Command{
+	Use:   "sst",
+	Short: "Inspect and produce standalone SSTable files.",
+	// The sst commands work on a single file, so they don't need --dir.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error { return nil },
+}
+
+var sstDumpCmd = &cobra.Command{
+	Use:   "dump",
+	Short: "Print the entries of an SSTable file.",
+	Long: `
+This command prints the key range and every entry of an SSTable file, either written by
+"badger sst build" or copied from the directory of a DB that doesn't use encryption.
+`,
+	RunE: sstDump,
+}
+
+var sstBuildCmd = &cobra.Command{
+	Use:   "build",
+	Short: "Build an SSTable file from key-value pairs.",
+	Long: `
+This command reads key-value pairs from the input file, one per line, with the key and the value
+separated by a tab. The pairs are sorted, and written to a new SSTable file at the given version.
+The file can be loaded into a DB with DB.IngestExternalFiles.
+`,
+	RunE: sstBuild,
+}
+
+var sstOpt = struct {
+	file        string
+	input       string
+	compression uint32
+	version     uint64
+	hexData     bool
+	keyPath     string
+}{}
+
+func init() {
+	RootCmd.AddCommand(sstCmd)
+	sstCmd.AddCommand(sstDumpCmd)
+	sstCmd.AddCommand(sstBuildCmd)
+
+	sstCmd.PersistentFlags().StringVarP(&sstOpt.file, "file", "f", "", "Path of the SSTable file.")
+	sstCmd.PersistentFlags().Uint32Var(&sstOpt.compression, "compression", 0,
+		"Compression type of the SSTable. 0 to disable, 1 for Snappy, and 2 for ZSTD.")
+	sstCmd.PersistentFlags().StringVarP(&sstOpt.keyPath, "encryption-key-file", "e", "",
+		"Path of the encryption key file.")
+	sstCmd.PersistentFlags().BoolVar(&sstOpt.hexData, "hex", false,
+		"If set to true, keys and values are hex encoded.")
+
+	sstBuildCmd.Flags().StringVarP(&sstOpt.input, "input", "i", "",
+		"Path of the input file with tab separated key-value pairs.")
+	sstBuildCmd.Flags().Uint64Var(&sstOpt.version, "version", 1, "Version of the keys.")
+}
+
+func sstOptions() (badger.Options, error) {
+	if sstOpt.file == "" {
+		return badger.Options{}, errors.New("--file is required")
+	}
+	if sstOpt.compression > 2 {
+		return badger.Options{}, errors.New(
+			"compression value must be one of 0 (disabled), 1 (Snappy), or 2 (ZSTD)")
+	}
+	encKey, err := getKey(sstOpt.keyPath)
+	if err != nil {
+		return badger.Options{}, err
+	}
+	return badger.DefaultOptions("").
+		WithCompression(options.CompressionType(sstOpt.compression)).
+		WithEncryptionKey(encKey), nil
+}
+
+func sstFormat(b []byte) string {
+	if sstOpt.hexData {
+		return hex.EncodeToString(b)
+	}
+	return fmt.Sprintf("%q", b)
+}
+
+func sstDump(cmd *cobra.Command, args []string) error {
+	opt, err := sstOptions()
+	if err != nil {
+		return err
+	}
+	r, err := badger.OpenSSTReader(sstOpt.file, opt)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	left, leftVersion := r.Smallest()
+	right, rightVersion := r.Biggest()
+	fmt.Printf("SSTable %s: %s, %d entries, max version %d\n",
+		sstOpt.file, hbytes(r.Size()), r.KeyCount(), r.MaxVersion())
+	fmt.Printf("Key range: %s v%d -> %s v%d\n\n",
+		sstFormat(left), leftVersion, sstFormat(right), rightVersion)
+
+	it := r.NewIterator()
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		var flags string
+		if it.IsDeleted() {
+			flags += " {deleted}"
+		}
+		if it.DiscardEarlierVersions() {
+			flags += " {discard}"
+		}
+		if it.ExpiresAt() > 0 {
+			flags += fmt.Sprintf(" {expires at: %d}", it.ExpiresAt())
+		}
+		fmt.Printf("%s v%d user meta: %d%s -> %s\n", sstFormat(it.Key()), it.Version(),
+			it.UserMeta(), flags, sstFormat(it.Value()))
+	}
+	return nil
+}
+
+func sstBuild(cmd *cobra.Command, args []string) error {
+	opt, err := sstOptions()
+	if err != nil {
+		return err
+	}
+	if sstOpt.input == "" {
+		return errors.New("--input is required")
+	}
+	in, err := os.Open(sstOpt.input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	type kv struct{ key, value []byte }
+	var kvs []kv
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 1<<30)
+	for line := 1; scanner.Scan(); line++ {
+		parts := bytes.SplitN(scanner.Bytes(), []byte{'\t'}, 2)
+		if len(parts) != 2 {
+			return errors.Errorf("line %d: expected a tab separated key-value pair", line)
+		}
+		pair := kv{key: append([]byte{}, parts[0]...), value: append([]byte{}, parts[1]...)}
+		if sstOpt.hexData {
+			if pair.key, err = hex.DecodeString(string(parts[0])); err != nil {
+				return errors.Wrapf(err, "line %d", line)
+			}
+			if pair.value, err = hex.DecodeString(string(parts[1])); err != nil {
+				return errors.Wrapf(err, "line %d", line)
+			}
+		}
+		kvs = append(kvs, pair)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	sort.SliceStable(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].key, kvs[j].key) < 0 })
+
+	w, err := badger.NewSSTWriter(sstOpt.file, opt)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for i, pair := range kvs {
+		if i > 0 && bytes.Equal(pair.key, kvs[i-1].key) {
+			return errors.Errorf("duplicate key: %s", sstFormat(pair.key))
+		}
+		if err := w.Set(pair.key, pair.value, sstOpt.version); err != nil {
+			return err
+		}
+	}
+	if err := w.Finish(); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d keys to %s\n", len(kvs), sstOpt.file)
+	return nil
+}
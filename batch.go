@@ -35,6 +35,14 @@ type WriteBatch struct {
 	isManaged bool
 	commitTs  uint64
 	finished  bool
+
+	// The applied index set by SetAppliedIndex, and the highest version set by the batch.
+	appliedIndex    uint64
+	hasAppliedIndex bool
+	maxVersion      uint64
+	// indexEntry is the entry of the applied index in the open transaction, once SetAppliedIndex
+	// has been called. Its value is set when the transaction is committed.
+	indexEntry *Entry
 }
 
 // NewWriteBatch creates a new WriteBatch. This provides a way to conveniently do a lot of writes,
@@ -42,6 +50,10 @@ type WriteBatch struct {
 // waiting for them to commit, thus achieving good performance. This API hides away the logic of
 // creating and committing transactions. Due to the nature of SSI guaratees provided by Badger,
 // blind writes can never encounter transaction conflicts (ErrConflict).
+//
+// Keys covered by a secondary index can't be written with a WriteBatch, since updating the index
+// needs the old value of the key, which the batch can't read without conflicts. Such writes return
+// ErrIndexedWriteBatch.
 func (db *DB) NewWriteBatch() *WriteBatch {
 	if db.opt.managedTxns {
 		panic("cannot use NewWriteBatch in managed mode. Use NewWriteBatchAt instead")
@@ -50,12 +62,26 @@ func (db *DB) NewWriteBatch() *WriteBatch {
 }
 
 func (db *DB) newWriteBatch(isManaged bool) *WriteBatch {
-	return &WriteBatch{
+	wb := &WriteBatch{
 		db:        db,
 		isManaged: isManaged,
-		txn:       db.newTransaction(true, isManaged),
 		throttle:  y.NewThrottle(16),
 	}
+	wb.newTxn()
+	return wb
+}
+
+func (wb *WriteBatch) newTxn() {
+	wb.txn = wb.db.newTransaction(true, wb.isManaged)
+	wb.txn.inBatch = true
+	wb.txn.commitTs = wb.commitTs
+	wb.indexEntry = nil
+	if wb.hasAppliedIndex {
+		// Room is made for the index right away, so that it fits when the txn is full.
+		if err := wb.addAppliedIndex(); err != nil && wb.err == nil {
+			wb.err = err
+		}
+	}
 }
 
 // SetMaxPendingTxns sets a limit on maximum number of pending transactions while writing batches.
@@ -125,6 +151,9 @@ func (wb *WriteBatch) SetEntryAt(e *Entry, ts uint64) error {
 
 // Should be called with lock acquired.
 func (wb *WriteBatch) handleEntry(e *Entry) error {
+	if e.version > wb.maxVersion {
+		wb.maxVersion = e.version
+	}
 	if err := wb.txn.SetEntry(e); err != ErrTxnTooBig {
 		return err
 	}
@@ -190,9 +219,9 @@ func (wb *WriteBatch) commit() error {
 		wb.err = err
 		return wb.err
 	}
+	wb.setAppliedIndex()
 	wb.txn.CommitWith(wb.callback)
-	wb.txn = wb.db.newTransaction(true, wb.isManaged)
-	wb.txn.commitTs = wb.commitTs
+	wb.newTxn()
 	return wb.err
 }
 
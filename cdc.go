@@ -0,0 +1,304 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// consumerOffsetPrefix is the prefix of the keys holding the offsets of the change consumers.
+var consumerOffsetPrefix = append(append([]byte{}, badgerPrefix...), "cdc!"...)
+
+func consumerOffsetKey(consumer string) []byte {
+	return append(append([]byte{}, consumerOffsetPrefix...), consumer...)
+}
+
+// IsDeletedKV returns true if the KV, as delivered by SubscribeSince or SubscribeConsumer,
+// records the deletion of its key.
+func IsDeletedKV(kv *pb.KV) bool {
+	return len(kv.Meta) > 0 && kv.Meta[0]&bitDelete > 0
+}
+
+// ConsumerOffset returns the commit timestamp up to which the named consumer has processed the
+// changes, as last stored by SetConsumerOffset or SubscribeConsumer. It is zero for a new
+// consumer.
+func (db *DB) ConsumerOffset(consumer string) (uint64, error) {
+	var ts uint64
+	err := db.View(func(txn *Txn) error {
+		item, err := txn.Get(consumerOffsetKey(consumer))
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) != 8 {
+				return errors.Errorf("Invalid offset for consumer %q", consumer)
+			}
+			ts = binary.BigEndian.Uint64(val)
+			return nil
+		})
+	})
+	return ts, err
+}
+
+// SetConsumerOffset stores the commit timestamp up to which the named consumer has processed the
+// changes. The next SubscribeConsumer call for it resumes after that timestamp.
+func (db *DB) SetConsumerOffset(consumer string, ts uint64) error {
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	if err := txn.addEntries(consumerOffsetEntry(consumer, ts)); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+func consumerOffsetEntry(consumer string, ts uint64) *Entry {
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, ts)
+	return &Entry{Key: consumerOffsetKey(consumer), Value: val}
+}
+
+// SubscribeSince is like Subscribe, but it first delivers the changes to the keys with the given
+// prefixes committed after sinceTs, so that a consumer can resume from the commit timestamp of
+// the last change it processed. Each change is delivered once: first from a Stream over a
+// snapshot of the DB, in key order with the versions of each key from the oldest to the newest,
+// and then from the live updates committed after that snapshot, in commit order.
+//
+// The KVs carry their commit timestamp in Version, the user metadata in UserMeta and the
+// deletion marker in Meta, like a backup. Use IsDeletedKV to tell deletions apart. Note that
+// the catch-up can only deliver the versions that compactions haven't discarded yet, so a
+// consumer that falls behind by more than NumVersionsToKeep versions of a key only sees the
+// latest ones.
+//
+// SubscribeSince is not supported in managed mode.
+func (db *DB) SubscribeSince(ctx context.Context, sinceTs uint64, cb func(kv *KVList) error,
+	prefixes ...[]byte) error {
+	return db.subscribeSince(ctx, sinceTs, cb, nil, prefixes)
+}
+
+// SubscribeConsumer is like SubscribeSince, but it resumes from the offset stored for the named
+// consumer, and stores a new offset each time cb returns successfully. The offsets are stored
+// asynchronously, so a consumer could see again some of the changes it processed right before a
+// crash.
+func (db *DB) SubscribeConsumer(ctx context.Context, consumer string,
+	cb func(kv *KVList) error, prefixes ...[]byte) error {
+	sinceTs, err := db.ConsumerOffset(consumer)
+	if err != nil {
+		return err
+	}
+	saveOffset := func(ts uint64) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		if err := txn.addEntries(consumerOffsetEntry(consumer, ts)); err != nil {
+			db.opt.Warningf("Unable to store offset %d for consumer %q: %v", ts, consumer, err)
+			return
+		}
+		// The callback of the subscriber shouldn't block on the write, which needs the
+		// publisher to make progress.
+		txn.CommitWith(func(err error) {
+			if err != nil {
+				db.opt.Warningf("Unable to store offset %d for consumer %q: %v",
+					ts, consumer, err)
+			}
+		})
+	}
+	return db.subscribeSince(ctx, sinceTs, cb, saveOffset, prefixes)
+}
+
+func (db *DB) subscribeSince(ctx context.Context, sinceTs uint64, cb func(kv *KVList) error,
+	saveOffset func(ts uint64), prefixes [][]byte) error {
+	if cb == nil {
+		return ErrNilCallback
+	}
+	catchUp := func() (uint64, error) {
+		return db.catchUp(ctx, sinceTs, cb, prefixes)
+	}
+	return db.subscribeAfter(ctx, SubscribeOptions{Prefixes: prefixes}, sinceTs, catchUp, cb,
+		saveOffset)
+}
+
+// subscribeAfter subscribes to the live updates, then runs catchUp, which delivers the changes
+// committed after sinceTs as of a snapshot and returns the read timestamp of the snapshot, and
+// then delivers to cb the live updates committed after that snapshot.
+func (db *DB) subscribeAfter(ctx context.Context, opt SubscribeOptions, sinceTs uint64,
+	catchUp func() (uint64, error), cb func(kv *KVList) error, saveOffset func(ts uint64)) error {
+	if db.opt.managedTxns {
+		return ErrManagedTxn
+	}
+
+	// Register for the live updates before picking the snapshot. Any commit after the snapshot
+	// is published after this point, and the ones at or before it are left to the catch-up.
+	c := z.NewCloser(1)
+	s, err := db.pub.newSubscriber(c, opt, true)
+	if err != nil {
+		return err
+	}
+
+	// Buffer the live updates during the catch-up, so that the publisher doesn't block on us.
+	var (
+		pending []subscriberUpdate
+		stop    = make(chan struct{})
+		stopped = make(chan struct{})
+	)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case u := <-s.sendCh:
+				pending = append(pending, u)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	readTs, err := catchUp()
+	close(stop)
+	<-stopped
+	if err == nil && saveOffset != nil && readTs > sinceTs {
+		saveOffset(readTs)
+	}
+
+	deliver := func(list *KVList) error {
+		var out KVList
+		for _, kv := range list.Kv {
+			if kv.Version > readTs && !bytes.HasPrefix(kv.Key, badgerPrefix) {
+				out.Kv = append(out.Kv, kv)
+			}
+		}
+		if len(out.Kv) == 0 {
+			return nil
+		}
+		if err := cb(&out); err != nil {
+			return err
+		}
+		if saveOffset != nil {
+			saveOffset(out.Kv[len(out.Kv)-1].Version)
+		}
+		return nil
+	}
+	if err != nil {
+		s.stop()
+		c.Done()
+		db.pub.deleteSubscriber(s.id)
+		return err
+	}
+	return db.listenForSubscriber(ctx, c, s, pending, deliver)
+}
+
+// catchUp streams the changes committed after sinceTs to the keys with the given prefixes, as of
+// a new snapshot of the DB. It returns the read timestamp of the snapshot.
+func (db *DB) catchUp(ctx context.Context, sinceTs uint64, cb func(kv *KVList) error,
+	prefixes [][]byte) (uint64, error) {
+	// The transaction keeps the versions of the snapshot from being discarded while the streams
+	// run. The streams read at their own timestamps, and skip the versions after readTs.
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	readTs := txn.readTs
+
+	for i, prefix := range prefixes {
+		// Skip the prefixes covered by another one.
+		var covered bool
+		for j, other := range prefixes {
+			if bytes.HasPrefix(prefix, other) && (len(other) < len(prefix) || j < i) {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+
+		stream := db.NewStream()
+		stream.Prefix = prefix
+		stream.SinceTs = sinceTs
+		stream.LogPrefix = "SubscribeSince"
+		stream.KeyToList = func(key []byte, itr *Iterator) (*pb.KVList, error) {
+			list, err := keyChanges(key, itr, sinceTs, readTs)
+			if err != nil {
+				return nil, err
+			}
+			// Deliver the versions of the key from the oldest to the newest.
+			for i, j := 0, len(list.Kv)-1; i < j; i, j = i+1, j-1 {
+				list.Kv[i], list.Kv[j] = list.Kv[j], list.Kv[i]
+			}
+			return list, nil
+		}
+		stream.Send = func(list *pb.KVList) error {
+			out := &pb.KVList{Kv: make([]*pb.KV, 0, len(list.Kv))}
+			for _, kv := range list.Kv {
+				if kv.StreamDone {
+					continue
+				}
+				kv.StreamId = 0
+				out.Kv = append(out.Kv, kv)
+			}
+			if len(out.Kv) == 0 {
+				return nil
+			}
+			return cb(out)
+		}
+		if err := stream.Orchestrate(ctx); err != nil {
+			return 0, err
+		}
+	}
+	return readTs, nil
+}
+
+// keyChanges returns the versions of the key committed after sinceTs and at or before readTs,
+// from the newest to the oldest, with the deletion markers. A merge operand is returned as the
+// value of the key at its version. The iterator must be positioned at the newest version of the
+// key.
+func keyChanges(key []byte, itr *Iterator, sinceTs, readTs uint64) (*pb.KVList, error) {
+	list := &pb.KVList{}
+	for ; itr.Valid(); itr.Next() {
+		item := itr.Item()
+		if !bytes.Equal(item.Key(), key) || item.Version() <= sinceTs {
+			break
+		}
+		if item.Version() > readTs {
+			continue
+		}
+		if item.meta&bitMergeOperand > 0 {
+			item.resolveMerge(item.Version() - 1)
+		}
+		kv := &pb.KV{
+			Key:       item.KeyCopy(nil),
+			UserMeta:  []byte{item.UserMeta()},
+			Meta:      []byte{item.meta & (bitDelete | bitDiscardEarlierVersions)},
+			ExpiresAt: item.ExpiresAt(),
+			Version:   item.Version(),
+		}
+		if item.meta&bitDelete == 0 {
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return nil, err
+			}
+			kv.Value = val
+		}
+		list.Kv = append(list.Kv, kv)
+	}
+	return list, nil
+}
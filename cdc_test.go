@@ -0,0 +1,164 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// changeCollector records the changes delivered to a subscriber.
+type changeCollector struct {
+	sync.Mutex
+	seen    map[string]int
+	deleted map[string]bool
+	total   int
+}
+
+func newChangeCollector() *changeCollector {
+	return &changeCollector{seen: make(map[string]int), deleted: make(map[string]bool)}
+}
+
+func (c *changeCollector) cb(list *KVList) error {
+	c.Lock()
+	defer c.Unlock()
+	for _, kv := range list.Kv {
+		id := fmt.Sprintf("%s@%d", kv.Key, kv.Version)
+		c.seen[id]++
+		c.total++
+		if IsDeletedKV(kv) {
+			c.deleted[string(kv.Key)] = true
+		}
+	}
+	return nil
+}
+
+func (c *changeCollector) count() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.total
+}
+
+func (c *changeCollector) waitFor(t *testing.T, n int) {
+	for i := 0; i < 500 && c.count() < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, n, c.count())
+}
+
+func TestSubscribeSince(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		var midTs uint64
+		for i := 0; i < 100; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%03d", i)), []byte("old"), 0)
+			if i == 49 {
+				txn := db.NewTransaction(false)
+				midTs = txn.readTs
+				txn.Discard()
+			}
+		}
+		txnSet(t, db, []byte("other"), []byte("x"), 0)
+		txnDelete(t, db, []byte("key000"))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		all, since := newChangeCollector(), newChangeCollector()
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			require.Equal(t, context.Canceled, db.SubscribeSince(ctx, 0, all.cb, []byte("key")))
+		}()
+		go func() {
+			defer wg.Done()
+			require.Equal(t, context.Canceled,
+				db.SubscribeSince(ctx, midTs, since.cb, []byte("key"), []byte("key0")))
+		}()
+		// Write while the subscribers catch up, and after.
+		for i := 100; i < 200; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%03d", i)), []byte("new"), 0)
+		}
+
+		// 100 old keys, the deletion, and 100 new keys.
+		all.waitFor(t, 201)
+		since.waitFor(t, 151)
+		cancel()
+		wg.Wait()
+
+		for _, c := range []*changeCollector{all, since} {
+			for id, n := range c.seen {
+				require.Equal(t, 1, n, "%s delivered %d times", id, n)
+			}
+			require.True(t, c.deleted["key000"])
+			require.Len(t, c.deleted, 1)
+		}
+	})
+}
+
+func TestSubscribeConsumer(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		var lastTs uint64
+		write := func(start, end int) {
+			for i := start; i < end; i++ {
+				txnSet(t, db, []byte(fmt.Sprintf("key%03d", i)), []byte("val"), 0)
+			}
+			txn := db.NewTransaction(false)
+			lastTs = txn.readTs
+			txn.Discard()
+		}
+		consume := func(expected int) {
+			ctx, cancel := context.WithCancel(context.Background())
+			c := newChangeCollector()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				require.Equal(t, context.Canceled,
+					db.SubscribeConsumer(ctx, "consumer", c.cb, []byte("key")))
+			}()
+			c.waitFor(t, expected)
+			// Wait for the offset of the last change to be stored.
+			for i := 0; i < 500; i++ {
+				ts, err := db.ConsumerOffset("consumer")
+				require.NoError(t, err)
+				if ts >= lastTs {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			cancel()
+			<-done
+		}
+
+		ts, err := db.ConsumerOffset("consumer")
+		require.NoError(t, err)
+		require.Zero(t, ts)
+
+		write(0, 50)
+		consume(50)
+		// Only the changes after the stored offset are delivered.
+		write(50, 70)
+		consume(20)
+
+		// The offset can be rewound.
+		require.NoError(t, db.SetConsumerOffset("consumer", 0))
+		consume(70)
+	})
+}
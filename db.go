@@ -58,6 +58,7 @@ type closers struct {
 	valueGC     *z.Closer
 	pub         *z.Closer
 	cacheHealth *z.Closer
+	tail        *z.Closer
 }
 
 // DB provides the various functions required to interact with Badger.
@@ -76,6 +77,8 @@ type DB struct {
 
 	// Initialized via openMemTables.
 	nextMemFid int
+	// walRecovery records the data discarded while replaying the memtable WALs.
+	walRecovery WALRecoveryReport
 
 	opt       Options
 	manifest  *manifestFile
@@ -94,8 +97,13 @@ type DB struct {
 	isClosed    uint32
 
 	orc *oracle
+	// openTs is the first commit timestamp of this run of the DB. The versions below it were
+	// written before the DB was opened.
+	openTs uint64
 
 	pub        *publisher
+	tail       *tailer       // Follows the writes of another process, with Options.TailInterval.
+	indexes    indexRegistry // Secondary indexes declared with RegisterIndex.
 	registry   *KeyRegistry
 	blockCache *ristretto.Cache
 	indexCache *ristretto.Cache
@@ -149,8 +157,25 @@ func checkAndSetOptions(opt *Options) error {
 		// Do not perform compaction in read only mode.
 		opt.CompactL0OnClose = false
 	}
+	if opt.TailInterval > 0 && (!opt.ReadOnly || opt.InMemory) {
+		return errors.New("TailInterval can only be used in ReadOnly mode, with a directory")
+	}
+
+	if opt.InMemory {
+		// There are no files to be read in InMemory mode.
+		opt.DirectIO = false
+	}
+	if opt.DirectIO {
+		if !y.DirectIOSupported() {
+			return y.ErrDirectIONotSupported
+		}
+		if opt.BlockCacheSize == 0 {
+			return errors.New("BlockCacheSize should be set since DirectIO is enabled")
+		}
+	}
 
-	needCache := (opt.Compression != options.None) || (len(opt.EncryptionKey) > 0)
+	needCache := (opt.Compression != options.None) || (len(opt.EncryptionKey) > 0) ||
+		opt.KeyProvider != nil
 	if needCache && opt.BlockCacheSize == 0 {
 		panic("BlockCacheSize should be set since compression/encryption are enabled")
 	}
@@ -172,7 +197,8 @@ func Open(opt Options) (*DB, error) {
 			return nil, err
 		}
 		var err error
-		if !opt.BypassLockGuard {
+		// A DB tailing the directory leaves the lock to the process writing to it.
+		if !opt.BypassLockGuard && !opt.tailing() {
 			dirLockGuard, err = acquireDirectoryLock(opt.Dir, lockFile, opt.ReadOnly)
 			if err != nil {
 				return nil, err
@@ -223,8 +249,9 @@ func Open(opt Options) (*DB, error) {
 		dirLockGuard:  dirLockGuard,
 		valueDirGuard: valueDirLockGuard,
 		orc:           newOracle(opt),
-		pub:           newPublisher(),
+		walRecovery:   WALRecoveryReport{Mode: opt.WALRecoveryMode},
 	}
+	db.pub = newPublisher(db)
 	// Cleanup all the goroutines started by badger in case of an error.
 	defer func() {
 		if err != nil {
@@ -291,6 +318,8 @@ func Open(opt Options) (*DB, error) {
 		EncryptionKey:                 opt.EncryptionKey,
 		EncryptionKeyRotationDuration: opt.EncryptionKeyRotationDuration,
 		InMemory:                      opt.InMemory,
+		KeyProvider:                   opt.KeyProvider,
+		EncryptionAlgo:                opt.EncryptionAlgo,
 	}
 
 	if db.registry, err = OpenKeyRegistry(krOpt); err != nil {
@@ -301,11 +330,15 @@ func Open(opt Options) (*DB, error) {
 	go db.updateSize(db.closers.updateSize)
 
 	if err := db.openMemTables(db.opt); err != nil {
+		if _, ok := err.(*WALCorruptedError); ok {
+			return nil, err
+		}
 		return nil, y.Wrapf(err, "while opening memtables")
 	}
 
-	db.mt, err = db.newMemTable()
-	if err != nil {
+	if db.opt.tailing() {
+		db.mt = newTailedMutableMemTable(db.opt)
+	} else if db.mt, err = db.newMemTable(); err != nil {
 		return nil, y.Wrapf(err, "cannot create memtable")
 	}
 
@@ -350,6 +383,16 @@ func Open(opt Options) (*DB, error) {
 	// compaction when run in offline mode via the flatten tool.
 	db.orc.readMark.Done(db.orc.nextTxnTs)
 	db.orc.incrementNextTs()
+	db.openTs = db.orc.nextTxnTs
+
+	if db.opt.tailing() {
+		db.tail = newTailer(db)
+		if err = db.tail.refresh(); err != nil {
+			return db, y.Wrapf(err, "while tailing %s", db.opt.Dir)
+		}
+		db.closers.tail = z.NewCloser(1)
+		go db.tail.run(db.closers.tail)
+	}
 
 	db.closers.writes = z.NewCloser(1)
 	go db.doWrites(db.closers.writes)
@@ -443,6 +486,9 @@ func (db *DB) cleanup() {
 	if db.closers.pub != nil {
 		db.closers.pub.Signal()
 	}
+	if db.closers.tail != nil {
+		db.closers.tail.Signal()
+	}
 
 	db.orc.Stop()
 
@@ -487,6 +533,9 @@ func (db *DB) close() (err error) {
 
 	atomic.StoreInt32(&db.blockWrites, 1)
 
+	if db.closers.tail != nil {
+		db.closers.tail.SignalAndWait()
+	}
 	if !db.opt.InMemory {
 		// Stop value GC first.
 		db.closers.valueGC.SignalAndWait()
@@ -754,8 +803,6 @@ func (db *DB) writeRequests(reqs []*request) error {
 		return err
 	}
 
-	db.opt.Debugf("Sending updates to subscribers")
-	db.pub.sendUpdates(reqs)
 	db.opt.Debugf("Writing to memtable")
 	var count int
 	for _, b := range reqs {
@@ -783,6 +830,10 @@ func (db *DB) writeRequests(reqs []*request) error {
 			return y.Wrap(err, "writeRequests")
 		}
 	}
+	// The updates are sent once they are in the memtable, where the publisher reads the versions
+	// the merge operands apply to.
+	db.opt.Debugf("Sending updates to subscribers")
+	db.pub.sendUpdates(reqs)
 	done(nil)
 	db.opt.Debugf("%d entries written", count)
 	return nil
@@ -1004,8 +1055,10 @@ func (db *DB) handleFlushTask(ft flushTask) error {
 	if err != nil {
 		return y.Wrapf(err, "failed to get datakey in db.handleFlushTask")
 	}
+	fileID := db.lc.reserveFileID()
 	bopts := buildTableOptions(db.opt)
 	bopts.DataKey = dk
+	bopts.TableID = fileID
 	// Builder does not need cache but the same options are used for opening table.
 	bopts.BlockCache = db.blockCache
 	bopts.IndexCache = db.indexCache
@@ -1018,7 +1071,6 @@ func (db *DB) handleFlushTask(ft flushTask) error {
 		return nil
 	}
 
-	fileID := db.lc.reserveFileID()
 	tbl, err := table.CreateTable(table.NewFilename(fileID, db.opt.Dir), tableData, bopts)
 	if err != nil {
 		return y.Wrap(err, "error while creating table")
@@ -1167,6 +1219,10 @@ func (db *DB) RunValueLogGC(discardRatio float64) error {
 	if db.opt.InMemory {
 		return ErrGCInMemoryMode
 	}
+	// The value log belongs to the process we are tailing.
+	if db.opt.tailing() {
+		return ErrRejected
+	}
 	if discardRatio >= 1.0 || discardRatio <= 0.0 {
 		return ErrInvalidRequest
 	}
@@ -1200,15 +1256,34 @@ type Sequence struct {
 // Next would return the next integer in the sequence, updating the lease by running a transaction
 // if needed.
 func (seq *Sequence) Next() (uint64, error) {
+	return seq.NextN(1)
+}
+
+// NextN reserves the next n integers of the sequence, and returns the first one. The integers
+// from it up to, but not including, it plus n all belong to the caller. If the current lease
+// doesn't hold n more integers, NextN extends it, to at least n integers, by running a
+// transaction.
+//
+// With Options.ReuseSequenceLeases, every call also runs a transaction to record the integers
+// handed out.
+func (seq *Sequence) NextN(n uint64) (uint64, error) {
+	if n == 0 {
+		return 0, ErrZeroCount
+	}
 	seq.Lock()
 	defer seq.Unlock()
-	if seq.next >= seq.leased {
-		if err := seq.updateLease(); err != nil {
+	if seq.leased-seq.next < n {
+		// The new lease also records the integers handed out below.
+		if err := seq.updateLease(n); err != nil {
+			return 0, err
+		}
+	} else if seq.db.opt.ReuseSequenceLeases {
+		if err := seq.updateHighWaterMark(seq.next + n); err != nil {
 			return 0, err
 		}
 	}
 	val := seq.next
-	seq.next++
+	seq.next += n
 	return val, nil
 }
 
@@ -1219,25 +1294,13 @@ func (seq *Sequence) Release() error {
 	seq.Lock()
 	defer seq.Unlock()
 	err := seq.db.Update(func(txn *Txn) error {
-		item, err := txn.Get(seq.key)
+		num, _, _, err := seq.readLease(txn)
 		if err != nil {
 			return err
 		}
-
-		var num uint64
-		if err := item.Value(func(v []byte) error {
-			num = binary.BigEndian.Uint64(v)
-			return nil
-		}); err != nil {
-			return err
-		}
-
 		if num == seq.leased {
-			var buf [8]byte
-			binary.BigEndian.PutUint64(buf[:], seq.next)
-			return txn.SetEntry(NewEntry(seq.key, buf[:]))
+			return seq.writeLease(txn, seq.next, seq.next)
 		}
-
 		return nil
 	})
 	if err != nil {
@@ -1247,34 +1310,112 @@ func (seq *Sequence) Release() error {
 	return nil
 }
 
-func (seq *Sequence) updateLease() error {
-	return seq.db.Update(func(txn *Txn) error {
-		item, err := txn.Get(seq.key)
-		switch {
-		case err == ErrKeyNotFound:
-			seq.next = 0
-		case err != nil:
-			return err
+// readLease returns the end of the lease stored under the key of the sequence, and its
+// high-water mark: no integer at or above it has been handed out. The lease is stale if it was
+// stored before the DB was opened, in which case its holder is gone.
+//
+// The value of the key is the end of the lease, followed by the high-water mark only if
+// Options.ReuseSequenceLeases was set when it was written.
+func (seq *Sequence) readLease(txn *Txn) (leased, hwm uint64, stale bool, err error) {
+	item, err := txn.Get(seq.key)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	err = item.Value(func(v []byte) error {
+		switch len(v) {
+		case 8:
+			leased = binary.BigEndian.Uint64(v)
+			hwm = leased
+		case 16:
+			leased = binary.BigEndian.Uint64(v)
+			hwm = binary.BigEndian.Uint64(v[8:])
 		default:
-			var num uint64
-			if err := item.Value(func(v []byte) error {
-				num = binary.BigEndian.Uint64(v)
+			return errors.Errorf("Invalid lease of sequence %q", seq.key)
+		}
+		return nil
+	})
+	if _, pending := txn.pendingWrites[string(seq.key)]; !pending {
+		stale = item.Version() < seq.db.openTs
+	}
+	return leased, hwm, stale, err
+}
+
+func (seq *Sequence) writeLease(txn *Txn, leased, hwm uint64) error {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:], leased)
+	if !seq.db.opt.ReuseSequenceLeases {
+		return txn.SetEntry(NewEntry(seq.key, buf[:8]))
+	}
+	binary.BigEndian.PutUint64(buf[8:], hwm)
+	return txn.SetEntry(NewEntry(seq.key, buf[:]))
+}
+
+// lease takes a new lease of at least n integers in txn, the first n of which are handed out
+// right away. It returns the first integer and the end of the lease.
+func (seq *Sequence) lease(txn *Txn, n uint64) (next, leased uint64, err error) {
+	num, hwm, stale, err := seq.readLease(txn)
+	switch {
+	case err == ErrKeyNotFound:
+		next = 0
+	case err != nil:
+		return 0, 0, err
+	case num == seq.leased && seq.next < seq.leased:
+		// Nobody leased integers after ours, so the current lease can be extended in place.
+		next = seq.next
+	case stale && seq.db.opt.ReuseSequenceLeases:
+		// The integers between the high-water mark and the end of the lease were never handed
+		// out.
+		next = hwm
+	default:
+		next = num
+	}
+
+	size := seq.bandwidth
+	if n > size {
+		size = n
+	}
+	leased = next + size
+	if err := seq.writeLease(txn, leased, next+n); err != nil {
+		return 0, 0, err
+	}
+	return next, leased, nil
+}
+
+func (seq *Sequence) updateLease(n uint64) error {
+	var next, leased uint64
+	err := seq.db.Update(func(txn *Txn) error {
+		var err error
+		next, leased, err = seq.lease(txn, n)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	seq.next, seq.leased = next, leased
+	return nil
+}
+
+// updateHighWaterMark records that the integers below hwm have been handed out. Nothing needs to
+// be recorded once another sequence leased integers after ours, since its lease starts above
+// them.
+func (seq *Sequence) updateHighWaterMark(hwm uint64) error {
+	for {
+		err := seq.db.Update(func(txn *Txn) error {
+			num, _, _, err := seq.readLease(txn)
+			switch {
+			case err == ErrKeyNotFound:
 				return nil
-			}); err != nil {
+			case err != nil:
 				return err
+			case num != seq.leased:
+				return nil
 			}
-			seq.next = num
-		}
-
-		lease := seq.next + seq.bandwidth
-		var buf [8]byte
-		binary.BigEndian.PutUint64(buf[:], lease)
-		if err = txn.SetEntry(NewEntry(seq.key, buf[:])); err != nil {
+			return seq.writeLease(txn, seq.leased, hwm)
+		})
+		if err != ErrConflict {
 			return err
 		}
-		seq.leased = lease
-		return nil
-	})
+	}
 }
 
 // GetSequence would initiate a new sequence object, generating it from the stored lease, if
@@ -1301,10 +1442,49 @@ func (db *DB) GetSequence(key []byte, bandwidth uint64) (*Sequence, error) {
 		leased:    0,
 		bandwidth: bandwidth,
 	}
-	err := seq.updateLease()
+	err := seq.updateLease(0)
 	return seq, err
 }
 
+// GetSequences is like GetSequence, but leases the sequences of all the keys in a single
+// transaction. The returned sequences are in the order of the keys.
+//
+// GetSequences is not supported on ManagedDB. Calling this would result in a panic.
+func (db *DB) GetSequences(keys [][]byte, bandwidth uint64) ([]*Sequence, error) {
+	if db.opt.managedTxns {
+		panic("Cannot use GetSequences with managedDB=true.")
+	}
+	if bandwidth == 0 {
+		return nil, ErrZeroBandwidth
+	}
+	seqs := make([]*Sequence, len(keys))
+	for i, key := range keys {
+		if len(key) == 0 {
+			return nil, ErrEmptyKey
+		}
+		seqs[i] = &Sequence{db: db, key: key, bandwidth: bandwidth}
+	}
+
+	next := make([]uint64, len(seqs))
+	leased := make([]uint64, len(seqs))
+	err := db.Update(func(txn *Txn) error {
+		for i, seq := range seqs {
+			var err error
+			if next[i], leased[i], err = seq.lease(txn, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, seq := range seqs {
+		seq.next, seq.leased = next[i], leased[i]
+	}
+	return seqs, nil
+}
+
 // Tables gets the TableInfo objects from the level controller. If withKeysCount
 // is true, TableInfo objects also contain counts of keys for the tables.
 func (db *DB) Tables() []TableInfo {
@@ -1679,6 +1859,97 @@ func (db *DB) DropPrefix(prefixes ...[]byte) error {
 	return nil
 }
 
+// ReencryptAll rewrites all the data under a new data key, and then removes the data keys it
+// replaced from the key registry, so that a compromised data key no longer decrypts any data. It
+// does this in the following way:
+// - Generate a new data key.
+// - Stop accepting new writes, flush out all memtables, and move the writes to a new memtable and
+//   a new value log file, encrypted with the new data key. Resume writes.
+// - Stop compactions. Compact L0->L1, and the rest of the levels, Li->Li, picking the tables
+//   encrypted with an older data key. Resume compactions.
+// - Rewrite the value log files encrypted with an older data key, like the value log GC does.
+// - Remove the data keys which are no longer in use from the key registry.
+//
+// The value log files still being read by iterators are only deleted once the iterators are
+// closed, and their data keys are kept until then. Running ReencryptAll again removes them.
+// ReencryptAll returns ErrEncryptionDisabled if the DB isn't encrypted, and ErrRejected if a
+// value log GC is running.
+func (db *DB) ReencryptAll() error {
+	if !db.shouldEncrypt() {
+		return ErrEncryptionDisabled
+	}
+	db.opt.Infof("ReencryptAll called")
+	dk, err := db.registry.rotateDataKey()
+	if err != nil {
+		return y.Wrapf(err, "while generating a new data key")
+	}
+	if err := db.rotateDataKey(dk.KeyId); err != nil {
+		return err
+	}
+
+	db.stopCompactions()
+	tables, err := db.lc.reencryptTables(dk.KeyId)
+	db.startCompactions()
+	if err != nil {
+		return err
+	}
+	files, err := db.vlog.reencrypt(dk.KeyId)
+	if err != nil {
+		return err
+	}
+
+	inUse := make(map[uint64]struct{})
+	db.lc.keyIDs(inUse)
+	db.vlog.keyIDs(inUse)
+	db.RLock()
+	for _, mt := range append([]*memTable{db.mt}, db.imm...) {
+		if mt.wal != nil {
+			inUse[mt.wal.keyID()] = struct{}{}
+		}
+	}
+	db.RUnlock()
+	purged, err := db.registry.purgeDataKeys(dk.KeyId, inUse)
+	if err != nil {
+		return err
+	}
+	db.opt.Infof("ReencryptAll done. Rewrote %d tables and %d value log files. "+
+		"Removed %d data keys.", tables, files, purged)
+	return nil
+}
+
+// rotateDataKey flushes out all memtables, and moves the writes to a new memtable and, if needed,
+// a new value log file, so that they get encrypted with the data key of the given ID.
+func (db *DB) rotateDataKey(keyID uint64) error {
+	f, err := db.prepareToDrop()
+	if err != nil {
+		return err
+	}
+	defer f()
+	// Block all foreign interactions with memory tables.
+	db.Lock()
+	defer db.Unlock()
+
+	db.imm = append(db.imm, db.mt)
+	for _, memtable := range db.imm {
+		if memtable.sl.Empty() {
+			memtable.DecrRef()
+			continue
+		}
+		db.opt.Debugf("Flushing memtable")
+		if err := db.handleFlushTask(flushTask{mt: memtable}); err != nil {
+			db.opt.Errorf("While trying to flush memtable: %v", err)
+			return err
+		}
+		memtable.DecrRef()
+	}
+	db.imm = db.imm[:0]
+	db.mt, err = db.newMemTable()
+	if err != nil {
+		return y.Wrapf(err, "cannot create new mem table")
+	}
+	return db.vlog.rotateDataKey(keyID)
+}
+
 // KVList contains a list of key-value pairs.
 type KVList = pb.KVList
 
@@ -1689,46 +1960,142 @@ type KVList = pb.KVList
 // The given function will be called with a new KVList containing the modified keys and the
 // corresponding values.
 func (db *DB) Subscribe(ctx context.Context, cb func(kv *KVList) error, prefixes ...[]byte) error {
+	return db.SubscribeWith(ctx, SubscribeOptions{Prefixes: prefixes}, cb)
+}
+
+// SubscribeWith is like Subscribe, with the keys to watch, the filters and the handling of a
+// slow subscriber given in opt.
+func (db *DB) SubscribeWith(ctx context.Context, opt SubscribeOptions,
+	cb func(kv *KVList) error) error {
 	if cb == nil {
 		return ErrNilCallback
 	}
+	if err := validateSubscribeOptions(opt); err != nil {
+		return err
+	}
 
 	c := z.NewCloser(1)
-	recvCh, id := db.pub.newSubscriber(c, prefixes...)
-	slurp := func(batch *pb.KVList) error {
+	s, err := db.pub.newSubscriber(c, opt, false)
+	if err != nil {
+		return err
+	}
+	return db.listenForSubscriber(ctx, c, s, nil, cb)
+}
+
+func validateSubscribeOptions(opt SubscribeOptions) error {
+	if opt.BufferSize < 0 {
+		return errors.New("Subscriber BufferSize can't be negative")
+	}
+	for _, r := range opt.Ranges {
+		if len(r.End) > 0 && bytes.Compare(r.Start, r.End) >= 0 {
+			return errors.Errorf("Invalid key range: [%q, %q)", r.Start, r.End)
+		}
+	}
+	switch opt.SlowPolicy {
+	case BlockSlowSubscriber, SpillSlowSubscriber, DisconnectSlowSubscriber:
+	case DropSlowSubscriber:
+		if opt.OnGap == nil {
+			return errors.New("OnGap must be set with DropSlowSubscriber")
+		}
+	default:
+		return errors.Errorf("Invalid SlowPolicy: %d", opt.SlowPolicy)
+	}
+	return nil
+}
+
+// listenForSubscriber calls cb with the batches of updates received by the subscriber, starting
+// with the pending ones, until the context is done, the DB is closed, the subscriber gets
+// disconnected or cb returns an error.
+func (db *DB) listenForSubscriber(ctx context.Context, c *z.Closer, s *subscriber,
+	pending []subscriberUpdate, cb func(kv *KVList) error) error {
+	defer s.stop()
+
+	batch := new(pb.KVList)
+	flush := func() error {
+		if len(batch.Kv) == 0 {
+			return nil
+		}
+		var version uint64
+		for _, kv := range batch.Kv {
+			if kv.Version > version {
+				version = kv.Version
+			}
+		}
+		list := batch
+		batch = new(pb.KVList)
+		if err := cb(list); err != nil {
+			return err
+		}
+		s.setDelivered(version)
+		return nil
+	}
+	handle := func(u subscriberUpdate) error {
+		if u.gap == nil {
+			batch.Kv = append(batch.Kv, u.list.Kv...)
+			return nil
+		}
+		// Deliver the updates before the gap first.
+		if err := flush(); err != nil {
+			return err
+		}
+		if err := s.opt.OnGap(*u.gap); err != nil {
+			return err
+		}
+		s.setDelivered(u.gap.MaxVersion)
+		return nil
+	}
+	slurp := func(u subscriberUpdate) error {
+		if err := handle(u); err != nil {
+			return err
+		}
 		for {
 			select {
-			case kvs := <-recvCh:
-				batch.Kv = append(batch.Kv, kvs.Kv...)
-			default:
-				if len(batch.GetKv()) > 0 {
-					return cb(batch)
+			case u := <-s.sendCh:
+				if err := handle(u); err != nil {
+					return err
 				}
-				return nil
+			default:
+				return flush()
 			}
 		}
 	}
+	// stop is called when the subscriber quits by itself.
+	stop := func(err error) error {
+		// Stop first, since the publisher might be blocked on us while holding its lock.
+		s.stop()
+		c.Done()
+		db.pub.deleteSubscriber(s.id)
+		return err
+	}
+
+	for _, u := range pending {
+		if err := handle(u); err != nil {
+			return stop(err)
+		}
+	}
+	if err := flush(); err != nil {
+		return stop(err)
+	}
 	for {
 		select {
 		case <-c.HasBeenClosed():
 			// No need to delete here. Closer will be called only while
 			// closing DB. Subscriber will be deleted by cleanSubscribers.
-			err := slurp(new(pb.KVList))
+			err := slurp(subscriberUpdate{list: new(pb.KVList)})
 			// Drain if any pending updates.
 			c.Done()
 			return err
-		case <-ctx.Done():
+		case <-s.disconnected:
+			// The publisher has already deleted the subscriber.
 			c.Done()
-			db.pub.deleteSubscriber(id)
+			return s.err
+		case <-ctx.Done():
 			// Delete the subscriber to avoid further updates.
-			return ctx.Err()
-		case batch := <-recvCh:
-			err := slurp(batch)
-			if err != nil {
-				c.Done()
+			return stop(ctx.Err())
+		case u := <-s.sendCh:
+			if err := slurp(u); err != nil {
 				// Delete the subscriber if there is an error by the callback.
-				db.pub.deleteSubscriber(id)
-				return err
+				return stop(err)
 			}
 		}
 	}
@@ -1736,7 +2103,7 @@ func (db *DB) Subscribe(ctx context.Context, cb func(kv *KVList) error, prefixes
 
 // shouldEncrypt returns bool, which tells whether to encrypt or not.
 func (db *DB) shouldEncrypt() bool {
-	return len(db.opt.EncryptionKey) > 0
+	return len(db.opt.EncryptionKey) > 0 || db.opt.KeyProvider != nil
 }
 
 func (db *DB) syncDir(dir string) error {
@@ -30,6 +30,7 @@ import (
 	"regexp"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -1010,3 +1011,188 @@ func TestKeyCount(t *testing.T) {
 	})
 	require.Equal(t, N, uint64(count))
 }
+
+func TestDirectIO(t *testing.T) {
+	if !y.DirectIOSupported() {
+		t.Skip("Direct I/O is not supported")
+	}
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opt := getTestOptions(dir).
+		WithDirectIO(true).
+		WithBlockCacheSize(10 << 20).
+		WithValueThreshold(32).
+		WithValueLogFileSize(1 << 20)
+
+	_, err = Open(opt.WithBlockCacheSize(0))
+	require.Error(t, err)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	h := testHelper{db: db, t: t}
+	h.writeRange(0, 20000)
+	h.readRange(0, 20000)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NotEmpty(t, db.Tables())
+	h.db = db
+	h.readRange(0, 20000)
+}
+
+func TestBlockHashIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opt := getTestOptions(dir).
+		WithBlockHashIndex(true).
+		WithValueThreshold(32)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	h := testHelper{db: db, t: t}
+	h.writeRange(0, 20000)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NotEmpty(t, db.Tables())
+	h.db = db
+	h.readRange(0, 20000)
+}
+
+func TestIngestExternalFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	extDir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(extDir)
+
+	opt := getTestOptions(dir)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%08d", i)) }
+	writeExternal := func(name string, start, end int) string {
+		b := table.NewTableBuilder(buildTableOptions(opt))
+		defer b.Close()
+		for i := start; i < end; i++ {
+			b.Add(y.KeyWithTs(key(i), 1), y.ValueStruct{Value: []byte("new")}, 0)
+		}
+		fname := path.Join(extDir, name)
+		require.NoError(t, ioutil.WriteFile(fname, b.Finish(false), 0666))
+		return fname
+	}
+	files := []string{writeExternal("a.sst", 5000, 6000), writeExternal("b.sst", 500, 1000)}
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	wb := db.NewWriteBatch()
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, wb.Set(key(i), []byte("old")))
+	}
+	require.NoError(t, wb.Flush())
+
+	oldTxn := db.NewTransaction(false)
+	require.NoError(t, db.IngestExternalFiles(files))
+
+	check := func(txn *Txn, i int, expected string) {
+		item, err := txn.Get(key(i))
+		require.NoError(t, err)
+		require.NoError(t, item.Value(func(val []byte) error {
+			require.Equal(t, expected, string(val))
+			return nil
+		}))
+	}
+	checkAll := func(db *DB) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 500; i++ {
+				check(txn, i, "old")
+			}
+			for i := 500; i < 1000; i++ {
+				check(txn, i, "new")
+			}
+			for i := 5000; i < 6000; i++ {
+				check(txn, i, "new")
+			}
+			return nil
+		}))
+	}
+	checkAll(db)
+
+	// Transactions started before the ingestion don't see the ingested keys.
+	check(oldTxn, 500, "old")
+	_, err = oldTxn.Get(key(5000))
+	require.Equal(t, ErrKeyNotFound, err)
+	oldTxn.Discard()
+
+	// Nothing overlaps with the second file, so it goes to the last level.
+	var found bool
+	for _, ti := range db.Tables() {
+		if bytes.Equal(y.ParseKey(ti.Left), key(5000)) {
+			require.Equal(t, opt.MaxLevels-1, ti.Level)
+			found = true
+		}
+	}
+	require.True(t, found)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	checkAll(db)
+
+	// Overlapping external files are rejected.
+	overlap := writeExternal("c.sst", 900, 1100)
+	require.Error(t, db.IngestExternalFiles([]string{files[1], overlap}))
+}
+
+func TestIngestExternalFilesAtomic(t *testing.T) {
+	extDir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(extDir)
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := func(i int) []byte { return []byte(fmt.Sprintf("%08d", i)) }
+		var files []string
+		for f := 0; f < 3; f++ {
+			b := table.NewTableBuilder(buildTableOptions(db.opt))
+			for i := f * 100; i < (f+1)*100; i++ {
+				b.Add(y.KeyWithTs(key(i), 1), y.ValueStruct{Value: []byte("new")}, 0)
+			}
+			fname := path.Join(extDir, fmt.Sprintf("%d.sst", f))
+			require.NoError(t, ioutil.WriteFile(fname, b.Finish(false), 0666))
+			b.Close()
+			files = append(files, fname)
+		}
+
+		// Fail the third table: its file already exists in the DB directory.
+		tables := len(db.Tables())
+		taken := table.NewFilename(atomic.LoadUint64(&db.lc.nextFileID)+2, db.opt.Dir)
+		require.NoError(t, ioutil.WriteFile(taken, nil, 0666))
+		require.Error(t, db.IngestExternalFiles(files))
+		require.NoError(t, os.Remove(taken))
+
+		// None of the tables built before the failure were added.
+		require.Len(t, db.Tables(), tables)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 300; i++ {
+				_, err := txn.Get(key(i))
+				require.Equal(t, ErrKeyNotFound, err)
+			}
+			return nil
+		}))
+		require.NoError(t, db.IngestExternalFiles(files))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 300; i++ {
+				_, err := txn.Get(key(i))
+				require.NoError(t, err)
+			}
+			return nil
+		}))
+	})
+}
@@ -1663,6 +1663,104 @@ func TestTestSequence2(t *testing.T) {
 	})
 }
 
+func TestSequence_NextN(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		seq, err := db.GetSequence(key, 10)
+		require.NoError(t, err)
+		_, err = seq.NextN(0)
+		require.Equal(t, ErrZeroCount, err)
+
+		num, err := seq.NextN(4)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), num)
+		// The lease is extended in place, since nobody leased after it.
+		num, err = seq.NextN(25)
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), num)
+		num, err = seq.Next()
+		require.NoError(t, err)
+		require.Equal(t, uint64(29), num)
+
+		// Another sequence leased after ours, so the ranges that don't fit in the current lease
+		// start after its lease.
+		other, err := db.GetSequence(key, 10)
+		require.NoError(t, err)
+		num, err = seq.NextN(5)
+		require.NoError(t, err)
+		require.Equal(t, uint64(30), num)
+		num, err = seq.NextN(5)
+		require.NoError(t, err)
+		require.Equal(t, uint64(49), num)
+		num, err = other.Next()
+		require.NoError(t, err)
+		require.Equal(t, uint64(39), num)
+	})
+}
+
+func TestGetSequences(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		_, err := db.GetSequences([][]byte{[]byte("a"), nil}, 10)
+		require.Equal(t, ErrEmptyKey, err)
+		_, err = db.GetSequences([][]byte{[]byte("a")}, 0)
+		require.Equal(t, ErrZeroBandwidth, err)
+
+		seqs, err := db.GetSequences([][]byte{[]byte("a"), []byte("b"), []byte("a")}, 10)
+		require.NoError(t, err)
+		require.Len(t, seqs, 3)
+		// The leases of the same key don't overlap.
+		for i, expected := range []uint64{0, 0, 10} {
+			num, err := seqs[i].Next()
+			require.NoError(t, err)
+			require.Equal(t, expected, num)
+		}
+		for _, seq := range seqs {
+			require.NoError(t, seq.Release())
+		}
+	})
+}
+
+func TestSequence_ReuseLeases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithReuseSequenceLeases(true)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	seq, err := db.GetSequence([]byte("key"), 100)
+	require.NoError(t, err)
+	for i := uint64(0); i < 5; i++ {
+		num, err := seq.Next()
+		require.NoError(t, err)
+		require.Equal(t, i, num)
+	}
+	num, err := seq.NextN(10)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), num)
+
+	// A live lease is never taken over.
+	other, err := db.GetSequence([]byte("key"), 100)
+	require.NoError(t, err)
+	num, err = other.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), num)
+	num, err = seq.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(15), num)
+	// Close the DB without releasing the sequences, as a crash would.
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	seq, err = db.GetSequence([]byte("key"), 100)
+	require.NoError(t, err)
+	num, err = seq.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(101), num)
+}
+
 func TestReadOnly(t *testing.T) {
 	t.Skipf("TODO: ReadOnly needs truncation, so this fails")
 
@@ -2107,6 +2205,166 @@ func TestVerifyChecksum(t *testing.T) {
 	})
 }
 
+func TestReencryptAll(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.Equal(t, ErrEncryptionDisabled, db.ReencryptAll())
+	})
+
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	require.NoError(t, err)
+	opt := getTestOptions(dir).
+		WithEncryptionKey(key).
+		WithBlockCacheSize(1 << 20).
+		WithIndexCacheSize(1 << 20).
+		WithValueThreshold(32).
+		WithValueLogFileSize(1 << 20)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	n := 3000
+	for i := 0; i < n; i += 10 {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for j := i; j < i+10; j++ {
+				val := make([]byte, 1<<10)
+				binary.BigEndian.PutUint64(val, uint64(j))
+				if err := txn.Set([]byte(fmt.Sprintf("key%05d", j)), val); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	old, err := db.registry.LatestDataKey()
+	require.NoError(t, err)
+
+	check := func(db *DB) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+				require.NoError(t, err)
+				v, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, uint64(i), binary.BigEndian.Uint64(v))
+			}
+			return nil
+		}))
+	}
+	check(db)
+
+	require.NoError(t, db.ReencryptAll())
+	latest, err := db.registry.LatestDataKey()
+	require.NoError(t, err)
+	require.True(t, latest.KeyId > old.KeyId)
+	inUse := make(map[uint64]struct{})
+	db.lc.keyIDs(inUse)
+	db.vlog.keyIDs(inUse)
+	require.NotContains(t, inUse, old.KeyId)
+	_, err = db.registry.DataKey(old.KeyId)
+	require.Error(t, err)
+	check(db)
+	require.NoError(t, db.Close())
+
+	// The retired data key is gone from the key registry file too.
+	db, err = Open(opt)
+	require.NoError(t, err)
+	_, err = db.registry.DataKey(old.KeyId)
+	require.Error(t, err)
+	check(db)
+	require.NoError(t, db.Close())
+}
+
+func TestEncryptionAlgoGCM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	require.NoError(t, err)
+	opt := getTestOptions(dir).
+		WithEncryptionKey(key).
+		WithBlockCacheSize(1 << 20).
+		WithIndexCacheSize(1 << 20).
+		WithValueThreshold(32).
+		WithValueLogFileSize(1 << 20)
+
+	n := 2000
+	write := func(db *DB, from int) {
+		for i := from; i < from+n/2; i += 10 {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				for j := i; j < i+10; j++ {
+					val := make([]byte, 1<<10)
+					binary.BigEndian.PutUint64(val, uint64(j))
+					if err := txn.Set([]byte(fmt.Sprintf("key%05d", j)), val); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+	}
+	check := func(db *DB) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+				require.NoError(t, err)
+				v, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, uint64(i), binary.BigEndian.Uint64(v))
+			}
+			return nil
+		}))
+	}
+
+	// Half of the data is written with AES-CTR, the other half with AES-GCM.
+	db, err := Open(opt)
+	require.NoError(t, err)
+	write(db, 0)
+	ctr, err := db.registry.LatestDataKey()
+	require.NoError(t, err)
+	require.Equal(t, pb.EncryptionAlgo_aes, ctr.EncryptionAlgo)
+	require.NoError(t, db.Close())
+
+	opt = opt.WithEncryptionAlgo(options.AESGCM)
+	db, err = Open(opt)
+	require.NoError(t, err)
+	write(db, n/2)
+	gcm, err := db.registry.LatestDataKey()
+	require.NoError(t, err)
+	require.Equal(t, pb.EncryptionAlgo_aes_gcm, gcm.EncryptionAlgo)
+	require.True(t, gcm.KeyId > ctr.KeyId)
+	check(db)
+	require.NoError(t, db.Close())
+
+	// The entries still in the write-ahead logs are replayed with their own mode.
+	db, err = Open(opt)
+	require.NoError(t, err)
+	check(db)
+
+	// Migrate all of the data to AES-GCM.
+	require.NoError(t, db.ReencryptAll())
+	inUse := make(map[uint64]struct{})
+	db.lc.keyIDs(inUse)
+	db.vlog.keyIDs(inUse)
+	for id := range inUse {
+		dk, err := db.registry.DataKey(id)
+		require.NoError(t, err)
+		require.Equal(t, pb.EncryptionAlgo_aes_gcm, dk.EncryptionAlgo)
+	}
+	_, err = db.registry.DataKey(ctr.KeyId)
+	require.Error(t, err)
+	check(db)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	check(db)
+	require.NoError(t, db.Close())
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 	os.Exit(m.Run())
@@ -82,6 +82,9 @@ var (
 	// ErrZeroBandwidth is returned if the user passes in zero bandwidth for sequence.
 	ErrZeroBandwidth = errors.New("Bandwidth must be greater than zero")
 
+	// ErrZeroCount is returned if the user asks for zero integers of a sequence.
+	ErrZeroCount = errors.New("Count must be greater than zero")
+
 	// ErrInvalidLoadingMode is returned when opt.ValueLogLoadingMode option is not
 	// within the valid range
 	ErrInvalidLoadingMode = errors.New("Invalid ValueLogLoadingMode, must be FileIO or MemoryMap")
@@ -97,6 +100,11 @@ var (
 	ErrTruncateNeeded = errors.New(
 		"Log truncate required to run DB. This might result in data loss")
 
+	// ErrWALCorrupted is returned when a memtable WAL has corrupt entries and the
+	// WALRecoveryMode doesn't allow discarding them. Open returns it as the cause of a
+	// *WALCorruptedError.
+	ErrWALCorrupted = errors.New("WAL is corrupted and cannot be recovered in the current mode")
+
 	// ErrBlockedWrites is returned if the user called DropAll. During the process of dropping all
 	// data from Badger, we stop accepting new writes, by returning this error.
 	ErrBlockedWrites = errors.New("Writes are blocked, possibly due to DropAll or Close")
@@ -104,6 +112,19 @@ var (
 	// ErrNilCallback is returned when subscriber's callback is nil.
 	ErrNilCallback = errors.New("Callback cannot be nil")
 
+	// ErrNoMergeFunc is returned when merge operands are written to a DB opened without
+	// Options.MergeFunc.
+	ErrNoMergeFunc = errors.New("Merge operands require Options.MergeFunc to be set")
+
+	// ErrIndexedWriteBatch is returned when a WriteBatch outside of managed mode writes a key
+	// covered by a secondary index.
+	ErrIndexedWriteBatch = errors.New(
+		"Keys covered by a secondary index can't be written with a WriteBatch")
+
+	// ErrSlowSubscriber is returned by a subscription with the DisconnectSlowSubscriber policy
+	// when the subscriber falls behind.
+	ErrSlowSubscriber = errors.New("Subscriber is too slow to keep up with the updates")
+
 	// ErrEncryptionKeyMismatch is returned when the storage key is not
 	// matched with the key previously given.
 	ErrEncryptionKeyMismatch = errors.New("Encryption key mismatch")
@@ -114,9 +135,35 @@ var (
 	// ErrInvalidEncryptionKey is returned if length of encryption keys is invalid.
 	ErrInvalidEncryptionKey = errors.New("Encryption key's length should be" +
 		"either 16, 24, or 32 bytes")
+
+	// ErrEncryptionDisabled is returned when an operation needs the DB to be encrypted.
+	ErrEncryptionDisabled = errors.New("Encryption is not enabled")
+
+	// ErrEncryptionKeyAndKeyProvider is returned if both an encryption key and a key provider
+	// are given.
+	ErrEncryptionKeyAndKeyProvider = errors.New(
+		"EncryptionKey and KeyProvider cannot be used together")
 	// ErrGCInMemoryMode is returned when db.RunValueLogGC is called in in-memory mode.
 	ErrGCInMemoryMode = errors.New("Cannot run value log GC when DB is opened in InMemory mode")
 
 	// ErrDBClosed is returned when a get operation is performed after closing the DB.
 	ErrDBClosed = errors.New("DB Closed")
+
+	// ErrOverlappingKeyRange is returned by StreamWriter.Flush, after PrepareIncremental, if the
+	// written keys overlap with the keys already in the DB, or with the keys of another stream.
+	ErrOverlappingKeyRange = errors.New("Key range overlaps with the existing keys")
+
+	// ErrInvalidResumeToken is returned by Stream.Orchestrate if the ResumeToken is malformed, or
+	// doesn't match the readTs, the Prefix or the SinceTs of the stream.
+	ErrInvalidResumeToken = errors.New("Invalid stream resume token")
+
+	// ErrFollowerNotManaged is returned by FollowPrimary if the DB wasn't opened with OpenManaged.
+	ErrFollowerNotManaged = errors.New("A replication follower must be opened with OpenManaged")
+
+	// ErrNotTailing is returned by DB.Refresh if the DB wasn't opened with Options.TailInterval.
+	ErrNotTailing = errors.New("DB is not tailing the writes of another process")
+
+	// ErrCorruptBackup is returned by DB.LoadFrom if a part of the backup doesn't match the size or
+	// the checksum recorded in its manifest.
+	ErrCorruptBackup = errors.New("Backup part doesn't match its manifest")
 )
@@ -128,8 +128,90 @@ func (rcv *TableIndex) MutateKeyCount(n uint32) bool {
 	return rcv._tab.MutateUint32Slot(14, n)
 }
 
+func (rcv *TableIndex) NumBlocks() uint32 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(16))
+	if o != 0 {
+		return rcv._tab.GetUint32(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *TableIndex) MutateNumBlocks(n uint32) bool {
+	return rcv._tab.MutateUint32Slot(16, n)
+}
+
+func (rcv *TableIndex) PartitionSize() uint32 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(18))
+	if o != 0 {
+		return rcv._tab.GetUint32(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *TableIndex) MutatePartitionSize(n uint32) bool {
+	return rcv._tab.MutateUint32Slot(18, n)
+}
+
+func (rcv *TableIndex) FilterType() uint32 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(20))
+	if o != 0 {
+		return rcv._tab.GetUint32(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *TableIndex) MutateFilterType(n uint32) bool {
+	return rcv._tab.MutateUint32Slot(20, n)
+}
+
+func (rcv *TableIndex) BlockHashIndex() bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(22))
+	if o != 0 {
+		return rcv._tab.GetBool(o + rcv._tab.Pos)
+	}
+	return false
+}
+
+func (rcv *TableIndex) MutateBlockHashIndex(n bool) bool {
+	return rcv._tab.MutateBoolSlot(22, n)
+}
+
+func (rcv *TableIndex) CompressionDict(j int) byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(24))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.GetByte(a + flatbuffers.UOffsetT(j*1))
+	}
+	return 0
+}
+
+func (rcv *TableIndex) CompressionDictLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(24))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
+}
+
+func (rcv *TableIndex) CompressionDictBytes() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(24))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *TableIndex) MutateCompressionDict(j int, n byte) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(24))
+	if o != 0 {
+		a := rcv._tab.Vector(o)
+		return rcv._tab.MutateByte(a+flatbuffers.UOffsetT(j*1), n)
+	}
+	return false
+}
+
 func TableIndexStart(builder *flatbuffers.Builder) {
-	builder.StartObject(6)
+	builder.StartObject(11)
 }
 func TableIndexAddOffsets(builder *flatbuffers.Builder, offsets flatbuffers.UOffsetT) {
 	builder.PrependUOffsetTSlot(0, flatbuffers.UOffsetT(offsets), 0)
@@ -155,6 +237,24 @@ func TableIndexAddUncompressedSize(builder *flatbuffers.Builder, uncompressedSiz
 func TableIndexAddKeyCount(builder *flatbuffers.Builder, keyCount uint32) {
 	builder.PrependUint32Slot(5, keyCount, 0)
 }
+func TableIndexAddNumBlocks(builder *flatbuffers.Builder, numBlocks uint32) {
+	builder.PrependUint32Slot(6, numBlocks, 0)
+}
+func TableIndexAddPartitionSize(builder *flatbuffers.Builder, partitionSize uint32) {
+	builder.PrependUint32Slot(7, partitionSize, 0)
+}
+func TableIndexAddFilterType(builder *flatbuffers.Builder, filterType uint32) {
+	builder.PrependUint32Slot(8, filterType, 0)
+}
+func TableIndexAddBlockHashIndex(builder *flatbuffers.Builder, blockHashIndex bool) {
+	builder.PrependBoolSlot(9, blockHashIndex, false)
+}
+func TableIndexAddCompressionDict(builder *flatbuffers.Builder, compressionDict flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(10, flatbuffers.UOffsetT(compressionDict), 0)
+}
+func TableIndexStartCompressionDictVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(1, numElems, 1)
+}
 func TableIndexEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
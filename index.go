@@ -0,0 +1,375 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/pkg/errors"
+)
+
+// indexKeyPrefix is the prefix of all the secondary index entries.
+var indexKeyPrefix = append(append([]byte{}, badgerPrefix...), "index!"...)
+
+// IndexFunc returns the index values of a key-value pair. The pair is listed under each of the
+// returned values in the index. It is called on every write to a key under the prefix of the
+// index, and must be deterministic, since it is also called on the old value of the key to
+// remove its entries.
+type IndexFunc func(key, value []byte) [][]byte
+
+// secondaryIndex is an index declared with DB.RegisterIndex.
+//
+// Each pair listed in the index is stored as an internal key with an empty value, laid out as
+// +--------------+------+---------------------+------------------+-------------+
+// | Index prefix | Name | Escaped index value | Terminator (0 1) | Primary key |
+// +--------------+------+---------------------+------------------+-------------+
+// where the name is preceded by its length, and each zero byte of the index value is escaped as
+// 0 0xFF. This keeps the entries sorted by index value and then by primary key, and makes the
+// entries of all the index values with a given prefix share the prefix of their keys.
+type secondaryIndex struct {
+	name   string
+	prefix []byte
+	fn     IndexFunc
+	// keyPrefix is the common prefix of all the entries of this index.
+	keyPrefix []byte
+}
+
+func newSecondaryIndex(name string, prefix []byte, fn IndexFunc) *secondaryIndex {
+	keyPrefix := make([]byte, 0, len(indexKeyPrefix)+2+len(name))
+	keyPrefix = append(keyPrefix, indexKeyPrefix...)
+	keyPrefix = append(keyPrefix, byte(len(name)>>8), byte(len(name)))
+	keyPrefix = append(keyPrefix, name...)
+	return &secondaryIndex{
+		name:      name,
+		prefix:    append([]byte{}, prefix...),
+		fn:        fn,
+		keyPrefix: keyPrefix,
+	}
+}
+
+// valuePrefix returns the prefix of the keys of all the entries whose index value starts with
+// the given prefix.
+func (idx *secondaryIndex) valuePrefix(prefix []byte) []byte {
+	out := make([]byte, 0, len(idx.keyPrefix)+len(prefix)+2)
+	out = append(out, idx.keyPrefix...)
+	for _, b := range prefix {
+		out = append(out, b)
+		if b == 0 {
+			out = append(out, 0xFF)
+		}
+	}
+	return out
+}
+
+// entryKey returns the key of the entry listing the primary key under the index value.
+func (idx *secondaryIndex) entryKey(value, key []byte) []byte {
+	out := idx.valuePrefix(value)
+	out = append(out, 0, 1)
+	return append(out, key...)
+}
+
+// parseEntryKey returns the index value and the primary key of an entry of this index.
+func (idx *secondaryIndex) parseEntryKey(k []byte) ([]byte, []byte, bool) {
+	if !bytes.HasPrefix(k, idx.keyPrefix) {
+		return nil, nil, false
+	}
+	k = k[len(idx.keyPrefix):]
+	var value []byte
+	for i := 0; i+1 < len(k); i++ {
+		if k[i] != 0 {
+			continue
+		}
+		switch k[i+1] {
+		case 0xFF:
+			value = append(value, k[:i+1]...)
+			k = k[i+2:]
+			i = -1
+		case 1:
+			return append(value, k[:i]...), k[i+2:], true
+		default:
+			return nil, nil, false
+		}
+	}
+	return nil, nil, false
+}
+
+// indexRegistry holds the secondary indexes declared on a DB.
+type indexRegistry struct {
+	sync.RWMutex
+	indexes []*secondaryIndex
+}
+
+func (r *indexRegistry) get(name string) *secondaryIndex {
+	r.RLock()
+	defer r.RUnlock()
+	for _, idx := range r.indexes {
+		if idx.name == name {
+			return idx
+		}
+	}
+	return nil
+}
+
+// matching returns the indexes that cover the given key.
+func (r *indexRegistry) matching(key []byte) []*secondaryIndex {
+	r.RLock()
+	defer r.RUnlock()
+	var out []*secondaryIndex
+	for _, idx := range r.indexes {
+		if bytes.HasPrefix(key, idx.prefix) {
+			out = append(out, idx)
+		}
+	}
+	return out
+}
+
+// RegisterIndex declares a secondary index over the keys with the given prefix. From then on,
+// every transaction that sets or deletes such a key also updates the entries of the index in the
+// same commit, using fn to compute the index values of the old and the new value of the key.
+//
+// Indexes are not persisted. They must be registered each time the DB is opened, before any
+// write to the indexed keys. Writes that happened while the index wasn't registered can be
+// accounted for with RebuildIndex.
+//
+// The entries of the indexes are internal keys, under the !badger! prefix. Like the other
+// internal keys, they are left out of Backup, Stream and replication, so the indexes must be
+// rebuilt with RebuildIndex after a restore, and on the followers.
+//
+// Outside of managed mode, the indexed keys can't be written with a WriteBatch.
+func (db *DB) RegisterIndex(name string, prefix []byte, fn IndexFunc) error {
+	if name == "" || len(name) > 1<<16-1 {
+		return errors.New("Index name must be between 1 and 65535 bytes long")
+	}
+	if fn == nil {
+		return errors.New("Index function can't be nil")
+	}
+	db.indexes.Lock()
+	defer db.indexes.Unlock()
+	for _, idx := range db.indexes.indexes {
+		if idx.name == name {
+			return errors.Errorf("Index %q is already registered", name)
+		}
+	}
+	db.indexes.indexes = append(db.indexes.indexes, newSecondaryIndex(name, prefix, fn))
+	return nil
+}
+
+// indexEntries returns the index entries to write along with the entry: deletions of the entries
+// of the old value of the key, and the entries of its new value. The old value is read in the
+// transaction, so a concurrent write to the key would make the transaction conflict.
+//
+// A WriteBatch outside of managed mode can't conflict, nor read the value of the key as of its
+// commit, so its writes to indexed keys are rejected. The transactions of a managed WriteBatch read at timestamp 0, and so can't see the old value.
+// For them, the old value is read as of just before the version the entry is written at.
+func (txn *Txn) indexEntries(e *Entry) ([]*Entry, error) {
+	indexes := txn.db.indexes.matching(e.Key)
+	if len(indexes) == 0 {
+		return nil, nil
+	}
+	if txn.inBatch && !txn.db.opt.managedTxns {
+		return nil, ErrIndexedWriteBatch
+	}
+	rtxn := txn
+	if txn.db.opt.managedTxns && txn.readTs == 0 {
+		version := e.version
+		if version == 0 {
+			version = txn.commitTs
+		}
+		if version == 0 {
+			return nil, errors.Errorf("Indexed key %q must be written at a version", e.Key)
+		}
+		rtxn = txn.db.NewTransactionAt(version-1, false)
+		defer rtxn.Discard()
+	}
+	var old []byte
+	item, err := rtxn.Get(e.Key)
+	switch {
+	case err == ErrKeyNotFound:
+	case err != nil:
+		return nil, err
+	default:
+		if old, err = item.ValueCopy(nil); err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []*Entry
+	for _, idx := range indexes {
+		if item != nil {
+			for _, v := range idx.fn(e.Key, old) {
+				entries = append(entries, &Entry{
+					Key:     idx.entryKey(v, e.Key),
+					meta:    bitDelete,
+					version: e.version,
+				})
+			}
+		}
+		if e.meta&bitDelete > 0 {
+			continue
+		}
+		for _, v := range idx.fn(e.Key, e.Value) {
+			entries = append(entries, &Entry{
+				Key:       idx.entryKey(v, e.Key),
+				ExpiresAt: e.ExpiresAt,
+				version:   e.version,
+			})
+		}
+	}
+	return entries, nil
+}
+
+// IndexIterator iterates over the entries of a secondary index, in increasing order of index
+// values, and then of primary keys.
+type IndexIterator struct {
+	txn        *Txn
+	idx        *secondaryIndex
+	it         *Iterator
+	value, key []byte
+}
+
+// NewIndexIterator returns an iterator over the entries of the named index whose index value
+// starts with valuePrefix. Like any Iterator, it must be closed before the transaction is
+// discarded.
+func (txn *Txn) NewIndexIterator(name string, valuePrefix []byte) (*IndexIterator, error) {
+	idx := txn.db.indexes.get(name)
+	if idx == nil {
+		return nil, errors.Errorf("Index %q is not registered", name)
+	}
+	opt := DefaultIteratorOptions
+	opt.PrefetchValues = false
+	opt.InternalAccess = true
+	opt.Prefix = idx.valuePrefix(valuePrefix)
+	return &IndexIterator{
+		txn: txn,
+		idx: idx,
+		it:  txn.NewIterator(opt),
+	}, nil
+}
+
+// skip moves the underlying iterator to the first valid entry, and parses its key.
+func (ii *IndexIterator) skip() {
+	for ; ii.it.Valid(); ii.it.Next() {
+		if value, key, ok := ii.idx.parseEntryKey(ii.it.Item().Key()); ok {
+			ii.value, ii.key = value, key
+			return
+		}
+	}
+}
+
+// Rewind moves the iterator to the first entry.
+func (ii *IndexIterator) Rewind() {
+	ii.it.Rewind()
+	ii.skip()
+}
+
+// Seek moves the iterator to the first entry with an index value greater than or equal to value.
+func (ii *IndexIterator) Seek(value []byte) {
+	ii.it.Seek(ii.idx.valuePrefix(value))
+	ii.skip()
+}
+
+// Next moves the iterator to the next entry.
+func (ii *IndexIterator) Next() {
+	ii.it.Next()
+	ii.skip()
+}
+
+// Valid returns false when the iteration is done.
+func (ii *IndexIterator) Valid() bool { return ii.it.Valid() }
+
+// IndexValue returns the index value of the current entry. The slice is only valid until the
+// iterator moves.
+func (ii *IndexIterator) IndexValue() []byte { return ii.value }
+
+// PrimaryKey returns the key listed in the current entry. The slice is only valid until the
+// iterator moves.
+func (ii *IndexIterator) PrimaryKey() []byte { return ii.key }
+
+// Item reads the key listed in the current entry in the transaction of the iterator.
+func (ii *IndexIterator) Item() (*Item, error) {
+	return ii.txn.Get(ii.key)
+}
+
+// Close closes the iterator.
+func (ii *IndexIterator) Close() { ii.it.Close() }
+
+// RebuildIndex drops all the entries of the named index, and recreates them from the keys
+// under its prefix using Stream. It should be run while nothing writes to those keys, since a
+// write racing with the rebuild could leave a stale entry behind.
+//
+// RebuildIndex is not supported in managed mode.
+func (db *DB) RebuildIndex(name string) error {
+	if db.opt.managedTxns {
+		return ErrManagedTxn
+	}
+	idx := db.indexes.get(name)
+	if idx == nil {
+		return errors.Errorf("Index %q is not registered", name)
+	}
+	if err := db.DropPrefix(idx.keyPrefix); err != nil {
+		return err
+	}
+
+	stream := db.NewStream()
+	stream.Prefix = idx.prefix
+	stream.LogPrefix = "RebuildIndex." + name
+	// Only the latest version of each key is indexed.
+	stream.KeyToList = func(key []byte, itr *Iterator) (*pb.KVList, error) {
+		item := itr.Item()
+		if item.IsDeletedOrExpired() {
+			return nil, nil
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.KVList{Kv: []*pb.KV{{
+			Key:       item.KeyCopy(nil),
+			Value:     val,
+			ExpiresAt: item.ExpiresAt(),
+		}}}, nil
+	}
+
+	txn := db.NewTransaction(true)
+	defer func() { txn.Discard() }()
+	stream.Send = func(list *pb.KVList) error {
+		for _, kv := range list.Kv {
+			for _, v := range idx.fn(kv.Key, kv.Value) {
+				e := &Entry{Key: idx.entryKey(v, kv.Key), ExpiresAt: kv.ExpiresAt}
+				err := txn.addEntries(e)
+				if err == ErrTxnTooBig {
+					if err = txn.Commit(); err != nil {
+						return err
+					}
+					txn = db.NewTransaction(true)
+					err = txn.addEntries(e)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := stream.Orchestrate(context.Background()); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
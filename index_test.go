@@ -0,0 +1,219 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// cityIndex indexes "user:<id>" keys by the city in values like "<name>,<city>".
+func cityIndex(key, value []byte) [][]byte {
+	parts := bytes.SplitN(value, []byte(","), 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	return [][]byte{parts[1]}
+}
+
+func indexScan(t *testing.T, db *DB, name string, valuePrefix []byte) []string {
+	var res []string
+	require.NoError(t, db.View(func(txn *Txn) error {
+		it, err := txn.NewIndexIterator(name, valuePrefix)
+		require.NoError(t, err)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			res = append(res, fmt.Sprintf("%s=%s", it.IndexValue(), it.PrimaryKey()))
+		}
+		return nil
+	}))
+	return res
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.RegisterIndex("city", []byte("user:"), cityIndex))
+		require.Error(t, db.RegisterIndex("city", []byte("user:"), cityIndex))
+
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			require.NoError(t, txn.Set([]byte("user:1"), []byte("alice,paris")))
+			require.NoError(t, txn.Set([]byte("user:2"), []byte("bob,berlin")))
+			require.NoError(t, txn.Set([]byte("user:3"), []byte("carol,paris")))
+			// Not under the indexed prefix.
+			require.NoError(t, txn.Set([]byte("org:1"), []byte("acme,paris")))
+
+			// The pending index entries are visible in the transaction.
+			it, err := txn.NewIndexIterator("city", []byte("paris"))
+			require.NoError(t, err)
+			defer it.Close()
+			var n int
+			for it.Rewind(); it.Valid(); it.Next() {
+				item, err := it.Item()
+				require.NoError(t, err)
+				require.Equal(t, it.PrimaryKey(), item.Key())
+				n++
+			}
+			require.Equal(t, 2, n)
+			return nil
+		}))
+		require.Equal(t, []string{"berlin=user:2", "paris=user:1", "paris=user:3"},
+			indexScan(t, db, "city", nil))
+
+		// Overwrites and deletes remove the old entries.
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			require.NoError(t, txn.Set([]byte("user:1"), []byte("alice,rome")))
+			require.NoError(t, txn.Set([]byte("user:1"), []byte("alice,oslo")))
+			return txn.Delete([]byte("user:3"))
+		}))
+		require.Equal(t, []string{"berlin=user:2", "oslo=user:1"}, indexScan(t, db, "city", nil))
+		require.Equal(t, []string{"oslo=user:1"}, indexScan(t, db, "city", []byte("o")))
+
+		// An index value that is a prefix of another one isn't mixed up with it.
+		txnSet(t, db, []byte("user:4"), []byte("dan,os"), 0)
+		require.Equal(t, []string{"os=user:4", "oslo=user:1"},
+			indexScan(t, db, "city", []byte("os")))
+
+		// Zero bytes in index values are escaped.
+		txnSet(t, db, []byte("user:5"), []byte("eve,o\x00s"), 0)
+		require.Equal(t, []string{"o\x00s=user:5"}, indexScan(t, db, "city", []byte("o\x00")))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it, err := txn.NewIndexIterator("city", nil)
+			require.NoError(t, err)
+			defer it.Close()
+			it.Seek([]byte("os"))
+			require.True(t, it.Valid())
+			require.Equal(t, []byte("user:4"), it.PrimaryKey())
+			return nil
+		}))
+
+		// Index entries are internal keys.
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				require.False(t, bytes.HasPrefix(it.Item().Key(), badgerPrefix))
+			}
+			return nil
+		}))
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.NewIndexIterator("missing", nil)
+			require.Error(t, err)
+			return nil
+		}))
+	})
+}
+
+func TestSecondaryIndexConflict(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.RegisterIndex("city", []byte("user:"), cityIndex))
+		txnSet(t, db, []byte("user:1"), []byte("alice,paris"), 0)
+
+		// Both transactions read the old value to update the index, so they conflict.
+		txn1 := db.NewTransaction(true)
+		txn2 := db.NewTransaction(true)
+		require.NoError(t, txn1.Set([]byte("user:1"), []byte("alice,rome")))
+		require.NoError(t, txn2.Set([]byte("user:1"), []byte("alice,oslo")))
+		require.NoError(t, txn1.Commit())
+		require.Equal(t, ErrConflict, txn2.Commit())
+		require.Equal(t, []string{"rome=user:1"}, indexScan(t, db, "city", nil))
+	})
+}
+
+func TestSecondaryIndexWriteBatch(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.RegisterIndex("city", []byte("user:"), cityIndex))
+		txnSet(t, db, []byte("user:1"), []byte("alice,paris"), 0)
+
+		// The batch can't read the old value without conflicting, so it can't update the index.
+		wb := db.NewWriteBatch()
+		require.Equal(t, ErrIndexedWriteBatch, wb.Set([]byte("user:1"), []byte("alice,rome")))
+		require.Equal(t, ErrIndexedWriteBatch, wb.Delete([]byte("user:1")))
+		require.NoError(t, wb.Set([]byte("other:1"), []byte("bob,rome")))
+		require.NoError(t, wb.Flush())
+		require.Equal(t, []string{"paris=user:1"}, indexScan(t, db, "city", nil))
+	})
+}
+
+func TestRebuildIndex(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		// Written before the index is registered.
+		wb := db.NewWriteBatch()
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, wb.Set([]byte(fmt.Sprintf("user:%04d", i)),
+				[]byte(fmt.Sprintf("name%d,city%d", i, i%10))))
+		}
+		require.NoError(t, wb.Flush())
+		require.NoError(t, db.RegisterIndex("city", []byte("user:"), cityIndex))
+		require.Empty(t, indexScan(t, db, "city", nil))
+
+		require.NoError(t, db.RebuildIndex("city"))
+		require.Len(t, indexScan(t, db, "city", nil), 1000)
+		res := indexScan(t, db, "city", []byte("city3"))
+		require.Len(t, res, 100)
+		require.Equal(t, "city3=user:0003", res[0])
+
+		// Rebuilding again drops the old entries first.
+		require.NoError(t, db.RebuildIndex("city"))
+		require.Len(t, indexScan(t, db, "city", nil), 1000)
+	})
+}
+
+func TestSecondaryIndexManagedWriteBatch(t *testing.T) {
+	opt := getTestOptions("")
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		require.NoError(t, db.RegisterIndex("city", []byte("user:"), cityIndex))
+		scan := func(readTs uint64) []string {
+			txn := db.NewTransactionAt(readTs, false)
+			defer txn.Discard()
+			it, err := txn.NewIndexIterator("city", nil)
+			require.NoError(t, err)
+			defer it.Close()
+			var res []string
+			for it.Rewind(); it.Valid(); it.Next() {
+				res = append(res, fmt.Sprintf("%s=%s", it.IndexValue(), it.PrimaryKey()))
+			}
+			return res
+		}
+
+		wb := db.NewManagedWriteBatch()
+		require.NoError(t, wb.SetEntryAt(NewEntry([]byte("user:1"), []byte("alice,paris")), 1))
+		require.NoError(t, wb.SetEntryAt(NewEntry([]byte("user:2"), []byte("bob,berlin")), 1))
+		require.NoError(t, wb.Flush())
+
+		wb = db.NewManagedWriteBatch()
+		require.NoError(t, wb.SetEntryAt(NewEntry([]byte("user:1"), []byte("alice,rome")), 2))
+		require.NoError(t, wb.Flush())
+
+		wb = db.NewWriteBatchAt(3)
+		require.NoError(t, wb.Delete([]byte("user:2")))
+		require.NoError(t, wb.Flush())
+
+		require.Equal(t, []string{"berlin=user:2", "paris=user:1"}, scan(1))
+		require.Equal(t, []string{"berlin=user:2", "rome=user:1"}, scan(2))
+		require.Equal(t, []string{"rome=user:1"}, scan(3))
+
+		// A managed WriteBatch without a version can't update the index.
+		wb = db.NewManagedWriteBatch()
+		require.Error(t, wb.Set([]byte("user:3"), []byte("carol,paris")))
+		wb.Cancel()
+	})
+}
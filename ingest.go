@@ -0,0 +1,229 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sort"
+
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgraph-io/badger/v2/table"
+	"github.com/dgraph-io/badger/v2/y"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+// IngestExternalFiles adds the SSTables at the given paths to the DB. The tables must have been
+// built offline using SSTWriter or table.Builder, with the BlockSize and Compression of the DB
+// and without encryption. Each table must hold at most one version of a key, and the tables must
+// not overlap with each other. Values must be stored inline, since the value log of the DB
+// knows nothing about them.
+//
+// All the keys in the ingested tables are assigned a single new commit timestamp, so they
+// become visible to new transactions at once, and take precedence over any existing version of
+// the same keys. Each table is rewritten into the DB directory and placed at the deepest level
+// where it doesn't overlap with any table or running compaction in that level or above it.
+// Either all the tables are added, or none of them is. The original files are left untouched.
+//
+// IngestExternalFiles is not supported in managed mode, where the caller owns the timestamps.
+func (db *DB) IngestExternalFiles(paths []string) error {
+	if db.opt.managedTxns {
+		return ErrManagedTxn
+	}
+	if db.opt.ReadOnly {
+		return errors.New("Cannot ingest files into a DB opened in read-only mode")
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	ext := make([]*table.Table, 0, len(paths))
+	defer func() {
+		for _, t := range ext {
+			_ = t.DecrRef()
+		}
+	}()
+	topt := buildTableOptions(db.opt)
+	topt.DataKey = nil
+	topt.BlockCache = nil
+	topt.IndexCache = nil
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return y.Wrapf(err, "while reading external file: %s", path)
+		}
+		t, err := table.OpenInMemoryTable(data, 0, &topt)
+		if err != nil {
+			return y.Wrapf(err, "while opening external file: %s", path)
+		}
+		ext = append(ext, t)
+		if err := validateExternalTable(t); err != nil {
+			return y.Wrapf(err, "external file: %s", path)
+		}
+	}
+	sort.Slice(ext, func(i, j int) bool {
+		return y.CompareKeys(ext[i].Smallest(), ext[j].Smallest()) < 0
+	})
+	for i := 1; i < len(ext); i++ {
+		if bytes.Compare(y.ParseKey(ext[i-1].Biggest()), y.ParseKey(ext[i].Smallest())) >= 0 {
+			return errors.New("External files overlap with each other")
+		}
+	}
+
+	// Reserve a commit timestamp for the ingested keys. Readers wait on the txnMark for this
+	// timestamp, so none of the keys are visible until all the tables have been placed.
+	db.orc.Lock()
+	ts := db.orc.nextTxnTs
+	db.orc.nextTxnTs++
+	db.orc.txnMark.Begin(ts)
+	db.orc.Unlock()
+	defer db.orc.doneCommit(ts)
+
+	tables := make([]*table.Table, 0, len(ext))
+	defer func() {
+		// Once added, the levels hold their own references to the tables. Otherwise, releasing
+		// the references deletes the tables.
+		for _, t := range tables {
+			_ = t.DecrRef()
+		}
+	}()
+	for _, t := range ext {
+		tbl, err := db.buildIngestedTable(t, ts)
+		if err != nil {
+			return err
+		}
+		if tbl != nil {
+			tables = append(tables, tbl)
+		}
+	}
+	if err := db.lc.addIngestedTables(tables); err != nil {
+		return err
+	}
+	return db.syncDir(db.opt.Dir)
+}
+
+// validateExternalTable checks that the table holds at most one version of each key, and no
+// value pointers.
+func validateExternalTable(t *table.Table) error {
+	it := t.NewIterator(0)
+	defer it.Close()
+	var last []byte
+	for it.Rewind(); it.Valid(); it.Next() {
+		key := y.ParseKey(it.Key())
+		if last != nil && bytes.Equal(key, last) {
+			return errors.Errorf("Duplicate key: %q", key)
+		}
+		last = y.SafeCopy(last, key)
+		if it.Value().Meta&bitValuePointer > 0 {
+			return errors.Errorf("Key %q holds a value pointer", key)
+		}
+	}
+	return nil
+}
+
+// buildIngestedTable rewrites the external table into a new table of the DB, with all the keys
+// at version ts. It returns a nil table if the external table is empty.
+func (db *DB) buildIngestedTable(ext *table.Table, ts uint64) (*table.Table, error) {
+	bopts := buildTableOptions(db.opt)
+	dk, err := db.registry.LatestDataKey()
+	if err != nil {
+		return nil, y.Wrapf(err, "Error while retrieving datakey in IngestExternalFiles")
+	}
+	bopts.DataKey = dk
+	bopts.TableID = db.lc.reserveFileID()
+	builder := table.NewTableBuilder(bopts)
+	defer builder.Close()
+
+	it := ext.NewIterator(0)
+	for it.Rewind(); it.Valid(); it.Next() {
+		vs := it.Value()
+		vs.Version = ts
+		builder.Add(y.KeyWithTs(y.ParseKey(it.Key()), ts), vs, 0)
+	}
+	if err := it.Close(); err != nil {
+		return nil, err
+	}
+	if builder.Empty() {
+		return nil, nil
+	}
+
+	data := builder.Finish(db.opt.InMemory)
+	fileID := bopts.TableID
+	opts := buildTableOptions(db.opt)
+	opts.DataKey = builder.DataKey()
+	opts.BlockCache = db.blockCache
+	opts.IndexCache = db.indexCache
+	if db.opt.InMemory {
+		return table.OpenInMemoryTable(data, fileID, &opts)
+	}
+	return table.CreateTable(table.NewFilename(fileID, db.opt.Dir), data, opts)
+}
+
+// addIngestedTables adds each table to the deepest level such that neither that level nor any
+// level above it has a table or a running compaction overlapping with it. The tables are recorded
+// in the MANIFEST with a single change, so that either all of them or none of them are added.
+func (s *levelsController) addIngestedTables(tables []*table.Table) error {
+	if len(tables) == 0 {
+		return nil
+	}
+	// Holding the cstatus lock keeps new compactions from picking up the key ranges while we
+	// look for the levels.
+	s.cstatus.Lock()
+	levels := make([]int, len(tables))
+	changes := make([]*pb.ManifestChange, 0, len(tables))
+	for i, t := range tables {
+		kr := getKeyRange(t)
+		for l := 0; l < len(s.levels); l++ {
+			if s.cstatus.levels[l].overlapsWith(kr) || s.levels[l].overlapsWith(kr) {
+				break
+			}
+			levels[i] = l
+		}
+		changes = append(changes,
+			newCreateChange(t.ID(), levels[i], t.KeyID(), t.CompressionType()))
+	}
+	if !tables[0].IsInmemory {
+		if err := s.kv.manifest.addChanges(changes); err != nil {
+			s.cstatus.Unlock()
+			return err
+		}
+	}
+
+	var l0 []*table.Table
+	for i, t := range tables {
+		if levels[i] == 0 {
+			l0 = append(l0, t)
+			continue
+		}
+		if err := s.levels[levels[i]].replaceTables(nil, []*table.Table{t}); err != nil {
+			s.cstatus.Unlock()
+			return err
+		}
+		s.kv.opt.Infof("Table ingested: %d at level: %d. Size: %s\n",
+			t.ID(), levels[i], humanize.Bytes(uint64(t.Size())))
+	}
+	s.cstatus.Unlock()
+
+	// Adding to level 0 might stall until L0 gets compacted, so it must run without the lock.
+	for _, t := range l0 {
+		s.addToLevel0(t)
+		s.kv.opt.Infof("Table ingested: %d at level: 0. Size: %s\n",
+			t.ID(), humanize.Bytes(uint64(t.Size())))
+	}
+	return nil
+}
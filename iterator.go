@@ -303,6 +303,10 @@ type IteratorOptions struct {
 	// prefix are picked based on their range of keys.
 	prefixIsKey bool   // If set, use the prefix for bloom filter lookup.
 	Prefix      []byte // Only iterate over this given prefix.
+
+	// sinceTs is used by Stream to skip the tables that only hold versions at or below it. The
+	// iterator can still return such versions from the other tables and the memtables.
+	sinceTs uint64
 }
 
 func (opt *IteratorOptions) compareToPrefix(key []byte) int {
@@ -333,6 +337,20 @@ func (opt *IteratorOptions) pickTable(t table.TableInterface) bool {
 	return true
 }
 
+// pickNewTables filters out the tables that only hold versions at or below opt.sinceTs.
+func (opt *IteratorOptions) pickNewTables(tables []*table.Table) []*table.Table {
+	if opt.sinceTs == 0 {
+		return tables
+	}
+	out := tables[:0]
+	for _, t := range tables {
+		if t.MaxVersion() > opt.sinceTs {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
 // pickTables picks the necessary table for the iterator. This function also assumes
 // that the tables are sorted in the right order.
 func (opt *IteratorOptions) pickTables(all []*table.Table) []*table.Table {
@@ -612,6 +630,7 @@ FILL:
 
 	mi.Next()                           // Advance but no fill item yet.
 	if !it.opt.Reverse || !mi.Valid() { // Forward direction, or invalid.
+		it.resolveMerge(item)
 		setItem(item)
 		return true
 	}
@@ -624,10 +643,25 @@ FILL:
 		goto FILL
 	}
 	// Ignore the next candidate. Return the current one.
+	it.resolveMerge(item)
 	setItem(item)
 	return true
 }
 
+// resolveMerge replaces the merge operand held by the item, if any, with the value of the key.
+func (it *Iterator) resolveMerge(item *Item) {
+	if item.meta&bitMergeOperand == 0 {
+		return
+	}
+	// A pending write of the transaction is at readTs, and applies on top of what it reads.
+	ts := item.version - 1
+	if e, ok := it.txn.pendingWrites[string(item.key)]; ok && item.version == it.readTs &&
+		e.meta&bitMergeOperand > 0 {
+		ts = item.version
+	}
+	item.resolveMerge(ts)
+}
+
 func (it *Iterator) fill(item *Item) {
 	vs := it.iitr.Value()
 	item.meta = vs.Meta
@@ -639,6 +673,12 @@ func (it *Iterator) fill(item *Item) {
 
 	item.vptr = y.SafeCopy(item.vptr, vs.Value)
 	item.val = nil
+	item.err = nil
+	item.status = 0
+	if vs.Meta&bitMergeOperand > 0 && !it.opt.AllVersions {
+		// The value is set once the operand is merged, before the item is returned.
+		return
+	}
 	if it.opt.PrefetchValues {
 		item.wg.Add(1)
 		go func() {
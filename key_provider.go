@@ -0,0 +1,32 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+// KeyProvider wraps and unwraps the data keys of the key registry with a master key that it keeps
+// to itself, typically in a key management service (KMS). The key registry only stores the
+// wrapped data keys, so the master key never has to be passed in the options. This is known as
+// envelope encryption.
+//
+// The kms package provides a KeyProvider reading the master key from a file, and a KeyProvider
+// talking to a KMS stand-in over a local socket.
+type KeyProvider interface {
+	// WrapKey encrypts the given data key.
+	WrapKey(key []byte) ([]byte, error)
+	// UnwrapKey decrypts a data key encrypted by WrapKey. It should fail, or return a different
+	// key, when the data key was wrapped with another master key.
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
@@ -28,8 +28,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/dgraph-io/badger/v2/options"
 	"github.com/dgraph-io/badger/v2/pb"
 	"github.com/dgraph-io/badger/v2/y"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -42,6 +44,14 @@ const (
 // SanityText is used to check whether the given user provided storage key is valid or not
 var sanityText = []byte("Hello Badger")
 
+// keyProviderMarker takes the place of the sanity text in a key registry whose data keys are
+// wrapped by a KeyProvider. It is followed by the length of the wrapped sanity text and the
+// wrapped sanity text.
+var keyProviderMarker = []byte("Badger KMS\x00\x00")
+
+// keyProviderDataKeySize is the size of the data keys wrapped by a KeyProvider, for AES-256.
+const keyProviderDataKeySize = 32
+
 // KeyRegistry used to maintain all the data keys.
 type KeyRegistry struct {
 	sync.RWMutex
@@ -58,6 +68,16 @@ type KeyRegistryOptions struct {
 	EncryptionKey                 []byte
 	EncryptionKeyRotationDuration time.Duration
 	InMemory                      bool
+	// KeyProvider wraps the data keys instead of EncryptionKey.
+	KeyProvider KeyProvider
+	// EncryptionAlgo is the AES mode of the new data keys.
+	EncryptionAlgo options.EncryptionAlgo
+}
+
+// encrypted returns true if the data keys are encrypted, with either EncryptionKey or
+// KeyProvider.
+func (opt KeyRegistryOptions) encrypted() bool {
+	return len(opt.EncryptionKey) > 0 || opt.KeyProvider != nil
 }
 
 // newKeyRegistry returns KeyRegistry.
@@ -72,6 +92,9 @@ func newKeyRegistry(opt KeyRegistryOptions) *KeyRegistry {
 // OpenKeyRegistry opens key registry if it exists, otherwise it'll create key registry
 // and returns key registry.
 func OpenKeyRegistry(opt KeyRegistryOptions) (*KeyRegistry, error) {
+	if len(opt.EncryptionKey) > 0 && opt.KeyProvider != nil {
+		return nil, ErrEncryptionKeyAndKeyProvider
+	}
 	// sanity check the encryption key length.
 	if len(opt.EncryptionKey) > 0 {
 		switch len(opt.EncryptionKey) {
@@ -131,6 +154,7 @@ func OpenKeyRegistry(opt KeyRegistryOptions) (*KeyRegistry, error) {
 // keyRegistryIterator reads all the datakey from the key registry
 type keyRegistryIterator struct {
 	encryptionKey []byte
+	keyProvider   KeyProvider
 	fp            *os.File
 	// lenCrcBuf contains crc buf and data length to move forward.
 	lenCrcBuf [8]byte
@@ -138,16 +162,18 @@ type keyRegistryIterator struct {
 
 // newKeyRegistryIterator returns iterator which will allow you to iterate
 // over the data key of the key registry.
-func newKeyRegistryIterator(fp *os.File, encryptionKey []byte) (*keyRegistryIterator, error) {
+func newKeyRegistryIterator(fp *os.File, opt KeyRegistryOptions) (*keyRegistryIterator, error) {
 	return &keyRegistryIterator{
-		encryptionKey: encryptionKey,
+		encryptionKey: opt.EncryptionKey,
+		keyProvider:   opt.KeyProvider,
 		fp:            fp,
 		lenCrcBuf:     [8]byte{},
-	}, validRegistry(fp, encryptionKey)
+	}, validRegistry(fp, opt)
 }
 
-// validRegistry checks that given encryption key is valid or not.
-func validRegistry(fp *os.File, encryptionKey []byte) error {
+// validRegistry checks that given encryption key or key provider is valid or not.
+func validRegistry(fp *os.File, opt KeyRegistryOptions) error {
+	encryptionKey := opt.EncryptionKey
 	iv := make([]byte, aes.BlockSize)
 	var err error
 	if _, err = fp.Read(iv); err != nil {
@@ -157,6 +183,12 @@ func validRegistry(fp *os.File, encryptionKey []byte) error {
 	if _, err = fp.Read(eSanityText); err != nil {
 		return y.Wrapf(err, "Error while reading sanity text.")
 	}
+	if bytes.Equal(eSanityText, keyProviderMarker) {
+		return validProviderRegistry(fp, opt.KeyProvider)
+	}
+	if opt.KeyProvider != nil {
+		return ErrEncryptionKeyMismatch
+	}
 	if len(encryptionKey) > 0 {
 		// Decrypting sanity text.
 		if eSanityText, err = y.XORBlockAllocate(eSanityText, encryptionKey, iv); err != nil {
@@ -170,6 +202,30 @@ func validRegistry(fp *os.File, encryptionKey []byte) error {
 	return nil
 }
 
+// validProviderRegistry checks that the key provider unwraps the sanity text of a key registry
+// written with a key provider.
+func validProviderRegistry(fp *os.File, kp KeyProvider) error {
+	if kp == nil {
+		return ErrEncryptionKeyMismatch
+	}
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(fp, lenBuf[:]); err != nil {
+		return y.Wrapf(err, "Error while reading wrapped sanity text length.")
+	}
+	wrapped := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+	if _, err := io.ReadFull(fp, wrapped); err != nil {
+		return y.Wrapf(err, "Error while reading wrapped sanity text.")
+	}
+	text, err := kp.UnwrapKey(wrapped)
+	if err != nil {
+		return errors.Wrapf(ErrEncryptionKeyMismatch, "While unwrapping sanity text: %v", err)
+	}
+	if !bytes.Equal(text, sanityText) {
+		return ErrEncryptionKeyMismatch
+	}
+	return nil
+}
+
 func (kri *keyRegistryIterator) next() (*pb.DataKey, error) {
 	var err error
 	// Read crc buf and data length.
@@ -198,7 +254,11 @@ func (kri *keyRegistryIterator) next() (*pb.DataKey, error) {
 	if err = dataKey.Unmarshal(data); err != nil {
 		return nil, y.Wrapf(err, "While unmarshal of datakey in keyRegistryIterator.next")
 	}
-	if len(kri.encryptionKey) > 0 {
+	if kri.keyProvider != nil {
+		if dataKey.Data, err = kri.keyProvider.UnwrapKey(dataKey.Data); err != nil {
+			return nil, y.Wrapf(err, "While unwrapping datakey in keyRegistryIterator.next")
+		}
+	} else if len(kri.encryptionKey) > 0 {
 		// Decrypt the key if the storage key exists.
 		if dataKey.Data, err = y.XORBlockAllocate(dataKey.Data, kri.encryptionKey, dataKey.Iv); err != nil {
 			return nil, y.Wrapf(err, "While decrypting datakey in keyRegistryIterator.next")
@@ -209,7 +269,7 @@ func (kri *keyRegistryIterator) next() (*pb.DataKey, error) {
 
 // readKeyRegistry will read the key registry file and build the key registry struct.
 func readKeyRegistry(fp *os.File, opt KeyRegistryOptions) (*KeyRegistry, error) {
-	itr, err := newKeyRegistryIterator(fp, opt.EncryptionKey)
+	itr, err := newKeyRegistryIterator(fp, opt)
 	if err != nil {
 		return nil, err
 	}
@@ -242,6 +302,9 @@ Structure of Key Registry.
 +-------------------+---------------------+--------------------+--------------+------------------+
 |     IV            | Sanity Text         | DataKey1           | DataKey2     | ...              |
 +-------------------+---------------------+--------------------+--------------+------------------+
+
+With a key provider, the sanity text is replaced by the key provider marker, followed by the
+length of the wrapped sanity text and the wrapped sanity text.
 */
 
 // WriteKeyRegistry will rewrite the existing key registry file with new one.
@@ -252,7 +315,15 @@ func WriteKeyRegistry(reg *KeyRegistry, opt KeyRegistryOptions) error {
 	y.Check(err)
 	// Encrypt sanity text if the encryption key is presents.
 	eSanity := sanityText
-	if len(opt.EncryptionKey) > 0 {
+	if opt.KeyProvider != nil {
+		wrapped, err := opt.KeyProvider.WrapKey(sanityText)
+		if err != nil {
+			return y.Wrapf(err, "Error while wrapping sanity text in WriteKeyRegistry")
+		}
+		var lenBuf [4]byte
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(len(wrapped)))
+		eSanity = append(append(append([]byte{}, keyProviderMarker...), lenBuf[:]...), wrapped...)
+	} else if len(opt.EncryptionKey) > 0 {
 		var err error
 		eSanity, err = y.XORBlockAllocate(eSanity, opt.EncryptionKey, iv)
 		if err != nil {
@@ -264,7 +335,7 @@ func WriteKeyRegistry(reg *KeyRegistry, opt KeyRegistryOptions) error {
 	// Write all the datakeys to the buf.
 	for _, k := range reg.dataKeys {
 		// Writing the datakey to the given buffer.
-		if err := storeDataKey(buf, opt.EncryptionKey, k); err != nil {
+		if err := storeDataKey(buf, opt, k); err != nil {
 			return y.Wrapf(err, "Error while storing datakey in WriteKeyRegistry")
 		}
 	}
@@ -294,6 +365,31 @@ func WriteKeyRegistry(reg *KeyRegistry, opt KeyRegistryOptions) error {
 	return syncDir(opt.Dir)
 }
 
+// reload reads the data keys added to the registry file by the process writing to the directory,
+// for a DB tailing it.
+func (kr *KeyRegistry) reload() error {
+	if !kr.opt.encrypted() || kr.opt.InMemory {
+		return nil
+	}
+	fp, err := y.OpenExistingFile(filepath.Join(kr.opt.Dir, KeyRegistryFileName), y.ReadOnly)
+	if err != nil {
+		return y.Wrapf(err, "Error while opening key registry.")
+	}
+	defer fp.Close()
+	fresh, err := readKeyRegistry(fp, kr.opt)
+	if fresh == nil {
+		return err
+	}
+	kr.Lock()
+	defer kr.Unlock()
+	for id, dk := range fresh.dataKeys {
+		if _, ok := kr.dataKeys[id]; !ok {
+			kr.dataKeys[id] = dk
+		}
+	}
+	return err
+}
+
 // DataKey returns datakey of the given key id.
 func (kr *KeyRegistry) DataKey(id uint64) (*pb.DataKey, error) {
 	kr.RLock()
@@ -313,7 +409,7 @@ func (kr *KeyRegistry) DataKey(id uint64) (*pb.DataKey, error) {
 // period. If the last generated datakey lifetime exceeds the rotation period.
 // It'll create new datakey.
 func (kr *KeyRegistry) LatestDataKey() (*pb.DataKey, error) {
-	if len(kr.opt.EncryptionKey) == 0 {
+	if !kr.opt.encrypted() {
 		// nil is for no encryption.
 		return nil, nil
 	}
@@ -322,10 +418,16 @@ func (kr *KeyRegistry) LatestDataKey() (*pb.DataKey, error) {
 	validKey := func() (*pb.DataKey, bool) {
 		// Time diffrence from the last generated time.
 		diff := time.Since(time.Unix(kr.lastCreated, 0))
-		if diff < kr.opt.EncryptionKeyRotationDuration {
-			return kr.dataKeys[kr.nextKeyID], true
+		if diff >= kr.opt.EncryptionKeyRotationDuration {
+			return nil, false
+		}
+		// A data key of another AES mode is rotated, so that the new data is written with the
+		// configured mode.
+		dk, ok := kr.dataKeys[kr.nextKeyID]
+		if !ok || dk.EncryptionAlgo != kr.algo() {
+			return nil, false
 		}
-		return nil, false
+		return dk, true
 	}
 	kr.RLock()
 	key, valid := validKey()
@@ -342,7 +444,11 @@ func (kr *KeyRegistry) LatestDataKey() (*pb.DataKey, error) {
 	if valid {
 		return key, nil
 	}
-	k := make([]byte, len(kr.opt.EncryptionKey))
+	keySize := len(kr.opt.EncryptionKey)
+	if kr.opt.KeyProvider != nil {
+		keySize = keyProviderDataKeySize
+	}
+	k := make([]byte, keySize)
 	iv, err := y.GenerateIV()
 	if err != nil {
 		return nil, err
@@ -354,16 +460,17 @@ func (kr *KeyRegistry) LatestDataKey() (*pb.DataKey, error) {
 	// Otherwise Increment the KeyID and generate new datakey.
 	kr.nextKeyID++
 	dk := &pb.DataKey{
-		KeyId:     kr.nextKeyID,
-		Data:      k,
-		CreatedAt: time.Now().Unix(),
-		Iv:        iv,
+		KeyId:          kr.nextKeyID,
+		Data:           k,
+		CreatedAt:      time.Now().Unix(),
+		Iv:             iv,
+		EncryptionAlgo: kr.algo(),
 	}
 	// Don't store the datakey on file if badger is running in InMemory mode.
 	if !kr.opt.InMemory {
 		// Store the datekey.
 		buf := &bytes.Buffer{}
-		if err = storeDataKey(buf, kr.opt.EncryptionKey, dk); err != nil {
+		if err = storeDataKey(buf, kr.opt, dk); err != nil {
 			return nil, err
 		}
 		// Persist the datakey to the disk
@@ -378,6 +485,11 @@ func (kr *KeyRegistry) LatestDataKey() (*pb.DataKey, error) {
 	return dk, nil
 }
 
+// algo returns the AES mode of the new data keys.
+func (kr *KeyRegistry) algo() pb.EncryptionAlgo {
+	return pb.EncryptionAlgo(kr.opt.EncryptionAlgo)
+}
+
 // Close closes the key registry.
 func (kr *KeyRegistry) Close() error {
 	if !(kr.opt.ReadOnly || kr.opt.InMemory) {
@@ -386,39 +498,79 @@ func (kr *KeyRegistry) Close() error {
 	return nil
 }
 
-// storeDataKey stores datakey in an encrypted format in the given buffer. If storage key preset.
-func storeDataKey(buf *bytes.Buffer, storageKey []byte, k *pb.DataKey) error {
-	// xor will encrypt the IV and xor with the given data.
-	// It'll used for both encryption and decryption.
-	xor := func() error {
-		if len(storageKey) == 0 {
-			return nil
-		}
-		var err error
-		k.Data, err = y.XORBlockAllocate(k.Data, storageKey, k.Iv)
-		return err
+// storeDataKey stores datakey in an encrypted format in the given buffer. If storage key or key
+// provider preset.
+func storeDataKey(buf *bytes.Buffer, opt KeyRegistryOptions, k *pb.DataKey) error {
+	// In memory datakey will be plain text so encrypting a copy before storing to the disk.
+	stored := &pb.DataKey{
+		KeyId:          k.KeyId,
+		Data:           k.Data,
+		Iv:             k.Iv,
+		CreatedAt:      k.CreatedAt,
+		EncryptionAlgo: k.EncryptionAlgo,
 	}
-	// In memory datakey will be plain text so encrypting before storing to the disk.
 	var err error
-	if err = xor(); err != nil {
+	switch {
+	case opt.KeyProvider != nil:
+		stored.Data, err = opt.KeyProvider.WrapKey(k.Data)
+	case len(opt.EncryptionKey) > 0:
+		// xor will encrypt the IV and xor with the given data.
+		stored.Data, err = y.XORBlockAllocate(k.Data, opt.EncryptionKey, k.Iv)
+	}
+	if err != nil {
 		return y.Wrapf(err, "Error while encrypting datakey in storeDataKey")
 	}
 	var data []byte
-	if data, err = k.Marshal(); err != nil {
-		err = y.Wrapf(err, "Error while marshaling datakey in storeDataKey")
-		var err2 error
-		// decrypting the datakey back.
-		if err2 = xor(); err2 != nil {
-			return y.Wrapf(err,
-				y.Wrapf(err2, "Error while decrypting datakey in storeDataKey").Error())
-		}
-		return err
+	if data, err = stored.Marshal(); err != nil {
+		return y.Wrapf(err, "Error while marshaling datakey in storeDataKey")
 	}
 	var lenCrcBuf [8]byte
 	binary.BigEndian.PutUint32(lenCrcBuf[0:4], uint32(len(data)))
 	binary.BigEndian.PutUint32(lenCrcBuf[4:8], crc32.Checksum(data, y.CastagnoliCrcTable))
 	y.Check2(buf.Write(lenCrcBuf[:]))
 	y.Check2(buf.Write(data))
-	// Decrypting the datakey back since we're using the pointer.
-	return xor()
+	return nil
+}
+
+// rotateDataKey generates a new data key, regardless of the rotation period, and returns it.
+func (kr *KeyRegistry) rotateDataKey() (*pb.DataKey, error) {
+	kr.Lock()
+	kr.lastCreated = 0
+	kr.Unlock()
+	return kr.LatestDataKey()
+}
+
+// purgeDataKeys removes the data keys older than the given key ID which aren't in use anymore, and
+// rewrites the key registry without them. It returns the number of data keys removed.
+func (kr *KeyRegistry) purgeDataKeys(before uint64, inUse map[uint64]struct{}) (int, error) {
+	kr.Lock()
+	defer kr.Unlock()
+	var purged int
+	for id := range kr.dataKeys {
+		if _, ok := inUse[id]; !ok && id < before {
+			delete(kr.dataKeys, id)
+			purged++
+		}
+	}
+	if purged == 0 || kr.opt.InMemory {
+		return purged, nil
+	}
+	if err := WriteKeyRegistry(kr, kr.opt); err != nil {
+		return 0, y.Wrapf(err, "Error while rewriting key registry")
+	}
+	// The registry file has been replaced, so the new data keys must be appended to the new one.
+	fp, err := y.OpenExistingFile(filepath.Join(kr.opt.Dir, KeyRegistryFileName), y.Sync)
+	if err != nil {
+		return 0, y.Wrapf(err, "Error while reopening key registry")
+	}
+	if _, err := fp.Seek(0, io.SeekEnd); err != nil {
+		fp.Close()
+		return 0, y.Wrapf(err, "Error while seeking to the end of key registry")
+	}
+	oldFp := kr.fp
+	kr.fp = fp
+	if err := oldFp.Close(); err != nil {
+		return purged, y.Wrapf(err, "Error while closing the old key registry")
+	}
+	return purged, nil
 }
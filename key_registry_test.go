@@ -18,8 +18,10 @@ package badger
 import (
 	"io/ioutil"
 	"math/rand"
+	"path/filepath"
 	"testing"
 
+	"github.com/dgraph-io/badger/v2/kms"
 	"github.com/stretchr/testify/require"
 )
 
@@ -157,3 +159,57 @@ func TestKeyRegistryInMemory(t *testing.T) {
 	require.NoError(t, err)
 	require.NoError(t, kr.Close())
 }
+
+func newTestKeyProvider(t *testing.T, dir, name string) KeyProvider {
+	masterKey := make([]byte, 32)
+	_, err := rand.Read(masterKey)
+	require.NoError(t, err)
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, masterKey, 0600))
+	kp, err := kms.NewFileProvider(path)
+	require.NoError(t, err)
+	return kp
+}
+
+func TestKeyRegistryKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	keyDir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(keyDir)
+
+	opt := getRegistryTestOptions(dir, nil)
+	opt.KeyProvider = newTestKeyProvider(t, keyDir, "master.key")
+	kr, err := OpenKeyRegistry(opt)
+	require.NoError(t, err)
+	dk, err := kr.LatestDataKey()
+	require.NoError(t, err)
+	require.Len(t, dk.Data, keyProviderDataKeySize)
+	require.NoError(t, kr.Close())
+
+	kr, err = OpenKeyRegistry(opt)
+	require.NoError(t, err)
+	dk1, err := kr.DataKey(dk.GetKeyId())
+	require.NoError(t, err)
+	require.Equal(t, dk.Data, dk1.Data)
+	require.NoError(t, kr.Close())
+
+	// The registry can't be opened without the provider, or with another master key.
+	encryptionKey := make([]byte, 32)
+	_, err = rand.Read(encryptionKey)
+	require.NoError(t, err)
+	for _, o := range []KeyRegistryOptions{
+		getRegistryTestOptions(dir, nil),
+		getRegistryTestOptions(dir, encryptionKey),
+		{Dir: dir, KeyProvider: newTestKeyProvider(t, keyDir, "other.key")},
+	} {
+		_, err = OpenKeyRegistry(o)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), ErrEncryptionKeyMismatch.Error())
+	}
+
+	opt.EncryptionKey = encryptionKey
+	_, err = OpenKeyRegistry(opt)
+	require.Equal(t, ErrEncryptionKeyAndKeyProvider, err)
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package kms provides key providers, which wrap and unwrap the data keys of an encrypted DB
+// with a master key. They can be used as the KeyProvider of a DB, set with
+// Options.WithKeyProvider.
+//
+// FileProvider reads the master key from a file. SocketProvider asks a Server, holding the
+// master key in another process, over a local socket. The Server is a stand-in for a real key
+// management service, meant for testing.
+package kms
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidKey is returned if the length of a master key is not 16, 24 or 32 bytes.
+var ErrInvalidKey = errors.New("Master key's length should be either 16, 24, or 32 bytes")
+
+// aeadWrapper wraps the data keys with AES-GCM. A wrapped key is made of the nonce followed by
+// the sealed key.
+type aeadWrapper struct {
+	aead cipher.AEAD
+}
+
+func newAEADWrapper(masterKey []byte) (*aeadWrapper, error) {
+	switch len(masterKey) {
+	case 16, 24, 32:
+	default:
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadWrapper{aead: aead}, nil
+}
+
+// WrapKey seals the data key with a random nonce.
+func (w *aeadWrapper) WrapKey(key []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize(), w.aead.NonceSize()+len(key)+w.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return w.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// UnwrapKey opens a data key sealed by WrapKey. It fails if the key was sealed with another
+// master key.
+func (w *aeadWrapper) UnwrapKey(wrapped []byte) ([]byte, error) {
+	n := w.aead.NonceSize()
+	if len(wrapped) < n+w.aead.Overhead() {
+		return nil, errors.New("Wrapped key is too short")
+	}
+	return w.aead.Open(nil, wrapped[:n], wrapped[n:], nil)
+}
+
+// FileProvider wraps the data keys with AES-GCM, using a master key read from a file.
+type FileProvider struct {
+	*aeadWrapper
+}
+
+// NewFileProvider returns a FileProvider using the master key stored in the file at the given
+// path. The file must hold the raw 16, 24 or 32 bytes of the key.
+func NewFileProvider(path string) (*FileProvider, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while reading master key from %s", path)
+	}
+	w, err := newAEADWrapper(key)
+	if err != nil {
+		return nil, err
+	}
+	return &FileProvider{aeadWrapper: w}, nil
+}
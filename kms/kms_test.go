@@ -0,0 +1,95 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func randomKey(t *testing.T, n int) []byte {
+	key := make([]byte, n)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return key
+}
+
+func TestFileProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "master.key")
+	require.NoError(t, ioutil.WriteFile(path, []byte("short"), 0600))
+	_, err = NewFileProvider(path)
+	require.Equal(t, ErrInvalidKey, err)
+
+	require.NoError(t, ioutil.WriteFile(path, randomKey(t, 32), 0600))
+	p, err := NewFileProvider(path)
+	require.NoError(t, err)
+
+	dataKey := randomKey(t, 32)
+	wrapped, err := p.WrapKey(dataKey)
+	require.NoError(t, err)
+	require.NotContains(t, string(wrapped), string(dataKey))
+	unwrapped, err := p.UnwrapKey(wrapped)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+
+	// Another master key can't unwrap the data key.
+	require.NoError(t, ioutil.WriteFile(path, randomKey(t, 16), 0600))
+	other, err := NewFileProvider(path)
+	require.NoError(t, err)
+	_, err = other.UnwrapKey(wrapped)
+	require.Error(t, err)
+	_, err = other.UnwrapKey([]byte("x"))
+	require.Error(t, err)
+}
+
+func TestSocketProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kms.sock")
+
+	p := NewSocketProvider(path)
+	_, err = p.WrapKey([]byte("key"))
+	require.Error(t, err, "no server is listening")
+
+	s, err := NewServer(randomKey(t, 32))
+	require.NoError(t, err)
+	require.NoError(t, s.ListenAndServe(path))
+	defer func() { require.NoError(t, s.Close()) }()
+
+	dataKey := randomKey(t, 32)
+	wrapped, err := p.WrapKey(dataKey)
+	require.NoError(t, err)
+	unwrapped, err := p.UnwrapKey(wrapped)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+
+	// The errors of the server are returned by the provider.
+	wrapped[len(wrapped)-1] ^= 1
+	_, err = p.UnwrapKey(wrapped)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "KMS error")
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Protocol of the socket KMS. Each connection carries a single request and its response.
+
+Request:  | op (1 byte) | length (4 bytes) | key |
+Response: | status (1 byte) | length (4 bytes) | key, or error message |
+*/
+const (
+	opWrap   byte = 1
+	opUnwrap byte = 2
+
+	statusOK    byte = 0
+	statusError byte = 1
+
+	// maxMessageSize bounds the keys and the error messages exchanged over the socket.
+	maxMessageSize = 1 << 16
+)
+
+func writeMessage(w io.Writer, tag byte, payload []byte) error {
+	buf := make([]byte, 5+len(payload))
+	buf[0] = tag
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(payload)))
+	copy(buf[5:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readMessage(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	l := binary.BigEndian.Uint32(hdr[1:])
+	if l > maxMessageSize {
+		return 0, nil, errors.Errorf("Message of %d bytes is too large", l)
+	}
+	payload := make([]byte, l)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
+
+// Server is a KMS stand-in, holding a master key and serving the requests of SocketProviders to
+// wrap and unwrap data keys with it.
+type Server struct {
+	w *aeadWrapper
+
+	mu sync.Mutex
+	l  net.Listener
+	wg sync.WaitGroup
+}
+
+// NewServer returns a Server wrapping the data keys with AES-GCM, using the given master key.
+func NewServer(masterKey []byte) (*Server, error) {
+	w, err := newAEADWrapper(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{w: w}, nil
+}
+
+// ListenAndServe listens on the Unix socket at the given path and serves the requests until the
+// server is closed, in the background.
+func (s *Server) ListenAndServe(path string) error {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return errors.Wrapf(err, "while listening on %s", path)
+	}
+	s.mu.Lock()
+	s.l = l
+	s.mu.Unlock()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				// The listener has been closed.
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.handle(conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	op, key, err := readMessage(conn)
+	if err != nil {
+		return
+	}
+	var out []byte
+	switch op {
+	case opWrap:
+		out, err = s.w.WrapKey(key)
+	case opUnwrap:
+		out, err = s.w.UnwrapKey(key)
+	default:
+		err = errors.Errorf("Unknown operation: %d", op)
+	}
+	if err != nil {
+		_ = writeMessage(conn, statusError, []byte(err.Error()))
+		return
+	}
+	_ = writeMessage(conn, statusOK, out)
+}
+
+// Close stops listening and waits for the requests being served.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	l := s.l
+	s.mu.Unlock()
+	var err error
+	if l != nil {
+		err = l.Close()
+	}
+	s.wg.Wait()
+	return err
+}
+
+// SocketProvider wraps and unwraps the data keys by asking a Server over a Unix socket, so that
+// the master key never enters the process.
+type SocketProvider struct {
+	path    string
+	timeout time.Duration
+}
+
+// NewSocketProvider returns a SocketProvider talking to the Server listening on the Unix socket
+// at the given path.
+func NewSocketProvider(path string) *SocketProvider {
+	return &SocketProvider{path: path, timeout: 10 * time.Second}
+}
+
+// WrapKey asks the server to wrap the data key.
+func (p *SocketProvider) WrapKey(key []byte) ([]byte, error) {
+	return p.call(opWrap, key)
+}
+
+// UnwrapKey asks the server to unwrap the data key.
+func (p *SocketProvider) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return p.call(opUnwrap, wrapped)
+}
+
+func (p *SocketProvider) call(op byte, key []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", p.path, p.timeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while connecting to KMS at %s", p.path)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(p.timeout)); err != nil {
+		return nil, err
+	}
+	if err := writeMessage(conn, op, key); err != nil {
+		return nil, errors.Wrapf(err, "while sending request to KMS at %s", p.path)
+	}
+	status, out, err := readMessage(conn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while reading response from KMS at %s", p.path)
+	}
+	if status != statusOK {
+		return nil, errors.Errorf("KMS error: %s", out)
+	}
+	return out, nil
+}
@@ -268,7 +268,7 @@ func (s *levelHandler) get(key []byte) (y.ValueStruct, error) {
 		defer it.Close()
 
 		y.NumLSMGets.Add(s.strLevel, 1)
-		it.Seek(key)
+		it.SeekPoint(key, hash)
 		if !it.Valid() {
 			continue
 		}
@@ -302,10 +302,10 @@ func (s *levelHandler) appendIterators(iters []y.Iterator, opt *IteratorOptions)
 				out = append(out, t)
 			}
 		}
-		return appendIteratorsReversed(iters, out, topt)
+		return appendIteratorsReversed(iters, opt.pickNewTables(out), topt)
 	}
 
-	tables := opt.pickTables(s.tables)
+	tables := opt.pickNewTables(opt.pickTables(s.tables))
 	if len(tables) == 0 {
 		return iters
 	}
@@ -329,3 +329,21 @@ func (s *levelHandler) overlappingTables(_ levelHandlerRLocked, kr keyRange) (in
 	})
 	return left, right
 }
+
+// overlapsWith returns true if any table in this level overlaps with the key range.
+func (s *levelHandler) overlapsWith(kr keyRange) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.level == 0 {
+		// Level 0 tables are sorted by their IDs, and may overlap with each other.
+		for _, t := range s.tables {
+			if getKeyRange(t).overlapsWith(kr) {
+				return true
+			}
+		}
+		return false
+	}
+	left, right := s.overlappingTables(levelHandlerRLocked{}, kr)
+	return right > left
+}
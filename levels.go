@@ -97,9 +97,12 @@ func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
 	if db.opt.InMemory {
 		return s, nil
 	}
-	// Compare manifest against directory, check for existent/non-existent files, and remove.
-	if err := revertToManifest(db, mf, getIDMap(db.opt.Dir)); err != nil {
-		return nil, err
+	// Compare manifest against directory, check for existent/non-existent files, and remove. The
+	// tables of a process we are tailing are its own business.
+	if !db.opt.tailing() {
+		if err := revertToManifest(db, mf, getIDMap(db.opt.Dir)); err != nil {
+			return nil, err
+		}
 	}
 
 	var mu sync.Mutex
@@ -137,28 +140,11 @@ func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
 				throttle.Done(rerr)
 				atomic.AddInt32(&numOpened, 1)
 			}()
-			dk, err := db.registry.DataKey(tf.KeyID)
-			if err != nil {
-				rerr = y.Wrapf(err, "Error while reading datakey")
-				return
-			}
-			topt := buildTableOptions(db.opt)
-			// Set compression from table manifest.
-			topt.Compression = tf.Compression
-			topt.DataKey = dk
-			topt.BlockCache = db.blockCache
-			topt.IndexCache = db.indexCache
-
-			mf, err := z.OpenMmapFile(fname, db.opt.getFileFlags(), 0)
-			if err != nil {
-				rerr = y.Wrapf(err, "Opening file: %q", fname)
-				return
-			}
-			t, err := table.OpenTable(mf, topt)
+			t, err := openTable(db, fname, tf)
 			if err != nil {
 				if strings.HasPrefix(err.Error(), "CHECKSUM_MISMATCH:") {
 					db.opt.Errorf(err.Error())
-					db.opt.Errorf("Ignoring table %s", mf.Fd.Name())
+					db.opt.Errorf("Ignoring table %s", fname)
 					// Do not set rerr. We will continue without this table.
 				} else {
 					rerr = y.Wrapf(err, "Opening table: %q", fname)
@@ -198,6 +184,29 @@ func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
 	return s, nil
 }
 
+// openTable opens the table file, as described by its entry in the manifest.
+func openTable(db *DB, fname string, tf TableManifest) (*table.Table, error) {
+	dk, err := db.registry.DataKey(tf.KeyID)
+	if err != nil {
+		return nil, y.Wrapf(err, "Error while reading datakey")
+	}
+	topt := buildTableOptions(db.opt)
+	// Set compression from table manifest.
+	topt.Compression = tf.Compression
+	topt.DataKey = dk
+	topt.BlockCache = db.blockCache
+	topt.IndexCache = db.indexCache
+
+	if db.opt.DirectIO {
+		return table.OpenDirectTable(fname, db.opt.getFileFlags(), topt)
+	}
+	mf, err := z.OpenMmapFile(fname, db.opt.getFileFlags(), 0)
+	if err != nil {
+		return nil, y.Wrapf(err, "Opening file: %q", fname)
+	}
+	return table.OpenTable(mf, topt)
+}
+
 // Closes the tables, for cleanup in newLevelsController.  (We Close() instead of using DecrRef()
 // because that would delete the underlying files.)  We ignore errors, which is OK because tables
 // are read-only.
@@ -349,6 +358,77 @@ func (s *levelsController) dropPrefixes(prefixes [][]byte) error {
 	return nil
 }
 
+// reencryptTables rewrites the tables encrypted with a data key older than keyID, so that they get
+// encrypted with the latest data key. If level 0 has such tables, it runs a L0->L1 compaction. On
+// the other levels, it runs Li->Li compactions of the groups of consecutive tables with an older
+// data key, like dropPrefixes. The compactions must be stopped. It returns the number of tables
+// rewritten.
+func (s *levelsController) reencryptTables(keyID uint64) (int, error) {
+	var rewritten int
+	for _, l := range s.levels {
+		var tableGroups [][]*table.Table
+		var tableGroup []*table.Table
+		finishGroup := func() {
+			if len(tableGroup) > 0 {
+				tableGroups = append(tableGroups, tableGroup)
+				tableGroup = nil
+			}
+		}
+
+		l.RLock()
+		for _, t := range l.tables {
+			if t.KeyID() < keyID {
+				tableGroup = append(tableGroup, t)
+			} else {
+				finishGroup()
+			}
+		}
+		finishGroup()
+		l.RUnlock()
+
+		if len(tableGroups) == 0 {
+			continue
+		}
+		if l.level == 0 {
+			l.RLock()
+			rewritten += len(l.tables)
+			l.RUnlock()
+			cp := compactionPriority{level: 0, score: 1.76}
+			if err := s.doCompact(176, cp); err != nil {
+				return rewritten, y.Wrapf(err, "while compacting level 0")
+			}
+			continue
+		}
+
+		s.kv.opt.Infof("Reencrypting level %d (%d tableGroups)", l.level, len(tableGroups))
+		for _, operation := range tableGroups {
+			cd := compactDef{
+				elog:      trace.New(fmt.Sprintf("Badger.L%d", l.level), "Compact"),
+				thisLevel: l,
+				nextLevel: l,
+				top:       nil,
+				bot:       operation,
+			}
+			if err := s.runCompactDef(l.level, cd); err != nil {
+				return rewritten, y.Wrapf(err, "while reencrypting level %d", l.level)
+			}
+			rewritten += len(operation)
+		}
+	}
+	return rewritten, nil
+}
+
+// keyIDs adds the IDs of the data keys used by the tables to ids.
+func (s *levelsController) keyIDs(ids map[uint64]struct{}) {
+	for _, l := range s.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			ids[t.KeyID()] = struct{}{}
+		}
+		l.RUnlock()
+	}
+}
+
 func (s *levelsController) startCompact(lc *z.Closer) {
 	n := s.kv.opt.NumCompactors
 	lc.AddRunning(n - 1)
@@ -533,15 +613,18 @@ nextTable:
 		valid = append(valid, table)
 	}
 	iters = append(iters, table.NewConcatIterator(valid, table.NOCACHE))
-	it := table.NewMergeIterator(iters, false)
+	var it y.Iterator = table.NewMergeIterator(iters, false)
 	defer it.Close() // Important to close the iterator to do ref counting.
 
-	it.Rewind()
-
 	// Pick a discard ts, so we can discard versions below this ts. We should
 	// never discard any versions starting from above this timestamp, because
 	// that would affect the snapshot view guarantee provided by transactions.
 	discardTs := s.kv.orc.discardAtOrBelow()
+	if s.kv.opt.MergeFunc != nil {
+		it = s.kv.newMergeFoldIterator(it, discardTs, hasOverlap, updateStats)
+	}
+
+	it.Rewind()
 
 	var numBuilds, numVersions int
 	var lastKey, skipKey []byte
@@ -557,8 +640,12 @@ nextTable:
 			return nil, nil,
 				y.Wrapf(err, "Error while retrieving datakey in levelsController.compactBuildTables")
 		}
+		// The file ID is reserved before building, so that the builder can authenticate the
+		// encrypted blocks along with it.
+		fileID := s.reserveFileID()
 		bopts := buildTableOptions(s.kv.opt)
 		bopts.DataKey = dk
+		bopts.TableID = fileID
 		// Builder does not need cache but the same options are used for opening table.
 		bopts.BlockCache = s.kv.blockCache
 		bopts.IndexCache = s.kv.indexCache
@@ -596,9 +683,9 @@ nextTable:
 
 			vs := it.Value()
 			version := y.ParseTs(it.Key())
-			// Do not discard entries inserted by merge operator. These entries will be
-			// discarded once they're merged
-			if version <= discardTs && vs.Meta&bitMergeEntry == 0 {
+			// Do not discard entries inserted by merge operator, nor the merge operands that
+			// couldn't be folded. These entries will be discarded once they're merged
+			if version <= discardTs && vs.Meta&(bitMergeEntry|bitMergeOperand) == 0 {
 				// Keep track of the number of versions encountered for this key. Only consider the
 				// versions which are below the minReadTs, otherwise, we might end up discarding the
 				// only valid version for a running transaction.
@@ -653,7 +740,6 @@ nextTable:
 			continue
 		}
 		numBuilds++
-		fileID := s.reserveFileID()
 		if err := inflightBuilders.Do(); err != nil {
 			// Can't return from here, until I decrRef all the tables that I built so far.
 			break
@@ -1014,7 +1100,13 @@ func (s *levelsController) addLevel0Table(t *table.Table) error {
 			return err
 		}
 	}
+	s.addToLevel0(t)
+	return nil
+}
 
+// addToLevel0 adds the table, already recorded in the MANIFEST, to level 0. It stalls until
+// level 0 has room for the table.
+func (s *levelsController) addToLevel0(t *table.Table) {
 	for !s.levels[0].tryAddLevel0Table(t) {
 		// Stall. Make sure all levels are healthy before we unstall.
 		s.cstatus.RLock()
@@ -1045,8 +1137,6 @@ func (s *levelsController) addLevel0Table(t *table.Table) error {
 			s.kv.opt.Infof("L0 was stalled for %s\n", dur.Round(time.Millisecond))
 		}
 	}
-
-	return nil
 }
 
 func (s *levelsController) close() error {
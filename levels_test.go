@@ -965,3 +965,106 @@ func TestKeyVersions(t *testing.T) {
 		})
 	})
 }
+
+func TestCompactionMergeOperands(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).
+		WithMergeFunc(func(existing, val []byte) []byte { return append(existing, val...) })
+	opt.managedTxns = true
+	op, discard := bitMergeOperand, bitDiscardEarlierVersions
+
+	checkValue := func(t *testing.T, db *DB, readTs uint64, expected string) {
+		txn := db.NewTransactionAt(readTs, false)
+		defer txn.Discard()
+		item, err := txn.Get([]byte("foo"))
+		require.NoError(t, err)
+		val, err := item.ValueCopy(nil)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(val))
+	}
+	compact := func(t *testing.T, db *DB, level int) {
+		cdef := compactDef{
+			thisLevel: db.lc.levels[level],
+			nextLevel: db.lc.levels[level+1],
+			top:       db.lc.levels[level].tables,
+			bot:       db.lc.levels[level+1].tables,
+		}
+		require.NoError(t, db.lc.runCompactDef(level, cdef))
+	}
+
+	t.Run("with base", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			createAndOpen(db, []keyValVersion{{"foo", "c", 3, op}, {"foo", "b", 2, op}}, 0)
+			createAndOpen(db, []keyValVersion{{"foo", "a", 1, 0}}, 1)
+			db.SetDiscardTs(10)
+			checkValue(t, db, 3, "abc")
+			compact(t, db, 0)
+			getAllAndCheck(t, db, []keyValVersion{{"foo", "abc", 3, discard}})
+			checkValue(t, db, 3, "abc")
+		})
+	})
+	t.Run("above discardTs", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			createAndOpen(db, []keyValVersion{{"foo", "c", 3, op}, {"foo", "b", 2, op}}, 0)
+			createAndOpen(db, []keyValVersion{{"foo", "a", 1, 0}}, 1)
+			db.SetDiscardTs(2)
+			compact(t, db, 0)
+			getAllAndCheck(t, db, []keyValVersion{{"foo", "c", 3, op}, {"foo", "ab", 2, discard}})
+			checkValue(t, db, 2, "ab")
+			checkValue(t, db, 3, "abc")
+		})
+	})
+	t.Run("without base", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			createAndOpen(db, []keyValVersion{{"foo", "c", 3, op}, {"foo", "b", 2, op}}, 0)
+			db.SetDiscardTs(10)
+			compact(t, db, 0)
+			getAllAndCheck(t, db, []keyValVersion{{"foo", "bc", 3, discard}})
+		})
+	})
+	t.Run("after deletion", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			createAndOpen(db, []keyValVersion{{"foo", "c", 3, op}, {"foo", "", 2, bitDelete}}, 0)
+			createAndOpen(db, []keyValVersion{{"foo", "a", 1, 0}}, 1)
+			db.SetDiscardTs(10)
+			compact(t, db, 0)
+			getAllAndCheck(t, db, []keyValVersion{{"foo", "c", 3, discard}})
+		})
+	})
+	t.Run("base in a lower level", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			createAndOpen(db, []keyValVersion{{"foo", "c", 3, op}, {"foo", "b", 2, op}}, 1)
+			createAndOpen(db, []keyValVersion{{"foo", "a", 1, 0}}, 3)
+			db.SetDiscardTs(10)
+			compact(t, db, 1)
+			// The operands are kept, since the compaction doesn't see the value they apply to.
+			getAllAndCheck(t, db, []keyValVersion{
+				{"foo", "c", 3, op}, {"foo", "b", 2, op}, {"foo", "a", 1, 0},
+			})
+			checkValue(t, db, 3, "abc")
+		})
+	})
+	t.Run("expired operand", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			opts := table.Options{BlockSize: db.opt.BlockSize, ChkMode: options.NoVerification}
+			b := table.NewTableBuilder(opts)
+			b.Add(y.KeyWithTs([]byte("foo"), 3),
+				y.ValueStruct{Value: []byte("c"), Meta: op, ExpiresAt: 1}, 0)
+			b.Add(y.KeyWithTs([]byte("foo"), 2), y.ValueStruct{Value: []byte("b"), Meta: op}, 0)
+			tab, err := table.CreateTable(
+				table.NewFilename(db.lc.reserveFileID(), db.opt.Dir), b.Finish(false), opts)
+			require.NoError(t, err)
+			require.NoError(t, db.manifest.addChanges([]*pb.ManifestChange{
+				newCreateChange(tab.ID(), 0, 0, tab.CompressionType()),
+			}))
+			db.lc.levels[0].tables = append(db.lc.levels[0].tables, tab)
+			createAndOpen(db, []keyValVersion{{"foo", "a", 1, 0}}, 1)
+			db.SetDiscardTs(10)
+			compact(t, db, 0)
+
+			txn := db.NewTransactionAt(3, false)
+			defer txn.Discard()
+			_, err = txn.Get([]byte("foo"))
+			require.Equal(t, ErrKeyNotFound, err)
+		})
+	})
+}
@@ -461,7 +461,7 @@ func newCreateChange(
 		Op:    pb.ManifestChange_CREATE,
 		Level: uint32(level),
 		KeyId: keyID,
-		// Hard coding it, since we're supporting only AES for now.
+		// The AES mode of the table, CTR or GCM, is recorded in its data key.
 		EncryptionAlgo: pb.EncryptionAlgo_aes,
 		Compression:    uint32(c),
 	}
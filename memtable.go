@@ -34,6 +34,7 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/dgraph-io/badger/v2/options"
 	"github.com/dgraph-io/badger/v2/pb"
 	"github.com/dgraph-io/badger/v2/skl"
 	"github.com/dgraph-io/badger/v2/y"
@@ -51,11 +52,14 @@ type memTable struct {
 	maxVersion uint64
 	opt        Options
 	buf        *bytes.Buffer
+	// recovery holds the ranges of the WAL discarded while replaying it.
+	recovery WALFileRecovery
 }
 
 func (db *DB) openMemTables(opt Options) error {
-	// We don't need to open any tables in in-memory mode.
-	if db.opt.InMemory {
+	// We don't need to open any tables in in-memory mode. When tailing another process, the
+	// tailer loads its memtables.
+	if db.opt.InMemory || db.opt.tailing() {
 		return nil
 	}
 	files, err := ioutil.ReadDir(db.opt.Dir)
@@ -82,8 +86,18 @@ func (db *DB) openMemTables(opt Options) error {
 	})
 	for _, fid := range fids {
 		mt, err := db.openMemTable(fid)
+		if mt != nil && mt.recovery.LostBytes > 0 {
+			db.opt.Warningf("Discarded %d bytes while replaying %s: %+v",
+				mt.recovery.LostBytes, mt.recovery.Path, mt.recovery.Truncated)
+			db.walRecovery.Files = append(db.walRecovery.Files, mt.recovery)
+		}
 		if err != nil {
-			return y.Wrapf(err, "while opening fid: %d", fid)
+			err = y.Wrapf(err, "while opening fid: %d", fid)
+			if mt != nil && mt.recovery.LostBytes > 0 &&
+				opt.WALRecoveryMode == options.AbsoluteConsistency {
+				return &WALCorruptedError{Report: db.WALRecoveryReport(), err: err}
+			}
+			return err
 		}
 		// These should no longer be written to. So, make them part of the imm.
 		db.imm = append(db.imm, mt)
@@ -194,13 +208,18 @@ func (mt *memTable) UpdateSkipList() error {
 	if mt.wal == nil || mt.sl == nil {
 		return nil
 	}
-	endOff, err := mt.wal.iterate(true, 0, mt.replayFunction(mt.opt))
+	endOff, rec, err := mt.wal.replay(mt.opt.WALRecoveryMode, mt.replayFunction(mt.opt))
+	mt.recovery = rec
 	if err != nil {
 		return y.Wrapf(err, "while iterating wal: %s", mt.wal.Fd.Name())
 	}
 	if endOff < mt.wal.size && mt.opt.ReadOnly {
 		return y.Wrapf(ErrTruncateNeeded, "end offset: %d < size: %d", endOff, mt.wal.size)
 	}
+	// Drop the ranges skipped before endOff from the WAL, so that it can be replayed in any mode.
+	if len(rec.Truncated) > 0 && rec.Truncated[0].Offset < endOff && !mt.opt.ReadOnly {
+		return mt.rewriteWAL()
+	}
 	return mt.wal.Truncate(int64(endOff))
 }
 
@@ -254,6 +273,47 @@ type logFile struct {
 	registry *KeyRegistry
 	writeAt  uint32
 	opt      Options
+	// directFd is used to read the file using direct I/O, once it is no longer being written to.
+	directFd *os.File
+}
+
+// openDirect opens the file for reading via direct I/O, if DirectIO is enabled. It should only be
+// called once the file is no longer being written to.
+func (lf *logFile) openDirect() error {
+	if !lf.opt.DirectIO || lf.directFd != nil {
+		return nil
+	}
+	fd, err := y.OpenDirectFile(lf.path, os.O_RDONLY)
+	if err != nil {
+		return y.Wrapf(err, "while opening %s for direct I/O", lf.path)
+	}
+	lf.directFd = fd
+	return nil
+}
+
+func (lf *logFile) closeDirect() error {
+	if lf.directFd == nil {
+		return nil
+	}
+	err := lf.directFd.Close()
+	lf.directFd = nil
+	return err
+}
+
+// Close closes the log file, truncating it to maxSz if maxSz is not negative.
+func (lf *logFile) Close(maxSz int64) error {
+	if err := lf.closeDirect(); err != nil {
+		return y.Wrapf(err, "while closing %s", lf.path)
+	}
+	return lf.MmapFile.Close(maxSz)
+}
+
+// Delete deletes the log file.
+func (lf *logFile) Delete() error {
+	if err := lf.closeDirect(); err != nil {
+		return y.Wrapf(err, "while closing %s", lf.path)
+	}
+	return y.DeleteMmapFile(lf.MmapFile)
 }
 
 func (lf *logFile) Truncate(end int64) error {
@@ -275,6 +335,8 @@ func (lf *logFile) Truncate(end int64) error {
 // +--------+-----+-------+-------+
 // | header | key | value | crc32 |
 // +--------+-----+-------+-------+
+// With AES-GCM, the encrypted key and value are followed by the authentication tag, which also
+// covers the header.
 func (lf *logFile) encodeEntry(buf *bytes.Buffer, e *Entry, offset uint32) (int, error) {
 	h := header{
 		klen:      uint32(len(e.Key)),
@@ -296,10 +358,17 @@ func (lf *logFile) encodeEntry(buf *bytes.Buffer, e *Entry, offset uint32) (int,
 		// TODO: no need to allocate the bytes. we can calculate the encrypted buf one by one
 		// since we're using ctr mode of AES encryption. Ordering won't changed. Need some
 		// refactoring in XORBlock which will work like stream cipher.
-		eBuf := make([]byte, 0, len(e.Key)+len(e.Value))
+		eBuf := make([]byte, 0, len(e.Key)+len(e.Value)+int(lf.encryptionOverhead()))
 		eBuf = append(eBuf, e.Key...)
 		eBuf = append(eBuf, e.Value...)
-		if err := y.XORBlockStream(
+		if lf.gcmEnabled() {
+			sealed, err := y.SealGCM(
+				eBuf[:0], eBuf, lf.dataKey.Data, lf.generateNonce(offset), headerEnc[:sz])
+			if err != nil {
+				return 0, y.Wrapf(err, "Error while encoding entry for vlog.")
+			}
+			y.Check2(writer.Write(sealed))
+		} else if err := y.XORBlockStream(
 			writer, eBuf, lf.dataKey.Data, lf.generateIV(offset)); err != nil {
 			return 0, y.Wrapf(err, "Error while encoding entry for vlog.")
 		}
@@ -313,7 +382,8 @@ func (lf *logFile) encodeEntry(buf *bytes.Buffer, e *Entry, offset uint32) (int,
 	binary.BigEndian.PutUint32(crcBuf[:], hash.Sum32())
 	y.Check2(buf.Write(crcBuf[:]))
 	// return encoded length.
-	return len(headerEnc[:sz]) + len(e.Key) + len(e.Value) + len(crcBuf), nil
+	return len(headerEnc[:sz]) + len(e.Key) + len(e.Value) + int(lf.encryptionOverhead()) +
+		len(crcBuf), nil
 }
 
 func (lf *logFile) writeEntry(buf *bytes.Buffer, e *Entry, opt Options) error {
@@ -337,7 +407,7 @@ func (lf *logFile) decodeEntry(buf []byte, offset uint32) (*Entry, error) {
 		var err error
 		// No need to worry about mmap. because, XORBlock allocates a byte array to do the
 		// xor. So, the given slice is not being mutated.
-		if kv, err = lf.decryptKV(kv, offset); err != nil {
+		if kv, err = lf.decryptKV(lf.encryptedKV(kv, h), h, offset); err != nil {
 			return nil, err
 		}
 	}
@@ -352,10 +422,43 @@ func (lf *logFile) decodeEntry(buf []byte, offset uint32) (*Entry, error) {
 	return e, nil
 }
 
-func (lf *logFile) decryptKV(buf []byte, offset uint32) ([]byte, error) {
+// decryptKV decrypts the key and the value of the entry with the given header at the given
+// offset. With AES-GCM, buf must hold exactly the encrypted key and value followed by the
+// authentication tag, which is checked against the header too.
+func (lf *logFile) decryptKV(buf []byte, h header, offset uint32) ([]byte, error) {
+	if lf.gcmEnabled() {
+		// The header is encoded the same way as when the entry was written.
+		var headerEnc [maxHeaderSize]byte
+		sz := h.Encode(headerEnc[:])
+		return y.OpenGCM(nil, buf, lf.dataKey.Data, lf.generateNonce(offset), headerEnc[:sz])
+	}
 	return y.XORBlockAllocate(buf, lf.dataKey.Data, lf.generateIV(offset))
 }
 
+// encryptedKV returns the encrypted key and value of an entry with the given header, along with
+// the authentication tag, from buf starting right after the header.
+func (lf *logFile) encryptedKV(buf []byte, h header) []byte {
+	sz := h.klen + h.vlen + lf.encryptionOverhead()
+	if uint32(len(buf)) < sz {
+		return buf
+	}
+	return buf[:sz]
+}
+
+// encryptionOverhead returns the number of bytes added to the key and the value of each entry by
+// the encryption.
+func (lf *logFile) encryptionOverhead() uint32 {
+	if lf.gcmEnabled() {
+		return y.GCMTagSize
+	}
+	return 0
+}
+
+// gcmEnabled returns true if the entries are encrypted with AES-GCM.
+func (lf *logFile) gcmEnabled() bool {
+	return lf.dataKey != nil && lf.dataKey.EncryptionAlgo == pb.EncryptionAlgo_aes_gcm
+}
+
 // KeyID returns datakey's ID.
 func (lf *logFile) keyID() uint64 {
 	if lf.dataKey == nil {
@@ -385,6 +488,10 @@ func (lf *logFile) read(p valuePointer, s *y.Slice) (buf []byte, err error) {
 		// dropAll and iterations are running simultaneously.
 		int64(offset+valsz) > int64(lfsz) {
 		err = y.ErrEOF
+	} else if lf.directFd != nil {
+		if buf, err = y.ReadDirect(lf.directFd, int(offset), int(valsz)); err == nil {
+			nbr = int64(valsz)
+		}
 	} else {
 		buf = lf.Data[offset : offset+valsz]
 		nbr = int64(valsz)
@@ -404,6 +511,15 @@ func (lf *logFile) generateIV(offset uint32) []byte {
 	return iv
 }
 
+// generateNonce will generate the AES-GCM nonce of the entry at the given offset, by mixing the
+// offset into the last 4 bytes of the base IV.
+func (lf *logFile) generateNonce(offset uint32) []byte {
+	nonce := make([]byte, y.GCMNonceSize)
+	y.AssertTrue(y.GCMNonceSize == copy(nonce, lf.baseIV))
+	binary.BigEndian.PutUint32(nonce[8:], binary.BigEndian.Uint32(nonce[8:])^offset)
+	return nonce
+}
+
 func (lf *logFile) doneWriting(offset uint32) error {
 	if lf.opt.SyncWrites {
 		if err := lf.Sync(); err != nil {
@@ -421,6 +537,10 @@ func (lf *logFile) doneWriting(offset uint32) error {
 	if err := lf.Truncate(int64(offset)); err != nil {
 		return y.Wrapf(err, "Unable to truncate file: %q", lf.path)
 	}
+	// The file won't be written to anymore. So, it can now be read via direct I/O.
+	if err := lf.openDirect(); err != nil {
+		return err
+	}
 
 	// Previously we used to close the file after it was written and reopen it in read-only mode.
 	// We no longer open files in read-only mode. We keep all vlog files open in read-write mode.
@@ -470,7 +590,8 @@ loop:
 		}
 
 		var vp valuePointer
-		vp.Len = uint32(int(e.hlen) + len(e.Key) + len(e.Value) + crc32.Size)
+		vp.Len = uint32(int(e.hlen) + len(e.Key) + len(e.Value) + int(lf.encryptionOverhead()) +
+			crc32.Size)
 		read.recordOffset += vp.Len
 
 		vp.Offset = e.offset
@@ -18,6 +18,7 @@ package badger
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/badger/v2/y"
@@ -38,7 +39,11 @@ type MergeOperator struct {
 // another representing a new value that needs to be ‘merged’ into it. MergeFunc
 // contains the logic to perform the ‘merge’ and return an updated value.
 // MergeFunc could perform operations like integer addition, list appends etc.
-// Note that the ordering of the operands is maintained.
+// Note that the ordering of the operands is maintained. When used as Options.MergeFunc,
+// the existing value is nil for the first operand written to a key without a value, and the
+// existing value can also be an operand, when two operands of a key are combined into one, like
+// for the operands merged in the same transaction. So f(f(a, b), c) must equal f(a, f(b, c)).
+// The merge package provides common merge functions.
 type MergeFunc func(existingVal, newVal []byte) []byte
 
 // GetMergeOperator creates a new MergeOperator for a given key and returns a
@@ -176,3 +181,326 @@ func (op *MergeOperator) Get() ([]byte, error) {
 func (op *MergeOperator) Stop() {
 	op.closer.SignalAndWait()
 }
+
+// Merge adds a merge operand for the key. When the key is read, Options.MergeFunc is applied to
+// the latest value written with Set, if any, and then to each operand written after it, from the
+// oldest to the newest. Unlike a read-modify-write, Merge doesn't read the key, so concurrent
+// merges to the same key don't conflict.
+//
+// Merge requires Options.MergeFunc, and returns ErrNoMergeFunc otherwise. The keys covered by a
+// secondary index are merged right away, since the index needs their new value.
+//
+// The current transaction keeps a reference to the key and operand byte slices. Users must not
+// modify them until the end of the transaction.
+func (txn *Txn) Merge(key, operand []byte) error {
+	return txn.modify(&Entry{Key: key, Value: operand, meta: bitMergeOperand})
+}
+
+// Merge is equivalent of Txn.Merge.
+func (wb *WriteBatch) Merge(key, operand []byte) error {
+	return wb.SetEntry(&Entry{Key: key, Value: operand, meta: bitMergeOperand})
+}
+
+// prepareMerge returns the entry to write for a merge operand. The operand is combined with the
+// pending write of the key in the transaction, if any, so that none of them is lost.
+func (txn *Txn) prepareMerge(e *Entry) (*Entry, error) {
+	f := txn.db.opt.MergeFunc
+	if f == nil {
+		return nil, ErrNoMergeFunc
+	}
+	out := *e
+	if len(txn.db.indexes.matching(e.Key)) > 0 {
+		// The index entries are computed from the new value of the key.
+		var old []byte
+		item, err := txn.Get(e.Key)
+		switch {
+		case err == ErrKeyNotFound:
+		case err != nil:
+			return nil, err
+		default:
+			if old, err = item.ValueCopy(nil); err != nil {
+				return nil, err
+			}
+		}
+		out.Value = f(old, e.Value)
+		out.meta &^= bitMergeOperand
+		return &out, nil
+	}
+
+	prev, ok := txn.pendingWrites[string(e.Key)]
+	if !ok || prev.version != e.version {
+		return e, nil
+	}
+	switch {
+	case isDeletedOrExpired(prev.meta, prev.ExpiresAt):
+		out.Value = f(nil, e.Value)
+		out.meta &^= bitMergeOperand
+	case prev.meta&bitMergeOperand > 0:
+		out.Value = f(y.SafeCopy(nil, prev.Value), e.Value)
+	default:
+		out.Value = f(y.SafeCopy(nil, prev.Value), e.Value)
+		out.meta &^= bitMergeOperand
+	}
+	return &out, nil
+}
+
+// applyMerge returns the value of the key obtained by applying the merge operands, given from
+// the newest to the oldest, on top of the versions of the key at or below ts.
+func (txn *Txn) applyMerge(key []byte, operands [][]byte, ts uint64) ([]byte, error) {
+	var base []byte
+	for ts > 0 {
+		vs, err := txn.db.get(y.KeyWithTs(key, ts))
+		if err != nil {
+			return nil, err
+		}
+		if (vs.Value == nil && vs.Meta == 0) || isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+			break
+		}
+		item := &Item{
+			key:  key,
+			meta: vs.Meta,
+			vptr: y.SafeCopy(nil, vs.Value),
+			txn:  txn,
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		if vs.Meta&bitMergeOperand == 0 {
+			base = val
+			break
+		}
+		operands = append(operands, val)
+		ts = vs.Version - 1
+	}
+	return foldMerge(txn.db.opt.MergeFunc, base, operands), nil
+}
+
+// foldMerge applies the merge operands, given from the newest to the oldest, on top of base. If
+// the key has no value to apply them to, base is nil, so that the value is always built by the
+// merge function.
+func foldMerge(f MergeFunc, base []byte, operands [][]byte) []byte {
+	val := base
+	for i := len(operands) - 1; i >= 0; i-- {
+		val = f(val, operands[i])
+	}
+	return val
+}
+
+// mergeReadTxn returns a read-only transaction to resolve the merge operands written at or above
+// the given version. Unlike NewTransaction, it doesn't wait for the pending commits, so it can be
+// created on the write path. Outside of managed mode, it holds a read mark at the version until
+// it is discarded, which keeps the compactions from folding away the versions the operands apply
+// to.
+func (db *DB) mergeReadTxn(version uint64) *Txn {
+	txn := db.newTransaction(false, true)
+	txn.readTs = version
+	if !db.opt.managedTxns {
+		db.orc.readMark.Begin(version)
+	}
+	return txn
+}
+
+// resolveMerge replaces the merge operand held by the item with the value of the key, obtained
+// by merging the operand with the versions of the key at or below ts.
+func (item *Item) resolveMerge(ts uint64) {
+	operand, err := item.ValueCopy(nil)
+	var val []byte
+	if err == nil {
+		val, err = item.txn.applyMerge(item.key, [][]byte{operand}, ts)
+	}
+	item.meta &^= bitValuePointer | bitMergeOperand
+	item.vptr = val
+	item.val = val
+	item.err = err
+	item.status = prefetched
+}
+
+// mergeFoldIterator wraps the iterator of a compaction to fold the merge operands of each key
+// that no transaction can see individually anymore, i.e. the ones at or below discardTs, into a
+// single value. The folded value is returned with bitDiscardEarlierVersions, so that the
+// compaction drops the versions it replaces.
+//
+// The operands can only be folded once the value they apply to is known: when they are followed
+// by a value or a deletion of the key, or when no lower level holds older versions of the key.
+// Otherwise they are returned unchanged.
+type mergeFoldIterator struct {
+	y.Iterator
+	db         *DB
+	discardTs  uint64
+	hasOverlap bool
+	// onDiscard is called on the versions dropped by a fold.
+	onDiscard func(vs y.ValueStruct)
+	// skipValueLog keeps the operands whose fold needs to read the value log.
+	skipValueLog bool
+
+	lastKey []byte
+	// checked is set once the versions of lastKey at or below discardTs have been looked at.
+	checked bool
+	// pending holds the entries to return before moving the wrapped iterator.
+	pending []foldedEntry
+}
+
+type foldedEntry struct {
+	key []byte
+	vs  y.ValueStruct
+}
+
+func (db *DB) newMergeFoldIterator(it y.Iterator, discardTs uint64, hasOverlap bool,
+	onDiscard func(vs y.ValueStruct)) *mergeFoldIterator {
+	return &mergeFoldIterator{
+		Iterator:   it,
+		db:         db,
+		discardTs:  discardTs,
+		hasOverlap: hasOverlap,
+		onDiscard:  onDiscard,
+		// The L0 compaction run while closing the DB, with writes blocked, comes after the
+		// value log has been closed.
+		skipValueLog: atomic.LoadInt32(&db.blockWrites) == 1,
+	}
+}
+
+func (fi *mergeFoldIterator) Rewind() {
+	fi.Iterator.Rewind()
+	fi.pending, fi.lastKey = nil, nil
+	fi.prepare()
+}
+
+func (fi *mergeFoldIterator) Seek(key []byte) {
+	fi.Iterator.Seek(key)
+	fi.pending, fi.lastKey = nil, nil
+	fi.prepare()
+}
+
+func (fi *mergeFoldIterator) Next() {
+	if len(fi.pending) > 0 {
+		// The wrapped iterator is already on the entry after the pending ones.
+		fi.pending = fi.pending[1:]
+	} else {
+		fi.Iterator.Next()
+	}
+	if len(fi.pending) == 0 {
+		fi.prepare()
+	}
+}
+
+func (fi *mergeFoldIterator) Key() []byte {
+	if len(fi.pending) > 0 {
+		return fi.pending[0].key
+	}
+	return fi.Iterator.Key()
+}
+
+func (fi *mergeFoldIterator) Value() y.ValueStruct {
+	if len(fi.pending) > 0 {
+		return fi.pending[0].vs
+	}
+	return fi.Iterator.Value()
+}
+
+func (fi *mergeFoldIterator) Valid() bool {
+	return len(fi.pending) > 0 || fi.Iterator.Valid()
+}
+
+// prepare folds the merge operands at the current position of the wrapped iterator, if it is on
+// the latest version of a key at or below discardTs.
+func (fi *mergeFoldIterator) prepare() {
+	it := fi.Iterator
+	if !it.Valid() {
+		return
+	}
+	key := it.Key()
+	if !y.SameKey(key, fi.lastKey) {
+		fi.lastKey = y.SafeCopy(fi.lastKey, key)
+		fi.checked = false
+	}
+	if fi.checked || y.ParseTs(key) > fi.discardTs {
+		return
+	}
+	fi.checked = true
+	if it.Value().Meta&bitMergeOperand > 0 {
+		fi.fold()
+	}
+}
+
+func (fi *mergeFoldIterator) fold() {
+	it := fi.Iterator
+	var run []foldedEntry
+	var operands [][]byte
+	var err error
+	for ; it.Valid() && y.SameKey(it.Key(), fi.lastKey); it.Next() {
+		vs := it.Value()
+		if vs.Meta&bitMergeOperand == 0 || isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+			break
+		}
+		vs.Value = y.SafeCopy(nil, vs.Value)
+		run = append(run, foldedEntry{key: y.SafeCopy(nil, it.Key()), vs: vs})
+		if err == nil {
+			var val []byte
+			val, err = fi.value(vs)
+			operands = append(operands, val)
+		}
+	}
+	if len(run) == 0 {
+		// The latest operand is expired, and is returned as it is.
+		return
+	}
+	// Keep the operands if their base is unknown, or can't be read.
+	fi.pending = run
+	ended := !it.Valid() || !y.SameKey(it.Key(), fi.lastKey)
+	if err != nil || (ended && fi.hasOverlap) {
+		fi.warnFold(err)
+		return
+	}
+
+	var base []byte
+	if !ended {
+		if vs := it.Value(); !isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+			if base, err = fi.value(vs); err != nil {
+				fi.warnFold(err)
+				return
+			}
+		}
+	}
+	newest := run[0]
+	fi.pending = []foldedEntry{{
+		key: newest.key,
+		vs: y.ValueStruct{
+			Meta:      bitDiscardEarlierVersions,
+			UserMeta:  newest.vs.UserMeta,
+			ExpiresAt: newest.vs.ExpiresAt,
+			Value:     foldMerge(fi.db.opt.MergeFunc, base, operands),
+			Version:   y.ParseTs(newest.key),
+		},
+	}}
+	for _, e := range run {
+		fi.onDiscard(e.vs)
+	}
+}
+
+var errSkipValueLog = errors.New("Value log reads are skipped")
+
+func (fi *mergeFoldIterator) warnFold(err error) {
+	if err != nil && err != errSkipValueLog {
+		fi.db.opt.Warningf("Unable to fold merge operands of key %q: %v",
+			y.ParseKey(fi.lastKey), err)
+	}
+}
+
+// value returns a copy of the value of vs, read from the value log if needed.
+func (fi *mergeFoldIterator) value(vs y.ValueStruct) ([]byte, error) {
+	if vs.Meta&bitValuePointer == 0 {
+		return y.SafeCopy(nil, vs.Value), nil
+	}
+	if fi.skipValueLog {
+		return nil, errSkipValueLog
+	}
+	var vp valuePointer
+	vp.Decode(vs.Value)
+	buf, cb, err := fi.db.vlog.Read(vp, new(y.Slice))
+	defer runCallback(cb)
+	if err != nil {
+		return nil, err
+	}
+	return y.SafeCopy(nil, buf), nil
+}
@@ -0,0 +1,311 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package merge provides common merge functions, along with the helpers to encode their operands
+// and decode their results. They can be used as the MergeFunc of a DB, set with
+// Options.WithMergeFunc, or of a MergeOperator, returned by DB.GetMergeOperator.
+//
+// The merge functions never fail: an existing value that can't be decoded is treated as missing,
+// and an operand that can't be decoded leaves the existing value unchanged.
+package merge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+var errInvalidLength = errors.New("Invalid value length")
+
+// EncodeInt64 encodes v as an operand or a value of AddInt64.
+func EncodeInt64(v int64) []byte {
+	return EncodeUint64(uint64(v))
+}
+
+// DecodeInt64 decodes a value of AddInt64.
+func DecodeInt64(b []byte) (int64, error) {
+	v, err := DecodeUint64(b)
+	return int64(v), err
+}
+
+// EncodeUint64 encodes v as an operand or a value of MaxUint64 and MinUint64.
+func EncodeUint64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// DecodeUint64 decodes a value of MaxUint64 and MinUint64.
+func DecodeUint64(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, errInvalidLength
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// AddInt64 adds the operands, encoded with EncodeInt64, to the existing value. Overflows wrap
+// around.
+func AddInt64(existing, operand []byte) []byte {
+	delta, err := DecodeInt64(operand)
+	if err != nil {
+		return existing
+	}
+	v, _ := DecodeInt64(existing)
+	return EncodeInt64(v + delta)
+}
+
+// MaxUint64 keeps the greatest of the values, encoded with EncodeUint64.
+func MaxUint64(existing, operand []byte) []byte {
+	return pickUint64(existing, operand, func(a, b uint64) bool { return a > b })
+}
+
+// MinUint64 keeps the lowest of the values, encoded with EncodeUint64.
+func MinUint64(existing, operand []byte) []byte {
+	return pickUint64(existing, operand, func(a, b uint64) bool { return a < b })
+}
+
+// pickUint64 returns the operand if it is better than the existing value.
+func pickUint64(existing, operand []byte, better func(a, b uint64) bool) []byte {
+	o, err := DecodeUint64(operand)
+	if err != nil {
+		return existing
+	}
+	if v, err := DecodeUint64(existing); err == nil && !better(o, v) {
+		return existing
+	}
+	return EncodeUint64(o)
+}
+
+// The set operations of an operand of SetUnion. setFull, with an empty member, starts the
+// values of SetUnion holding all the members of a set, as opposed to the operands, which only
+// hold changes.
+const (
+	setAdd    byte = 0
+	setRemove byte = 1
+	setFull   byte = 2
+)
+
+// SetAdd returns an operand of SetUnion adding the members to the set.
+func SetAdd(members ...[]byte) []byte {
+	return encodeSetOps(setAdd, members)
+}
+
+// SetRemove returns an operand of SetUnion removing the members from the set.
+func SetRemove(members ...[]byte) []byte {
+	return encodeSetOps(setRemove, members)
+}
+
+// encodeSetOps encodes each member as the operation, followed by the length of the member as a
+// uvarint and the member itself. A set is encoded as the additions of its members, in order.
+func encodeSetOps(op byte, members [][]byte) []byte {
+	var buf bytes.Buffer
+	var lbuf [binary.MaxVarintLen64]byte
+	for _, m := range members {
+		buf.WriteByte(op)
+		buf.Write(lbuf[:binary.PutUvarint(lbuf[:], uint64(len(m)))])
+		buf.Write(m)
+	}
+	return buf.Bytes()
+}
+
+// decodeSetOps calls fn with each operation and member encoded in b.
+func decodeSetOps(b []byte, fn func(op byte, member []byte)) error {
+	for len(b) > 0 {
+		op := b[0]
+		if op != setAdd && op != setRemove && op != setFull {
+			return errors.Errorf("Invalid set operation: %d", op)
+		}
+		l, n := binary.Uvarint(b[1:])
+		if n <= 0 || uint64(len(b)-1-n) < l {
+			return errInvalidLength
+		}
+		b = b[1+n:]
+		fn(op, b[:l])
+		b = b[l:]
+	}
+	return nil
+}
+
+// DecodeSet returns the members of a value of SetUnion, in increasing order.
+func DecodeSet(b []byte) ([][]byte, error) {
+	var members [][]byte
+	err := decodeSetOps(b, func(op byte, member []byte) {
+		if op == setAdd {
+			members = append(members, member)
+		}
+	})
+	return members, err
+}
+
+// SetUnion applies the additions and the removals of the operand, built with SetAdd and
+// SetRemove, to the existing set. The members of the set are kept sorted.
+//
+// If the existing value is itself an operand, like when a DB combines two operands of a key, the
+// result is an operand holding the changes of both, removals included, so that SetUnion is
+// associative. The result is only a full set, without removals, if the existing value is nil or
+// a full set.
+func SetUnion(existing, operand []byte) []byte {
+	if err := decodeSetOps(operand, func(byte, []byte) {}); err != nil {
+		return existing
+	}
+	full := existing == nil
+	adds, removes := make(map[string]struct{}), make(map[string]struct{})
+	apply := func(op byte, member []byte) {
+		switch op {
+		case setAdd:
+			adds[string(member)] = struct{}{}
+			delete(removes, string(member))
+		case setRemove:
+			delete(adds, string(member))
+			removes[string(member)] = struct{}{}
+		}
+	}
+	_ = decodeSetOps(existing, func(op byte, member []byte) {
+		if op == setFull {
+			full = true
+		}
+		apply(op, member)
+	})
+	_ = decodeSetOps(operand, apply)
+
+	var out []byte
+	if full {
+		// The removals of members missing from a full set are no-ops.
+		out = encodeSetOps(setFull, [][]byte{nil})
+		removes = nil
+	}
+	out = append(out, encodeSetOps(setAdd, sortedMembers(adds))...)
+	return append(out, encodeSetOps(setRemove, sortedMembers(removes))...)
+}
+
+func sortedMembers(set map[string]struct{}) [][]byte {
+	members := make([]string, 0, len(set))
+	for m := range set {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	out := make([][]byte, len(members))
+	for i, m := range members {
+		out[i] = []byte(m)
+	}
+	return out
+}
+
+// EncodeList encodes the items as an operand or a value of BoundedAppend. Each item is preceded
+// by its length as a uvarint.
+func EncodeList(items ...[]byte) []byte {
+	var buf bytes.Buffer
+	var lbuf [binary.MaxVarintLen64]byte
+	for _, item := range items {
+		buf.Write(lbuf[:binary.PutUvarint(lbuf[:], uint64(len(item)))])
+		buf.Write(item)
+	}
+	return buf.Bytes()
+}
+
+// DecodeList returns the items of a value of BoundedAppend.
+func DecodeList(b []byte) ([][]byte, error) {
+	var items [][]byte
+	for len(b) > 0 {
+		l, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < l {
+			return nil, errInvalidLength
+		}
+		items = append(items, b[n:uint64(n)+l])
+		b = b[uint64(n)+l:]
+	}
+	return items, nil
+}
+
+// BoundedAppend returns a merge function appending the items of the operand, encoded with
+// EncodeList, to the existing list, and keeping only the last max items.
+func BoundedAppend(max int) func(existing, operand []byte) []byte {
+	return func(existing, operand []byte) []byte {
+		items, err := DecodeList(operand)
+		if err != nil {
+			return existing
+		}
+		old, err := DecodeList(existing)
+		if err != nil {
+			old = nil
+		}
+		items = append(old, items...)
+		if len(items) > max {
+			items = items[len(items)-max:]
+		}
+		return EncodeList(items...)
+	}
+}
+
+// JSONMergePatch applies the operand, a JSON merge patch as defined in RFC 7386, to the existing
+// JSON document. An object in the patch is merged into the document recursively, with the null
+// members removing the members of the document, and any other value replaces the document.
+//
+// Merge patches can't always be combined into one: when two patches are merged in the same
+// transaction, the null members nested in the second one are lost, and so is a member removed by
+// the first one and set to an object by the second one. Such patches should be merged in
+// separate transactions.
+func JSONMergePatch(existing, operand []byte) []byte {
+	patch, err := decodeJSON(operand)
+	if err != nil {
+		return existing
+	}
+	doc, err := decodeJSON(existing)
+	if err != nil {
+		doc = nil
+	}
+	out, err := json.Marshal(mergePatch(doc, patch))
+	if err != nil {
+		return existing
+	}
+	return out
+}
+
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	// Keep the numbers as they are written.
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("Trailing data after JSON value")
+	}
+	return v, nil
+}
+
+func mergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+			continue
+		}
+		d[k] = mergePatch(d[k], v)
+	}
+	return d
+}
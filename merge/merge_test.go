@@ -0,0 +1,152 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package merge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fold merges the operands like a DB does for a key without a value: the first one is applied
+// to a nil value.
+func fold(f func(existing, operand []byte) []byte, operands ...[]byte) []byte {
+	var val []byte
+	for _, o := range operands {
+		val = f(val, o)
+	}
+	return val
+}
+
+func TestAddInt64(t *testing.T) {
+	val := fold(AddInt64, EncodeInt64(5), EncodeInt64(-8), EncodeInt64(1))
+	v, err := DecodeInt64(val)
+	require.NoError(t, err)
+	require.Equal(t, int64(-2), v)
+
+	// Invalid operands are ignored, invalid values start over.
+	require.Equal(t, val, AddInt64(val, []byte("bad")))
+	v, err = DecodeInt64(AddInt64([]byte("bad"), EncodeInt64(3)))
+	require.NoError(t, err)
+	require.Equal(t, int64(3), v)
+
+	_, err = DecodeInt64([]byte("bad"))
+	require.Error(t, err)
+}
+
+func TestMaxMinUint64(t *testing.T) {
+	operands := [][]byte{EncodeUint64(5), EncodeUint64(9), EncodeUint64(2), EncodeUint64(7)}
+	v, err := DecodeUint64(fold(MaxUint64, operands...))
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), v)
+	v, err = DecodeUint64(fold(MinUint64, operands...))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), v)
+	require.Equal(t, EncodeUint64(4), MinUint64(nil, EncodeUint64(4)))
+}
+
+func TestSetUnion(t *testing.T) {
+	val := fold(SetUnion,
+		SetAdd([]byte("b"), []byte("a")),
+		SetAdd([]byte("c"), []byte("a")),
+		SetRemove([]byte("b"), []byte("x")),
+		SetAdd([]byte(""), []byte("d")),
+	)
+	members, err := DecodeSet(val)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte(""), []byte("a"), []byte("c"), []byte("d")}, members)
+
+	// A single operand is normalized: the removals are no-ops, and the members are deduplicated
+	// and sorted.
+	members, err = DecodeSet(fold(SetUnion, SetRemove([]byte("a"))))
+	require.NoError(t, err)
+	require.Empty(t, members)
+	members, err = DecodeSet(fold(SetUnion, SetAdd([]byte("b"), []byte("a"), []byte("a"))))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("b")}, members)
+
+	require.Equal(t, val, SetUnion(val, []byte{7, 1, 'a'}))
+	_, err = DecodeSet([]byte{0, 5, 'a'})
+	require.Error(t, err)
+}
+
+func TestSetUnionCombinedOperands(t *testing.T) {
+	base := fold(SetUnion, SetAdd([]byte("a"), []byte("c")))
+	ops := [][]byte{SetRemove([]byte("a")), SetAdd([]byte("b")), SetRemove([]byte("c"))}
+	want := [][]byte{[]byte("b")}
+
+	// Combining the operands first, in either grouping, keeps their removals.
+	for _, val := range [][]byte{
+		SetUnion(SetUnion(SetUnion(base, ops[0]), ops[1]), ops[2]),
+		SetUnion(base, SetUnion(SetUnion(ops[0], ops[1]), ops[2])),
+		SetUnion(base, SetUnion(ops[0], SetUnion(ops[1], ops[2]))),
+		SetUnion(SetUnion(base, ops[0]), SetUnion(ops[1], ops[2])),
+	} {
+		members, err := DecodeSet(val)
+		require.NoError(t, err)
+		require.Equal(t, want, members)
+	}
+
+	// A value written with SetAdd, rather than merged, is a valid base too.
+	members, err := DecodeSet(SetUnion(SetAdd([]byte("a")), SetUnion(ops[0], ops[1])))
+	require.NoError(t, err)
+	require.Equal(t, want, members)
+}
+
+func TestBoundedAppend(t *testing.T) {
+	f := BoundedAppend(3)
+	val := fold(f,
+		EncodeList([]byte("a")),
+		EncodeList([]byte("b"), []byte("c")),
+		EncodeList([]byte("d")),
+	)
+	items, err := DecodeList(val)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("b"), []byte("c"), []byte("d")}, items)
+
+	// A single operand is bounded too.
+	items, err = DecodeList(fold(BoundedAppend(2),
+		EncodeList([]byte("a"), []byte("b"), []byte("c"))))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("b"), []byte("c")}, items)
+
+	require.Equal(t, val, f(val, []byte{9}))
+	_, err = DecodeList([]byte{9})
+	require.Error(t, err)
+}
+
+func TestJSONMergePatch(t *testing.T) {
+	val := fold(JSONMergePatch,
+		[]byte(`{"a":"b","c":{"d":"e","f":"g"},"n":12345678901234567890}`),
+		[]byte(`{"a":"z","c":{"f":null,"h":[1,2]}}`),
+		[]byte(`{"x":{"y":true}}`),
+	)
+	require.JSONEq(t,
+		`{"a":"z","c":{"d":"e","h":[1,2]},"n":12345678901234567890,"x":{"y":true}}`,
+		string(val))
+	// Big numbers are kept as written.
+	require.Contains(t, string(val), "12345678901234567890")
+
+	// The null members of a single patch are removed too.
+	require.Equal(t, `{"b":1}`, string(fold(JSONMergePatch, []byte(`{"a":null,"b":1}`))))
+
+	// A patch that isn't an object replaces the document.
+	require.Equal(t, `[1]`, string(JSONMergePatch(val, []byte(`[1]`))))
+	require.Equal(t, `{"a":1}`, string(JSONMergePatch([]byte(`"str"`), []byte(`{"a":1}`))))
+	// Invalid patches are ignored.
+	require.Equal(t, val, JSONMergePatch(val, []byte(`{"a":`)))
+}
@@ -17,11 +17,17 @@
 package badger
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"fmt"
 	"io/ioutil"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v2/merge"
+	"github.com/dgraph-io/badger/v2/pb"
 	"github.com/stretchr/testify/require"
 )
 
@@ -163,7 +169,382 @@ func bytesToUint64(b []byte) uint64 {
 	return binary.BigEndian.Uint64(b)
 }
 
-// Merge function to add two uint64 numbers
+// Merge function to add two uint64 numbers. A nil existing value counts as zero.
 func add(existing, new []byte) []byte {
+	if existing == nil {
+		return new
+	}
 	return uint64ToBytes(bytesToUint64(existing) + bytesToUint64(new))
 }
+
+func TestMergeFunc(t *testing.T) {
+	get := func(t *testing.T, db *DB, key string) uint64 {
+		var res uint64
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte(key))
+			require.NoError(t, err)
+			val, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			res = bytesToUint64(val)
+			return nil
+		}))
+		return res
+	}
+	merge := func(t *testing.T, db *DB, key string, n uint64) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Merge([]byte(key), uint64ToBytes(n))
+		}))
+	}
+
+	t.Run("without MergeFunc", func(t *testing.T) {
+		runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				require.Equal(t, ErrNoMergeFunc, txn.Merge([]byte("key"), uint64ToBytes(1)))
+				return nil
+			}))
+		})
+	})
+
+	opt := getTestOptions("").WithMergeFunc(add)
+	t.Run("Get", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			for i := uint64(1); i <= 3; i++ {
+				merge(t, db, "counter", i)
+			}
+			require.Equal(t, uint64(6), get(t, db, "counter"))
+
+			// The operands of a transaction are combined, and visible in it.
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				require.NoError(t, txn.Merge([]byte("counter"), uint64ToBytes(1)))
+				require.NoError(t, txn.Merge([]byte("counter"), uint64ToBytes(2)))
+				item, err := txn.Get([]byte("counter"))
+				require.NoError(t, err)
+				return item.Value(func(val []byte) error {
+					require.Equal(t, uint64(9), bytesToUint64(val))
+					return nil
+				})
+			}))
+			require.Equal(t, uint64(9), get(t, db, "counter"))
+
+			// Operands apply on top of the latest value, or start over after a deletion.
+			txnSet(t, db, []byte("counter"), uint64ToBytes(10), 0)
+			merge(t, db, "counter", 5)
+			require.Equal(t, uint64(15), get(t, db, "counter"))
+			txnDelete(t, db, []byte("counter"))
+			merge(t, db, "counter", 7)
+			require.Equal(t, uint64(7), get(t, db, "counter"))
+
+			// A snapshot doesn't see the later operands.
+			txn := db.NewTransaction(false)
+			defer txn.Discard()
+			merge(t, db, "counter", 1)
+			item, err := txn.Get([]byte("counter"))
+			require.NoError(t, err)
+			val, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, uint64(7), bytesToUint64(val))
+		})
+	})
+	t.Run("Iterator", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			for i := 0; i < 10; i++ {
+				key := fmt.Sprintf("key%d", i)
+				if i%2 == 0 {
+					txnSet(t, db, []byte(key), uint64ToBytes(100), 0)
+				}
+				for j := 0; j <= i; j++ {
+					merge(t, db, key, 1)
+				}
+			}
+			for _, reverse := range []bool{false, true} {
+				for _, prefetch := range []bool{false, true} {
+					iopt := DefaultIteratorOptions
+					iopt.Reverse = reverse
+					iopt.PrefetchValues = prefetch
+					var n int
+					require.NoError(t, db.View(func(txn *Txn) error {
+						it := txn.NewIterator(iopt)
+						defer it.Close()
+						for it.Rewind(); it.Valid(); it.Next() {
+							var i int
+							_, err := fmt.Sscanf(string(it.Item().Key()), "key%d", &i)
+							require.NoError(t, err)
+							expected := uint64(i + 1)
+							if i%2 == 0 {
+								expected += 100
+							}
+							val, err := it.Item().ValueCopy(nil)
+							require.NoError(t, err)
+							require.Equal(t, expected, bytesToUint64(val))
+							n++
+						}
+						return nil
+					}))
+					require.Equal(t, 10, n)
+				}
+			}
+		})
+	})
+	t.Run("value log", func(t *testing.T) {
+		appendOpt := getTestOptions("").WithValueThreshold(32).
+			WithMergeFunc(func(existing, val []byte) []byte {
+				return append(existing, val...)
+			})
+		runBadgerTest(t, &appendOpt, func(t *testing.T, db *DB) {
+			wb := db.NewWriteBatch()
+			var expected []byte
+			for i := 0; i < 20; i++ {
+				val := bytes.Repeat([]byte{byte('a' + i)}, 64)
+				expected = append(expected, val...)
+				require.NoError(t, wb.Merge([]byte("list"), val))
+				require.NoError(t, wb.Flush())
+				wb = db.NewWriteBatch()
+			}
+			wb.Cancel()
+			require.NoError(t, db.View(func(txn *Txn) error {
+				item, err := txn.Get([]byte("list"))
+				require.NoError(t, err)
+				val, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, expected, val)
+				return nil
+			}))
+		})
+	})
+	t.Run("value log GC", func(t *testing.T) {
+		gcOpt := getTestOptions("").WithValueThreshold(32).WithValueLogFileSize(1 << 20).
+			WithMergeFunc(func(existing, val []byte) []byte {
+				return append(existing, val...)
+			})
+		runBadgerTest(t, &gcOpt, func(t *testing.T, db *DB) {
+			base, operand := bytes.Repeat([]byte("a"), 64), bytes.Repeat([]byte("b"), 64)
+			txnSet(t, db, []byte("list"), base, 0)
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Merge([]byte("list"), operand)
+			}))
+			for i := 0; len(db.vlog.sortedFids()) < 2; i++ {
+				txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), make([]byte, 32<<10), 0)
+			}
+			// The operand is moved by the rewrite, and must still be merged.
+			require.NoError(t, db.vlog.rewrite(db.vlog.filesMap[db.vlog.sortedFids()[0]]))
+			require.NoError(t, db.View(func(txn *Txn) error {
+				item, err := txn.Get([]byte("list"))
+				require.NoError(t, err)
+				val, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, append(base, operand...), val)
+				return nil
+			}))
+		})
+	})
+	t.Run("Stream", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			txnSet(t, db, []byte("counter"), uint64ToBytes(10), 0)
+			merge(t, db, "counter", 5)
+			var vals []uint64
+			stream := db.NewStream()
+			stream.Send = func(list *pb.KVList) error {
+				for _, kv := range list.Kv {
+					vals = append(vals, bytesToUint64(kv.Value))
+				}
+				return nil
+			}
+			require.NoError(t, stream.Orchestrate(context.Background()))
+			require.Equal(t, []uint64{15}, vals)
+		})
+	})
+	t.Run("Subscribe", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			// The changes made before subscribing are delivered by the catch-up, and the ones
+			// made after by the publisher. Both deliver the values of the key.
+			txnSet(t, db, []byte("counter"), uint64ToBytes(10), 0)
+			merge(t, db, "counter", 5)
+
+			var mu sync.Mutex
+			vals := make(map[uint64]uint64)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- db.SubscribeSince(ctx, 0, func(list *KVList) error {
+					mu.Lock()
+					defer mu.Unlock()
+					for _, kv := range list.Kv {
+						require.Equal(t, []byte{0}, kv.Meta)
+						vals[kv.Version] = bytesToUint64(kv.Value)
+					}
+					return nil
+				}, []byte("counter"))
+			}()
+			merge(t, db, "counter", 3)
+			merge(t, db, "counter", 2)
+
+			var got []uint64
+			for i := 0; i < 500 && len(got) < 4; i++ {
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				got = got[:0]
+				for v := uint64(1); v <= db.MaxVersion(); v++ {
+					if val, ok := vals[v]; ok {
+						got = append(got, val)
+					}
+				}
+				mu.Unlock()
+			}
+			require.Equal(t, []uint64{10, 15, 18, 20}, got)
+			cancel()
+			require.Equal(t, context.Canceled, <-done)
+		})
+	})
+	t.Run("Subscribe concurrent writes", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			var mu sync.Mutex
+			var last uint64
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- db.Subscribe(ctx, func(list *KVList) error {
+					mu.Lock()
+					defer mu.Unlock()
+					for _, kv := range list.Kv {
+						last = bytesToUint64(kv.Value)
+					}
+					return nil
+				}, []byte("counter"))
+			}()
+			// Wait for the subscription to be registered.
+			for db.pub.noOfSubscribers() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			// The merged values are read while the next commits go through the write path.
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						merge(t, db, "counter", 1)
+					}
+				}()
+			}
+			wg.Wait()
+			for i := 0; i < 500; i++ {
+				mu.Lock()
+				got := last
+				mu.Unlock()
+				if got == 400 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			mu.Lock()
+			require.Equal(t, uint64(400), last)
+			mu.Unlock()
+			cancel()
+			require.Equal(t, context.Canceled, <-done)
+		})
+	})
+	t.Run("read mark", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			merge(t, db, "counter", 1)
+			version := db.MaxVersion() + 1
+			// The transaction the publisher reads the operands written at version in keeps the
+			// versions below it from being discarded.
+			txn := db.mergeReadTxn(version)
+			merge(t, db, "counter", 1)
+			merge(t, db, "counter", 1)
+			require.True(t, db.orc.discardAtOrBelow() < version)
+			txn.Discard()
+			for i := 0; i < 100 && db.orc.discardAtOrBelow() < version; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			require.True(t, db.orc.discardAtOrBelow() >= version)
+		})
+	})
+}
+
+func TestBuiltinMergeFuncs(t *testing.T) {
+	t.Run("MergeOperator", func(t *testing.T) {
+		runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+			m := db.GetMergeOperator([]byte("counter"), merge.AddInt64, 200*time.Millisecond)
+			defer m.Stop()
+			require.NoError(t, m.Add(merge.EncodeInt64(10)))
+			require.NoError(t, m.Add(merge.EncodeInt64(-3)))
+			val, err := m.Get()
+			require.NoError(t, err)
+			v, err := merge.DecodeInt64(val)
+			require.NoError(t, err)
+			require.Equal(t, int64(7), v)
+
+			// The operands are combined with each other before the oldest one.
+			s := db.GetMergeOperator([]byte("set"), merge.SetUnion, 200*time.Millisecond)
+			defer s.Stop()
+			require.NoError(t, s.Add(merge.SetAdd([]byte("a"))))
+			require.NoError(t, s.Add(merge.SetRemove([]byte("a"))))
+			require.NoError(t, s.Add(merge.SetAdd([]byte("b"))))
+			val, err = s.Get()
+			require.NoError(t, err)
+			members, err := merge.DecodeSet(val)
+			require.NoError(t, err)
+			require.Equal(t, [][]byte{[]byte("b")}, members)
+		})
+	})
+	t.Run("MergeFunc", func(t *testing.T) {
+		opt := getTestOptions("").WithMergeFunc(merge.SetUnion)
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			for _, op := range [][]byte{
+				merge.SetAdd([]byte("b"), []byte("a")),
+				merge.SetAdd([]byte("c")),
+				merge.SetRemove([]byte("a")),
+			} {
+				require.NoError(t, db.Update(func(txn *Txn) error {
+					return txn.Merge([]byte("set"), op)
+				}))
+			}
+			require.NoError(t, db.View(func(txn *Txn) error {
+				item, err := txn.Get([]byte("set"))
+				require.NoError(t, err)
+				val, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				members, err := merge.DecodeSet(val)
+				require.NoError(t, err)
+				require.Equal(t, [][]byte{[]byte("b"), []byte("c")}, members)
+				return nil
+			}))
+
+			// A single operand goes through the merge function too.
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Merge([]byte("single"), merge.SetAdd([]byte("b"), []byte("a"), []byte("a")))
+			}))
+			require.NoError(t, db.View(func(txn *Txn) error {
+				item, err := txn.Get([]byte("single"))
+				require.NoError(t, err)
+				val, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				members, err := merge.DecodeSet(val)
+				require.NoError(t, err)
+				require.Equal(t, [][]byte{[]byte("a"), []byte("b")}, members)
+				return nil
+			}))
+
+			// The operands merged in the same transaction are combined, removals included.
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Merge([]byte("combined"), merge.SetAdd([]byte("a")))
+			}))
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				require.NoError(t, txn.Merge([]byte("combined"), merge.SetRemove([]byte("a"))))
+				return txn.Merge([]byte("combined"), merge.SetAdd([]byte("b")))
+			}))
+			require.NoError(t, db.View(func(txn *Txn) error {
+				item, err := txn.Get([]byte("combined"))
+				require.NoError(t, err)
+				val, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				members, err := merge.DecodeSet(val)
+				require.NoError(t, err)
+				require.Equal(t, [][]byte{[]byte("b")}, members)
+				return nil
+			}))
+		})
+	})
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package objstore provides object stores, which can be used as the BackupTarget of
+// Stream.BackupTo and DB.LoadFrom.
+//
+// Dir stores the objects as files in a local directory. S3 stores them in a bucket of an
+// S3-compatible object store. The S3Server is a stand-in for such an object store, keeping the
+// objects in memory, meant for testing.
+package objstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned by Get if the object doesn't exist.
+var ErrNotFound = errors.New("Object not found")
+
+// Dir stores the objects as files under a local directory. The slashes in the names of the
+// objects separate the subdirectories.
+type Dir struct {
+	dir string
+}
+
+// NewDir returns a Dir storing the objects under the given directory, which is created on the
+// first Put if it doesn't exist.
+func NewDir(dir string) *Dir {
+	return &Dir{dir: dir}
+}
+
+func (d *Dir) path(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return "", errors.Errorf("Invalid object name %q", name)
+	}
+	for _, c := range strings.Split(name, "/") {
+		if c == "" || c == "." || c == ".." {
+			return "", errors.Errorf("Invalid object name %q", name)
+		}
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(name)), nil
+}
+
+// Put writes the object to a temporary file, which is synced and then renamed, so that a reader
+// never sees a partial object.
+func (d *Dir) Put(ctx context.Context, name string, data []byte) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "while writing %s", path)
+	}
+	return nil
+}
+
+// Get reads the object, or returns ErrNotFound.
+func (d *Dir) Get(ctx context.Context, name string) ([]byte, error) {
+	path, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errors.Wrap(ErrNotFound, name)
+	}
+	return data, err
+}
+
+// List walks the directory for the objects starting with prefix. The temporary files of the
+// ongoing Puts are skipped.
+func (d *Dir) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := filepath.Walk(d.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == d.dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type store interface {
+	Put(ctx context.Context, name string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+func testStore(t *testing.T, s store) {
+	ctx := context.Background()
+	names, err := s.List(ctx, "")
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	_, err = s.Get(ctx, "a/missing")
+	require.Equal(t, ErrNotFound, errors.Cause(err))
+
+	var want []string
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("backup-%d/part %02d", i%2, i)
+		require.NoError(t, s.Put(ctx, name, []byte(name)))
+		if i%2 == 1 {
+			want = append(want, name)
+		}
+	}
+	require.NoError(t, s.Put(ctx, "backup-1/part 01", []byte("replaced")))
+
+	data, err := s.Get(ctx, "backup-0/part 04")
+	require.NoError(t, err)
+	require.Equal(t, "backup-0/part 04", string(data))
+	data, err = s.Get(ctx, "backup-1/part 01")
+	require.NoError(t, err)
+	require.Equal(t, "replaced", string(data))
+
+	names, err = s.List(ctx, "backup-1/")
+	require.NoError(t, err)
+	require.Equal(t, want, names)
+	names, err = s.List(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, names, 25)
+}
+
+func TestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objstore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d := NewDir(dir + "/target")
+	testStore(t, d)
+	for _, name := range []string{"", "/a", "a/", "a//b", "../a", "a/./b"} {
+		require.Error(t, d.Put(context.Background(), name, nil), name)
+	}
+}
+
+func TestS3(t *testing.T) {
+	srv := NewS3Server("access", "secret")
+	srv.MaxKeys = 4 // Page through the lists.
+	srv.CreateBucket("bucket")
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	testStore(t, NewS3(S3Options{
+		Endpoint:  ts.URL,
+		Bucket:    "bucket",
+		Prefix:    "backups/",
+		AccessKey: "access",
+		SecretKey: "secret",
+	}))
+
+	wrongKey := NewS3(S3Options{
+		Endpoint:  ts.URL,
+		Bucket:    "bucket",
+		AccessKey: "access",
+		SecretKey: "wrong",
+	})
+	require.Error(t, wrongKey.Put(context.Background(), "a", []byte("a")))
+
+	noBucket := NewS3(S3Options{
+		Endpoint:  ts.URL,
+		Bucket:    "missing",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	_, err := noBucket.List(context.Background(), "")
+	require.Error(t, err)
+}
+
+// TestSignV4 checks the signature against the get-vanilla case of the AWS Signature Version 4
+// test suite.
+func TestSignV4(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://example.amazonaws.com/", nil)
+	require.NoError(t, err)
+	now, err := time.Parse(amzDateFormat, "20150830T123600Z")
+	require.NoError(t, err)
+	payloadHash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	signV4(req, payloadHash, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		"us-east-1", "service", now)
+	require.Equal(t, "AWS4-HMAC-SHA256 "+
+		"Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, "+
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
@@ -0,0 +1,296 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// S3Options are the options of an S3 client.
+type S3Options struct {
+	// Endpoint is the base URL of the object store, like https://s3.us-east-1.amazonaws.com.
+	// The buckets are addressed in the path of the requests.
+	Endpoint string
+	// Bucket holds the objects.
+	Bucket string
+	// Prefix, if set, is prepended to the names of the objects.
+	Prefix string
+	// Region is used to sign the requests. Defaults to us-east-1.
+	Region string
+	// AccessKey and SecretKey are the credentials used to sign the requests, with AWS
+	// Signature Version 4.
+	AccessKey string
+	SecretKey string
+	// Client sends the requests. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// S3 stores the objects in a bucket of an S3-compatible object store.
+type S3 struct {
+	opt S3Options
+}
+
+// NewS3 returns an S3 client with the given options.
+func NewS3(opt S3Options) *S3 {
+	if opt.Region == "" {
+		opt.Region = "us-east-1"
+	}
+	if opt.Client == nil {
+		opt.Client = http.DefaultClient
+	}
+	opt.Endpoint = strings.TrimSuffix(opt.Endpoint, "/")
+	return &S3{opt: opt}
+}
+
+// s3Error is the body of the error responses.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// listBucketResult is the body of the responses to ListObjectsV2.
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	KeyCount              int            `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	Contents              []listedObject `xml:"Contents"`
+}
+
+type listedObject struct {
+	Key  string `xml:"Key"`
+	Size int    `xml:"Size"`
+}
+
+func (s *S3) do(ctx context.Context, method, key string, query url.Values,
+	body []byte) ([]byte, error) {
+	u := s.opt.Endpoint + "/" + uriEncode(s.opt.Bucket, true)
+	if key != "" {
+		u += "/" + uriEncode(key, false)
+	}
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, payloadHash, s.opt.AccessKey, s.opt.SecretKey, s.opt.Region, "s3", time.Now())
+
+	resp, err := s.opt.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return data, nil
+	}
+	var serr s3Error
+	_ = xml.Unmarshal(data, &serr)
+	if serr.Code == "NoSuchKey" {
+		return nil, errors.Wrap(ErrNotFound, key)
+	}
+	return nil, errors.Errorf("%s %s: %s: %s %s", method, u, resp.Status, serr.Code, serr.Message)
+}
+
+// Put uploads the object with a PutObject request.
+func (s *S3) Put(ctx context.Context, name string, data []byte) error {
+	_, err := s.do(ctx, http.MethodPut, s.opt.Prefix+name, nil, data)
+	return err
+}
+
+// Get downloads the object with a GetObject request, or returns ErrNotFound.
+func (s *S3) Get(ctx context.Context, name string) ([]byte, error) {
+	return s.do(ctx, http.MethodGet, s.opt.Prefix+name, nil, nil)
+}
+
+// List pages through the objects starting with prefix, with ListObjectsV2 requests.
+func (s *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	var token string
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s.opt.Prefix+prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		data, err := s.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res listBucketResult
+		if err := xml.Unmarshal(data, &res); err != nil {
+			return nil, errors.Wrap(err, "while decoding the list of objects")
+		}
+		for _, c := range res.Contents {
+			names = append(names, strings.TrimPrefix(c.Key, s.opt.Prefix))
+		}
+		if !res.IsTruncated {
+			break
+		}
+		if res.NextContinuationToken == "" {
+			return nil, errors.New("Truncated list of objects without a continuation token")
+		}
+		token = res.NextContinuationToken
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+const (
+	amzDateFormat = "20060102T150405Z"
+	signAlgorithm = "AWS4-HMAC-SHA256"
+)
+
+// signV4 signs the request with AWS Signature Version 4, setting its X-Amz-Date and Authorization
+// headers. The host and the X-Amz-* headers are signed.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region, service string,
+	now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	signedHeaders, sig := signature(req, payloadHash, secretKey, region, service, amzDate)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", signAlgorithm, accessKey,
+		credentialScope(amzDate, region, service), signedHeaders, sig))
+}
+
+func credentialScope(amzDate, region, service string) string {
+	return amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+}
+
+// signature computes the signature of the request, as of amzDate. It returns the signed headers
+// along with the signature.
+func signature(req *http.Request, payloadHash, secretKey, region, service,
+	amzDate string) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		signAlgorithm,
+		amzDate,
+		credentialScope(amzDate, region, service),
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), amzDate[:8])
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes the query sorted by key, as both the requests and their signatures
+// expect it.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes all the bytes but the unreserved characters, and the slashes unless
+// encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package objstore
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// authPattern parses the Authorization header of the requests signed by signV4.
+var authPattern = regexp.MustCompile(
+	`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/([^/]+)/aws4_request, ` +
+		`SignedHeaders=([^,]+), Signature=([0-9a-f]{64})$`)
+
+// S3Server is a stand-in for an S3-compatible object store, keeping the objects in memory. It
+// serves the PutObject, GetObject and ListObjectsV2 requests, with the buckets addressed in the
+// path, and checks that they are signed with its credentials. It is an http.Handler, meant to be
+// served by a test HTTP server.
+type S3Server struct {
+	// MaxKeys is the maximum number of objects listed in a response. Defaults to 1000.
+	MaxKeys int
+
+	accessKey string
+	secretKey string
+
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+// NewS3Server returns an S3Server accepting the requests signed with the given credentials.
+func NewS3Server(accessKey, secretKey string) *S3Server {
+	return &S3Server{
+		MaxKeys:   1000,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		buckets:   make(map[string]map[string][]byte),
+	}
+}
+
+// CreateBucket creates an empty bucket, if it doesn't exist yet.
+func (s *S3Server) CreateBucket(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = make(map[string][]byte)
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	data, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"Error"`
+		s3Error
+	}{s3Error: s3Error{Code: code, Message: message}})
+	_, _ = w.Write(data)
+}
+
+// authenticate checks the signature of the request, and that the payload matches its hash.
+func (s *S3Server) authenticate(r *http.Request, body []byte) bool {
+	m := authPattern.FindStringSubmatch(r.Header.Get("Authorization"))
+	amzDate := r.Header.Get("X-Amz-Date")
+	if m == nil || len(amzDate) != len(amzDateFormat) || m[1] != s.accessKey ||
+		m[2] != amzDate[:8] {
+		return false
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	sum := sha256.Sum256(body)
+	if payloadHash != hex.EncodeToString(sum[:]) {
+		return false
+	}
+	signedHeaders, sig := signature(r, payloadHash, s.secretKey, m[3], m[4], amzDate)
+	return signedHeaders == m[5] && subtle.ConstantTimeCompare([]byte(sig), []byte(m[6])) == 1
+}
+
+// ServeHTTP serves a request to the object store.
+func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if !s.authenticate(r, body) {
+		writeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch",
+			"The request signature does not match")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := parts[0], ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The bucket does not exist")
+		return
+	}
+	switch {
+	case r.Method == http.MethodPut && key != "":
+		objects[key] = body
+	case r.Method == http.MethodGet && key != "":
+		data, ok := objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The key does not exist")
+			return
+		}
+		_, _ = w.Write(data)
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		s.list(w, r, bucket, objects)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented",
+			"The request is not supported")
+	}
+}
+
+// list serves a ListObjectsV2 request. The continuation token is the last key listed. Should be
+// called with the lock held.
+func (s *S3Server) list(w http.ResponseWriter, r *http.Request, bucket string,
+	objects map[string][]byte) {
+	query := r.URL.Query()
+	prefix, after := query.Get("prefix"), query.Get("continuation-token")
+	maxKeys := s.MaxKeys
+	if v := query.Get("max-keys"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	res := listBucketResult{Name: bucket, Prefix: prefix, MaxKeys: maxKeys}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		res.IsTruncated = true
+		res.NextContinuationToken = keys[len(keys)-1]
+	}
+	res.KeyCount = len(keys)
+	for _, key := range keys {
+		res.Contents = append(res.Contents, listedObject{Key: key, Size: len(objects[key])})
+	}
+	data, err := xml.Marshal(res)
+	if err != nil {
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write(append([]byte(xml.Header), data...))
+}
@@ -73,6 +73,7 @@ type Options struct {
 	CompactL0OnClose     bool
 	LogRotatesToFlush    int32
 	ZSTDCompressionLevel int
+	ZSTDDictSize         int
 
 	// When set, checksum will be validated for each entry read from the value log file.
 	VerifyValueChecksum bool
@@ -80,6 +81,8 @@ type Options struct {
 	// Encryption related options.
 	EncryptionKey                 []byte        // encryption key
 	EncryptionKeyRotationDuration time.Duration // key rotation duration
+	KeyProvider                   KeyProvider   // wraps the data keys instead of EncryptionKey
+	EncryptionAlgo                options.EncryptionAlgo
 
 	// BypassLockGaurd will bypass the lock guard on badger. Bypassing lock
 	// guard can cause data corruption if multiple badger instances are using
@@ -94,6 +97,32 @@ type Options struct {
 	// conflict detection is disabled.
 	DetectConflicts bool
 
+	// WALRecoveryMode decides how corrupt entries are handled while replaying memtable WALs.
+	WALRecoveryMode options.WALRecoveryMode
+
+	// DirectIO makes the SSTables and the value log files get read using direct I/O.
+	DirectIO bool
+
+	// IndexPartitionSize is the number of block offsets stored in each partition of a table index.
+	IndexPartitionSize int
+
+	// FilterType is the type of the filter built for each table to skip lookups of absent keys.
+	FilterType options.FilterType
+
+	// BlockHashIndex adds a hash index of the keys to each block of the tables.
+	BlockHashIndex bool
+
+	// MergeFunc combines the merge operands written with Txn.Merge into the values of the keys.
+	MergeFunc MergeFunc
+
+	// ReuseSequenceLeases makes sequences record the integers they hand out, so that the unused
+	// part of a lease can be handed out again after a crash.
+	ReuseSequenceLeases bool
+
+	// TailInterval, in ReadOnly mode, makes the DB pick up the writes of the process writing to
+	// the directory every TailInterval.
+	TailInterval time.Duration
+
 	// Transaction start and commit timestamps are managed by end-user.
 	// This is only useful for databases built on top of Badger (like Dgraph).
 	// Not recommended for most users.
@@ -166,6 +195,12 @@ func buildTableOptions(opt Options) table.Options {
 		ChkMode:              opt.ChecksumVerificationMode,
 		Compression:          opt.Compression,
 		ZSTDCompressionLevel: opt.ZSTDCompressionLevel,
+		ZSTDDictSize:         opt.ZSTDDictSize,
+		DirectIO:             opt.DirectIO,
+		IndexPartitionSize:   opt.IndexPartitionSize,
+		FilterType:           opt.FilterType,
+		BlockHashIndex:       opt.BlockHashIndex,
+		Warningf:             opt.Warningf,
 	}
 }
 
@@ -453,6 +488,36 @@ func (opt Options) WithEncryptionKey(key []byte) Options {
 	return opt
 }
 
+// WithKeyProvider returns a new Options value with KeyProvider set to the given value.
+//
+// KeyProvider enables encryption like EncryptionKey, but the data keys are wrapped and unwrapped
+// by the KeyProvider, which holds the master key, instead of being encrypted with EncryptionKey.
+// The data keys are then AES-256 keys. KeyProvider and EncryptionKey cannot be used together. The
+// badger rotate command can move the data keys from one to the other.
+//
+// The default value of KeyProvider is nil.
+func (opt Options) WithKeyProvider(val KeyProvider) Options {
+	opt.KeyProvider = val
+	return opt
+}
+
+// WithEncryptionAlgo returns a new Options value with EncryptionAlgo set to the given value.
+//
+// EncryptionAlgo is the AES mode used to encrypt the data, when EncryptionKey or KeyProvider is
+// set. With options.AESGCM, reading a table block, a table index or a log entry that has been
+// tampered with fails with an error reporting y.ErrDecryptionFailed, instead of returning garbage.
+// GCM adds 16 bytes to every log entry and 28 bytes to every table block.
+//
+// The mode is recorded in each data key, so the data written with another mode stays readable.
+// Changing the mode makes the new files use a new data key. To move all of the existing data to
+// the new mode, open the DB with the new mode and call DB.ReencryptAll.
+//
+// The default value of EncryptionAlgo is options.AESCTR.
+func (opt Options) WithEncryptionAlgo(val options.EncryptionAlgo) Options {
+	opt.EncryptionAlgo = val
+	return opt
+}
+
 // WithEncryptionKeyRotationDuration returns new Options value with the duration set to
 // the given value.
 //
@@ -546,6 +611,21 @@ func (opt Options) WithZSTDCompressionLevel(cLevel int) Options {
 	return opt
 }
 
+// WithZSTDDictSize returns a new Options value with ZSTDDictSize set to the given value.
+//
+// Small blocks of similar keys compress poorly when each block is compressed on its own. When
+// ZSTDDictSize is set, a ZSTD dictionary of up to ZSTDDictSize bytes is trained on the first
+// blocks of each table, and all the blocks of the table are compressed with it. The dictionary is
+// stored in the table index, so it is cached along with the index. Tables too small to train a
+// dictionary on are compressed without one. This is only used when the compression is set to
+// options.ZSTD. Tables built without a dictionary can still be read.
+//
+// The default value of ZSTDDictSize is 0, which means that no dictionary is used.
+func (opt Options) WithZSTDDictSize(val int) Options {
+	opt.ZSTDDictSize = val
+	return opt
+}
+
 // WithBypassLockGuard returns a new Options value with BypassLockGuard
 // set to the given value.
 //
@@ -591,6 +671,141 @@ func (opt Options) WithDetectConflicts(b bool) Options {
 	return opt
 }
 
+// WithWALRecoveryMode returns a new Options value with WALRecoveryMode set to the given value.
+//
+// WALRecoveryMode decides what happens when a corrupt or incomplete entry is found while replaying
+// the write-ahead log of a memtable on DB open. options.PointInTime stops the replay at the first
+// bad entry and truncates the log there. options.AbsoluteConsistency makes Open fail instead, with
+// a *WALCorruptedError. options.SkipCorrupted drops the bad entries and continues replaying from
+// the next valid one, and then rewrites the log without them. The discarded ranges can be
+// inspected via DB.WALRecoveryReport, or the Report of the *WALCorruptedError.
+//
+// The default value of WALRecoveryMode is options.PointInTime.
+func (opt Options) WithWALRecoveryMode(mode options.WALRecoveryMode) Options {
+	opt.WALRecoveryMode = mode
+	return opt
+}
+
+// WithDirectIO returns a new Options value with DirectIO set to the given value.
+//
+// When DirectIO is set, the SSTables are neither memory mapped nor read via the page cache of the
+// OS. Instead, the tables (including the ones written by compactions and memtable flushes) are
+// written and read using O_DIRECT, and the value log files which are no longer being written to
+// are read the same way. This keeps a large DB from evicting the rest of the application's memory
+// from the page cache. Since every block read now goes to the disk, a block cache must be set via
+// WithBlockCacheSize. Direct I/O is only supported on Linux.
+//
+// The default value of DirectIO is false.
+func (opt Options) WithDirectIO(val bool) Options {
+	opt.DirectIO = val
+	return opt
+}
+
+// WithIndexPartitionSize returns a new Options value with IndexPartitionSize set to the given
+// value.
+//
+// By default, the offsets of all the blocks of a table are stored in a single index which is loaded
+// at once and kept in memory (or in the index cache, if encryption is enabled). With a large
+// MaxTableSize and a small BlockSize, this index can take a lot of memory. When IndexPartitionSize
+// is set, the block offsets of a table are split into partitions of IndexPartitionSize offsets
+// each, and the table index only points to these partitions. The partitions are loaded on demand
+// and cached in the block cache, so a block cache should be set via WithBlockCacheSize. Tables with
+// fewer blocks than IndexPartitionSize are not partitioned.
+//
+// The default value of IndexPartitionSize is 0, which means that the index is not partitioned.
+func (opt Options) WithIndexPartitionSize(val int) Options {
+	opt.IndexPartitionSize = val
+	return opt
+}
+
+// WithFilterType returns a new Options value with FilterType set to the given value.
+//
+// FilterType decides the kind of filter built for each table, which is used to skip the tables
+// that don't have the key being looked up. options.RibbonFilter takes about 25% less memory in
+// the index cache than options.BloomFilter for the same false positive rate, but takes longer to
+// build. The false positive rate is set via WithBloomFalsePositive. The filter type is recorded
+// in each table, so it can be changed across DB runs.
+//
+// The default value of FilterType is options.BloomFilter.
+func (opt Options) WithFilterType(val options.FilterType) Options {
+	opt.FilterType = val
+	return opt
+}
+
+// WithBlockHashIndex returns a new Options value with BlockHashIndex set to the given value.
+//
+// When BlockHashIndex is set, each block of the tables built from then on gets a hash index of
+// its keys. Point lookups (Txn.Get) use it to jump directly to the position of the key in the
+// block instead of binary searching the entries, which helps read heavy workloads with small
+// values and large blocks. The index takes about 3 bytes per key in each block. Tables built
+// without the hash index are still read using binary search.
+//
+// The default value of BlockHashIndex is false.
+func (opt Options) WithBlockHashIndex(val bool) Options {
+	opt.BlockHashIndex = val
+	return opt
+}
+
+// WithMergeFunc returns a new Options value with MergeFunc set to the given value.
+//
+// MergeFunc is the merge operator of the DB. Txn.Merge and WriteBatch.Merge write merge operands,
+// which are applied with MergeFunc, from the oldest to the newest, on top of the latest value of
+// the key written with Set when the key is read, and which compactions fold into a single value
+// once no transaction can see the individual versions anymore. This makes read-modify-write
+// updates such as counters and list appends cheap, since they don't need to read the key.
+// MergeFunc must be deterministic, and the same function must be used each time the DB is opened.
+// Folding the operands of a key discards the versions of the key below them. The subscribers and
+// the replication followers get the value of the key each operand results in, rather than the
+// operand itself.
+//
+// The default value of MergeFunc is nil, which disables Txn.Merge.
+func (opt Options) WithMergeFunc(val MergeFunc) Options {
+	opt.MergeFunc = val
+	return opt
+}
+
+// WithReuseSequenceLeases returns a new Options value with ReuseSequenceLeases set to the given
+// value.
+//
+// A Sequence leases a range of integers by storing the end of the range, and hands them out from
+// memory. When the process crashes before Sequence.Release is called, the integers left in the
+// lease are lost. When ReuseSequenceLeases is true, each call to Sequence.Next or Sequence.NextN
+// also stores a high-water mark proving that the integers above it were never handed out, and a
+// lease stored before the DB was opened is taken over from its high-water mark instead of its end.
+// This costs a transaction per call, and the high-water mark is only durable with SyncWrites.
+//
+// The default value of ReuseSequenceLeases is false.
+func (opt Options) WithReuseSequenceLeases(val bool) Options {
+	opt.ReuseSequenceLeases = val
+	return opt
+}
+
+// WithTailInterval returns a new Options value with TailInterval set to the given value.
+//
+// A DB opened in ReadOnly mode is a frozen view of the directory. When TailInterval is not zero,
+// the DB instead follows the writes of the process which has the directory open for writing, on
+// the same host: every TailInterval, it picks up the tables added to the MANIFEST by flushes and
+// compactions, and the entries appended to the memtable WALs and to the value log. DB.Refresh
+// does the same on demand. The writes become visible all at once, at a new read timestamp, so
+// reads keep seeing consistent snapshots of the DB, which lag behind the writer by up to
+// TailInterval.
+//
+// The directory lock isn't taken, so that the writer can hold it. The DB must be opened with the
+// same MaxTableSize, ValueLogFileSize and encryption options as the writer. Since the writer
+// doesn't know about the readers, the versions it discards, like the ones its compactions drop,
+// can disappear from under long-running transactions of the readers.
+//
+// The default value of TailInterval is zero, which disables tailing.
+func (opt Options) WithTailInterval(val time.Duration) Options {
+	opt.TailInterval = val
+	return opt
+}
+
+// tailing returns true if the DB follows the writes of another process.
+func (opt Options) tailing() bool {
+	return opt.ReadOnly && opt.TailInterval > 0
+}
+
 func (opt Options) getFileFlags() int {
 	var flags int
 	// opt.SyncWrites would be using msync to sync. All writes go through mmap.
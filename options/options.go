@@ -55,3 +55,45 @@ const (
 	// ZSTD mode indicates that a block is compressed using ZSTD algorithm.
 	ZSTD CompressionType = 2
 )
+
+// WALRecoveryMode specifies how corrupt entries in a memtable's write-ahead log (the .mem files)
+// should be handled when the WAL is replayed on DB open.
+type WALRecoveryMode int
+
+const (
+	// PointInTime indicates that the replay should stop at the first corrupt or incomplete record
+	// and truncate the log from there on. Everything written before the corruption is recovered.
+	PointInTime WALRecoveryMode = iota
+	// AbsoluteConsistency indicates that the DB should fail to open if the replay finds any
+	// corrupt or incomplete record in the log.
+	AbsoluteConsistency
+	// SkipCorrupted indicates that the replay should skip over corrupt records and continue with
+	// the next valid record found after them.
+	SkipCorrupted
+)
+
+// FilterType specifies the kind of filter that is built for each table to skip lookups of the keys
+// that are not in the table.
+type FilterType uint32
+
+const (
+	// BloomFilter indicates that a standard bloom filter is used.
+	BloomFilter FilterType = 0
+	// RibbonFilter indicates that a ribbon filter is used. It takes about 25% less memory than a
+	// bloom filter for the same false positive rate, at the cost of a slower table build.
+	RibbonFilter FilterType = 1
+)
+
+// EncryptionAlgo specifies the AES mode used to encrypt the tables, the value log and the
+// write-ahead logs.
+type EncryptionAlgo uint32
+
+const (
+	// AESCTR indicates that the data is encrypted with AES in counter mode. The encrypted data is
+	// not authenticated.
+	AESCTR EncryptionAlgo = 0
+	// AESGCM indicates that the data is encrypted with AES in Galois/Counter mode. Every table
+	// block, table index and log entry carries an authentication tag, so that any tampering with
+	// the encrypted data is detected when it's read.
+	AESGCM EncryptionAlgo = 1
+)
@@ -25,15 +25,18 @@ const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 type EncryptionAlgo int32
 
 const (
-	EncryptionAlgo_aes EncryptionAlgo = 0
+	EncryptionAlgo_aes     EncryptionAlgo = 0
+	EncryptionAlgo_aes_gcm EncryptionAlgo = 1
 )
 
 var EncryptionAlgo_name = map[int32]string{
 	0: "aes",
+	1: "aes_gcm",
 }
 
 var EncryptionAlgo_value = map[string]int32{
-	"aes": 0,
+	"aes":     0,
+	"aes_gcm": 1,
 }
 
 func (x EncryptionAlgo) String() string {
@@ -446,13 +449,14 @@ func (m *Checksum) GetSum() uint64 {
 }
 
 type DataKey struct {
-	KeyId                uint64   `protobuf:"varint,1,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
-	Data                 []byte   `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
-	Iv                   []byte   `protobuf:"bytes,3,opt,name=iv,proto3" json:"iv,omitempty"`
-	CreatedAt            int64    `protobuf:"varint,4,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	KeyId                uint64         `protobuf:"varint,1,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	Data                 []byte         `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Iv                   []byte         `protobuf:"bytes,3,opt,name=iv,proto3" json:"iv,omitempty"`
+	CreatedAt            int64          `protobuf:"varint,4,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	EncryptionAlgo       EncryptionAlgo `protobuf:"varint,5,opt,name=encryption_algo,json=encryptionAlgo,proto3,enum=badgerpb2.EncryptionAlgo" json:"encryption_algo,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
+	XXX_unrecognized     []byte         `json:"-"`
+	XXX_sizecache        int32          `json:"-"`
 }
 
 func (m *DataKey) Reset()         { *m = DataKey{} }
@@ -516,6 +520,13 @@ func (m *DataKey) GetCreatedAt() int64 {
 	return 0
 }
 
+func (m *DataKey) GetEncryptionAlgo() EncryptionAlgo {
+	if m != nil {
+		return m.EncryptionAlgo
+	}
+	return EncryptionAlgo_aes
+}
+
 func init() {
 	proto.RegisterEnum("badgerpb2.EncryptionAlgo", EncryptionAlgo_name, EncryptionAlgo_value)
 	proto.RegisterEnum("badgerpb2.ManifestChange_Operation", ManifestChange_Operation_name, ManifestChange_Operation_value)
@@ -531,45 +542,46 @@ func init() {
 func init() { proto.RegisterFile("badgerpb2.proto", fileDescriptor_e63e84f9f0d3998c) }
 
 var fileDescriptor_e63e84f9f0d3998c = []byte{
-	// 604 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x53, 0xdd, 0x6e, 0xda, 0x4c,
-	0x10, 0x65, 0x8d, 0xc3, 0xcf, 0x90, 0x10, 0xbe, 0xd5, 0x57, 0xc9, 0x51, 0x15, 0x4a, 0x1d, 0x55,
-	0x42, 0x95, 0x0a, 0x2a, 0x54, 0xbd, 0x27, 0x80, 0x14, 0x44, 0xa2, 0x48, 0xdb, 0x28, 0x8a, 0x7a,
-	0x83, 0x16, 0x7b, 0x02, 0x16, 0xf8, 0x47, 0xbb, 0x8b, 0x55, 0x1e, 0xa2, 0xf7, 0x7d, 0xa4, 0x5e,
-	0xf6, 0xa2, 0x0f, 0x50, 0xa5, 0x2f, 0x52, 0xed, 0xda, 0xa1, 0x70, 0xd1, 0xbb, 0x99, 0x33, 0xe3,
-	0x39, 0xe3, 0x73, 0x66, 0xe1, 0x74, 0xce, 0xfd, 0x05, 0x8a, 0x64, 0xde, 0xeb, 0x24, 0x22, 0x56,
-	0x31, 0xad, 0xee, 0x00, 0xf7, 0x27, 0x01, 0x6b, 0x7a, 0x4f, 0x1b, 0x50, 0x5c, 0xe1, 0xd6, 0x21,
-	0x2d, 0xd2, 0x3e, 0x66, 0x3a, 0xa4, 0xff, 0xc3, 0x51, 0xca, 0xd7, 0x1b, 0x74, 0x2c, 0x83, 0x65,
-	0x09, 0x7d, 0x09, 0xd5, 0x8d, 0x44, 0x31, 0x0b, 0x51, 0x71, 0xa7, 0x68, 0x2a, 0x15, 0x0d, 0xdc,
-	0xa0, 0xe2, 0xd4, 0x81, 0x72, 0x8a, 0x42, 0x06, 0x71, 0xe4, 0xd8, 0x2d, 0xd2, 0xb6, 0xd9, 0x73,
-	0x4a, 0xcf, 0x01, 0xf0, 0x4b, 0x12, 0x08, 0x94, 0x33, 0xae, 0x9c, 0x23, 0x53, 0xac, 0xe6, 0xc8,
-	0x40, 0x51, 0x0a, 0xb6, 0x19, 0x58, 0x32, 0x03, 0x4d, 0xac, 0x99, 0xa4, 0x12, 0xc8, 0xc3, 0x59,
-	0xe0, 0x3b, 0xd0, 0x22, 0xed, 0x13, 0x56, 0xc9, 0x80, 0x89, 0x4f, 0x5f, 0x41, 0x2d, 0x2f, 0xfa,
-	0x71, 0x84, 0x4e, 0xad, 0x45, 0xda, 0x15, 0x06, 0x19, 0x34, 0x8a, 0x23, 0x74, 0x47, 0x50, 0x9a,
-	0xde, 0x5f, 0x07, 0x52, 0xd1, 0x73, 0xb0, 0x56, 0xa9, 0x43, 0x5a, 0xc5, 0x76, 0xad, 0x77, 0xd2,
-	0xf9, 0xab, 0xc4, 0xf4, 0x9e, 0x59, 0xab, 0x54, 0xd3, 0xf0, 0xf5, 0x3a, 0xf6, 0x66, 0x02, 0x1f,
-	0x0d, 0x8d, 0xcd, 0x2a, 0x06, 0x60, 0xf8, 0xe8, 0x5e, 0xc1, 0x7f, 0x37, 0x3c, 0x0a, 0x1e, 0x51,
-	0xaa, 0xe1, 0x92, 0x47, 0x0b, 0xfc, 0x84, 0x8a, 0xf6, 0xa1, 0xec, 0x99, 0x44, 0xe6, 0x53, 0xcf,
-	0xf6, 0xa6, 0x1e, 0xb6, 0xb3, 0xe7, 0x4e, 0xf7, 0xab, 0x05, 0xf5, 0xc3, 0x1a, 0xad, 0x83, 0x35,
-	0xf1, 0x8d, 0xe2, 0x36, 0xb3, 0x26, 0x3e, 0xed, 0x83, 0x75, 0x9b, 0x18, 0xb5, 0xeb, 0xbd, 0x8b,
-	0x7f, 0x8e, 0xec, 0xdc, 0x26, 0x28, 0xb8, 0x0a, 0xe2, 0x88, 0x59, 0xb7, 0x89, 0x76, 0xe9, 0x1a,
-	0x53, 0x5c, 0x1b, 0x2f, 0x4e, 0x58, 0x96, 0xd0, 0x17, 0x50, 0x5a, 0xe1, 0x56, 0x0b, 0x97, 0xf9,
-	0x70, 0xb4, 0xc2, 0xed, 0xc4, 0xa7, 0x97, 0x70, 0x8a, 0x91, 0x27, 0xb6, 0x89, 0xfe, 0x7c, 0xc6,
-	0xd7, 0x8b, 0xd8, 0x58, 0x51, 0x3f, 0xf8, 0x83, 0xf1, 0xae, 0x63, 0xb0, 0x5e, 0xc4, 0xac, 0x8e,
-	0x07, 0x39, 0x6d, 0x41, 0xcd, 0x8b, 0xc3, 0x44, 0xa0, 0x34, 0x3e, 0x97, 0x0c, 0xed, 0x3e, 0xe4,
-	0x5e, 0x40, 0x75, 0xb7, 0x23, 0x05, 0x28, 0x0d, 0xd9, 0x78, 0x70, 0x37, 0x6e, 0x14, 0x74, 0x3c,
-	0x1a, 0x5f, 0x8f, 0xef, 0xc6, 0x0d, 0xe2, 0xa6, 0x50, 0x19, 0x2e, 0xd1, 0x5b, 0xc9, 0x4d, 0x48,
-	0xdf, 0x83, 0x6d, 0x76, 0x21, 0x66, 0x97, 0xf3, 0xbd, 0x5d, 0x9e, 0x5b, 0x3a, 0x9a, 0x5a, 0x04,
-	0x6a, 0x19, 0x32, 0xd3, 0xaa, 0xcf, 0x55, 0x6e, 0x42, 0x23, 0x96, 0xcd, 0x74, 0xe8, 0xbe, 0x81,
-	0xea, 0xae, 0x29, 0x63, 0x1d, 0xf6, 0x7b, 0xc3, 0x46, 0x81, 0x1e, 0x43, 0xe5, 0xe1, 0xe1, 0x8a,
-	0xcb, 0xe5, 0xc7, 0x0f, 0x0d, 0xe2, 0x7a, 0x50, 0x1e, 0x71, 0xc5, 0xa7, 0xb8, 0xdd, 0x13, 0x89,
-	0xec, 0x8b, 0x44, 0xc1, 0xf6, 0xb9, 0xe2, 0xf9, 0xd9, 0x9b, 0x58, 0x5b, 0x15, 0xa4, 0xf9, 0xb9,
-	0x5b, 0x41, 0xaa, 0xcf, 0xd9, 0x13, 0xc8, 0x15, 0xfa, 0xfa, 0x9c, 0xb5, 0xc6, 0x45, 0x56, 0xcd,
-	0x91, 0x81, 0x7a, 0x7b, 0x06, 0xf5, 0x43, 0x15, 0x69, 0x19, 0x8a, 0x1c, 0x65, 0xa3, 0x70, 0xd9,
-	0xff, 0xfe, 0xd4, 0x24, 0x3f, 0x9e, 0x9a, 0xe4, 0xd7, 0x53, 0x93, 0x7c, 0xfb, 0xdd, 0x2c, 0x7c,
-	0x7e, 0xbd, 0x08, 0xd4, 0x72, 0x33, 0xef, 0x78, 0x71, 0xd8, 0xf5, 0x17, 0x82, 0x27, 0xcb, 0x77,
-	0x41, 0xdc, 0xcd, 0x34, 0xe8, 0xa6, 0xbd, 0x6e, 0x32, 0x9f, 0x97, 0xcc, 0xab, 0xed, 0xff, 0x09,
-	0x00, 0x00, 0xff, 0xff, 0xa7, 0xb8, 0x6c, 0x4c, 0xc8, 0x03, 0x00, 0x00,
+	// 618 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x54, 0xcf, 0x6e, 0xda, 0x4e,
+	0x10, 0x66, 0x8d, 0xc3, 0x9f, 0x21, 0x21, 0xfe, 0xad, 0x7e, 0x95, 0x5c, 0x55, 0xa1, 0xd4, 0x51,
+	0x2b, 0x54, 0xa9, 0xa0, 0x42, 0xd5, 0x3b, 0x01, 0xa4, 0x20, 0x12, 0x45, 0xda, 0x46, 0x51, 0xd4,
+	0x0b, 0x5a, 0xec, 0x89, 0xb1, 0xc0, 0x7f, 0xe4, 0x5d, 0xac, 0xf2, 0x10, 0xbd, 0xf7, 0x0d, 0xfa,
+	0x2a, 0x3d, 0xf6, 0xd0, 0x07, 0xa8, 0xd2, 0x17, 0xa9, 0x76, 0x0d, 0x14, 0x0e, 0xbd, 0xf5, 0x36,
+	0xf3, 0xcd, 0xe7, 0xf9, 0xc6, 0xdf, 0x8c, 0x16, 0x4e, 0x67, 0xdc, 0xf3, 0x31, 0x4d, 0x66, 0xdd,
+	0x76, 0x92, 0xc6, 0x32, 0xa6, 0xd5, 0x1d, 0xe0, 0xfc, 0x20, 0x60, 0x4c, 0xee, 0xa8, 0x05, 0xc5,
+	0x05, 0xae, 0x6d, 0xd2, 0x24, 0xad, 0x63, 0xa6, 0x42, 0xfa, 0x3f, 0x1c, 0x65, 0x7c, 0xb9, 0x42,
+	0xdb, 0xd0, 0x58, 0x9e, 0xd0, 0x67, 0x50, 0x5d, 0x09, 0x4c, 0xa7, 0x21, 0x4a, 0x6e, 0x17, 0x75,
+	0xa5, 0xa2, 0x80, 0x6b, 0x94, 0x9c, 0xda, 0x50, 0xce, 0x30, 0x15, 0x41, 0x1c, 0xd9, 0x66, 0x93,
+	0xb4, 0x4c, 0xb6, 0x4d, 0xe9, 0x19, 0x00, 0x7e, 0x4a, 0x82, 0x14, 0xc5, 0x94, 0x4b, 0xfb, 0x48,
+	0x17, 0xab, 0x1b, 0xa4, 0x2f, 0x29, 0x05, 0x53, 0x37, 0x2c, 0xe9, 0x86, 0x3a, 0x56, 0x4a, 0x42,
+	0xa6, 0xc8, 0xc3, 0x69, 0xe0, 0xd9, 0xd0, 0x24, 0xad, 0x13, 0x56, 0xc9, 0x81, 0xb1, 0x47, 0x9f,
+	0x43, 0x6d, 0x53, 0xf4, 0xe2, 0x08, 0xed, 0x5a, 0x93, 0xb4, 0x2a, 0x0c, 0x72, 0x68, 0x18, 0x47,
+	0xe8, 0x0c, 0xa1, 0x34, 0xb9, 0xbb, 0x0a, 0x84, 0xa4, 0x67, 0x60, 0x2c, 0x32, 0x9b, 0x34, 0x8b,
+	0xad, 0x5a, 0xf7, 0xa4, 0xfd, 0xc7, 0x89, 0xc9, 0x1d, 0x33, 0x16, 0x99, 0x92, 0xe1, 0xcb, 0x65,
+	0xec, 0x4e, 0x53, 0x7c, 0xd0, 0x32, 0x26, 0xab, 0x68, 0x80, 0xe1, 0x83, 0x73, 0x09, 0xff, 0x5d,
+	0xf3, 0x28, 0x78, 0x40, 0x21, 0x07, 0x73, 0x1e, 0xf9, 0xf8, 0x01, 0x25, 0xed, 0x41, 0xd9, 0xd5,
+	0x89, 0xd8, 0x74, 0x7d, 0xba, 0xd7, 0xf5, 0x90, 0xce, 0xb6, 0x4c, 0xe7, 0xb3, 0x01, 0xf5, 0xc3,
+	0x1a, 0xad, 0x83, 0x31, 0xf6, 0xb4, 0xe3, 0x26, 0x33, 0xc6, 0x1e, 0xed, 0x81, 0x71, 0x93, 0x68,
+	0xb7, 0xeb, 0xdd, 0xf3, 0xbf, 0xb6, 0x6c, 0xdf, 0x24, 0x98, 0x72, 0x19, 0xc4, 0x11, 0x33, 0x6e,
+	0x12, 0xb5, 0xa5, 0x2b, 0xcc, 0x70, 0xa9, 0x77, 0x71, 0xc2, 0xf2, 0x84, 0x3e, 0x81, 0xd2, 0x02,
+	0xd7, 0xca, 0xb8, 0x7c, 0x0f, 0x47, 0x0b, 0x5c, 0x8f, 0x3d, 0x7a, 0x01, 0xa7, 0x18, 0xb9, 0xe9,
+	0x3a, 0x51, 0x9f, 0x4f, 0xf9, 0xd2, 0x8f, 0xf5, 0x2a, 0xea, 0x07, 0x7f, 0x30, 0xda, 0x31, 0xfa,
+	0x4b, 0x3f, 0x66, 0x75, 0x3c, 0xc8, 0x69, 0x13, 0x6a, 0x6e, 0x1c, 0x26, 0x29, 0x0a, 0xbd, 0xe7,
+	0x92, 0x96, 0xdd, 0x87, 0x9c, 0x73, 0xa8, 0xee, 0x66, 0xa4, 0x00, 0xa5, 0x01, 0x1b, 0xf5, 0x6f,
+	0x47, 0x56, 0x41, 0xc5, 0xc3, 0xd1, 0xd5, 0xe8, 0x76, 0x64, 0x11, 0x27, 0x83, 0xca, 0x60, 0x8e,
+	0xee, 0x42, 0xac, 0x42, 0xfa, 0x16, 0x4c, 0x3d, 0x0b, 0xd1, 0xb3, 0x9c, 0xed, 0xcd, 0xb2, 0xa5,
+	0xb4, 0x95, 0x74, 0x1a, 0xc8, 0x79, 0xc8, 0x34, 0x55, 0x9d, 0xab, 0x58, 0x85, 0xda, 0x2c, 0x93,
+	0xa9, 0xd0, 0x79, 0x09, 0xd5, 0x1d, 0x29, 0x57, 0x1d, 0xf4, 0xba, 0x03, 0xab, 0x40, 0x8f, 0xa1,
+	0x72, 0x7f, 0x7f, 0xc9, 0xc5, 0xfc, 0xfd, 0x3b, 0x8b, 0x38, 0x5f, 0x09, 0x94, 0x87, 0x5c, 0xf2,
+	0x09, 0xae, 0xf7, 0x5c, 0x22, 0xfb, 0x2e, 0x51, 0x30, 0x3d, 0x2e, 0xf9, 0xe6, 0xee, 0x75, 0xac,
+	0x76, 0x15, 0x64, 0x9b, 0x7b, 0x37, 0x82, 0x4c, 0xdd, 0xb3, 0x9b, 0x22, 0x97, 0xe8, 0xa9, 0x7b,
+	0x56, 0x26, 0x17, 0x59, 0x75, 0x83, 0xf4, 0xe5, 0xbf, 0x30, 0xfa, 0xf5, 0x2b, 0xa8, 0x1f, 0x32,
+	0x68, 0x19, 0x8a, 0x1c, 0x85, 0x55, 0xa0, 0x35, 0x28, 0x73, 0x14, 0x53, 0xdf, 0x0d, 0x2d, 0x72,
+	0xd1, 0xfb, 0xf6, 0xd8, 0x20, 0xdf, 0x1f, 0x1b, 0xe4, 0xe7, 0x63, 0x83, 0x7c, 0xf9, 0xd5, 0x28,
+	0x7c, 0x7c, 0xe1, 0x07, 0x72, 0xbe, 0x9a, 0xb5, 0xdd, 0x38, 0xec, 0x78, 0x7e, 0xca, 0x93, 0xf9,
+	0x9b, 0x20, 0xee, 0xe4, 0xc2, 0x9d, 0xac, 0xdb, 0x49, 0x66, 0xb3, 0x92, 0x7e, 0x07, 0x7a, 0xbf,
+	0x07, 0x00, 0x4a, 0xe9, 0xb8, 0x19, 0x1a, 0x04, 0x00, 0x00,
 }
 
 func (m *KV) Marshal() (dAtA []byte, err error) {
@@ -857,6 +869,11 @@ func (m *DataKey) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.EncryptionAlgo != 0 {
+		i = encodeVarintBadgerpb2(dAtA, i, uint64(m.EncryptionAlgo))
+		i--
+		dAtA[i] = 0x28
+	}
 	if m.CreatedAt != 0 {
 		i = encodeVarintBadgerpb2(dAtA, i, uint64(m.CreatedAt))
 		i--
@@ -1042,6 +1059,9 @@ func (m *DataKey) Size() (n int) {
 	if m.CreatedAt != 0 {
 		n += 1 + sovBadgerpb2(uint64(m.CreatedAt))
 	}
+	if m.EncryptionAlgo != 0 {
+		n += 1 + sovBadgerpb2(uint64(m.EncryptionAlgo))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -1911,6 +1931,25 @@ func (m *DataKey) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field EncryptionAlgo", wireType)
+			}
+			m.EncryptionAlgo = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowBadgerpb2
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.EncryptionAlgo |= EncryptionAlgo(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipBadgerpb2(dAtA[iNdEx:])
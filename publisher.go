@@ -17,34 +17,182 @@
 package badger
 
 import (
+	"expvar"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/dgraph-io/badger/v2/pb"
 	"github.com/dgraph-io/badger/v2/trie"
 	"github.com/dgraph-io/badger/v2/y"
 	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
 )
 
+// subscriberUpdate is either a batch of updates or the notification of a gap, sent to a
+// subscriber.
+type subscriberUpdate struct {
+	list *pb.KVList
+	gap  *SubscriberGap
+}
+
 type subscriber struct {
-	prefixes  [][]byte
-	sendCh    chan<- *pb.KVList
+	id        uint64
+	name      string
+	opt       SubscribeOptions
+	sendCh    chan subscriberUpdate
 	subCloser *z.Closer
+	// withMeta subscribers get the user metadata in KV.UserMeta and the deletion and discard
+	// markers in KV.Meta, like a backup, instead of the user metadata in KV.Meta.
+	withMeta bool
+
+	// done is closed once the subscriber stops listening, so that the publisher never blocks
+	// on it after that.
+	done     chan struct{}
+	stopOnce sync.Once
+	// disconnected is closed, after err is set, when the publisher disconnects the subscriber.
+	disconnected chan struct{}
+	err          error
+
+	// gap accumulates the updates dropped since the last notification. It is guarded by the
+	// publisher lock.
+	gap   *SubscriberGap
+	spill *spillQueue
+
+	// The following fields are accessed atomically.
+	publishedVersion uint64
+	deliveredVersion uint64
+	dropped          uint64
+}
+
+// stop marks the subscriber as done listening. It is safe to call more than once.
+func (s *subscriber) stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		if s.spill != nil {
+			s.spill.close()
+		}
+	})
+}
+
+func (s *subscriber) setDelivered(version uint64) {
+	for {
+		old := atomic.LoadUint64(&s.deliveredVersion)
+		if version <= old || atomic.CompareAndSwapUint64(&s.deliveredVersion, old, version) {
+			return
+		}
+	}
+}
+
+// lag returns the number of commit timestamps between the latest update published to the
+// subscriber and the latest one it has processed.
+func (s *subscriber) lag() uint64 {
+	published := atomic.LoadUint64(&s.publishedVersion)
+	delivered := atomic.LoadUint64(&s.deliveredVersion)
+	if published <= delivered {
+		return 0
+	}
+	return published - delivered
+}
+
+// inRanges returns true if the key falls in one of the key ranges of the subscriber.
+func (s *subscriber) inRanges(key []byte) bool {
+	for _, r := range s.opt.Ranges {
+		if r.contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches applies the filters of the subscriber to a KV with a watched key.
+func (s *subscriber) matches(kv *pb.KV, userMeta byte) bool {
+	if s.opt.UserMetaMask != 0 && userMeta&s.opt.UserMetaMask == 0 {
+		return false
+	}
+	return s.opt.Match == nil || s.opt.Match(kv)
+}
+
+// entryKVs builds the KVs published for an entry, once for each of the formats the
+// subscribers ask for, so that the subscribers asking for the same format share them.
+type entryKVs struct {
+	e          *Entry
+	key, value []byte
+	// kvs is indexed by withMeta | keysOnly<<1.
+	kvs [4]*pb.KV
+}
+
+func (ek *entryKVs) get(withMeta, keysOnly bool) *pb.KV {
+	var i int
+	if withMeta {
+		i |= 1
+	}
+	if keysOnly {
+		i |= 2
+	}
+	if ek.kvs[i] != nil {
+		return ek.kvs[i]
+	}
+	e := ek.e
+	if ek.key == nil {
+		ek.key = y.SafeCopy(nil, y.ParseKey(e.Key))
+	}
+	kv := &pb.KV{
+		Key:       ek.key,
+		ExpiresAt: e.ExpiresAt,
+		Version:   y.ParseTs(e.Key),
+	}
+	if !keysOnly {
+		if ek.value == nil {
+			ek.value = y.SafeCopy(nil, e.Value)
+		}
+		kv.Value = ek.value
+	}
+	if withMeta {
+		kv.UserMeta = []byte{e.UserMeta}
+		kv.Meta = []byte{e.meta & (bitDelete | bitDiscardEarlierVersions)}
+	} else {
+		kv.Meta = []byte{e.UserMeta}
+	}
+	ek.kvs[i] = kv
+	return kv
+}
+
+// pubBatch is a batch of requests handed over to the publisher. If the requests hold merge
+// operands, txn is the transaction their values are read in, taken on the write path.
+type pubBatch struct {
+	reqs requests
+	txn  *Txn
 }
 
 type publisher struct {
 	sync.Mutex
-	pubCh       chan requests
-	subscribers map[uint64]subscriber
-	nextID      uint64
-	indexer     *trie.Trie
+	db          *DB
+	pubCh       chan pubBatch
+	subscribers map[uint64]*subscriber
+	// rangeSubscribers are the subscribers watching key ranges, which are matched against every
+	// key, unlike the prefixes held in the indexer.
+	rangeSubscribers map[uint64]*subscriber
+	nextID           uint64
+	indexer          *trie.Trie
+	// lagPrefix prefixes the names of the subscribers in the badger_v2_subscriber_lag metric,
+	// which is shared by all the DBs of the process.
+	lagPrefix string
 }
 
-func newPublisher() *publisher {
+// numPublishers numbers the publishers of the process, to give each one its own lagPrefix.
+var numPublishers uint64
+
+func newPublisher(db *DB) *publisher {
 	return &publisher{
-		pubCh:       make(chan requests, 1000),
-		subscribers: make(map[uint64]subscriber),
-		nextID:      0,
-		indexer:     trie.NewTrie(),
+		db:               db,
+		lagPrefix:        fmt.Sprintf("db-%d/", atomic.AddUint64(&numPublishers, 1)),
+		pubCh:            make(chan pubBatch, 1000),
+		subscribers:      make(map[uint64]*subscriber),
+		rangeSubscribers: make(map[uint64]*subscriber),
+		nextID:           0,
+		indexer:          trie.NewTrie(),
 	}
 }
 
@@ -53,11 +201,11 @@ func (p *publisher) listenForUpdates(c *z.Closer) {
 		p.cleanSubscribers()
 		c.Done()
 	}()
-	slurp := func(batch requests) {
+	slurp := func(batch []pubBatch) {
 		for {
 			select {
-			case reqs := <-p.pubCh:
-				batch = append(batch, reqs...)
+			case b := <-p.pubCh:
+				batch = append(batch, b)
 			default:
 				p.publishUpdates(batch)
 				return
@@ -68,74 +216,224 @@ func (p *publisher) listenForUpdates(c *z.Closer) {
 		select {
 		case <-c.HasBeenClosed():
 			return
-		case reqs := <-p.pubCh:
-			slurp(reqs)
+		case b := <-p.pubCh:
+			slurp([]pubBatch{b})
 		}
 	}
 }
 
-func (p *publisher) publishUpdates(reqs requests) {
-	p.Lock()
+func (p *publisher) publishUpdates(batches []pubBatch) {
 	defer func() {
-		p.Unlock()
 		// Release all the request.
-		reqs.DecrRef()
+		for _, b := range batches {
+			b.reqs.DecrRef()
+		}
 	}()
-	batchedUpdates := make(map[uint64]*pb.KVList)
-	for _, req := range reqs {
-		for _, e := range req.Entries {
-			ids := p.indexer.Get(e.Key)
-			if len(ids) > 0 {
-				k := y.SafeCopy(nil, e.Key)
-				kv := &pb.KV{
-					Key:       y.ParseKey(k),
-					Value:     y.SafeCopy(nil, e.Value),
-					Meta:      []byte{e.UserMeta},
-					ExpiresAt: e.ExpiresAt,
-					Version:   y.ParseTs(k),
-				}
-				for id := range ids {
-					if _, ok := batchedUpdates[id]; !ok {
-						batchedUpdates[id] = &pb.KVList{}
+	type update struct {
+		ek  *entryKVs
+		ids map[uint64]struct{}
+	}
+	var updates []update
+	p.Lock()
+	for _, b := range batches {
+		for _, req := range b.reqs {
+			for _, e := range req.Entries {
+				ids := p.indexer.Get(e.Key)
+				if len(p.rangeSubscribers) > 0 {
+					key := y.ParseKey(e.Key)
+					for id, s := range p.rangeSubscribers {
+						if s.inRanges(key) {
+							ids[id] = struct{}{}
+						}
 					}
-					batchedUpdates[id].Kv = append(batchedUpdates[id].Kv, kv)
 				}
+				if len(ids) > 0 {
+					updates = append(updates, update{ek: &entryKVs{e: e}, ids: ids})
+				}
+			}
+		}
+	}
+	p.Unlock()
+
+	// The subscribers get the value of the key, rather than the merge operand. The values are
+	// read without holding the lock, in the transactions taken when the requests were written.
+	var txn *Txn
+	for _, b := range batches {
+		if b.txn != nil {
+			txn = b.txn
+			break
+		}
+	}
+	var next int
+	for _, u := range updates {
+		e := u.ek.e
+		if e.meta&bitMergeOperand > 0 {
+			key := y.ParseKey(e.Key)
+			val, err := txn.applyMerge(key, [][]byte{e.Value}, y.ParseTs(e.Key)-1)
+			if err != nil {
+				p.db.opt.Errorf("While merging key %q for the subscribers: %v", key, err)
+				continue
 			}
+			u.ek.value = append([]byte{}, val...)
+		}
+		updates[next] = u
+		next++
+	}
+	updates = updates[:next]
+	for _, b := range batches {
+		if b.txn != nil {
+			b.txn.Discard()
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	batchedUpdates := make(map[uint64]*pb.KVList)
+	for _, u := range updates {
+		for id := range u.ids {
+			// The subscriber may have gone away while the lock wasn't held.
+			s, ok := p.subscribers[id]
+			if !ok {
+				continue
+			}
+			kv := u.ek.get(s.withMeta, false)
+			if !s.matches(kv, u.ek.e.UserMeta) {
+				continue
+			}
+			if s.opt.KeysOnly {
+				kv = u.ek.get(s.withMeta, true)
+			}
+			if _, ok := batchedUpdates[id]; !ok {
+				batchedUpdates[id] = &pb.KVList{}
+			}
+			batchedUpdates[id].Kv = append(batchedUpdates[id].Kv, kv)
 		}
 	}
 
 	for id, kvs := range batchedUpdates {
-		p.subscribers[id].sendCh <- kvs
+		p.send(p.subscribers[id], kvs)
+	}
+}
+
+// send hands the updates over to the subscriber, following its SlowPolicy if it can't take
+// them right away. It must be called with the publisher lock held.
+func (p *publisher) send(s *subscriber, kvs *pb.KVList) {
+	for _, kv := range kvs.Kv {
+		if kv.Version > atomic.LoadUint64(&s.publishedVersion) {
+			atomic.StoreUint64(&s.publishedVersion, kv.Version)
+		}
+	}
+	update := subscriberUpdate{list: kvs}
+	switch s.opt.SlowPolicy {
+	case SpillSlowSubscriber:
+		if err := s.spill.push(kvs); err != nil {
+			p.disconnect(s, errors.Wrapf(err, "while spilling updates of subscriber %s", s.name))
+		}
+	case DropSlowSubscriber:
+		if s.gap != nil {
+			select {
+			case s.sendCh <- subscriberUpdate{gap: s.gap}:
+				s.gap = nil
+			default:
+			}
+		}
+		if s.gap == nil {
+			select {
+			case s.sendCh <- update:
+				return
+			default:
+				s.gap = &SubscriberGap{}
+			}
+		}
+		s.gap.add(kvs)
+		atomic.AddUint64(&s.dropped, uint64(len(kvs.Kv)))
+	case DisconnectSlowSubscriber:
+		select {
+		case s.sendCh <- update:
+		default:
+			p.disconnect(s, ErrSlowSubscriber)
+		}
+	default:
+		select {
+		case s.sendCh <- update:
+		case <-s.done:
+		}
 	}
 }
 
-func (p *publisher) newSubscriber(c *z.Closer, prefixes ...[]byte) (<-chan *pb.KVList, uint64) {
+// disconnect removes the subscriber and makes it return err. It must be called with the
+// publisher lock held.
+func (p *publisher) disconnect(s *subscriber, err error) {
+	if _, ok := p.subscribers[s.id]; !ok {
+		// Already removed.
+		return
+	}
+	p.remove(s)
+	s.err = err
+	close(s.disconnected)
+}
+
+func (p *publisher) newSubscriber(c *z.Closer, opt SubscribeOptions,
+	withMeta bool) (*subscriber, error) {
+	if opt.BufferSize == 0 {
+		opt.BufferSize = 1000
+	}
 	p.Lock()
 	defer p.Unlock()
-	ch := make(chan *pb.KVList, 1000)
 	id := p.nextID
+	s := &subscriber{
+		id:           id,
+		name:         opt.Name,
+		opt:          opt,
+		sendCh:       make(chan subscriberUpdate, opt.BufferSize),
+		subCloser:    c,
+		withMeta:     withMeta,
+		done:         make(chan struct{}),
+		disconnected: make(chan struct{}),
+	}
+	if s.name == "" {
+		s.name = fmt.Sprintf("subscriber-%d", id)
+	}
+	if opt.SlowPolicy == SpillSlowSubscriber {
+		var err error
+		onError := func(err error) {
+			p.Lock()
+			defer p.Unlock()
+			p.disconnect(s, err)
+		}
+		if s.spill, err = newSpillQueue(opt.SpillDir, s.sendCh, s.done, onError); err != nil {
+			return nil, err
+		}
+	}
 	// Increment next ID.
 	p.nextID++
-	p.subscribers[id] = subscriber{
-		prefixes:  prefixes,
-		sendCh:    ch,
-		subCloser: c,
-	}
-	for _, prefix := range prefixes {
+	p.subscribers[id] = s
+	for _, prefix := range opt.Prefixes {
 		p.indexer.Add(prefix, id)
 	}
-	return ch, id
+	if len(opt.Ranges) > 0 {
+		p.rangeSubscribers[id] = s
+	}
+	y.SubscriberLag.Set(p.lagPrefix+s.name, expvar.Func(func() interface{} { return s.lag() }))
+	return s, nil
+}
+
+// remove unregisters the subscriber. It must be called with the publisher lock held.
+func (p *publisher) remove(s *subscriber) {
+	for _, prefix := range s.opt.Prefixes {
+		p.indexer.Delete(prefix, s.id)
+	}
+	delete(p.subscribers, s.id)
+	delete(p.rangeSubscribers, s.id)
+	y.SubscriberLag.Delete(p.lagPrefix + s.name)
 }
 
 // cleanSubscribers stops all the subscribers. Ideally, It should be called while closing DB.
 func (p *publisher) cleanSubscribers() {
 	p.Lock()
 	defer p.Unlock()
-	for id, s := range p.subscribers {
-		for _, prefix := range s.prefixes {
-			p.indexer.Delete(prefix, id)
-		}
-		delete(p.subscribers, id)
+	for _, s := range p.subscribers {
+		p.remove(s)
 		s.subCloser.SignalAndWait()
 	}
 }
@@ -144,18 +442,59 @@ func (p *publisher) deleteSubscriber(id uint64) {
 	p.Lock()
 	defer p.Unlock()
 	if s, ok := p.subscribers[id]; ok {
-		for _, prefix := range s.prefixes {
-			p.indexer.Delete(prefix, id)
+		p.remove(s)
+	}
+}
+
+// stats returns the statistics of all the subscribers.
+func (p *publisher) stats() []SubscriberStats {
+	p.Lock()
+	defer p.Unlock()
+	out := make([]SubscriberStats, 0, len(p.subscribers))
+	for _, s := range p.subscribers {
+		st := SubscriberStats{
+			ID:               s.id,
+			Name:             s.name,
+			SlowPolicy:       s.opt.SlowPolicy,
+			Buffered:         len(s.sendCh),
+			PublishedVersion: atomic.LoadUint64(&s.publishedVersion),
+			DeliveredVersion: atomic.LoadUint64(&s.deliveredVersion),
+			Lag:              s.lag(),
+			Dropped:          atomic.LoadUint64(&s.dropped),
+		}
+		if s.spill != nil {
+			st.Spilled = s.spill.len()
 		}
+		out = append(out, st)
 	}
-	delete(p.subscribers, id)
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
 }
 
+// sendUpdates hands the written requests over to the publisher. It is called on the write path,
+// so that the transaction the merge operands are read in is taken before the versions they apply
+// to could be folded away.
 func (p *publisher) sendUpdates(reqs requests) {
-	if p.noOfSubscribers() != 0 {
-		reqs.IncrRef()
-		p.pubCh <- reqs
+	if p.noOfSubscribers() == 0 {
+		return
+	}
+	reqs.IncrRef()
+	b := pubBatch{reqs: reqs}
+	var minVersion uint64
+	for _, req := range reqs {
+		for _, e := range req.Entries {
+			if e.meta&bitMergeOperand == 0 {
+				continue
+			}
+			if v := y.ParseTs(e.Key); minVersion == 0 || v < minVersion {
+				minVersion = v
+			}
+		}
+	}
+	if minVersion > 0 {
+		b.txn = p.db.mergeReadTxn(minVersion)
 	}
+	p.pubCh <- b
 }
 
 func (p *publisher) noOfSubscribers() int {
@@ -16,14 +16,18 @@
 package badger
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgraph-io/badger/v2/y"
 )
 
 func TestPublisherOrdering(t *testing.T) {
@@ -101,3 +105,286 @@ func TestMultiplePrefix(t *testing.T) {
 		wg.Wait()
 	})
 }
+
+// slowSubscriber subscribes to the "key" prefix with a callback that blocks on its first call
+// until released.
+type slowSubscriber struct {
+	sync.Mutex
+	keys     []string
+	gaps     []SubscriberGap
+	entered  chan struct{}
+	release  chan struct{}
+	finished chan error
+}
+
+func startSlowSubscriber(t *testing.T, ctx context.Context, db *DB,
+	opt SubscribeOptions) *slowSubscriber {
+	s := &slowSubscriber{
+		entered:  make(chan struct{}),
+		release:  make(chan struct{}),
+		finished: make(chan error, 1),
+	}
+	first := true
+	opt.Prefixes = [][]byte{[]byte("key")}
+	opt.BufferSize = 1
+	if opt.SlowPolicy == DropSlowSubscriber {
+		opt.OnGap = func(gap SubscriberGap) error {
+			s.Lock()
+			defer s.Unlock()
+			s.gaps = append(s.gaps, gap)
+			return nil
+		}
+	}
+	go func() {
+		s.finished <- db.SubscribeWith(ctx, opt, func(kvs *pb.KVList) error {
+			if first {
+				first = false
+				close(s.entered)
+				<-s.release
+			}
+			s.Lock()
+			defer s.Unlock()
+			for _, kv := range kvs.Kv {
+				s.keys = append(s.keys, string(kv.Key))
+			}
+			return nil
+		})
+	}()
+	for len(db.SubscriberStats()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return s
+}
+
+func (s *slowSubscriber) numKeys() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.keys)
+}
+
+func writeKeys(t *testing.T, db *DB, start, end int) {
+	for i := start; i < end; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%03d", i)), []byte("value"), 0)
+	}
+}
+
+func TestSlowSubscriberSpill(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		ctx, cancel := context.WithCancel(context.Background())
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+		s := startSlowSubscriber(t, ctx, db, SubscribeOptions{
+			Name:       "spill",
+			SlowPolicy: SpillSlowSubscriber,
+			SpillDir:   dir,
+		})
+
+		writeKeys(t, db, 0, 1)
+		<-s.entered
+		writeKeys(t, db, 1, 200)
+		stats := db.SubscriberStats()
+		require.Len(t, stats, 1)
+		require.Equal(t, "spill", stats[0].Name)
+		require.NotZero(t, stats[0].Spilled)
+		require.NotZero(t, stats[0].Lag)
+		require.NotNil(t, y.SubscriberLag.Get(db.pub.lagPrefix+"spill"))
+
+		close(s.release)
+		for i := 0; i < 500 && s.numKeys() < 200; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// All the updates are delivered, in order.
+		require.Equal(t, 200, s.numKeys())
+		s.Lock()
+		for i, key := range s.keys {
+			require.Equal(t, fmt.Sprintf("key%03d", i), key)
+		}
+		s.Unlock()
+		for i := 0; i < 500 && db.SubscriberStats()[0].Lag > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.Zero(t, db.SubscriberStats()[0].Lag)
+
+		cancel()
+		require.Equal(t, context.Canceled, <-s.finished)
+		require.Nil(t, y.SubscriberLag.Get(db.pub.lagPrefix+"spill"))
+		// The spill file is removed.
+		for i := 0; i < 100; i++ {
+			if files, _ := ioutil.ReadDir(dir); len(files) == 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, files)
+	})
+}
+
+func TestSlowSubscriberDrop(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := startSlowSubscriber(t, ctx, db, SubscribeOptions{SlowPolicy: DropSlowSubscriber})
+
+		writeKeys(t, db, 0, 1)
+		<-s.entered
+		writeKeys(t, db, 1, 100)
+
+		close(s.release)
+		// The gap is notified along with the next update.
+		writeKeys(t, db, 100, 101)
+		for i := 0; i < 500; i++ {
+			s.Lock()
+			done := len(s.keys) > 0 && s.keys[len(s.keys)-1] == "key100"
+			s.Unlock()
+			if done {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		stats := db.SubscriberStats()
+		s.Lock()
+		defer s.Unlock()
+		require.Equal(t, "key100", s.keys[len(s.keys)-1])
+		require.Len(t, s.gaps, 1)
+		require.NotZero(t, s.gaps[0].Count)
+		require.Equal(t, stats[0].Dropped, s.gaps[0].Count)
+		// Every update is either delivered or accounted for in the gap.
+		require.Equal(t, 101, len(s.keys)+int(s.gaps[0].Count))
+		require.True(t, s.gaps[0].MinVersion <= s.gaps[0].MaxVersion)
+	})
+}
+
+func TestSlowSubscriberDisconnect(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		s := startSlowSubscriber(t, context.Background(), db,
+			SubscribeOptions{SlowPolicy: DisconnectSlowSubscriber})
+
+		writeKeys(t, db, 0, 1)
+		<-s.entered
+		// Writes don't block on the subscriber.
+		writeKeys(t, db, 1, 100)
+		close(s.release)
+		require.Equal(t, ErrSlowSubscriber, <-s.finished)
+		require.Empty(t, db.SubscriberStats())
+	})
+}
+
+func TestSubscribeWithInvalidOptions(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		cb := func(kvs *pb.KVList) error { return nil }
+		require.Error(t, db.SubscribeWith(context.Background(),
+			SubscribeOptions{SlowPolicy: DropSlowSubscriber}, cb))
+		require.Error(t, db.SubscribeWith(context.Background(),
+			SubscribeOptions{BufferSize: -1}, cb))
+		require.Equal(t, ErrNilCallback,
+			db.SubscribeWith(context.Background(), SubscribeOptions{}, nil))
+	})
+}
+
+func TestSubscribeFilters(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		got := make(map[string][]string)
+		subscribe := func(name string, opt SubscribeOptions) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := db.SubscribeWith(ctx, opt, func(kvs *pb.KVList) error {
+					mu.Lock()
+					defer mu.Unlock()
+					for _, kv := range kvs.Kv {
+						got[name] = append(got[name], fmt.Sprintf("%s=%s", kv.Key, kv.Value))
+					}
+					return nil
+				})
+				require.Equal(t, context.Canceled, err)
+			}()
+		}
+		subscribe("range", SubscribeOptions{
+			Ranges:   []KeyRange{{Start: []byte("b"), End: []byte("d")}, {Start: []byte("x")}},
+			KeysOnly: true,
+		})
+		subscribe("meta", SubscribeOptions{Prefixes: [][]byte{nil}, UserMetaMask: 0x2})
+		subscribe("match", SubscribeOptions{
+			Prefixes: [][]byte{nil},
+			Match:    func(kv *pb.KV) bool { return bytes.HasPrefix(kv.Value, []byte("big")) },
+		})
+		for len(db.SubscriberStats()) < 3 {
+			time.Sleep(time.Millisecond)
+		}
+
+		big := "big" + string(bytes.Repeat([]byte("v"), 1<<10))
+		for _, e := range []*Entry{
+			NewEntry([]byte("a"), []byte("1")).WithMeta(0x2),
+			NewEntry([]byte("b"), []byte(big)),
+			NewEntry([]byte("c"), []byte("3")).WithMeta(0x3),
+			NewEntry([]byte("d"), []byte("4")),
+			NewEntry([]byte("y"), []byte("5")).WithMeta(0x4),
+		} {
+			require.NoError(t, db.Update(func(txn *Txn) error { return txn.SetEntry(e) }))
+		}
+
+		expected := map[string][]string{
+			"range": {"b=", "c=", "y="},
+			"meta":  {"a=1", "c=3"},
+			"match": {"b=" + big},
+		}
+		for i := 0; i < 500; i++ {
+			mu.Lock()
+			n := len(got["range"]) + len(got["meta"]) + len(got["match"])
+			mu.Unlock()
+			if n >= 6 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+		wg.Wait()
+		require.Equal(t, expected, got)
+
+		require.Error(t, db.SubscribeWith(context.Background(), SubscribeOptions{
+			Ranges: []KeyRange{{Start: []byte("d"), End: []byte("b")}},
+		}, func(kvs *pb.KVList) error { return nil }))
+	})
+}
+
+func TestSubscriberLagPerDB(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db1 *DB) {
+		runBadgerTest(t, nil, func(t *testing.T, db2 *DB) {
+			require.NotEqual(t, db1.pub.lagPrefix, db2.pub.lagPrefix)
+			subscribe := func(db *DB) (context.CancelFunc, chan error) {
+				ctx, cancel := context.WithCancel(context.Background())
+				errCh := make(chan error, 1)
+				go func() {
+					errCh <- db.SubscribeWith(ctx, SubscribeOptions{Prefixes: [][]byte{nil}},
+						func(kvs *KVList) error { return nil })
+				}()
+				for i := 0; i < 100 && len(db.SubscriberStats()) == 0; i++ {
+					time.Sleep(10 * time.Millisecond)
+				}
+				require.Len(t, db.SubscriberStats(), 1)
+				return cancel, errCh
+			}
+			cancel1, errCh1 := subscribe(db1)
+			cancel2, errCh2 := subscribe(db2)
+			defer func() {
+				cancel2()
+				<-errCh2
+			}()
+			// Both DBs name their first subscriber subscriber-0.
+			require.NotNil(t, y.SubscriberLag.Get(db1.pub.lagPrefix+"subscriber-0"))
+			require.NotNil(t, y.SubscriberLag.Get(db2.pub.lagPrefix+"subscriber-0"))
+
+			cancel1()
+			require.Equal(t, context.Canceled, <-errCh1)
+			require.Nil(t, y.SubscriberLag.Get(db1.pub.lagPrefix+"subscriber-0"))
+			require.NotNil(t, y.SubscriberLag.Get(db2.pub.lagPrefix+"subscriber-0"))
+		})
+	})
+}
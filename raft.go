@@ -0,0 +1,225 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/pkg/errors"
+)
+
+// appliedIndexKey holds the index of the last log entry applied to the DB by a replicated state
+// machine, like a Raft group.
+var appliedIndexKey = append(append([]byte{}, badgerPrefix...), "applied-index"...)
+
+func appliedIndexEntry(index uint64) *Entry {
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, index)
+	return &Entry{Key: appliedIndexKey, Value: val}
+}
+
+// SetAppliedIndex records that the writes made so far by the WriteBatch apply the log entries up
+// to the given index. Every transaction the batch commits from then on also stores the latest
+// index set, so LastAppliedIndex only returns an index once all the writes made before it was set
+// have been committed, even if the batch is split into several transactions. The writes of a log
+// entry should be made before setting its index, and the entries after LastAppliedIndex should be
+// applied again on restart, since a transaction can hold some of the writes of the next entry.
+//
+// In a batch created by NewManagedWriteBatch, the index is written at the highest version set by
+// the batch, and these versions must grow with the index.
+func (wb *WriteBatch) SetAppliedIndex(index uint64) error {
+	wb.Lock()
+	defer wb.Unlock()
+	if wb.err != nil {
+		return wb.err
+	}
+	if wb.finished {
+		return y.ErrCommitAfterFinish
+	}
+	wb.appliedIndex = index
+	if wb.hasAppliedIndex {
+		return nil
+	}
+	wb.hasAppliedIndex = true
+	if err := wb.addAppliedIndex(); err != ErrTxnTooBig {
+		return err
+	}
+	// The writes of the full txn are committed without the index, which is added to the next one.
+	return wb.commit()
+}
+
+// addAppliedIndex adds the entry of the applied index to the open transaction. Should be called
+// with lock acquired.
+func (wb *WriteBatch) addAppliedIndex() error {
+	e := appliedIndexEntry(0)
+	if err := wb.txn.addEntries(e); err != nil {
+		return err
+	}
+	wb.indexEntry = e
+	return nil
+}
+
+// setAppliedIndex sets the value of the applied index entry of the open transaction, before it is
+// committed. Should be called with lock acquired.
+func (wb *WriteBatch) setAppliedIndex() {
+	e := wb.indexEntry
+	if e == nil {
+		return
+	}
+	binary.BigEndian.PutUint64(e.Value, wb.appliedIndex)
+	if wb.isManaged && wb.commitTs == 0 {
+		e.version = wb.maxVersion
+	}
+}
+
+// LastAppliedIndex returns the index stored by the last WriteBatch flushed with SetAppliedIndex,
+// or installed with a snapshot by StreamWriter.SetAppliedIndex. It is zero if no index has been
+// stored yet.
+func (db *DB) LastAppliedIndex() (uint64, error) {
+	var index uint64
+	err := db.View(func(txn *Txn) error {
+		item, err := txn.Get(appliedIndexKey)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) != 8 {
+				return errors.New("Invalid applied index")
+			}
+			index = binary.BigEndian.Uint64(val)
+			return nil
+		})
+	})
+	return index, err
+}
+
+// Snapshot is a consistent view of the DB, tagged with the applied index stored as of that view.
+// It can be sent to another DB with the Stream returned by NewStream, and installed there with a
+// StreamWriter, calling StreamWriter.SetAppliedIndex with Index before Flush.
+type Snapshot struct {
+	// Index is the applied index of the DB as of the snapshot. See LastAppliedIndex.
+	Index uint64
+	// ReadTs is the read timestamp of the snapshot.
+	ReadTs uint64
+
+	txn *Txn
+}
+
+// NewSnapshot takes a snapshot of the DB. The versions it reads are kept around until Discard is
+// called, so Discard must be called once the snapshot has been streamed.
+func (db *DB) NewSnapshot() (*Snapshot, error) {
+	if db.opt.managedTxns {
+		panic("This API can not be called in managed mode.")
+	}
+	return db.newSnapshot(db.NewTransaction(false))
+}
+
+// NewSnapshotAt takes a snapshot of the DB at the given read timestamp. Should only be used with
+// managed DB. Like for NewStreamAt, the caller must keep the versions visible at readTs until the
+// snapshot has been streamed.
+func (db *DB) NewSnapshotAt(readTs uint64) (*Snapshot, error) {
+	if !db.opt.managedTxns {
+		panic("This API can only be called in managed mode.")
+	}
+	return db.newSnapshot(db.NewTransactionAt(readTs, false))
+}
+
+func (db *DB) newSnapshot(txn *Txn) (*Snapshot, error) {
+	s := &Snapshot{ReadTs: txn.readTs, txn: txn}
+	item, err := txn.Get(appliedIndexKey)
+	switch {
+	case err == ErrKeyNotFound:
+		return s, nil
+	case err != nil:
+		txn.Discard()
+		return nil, err
+	}
+	err = item.Value(func(val []byte) error {
+		if len(val) != 8 {
+			return errors.New("Invalid applied index")
+		}
+		s.Index = binary.BigEndian.Uint64(val)
+		return nil
+	})
+	if err != nil {
+		txn.Discard()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewStream creates a Stream over the snapshot. The internal keys of Badger, including the applied
+// index, aren't streamed.
+func (s *Snapshot) NewStream() *Stream {
+	stream := s.txn.db.newStream()
+	stream.readTs = s.ReadTs
+	stream.txn = s.txn
+	stream.LogPrefix = "Badger.Snapshot"
+	return stream
+}
+
+// Discard releases the snapshot. Its streams must be done.
+func (s *Snapshot) Discard() {
+	s.txn.Discard()
+}
+
+// SetAppliedIndex sets the applied index stored by Flush, once the streamed data has been
+// installed, so that LastAppliedIndex returns the index of the installed snapshot. It is not
+// supported with PrepareIncremental.
+func (sw *StreamWriter) SetAppliedIndex(index uint64) error {
+	sw.writeLock.Lock()
+	defer sw.writeLock.Unlock()
+	if sw.incremental {
+		return errors.New("Cannot set the applied index of an incremental StreamWriter")
+	}
+	sw.appliedIndex = index
+	sw.hasAppliedIndex = true
+	return nil
+}
+
+// writeAppliedIndex stores the applied index set on the StreamWriter, after Flush has installed
+// the streamed data.
+func (sw *StreamWriter) writeAppliedIndex() error {
+	if !sw.hasAppliedIndex {
+		return nil
+	}
+	e := appliedIndexEntry(sw.appliedIndex)
+	if !sw.db.opt.managedTxns {
+		txn := sw.db.NewTransaction(true)
+		defer txn.Discard()
+		if err := txn.addEntries(e); err != nil {
+			return err
+		}
+		return txn.Commit()
+	}
+	// Write the index at the highest streamed version, so that it's visible along with the data.
+	ts := sw.maxVersion
+	if ts == 0 {
+		ts = 1
+	}
+	txn := sw.db.NewTransactionAt(math.MaxUint64, true)
+	defer txn.Discard()
+	if err := txn.addEntries(e); err != nil {
+		return err
+	}
+	return txn.CommitAt(ts, nil)
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBatchAppliedIndex(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		index, err := db.LastAppliedIndex()
+		require.NoError(t, err)
+		require.Zero(t, index)
+
+		for i := 1; i <= 3; i++ {
+			wb := db.NewWriteBatch()
+			for j := 0; j < 100; j++ {
+				require.NoError(t, wb.Set([]byte(fmt.Sprintf("key-%d-%d", i, j)), []byte("val")))
+			}
+			require.NoError(t, wb.SetAppliedIndex(uint64(i*10)))
+			require.NoError(t, wb.Flush())
+
+			index, err = db.LastAppliedIndex()
+			require.NoError(t, err)
+			require.Equal(t, uint64(i*10), index)
+		}
+
+		// A batch without an index leaves the last one.
+		wb := db.NewWriteBatch()
+		require.NoError(t, wb.Set([]byte("other"), []byte("val")))
+		require.NoError(t, wb.Flush())
+		index, err = db.LastAppliedIndex()
+		require.NoError(t, err)
+		require.Equal(t, uint64(30), index)
+
+		// The index isn't visible to the iterators.
+		require.NoError(t, db.View(func(txn *Txn) error {
+			itr := txn.NewIterator(DefaultIteratorOptions)
+			defer itr.Close()
+			count := 0
+			for itr.Rewind(); itr.Valid(); itr.Next() {
+				count++
+			}
+			require.Equal(t, 301, count)
+			return nil
+		}))
+	})
+}
+
+func TestWriteBatchAppliedIndexSplit(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		const numEntries, keysPerEntry = 500, 10
+		key := func(i, j int) []byte { return []byte(fmt.Sprintf("key-%03d-%d", i, j)) }
+		// check returns the applied index, and checks that all the writes before it are there.
+		check := func() uint64 {
+			var index uint64
+			require.NoError(t, db.View(func(txn *Txn) error {
+				item, err := txn.Get(appliedIndexKey)
+				if err == ErrKeyNotFound {
+					return nil
+				}
+				require.NoError(t, err)
+				val, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				index = binary.BigEndian.Uint64(val)
+				for i := 1; i <= int(index); i++ {
+					for j := 0; j < keysPerEntry; j++ {
+						_, err := txn.Get(key(i, j))
+						require.NoError(t, err)
+					}
+				}
+				return nil
+			}))
+			return index
+		}
+
+		wb := db.NewWriteBatch()
+		for i := 1; i <= numEntries; i++ {
+			for j := 0; j < keysPerEntry; j++ {
+				require.NoError(t, wb.Set(key(i, j), []byte("val")))
+			}
+			require.NoError(t, wb.SetAppliedIndex(uint64(i)))
+		}
+		// The batch is split into many transactions, which all store the index applied as of
+		// their commit.
+		var index uint64
+		for i := 0; i < 500 && index == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+			index = check()
+		}
+		require.True(t, index > 0 && index < numEntries)
+		require.NoError(t, wb.Flush())
+		require.Equal(t, uint64(numEntries), check())
+	})
+}
+
+func TestManagedWriteBatchAppliedIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	db, err := OpenManaged(getTestOptions(dir))
+	require.NoError(t, err)
+	defer db.Close()
+
+	wb := db.NewWriteBatchAt(5)
+	require.NoError(t, wb.Set([]byte("a"), []byte("a")))
+	require.NoError(t, wb.SetAppliedIndex(7))
+	require.NoError(t, wb.Flush())
+
+	wb = db.NewManagedWriteBatch()
+	require.NoError(t, wb.SetEntryAt(NewEntry([]byte("b"), []byte("b")), 8))
+	require.NoError(t, wb.SetAppliedIndex(9))
+	require.NoError(t, wb.Flush())
+
+	index, err := db.LastAppliedIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), index)
+}
+
+func TestSnapshotInstall(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		wb := db.NewWriteBatch()
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, wb.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte("old")))
+		}
+		require.NoError(t, wb.SetAppliedIndex(42))
+		require.NoError(t, wb.Flush())
+
+		snap, err := db.NewSnapshot()
+		require.NoError(t, err)
+		defer snap.Discard()
+		require.Equal(t, uint64(42), snap.Index)
+
+		// The writes after the snapshot aren't part of it.
+		wb = db.NewWriteBatch()
+		require.NoError(t, wb.Set([]byte("key-0000"), []byte("new")))
+		require.NoError(t, wb.SetAppliedIndex(43))
+		require.NoError(t, wb.Flush())
+
+		runBadgerTest(t, nil, func(t *testing.T, out *DB) {
+			sw := out.NewStreamWriter()
+			require.NoError(t, sw.Prepare())
+			stream := snap.NewStream()
+			stream.Send = func(list *pb.KVList) error {
+				return sw.Write(list)
+			}
+			require.NoError(t, stream.Orchestrate(context.Background()))
+			require.NoError(t, sw.SetAppliedIndex(snap.Index))
+			require.NoError(t, sw.Flush())
+
+			index, err := out.LastAppliedIndex()
+			require.NoError(t, err)
+			require.Equal(t, uint64(42), index)
+
+			require.NoError(t, out.View(func(txn *Txn) error {
+				itr := txn.NewIterator(DefaultIteratorOptions)
+				defer itr.Close()
+				count := 0
+				for itr.Rewind(); itr.Valid(); itr.Next() {
+					val, err := itr.Item().ValueCopy(nil)
+					require.NoError(t, err)
+					require.Equal(t, "old", string(val))
+					count++
+				}
+				require.Equal(t, 1000, count)
+				return nil
+			}))
+
+			// The follower keeps applying from the installed index.
+			wb := out.NewWriteBatch()
+			require.NoError(t, wb.Set([]byte("key-0000"), []byte("new")))
+			require.NoError(t, wb.SetAppliedIndex(43))
+			require.NoError(t, wb.Flush())
+			index, err = out.LastAppliedIndex()
+			require.NoError(t, err)
+			require.Equal(t, uint64(43), index)
+		})
+	})
+}
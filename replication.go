@@ -0,0 +1,523 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/pkg/errors"
+)
+
+// ReplicationConn is an ordered and reliable channel of messages between a primary and one of
+// its followers, like a TCP connection or a gRPC stream. The messages are opaque to the
+// transport, which must deliver each of them whole, in the order they were sent.
+type ReplicationConn interface {
+	// Send sends a message. The message isn't modified after Send returns, so the transport can
+	// keep it.
+	Send(msg []byte) error
+	// Recv blocks until a message is received. It returns io.EOF once the other end has closed
+	// the connection.
+	Recv() ([]byte, error)
+	// Close closes the connection, and unblocks Send and Recv.
+	Close() error
+}
+
+// ReplicationTransport connects the followers to a primary.
+type ReplicationTransport interface {
+	// Accept waits for the next follower to connect. It is called by the primary.
+	Accept(ctx context.Context) (ReplicationConn, error)
+	// Dial connects to the primary. It is called by the followers.
+	Dial(ctx context.Context) (ReplicationConn, error)
+}
+
+// The messages of the replication protocol. Each message starts with its type, followed by a
+// timestamp as a uvarint, and by a marshaled KVList for the messages carrying KVs.
+//
+// The follower starts with a hello carrying the commit timestamp it has replicated up to. The
+// primary answers with either a snapshot, for a follower which has never been replicated, or the
+// changes committed since that timestamp, both as of a snapshot of the DB. It marks the end of
+// the catch-up with the read timestamp of that snapshot, and then ships the batches committed
+// after it, as they are written.
+const (
+	replHello byte = iota + 1
+	replSnapshot
+	replCatchUp
+	replCaughtUp
+	replBatch
+)
+
+type replMsg struct {
+	typ  byte
+	ts   uint64
+	list *pb.KVList
+}
+
+func (m replMsg) encode() ([]byte, error) {
+	buf := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+m.list.Size())
+	buf[0] = m.typ
+	buf = buf[:1+binary.PutUvarint(buf[1:], m.ts)]
+	if m.list == nil {
+		return buf, nil
+	}
+	data, err := m.list.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, data...), nil
+}
+
+func decodeReplMsg(data []byte) (replMsg, error) {
+	var m replMsg
+	if len(data) == 0 || data[0] < replHello || data[0] > replBatch {
+		return m, errors.New("Invalid replication message")
+	}
+	m.typ = data[0]
+	ts, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return m, errors.New("Invalid replication message")
+	}
+	m.ts = ts
+	switch m.typ {
+	case replSnapshot, replCatchUp, replBatch:
+		m.list = &pb.KVList{}
+		if err := m.list.Unmarshal(data[1+n:]); err != nil {
+			return m, errors.Wrap(err, "while decoding replication message")
+		}
+	}
+	return m, nil
+}
+
+// ServeFollowers ships the writes of the DB to the followers connecting through the transport,
+// until ctx is done. Each follower first catches up, through a Stream over a snapshot of the DB,
+// and then gets the batches committed after that snapshot, as they go through the write
+// pipeline.
+//
+// A follower that can't keep up with the writes is disconnected, like a subscriber with the
+// DisconnectSlowSubscriber policy, and catches up again when it reconnects. The catch-up can only
+// ship the versions that compactions haven't discarded yet, so a follower that stays
+// disconnected for long could miss deletions, and should be rebuilt from an empty directory.
+//
+// The keys with the !badger! prefix aren't replicated. ServeFollowers is not supported in
+// managed mode.
+func (db *DB) ServeFollowers(ctx context.Context, t ReplicationTransport) error {
+	if db.opt.managedTxns {
+		return ErrManagedTxn
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := t.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "while accepting a follower")
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.serveFollower(ctx, conn); err != nil && ctx.Err() == nil {
+				db.opt.Warningf("Replication to a follower stopped: %v", err)
+			}
+		}()
+	}
+}
+
+func (db *DB) serveFollower(ctx context.Context, conn ReplicationConn) error {
+	defer conn.Close()
+
+	data, err := conn.Recv()
+	if err != nil {
+		return err
+	}
+	hello, err := decodeReplMsg(data)
+	if err != nil {
+		return err
+	}
+	if hello.typ != replHello {
+		return errors.Errorf("Unexpected replication message of type %d", hello.typ)
+	}
+
+	// The follower doesn't send anything after the hello, so Recv only returns once it is gone.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		_, _ = conn.Recv()
+		cancel()
+	}()
+
+	send := func(typ byte, ts uint64, list *pb.KVList) error {
+		data, err := replMsg{typ: typ, ts: ts, list: list}.encode()
+		if err != nil {
+			return err
+		}
+		return conn.Send(data)
+	}
+	catchUp := func() (uint64, error) {
+		readTs, err := db.replicationCatchUp(ctx, hello.ts, send)
+		if err != nil {
+			return 0, err
+		}
+		return readTs, send(replCaughtUp, readTs, nil)
+	}
+	opt := SubscribeOptions{
+		Prefixes:   [][]byte{nil},
+		SlowPolicy: DisconnectSlowSubscriber,
+	}
+	err = db.subscribeAfter(ctx, opt, hello.ts, catchUp, func(list *KVList) error {
+		return send(replBatch, 0, list)
+	}, nil)
+	if err == context.Canceled {
+		// The follower is gone, or ServeFollowers is done.
+		return nil
+	}
+	return err
+}
+
+// replicationCatchUp sends to a follower the changes committed after sinceTs, as of a new
+// snapshot of the DB, or the whole snapshot if sinceTs is zero. It returns the read timestamp of
+// the snapshot.
+func (db *DB) replicationCatchUp(ctx context.Context, sinceTs uint64,
+	send func(typ byte, ts uint64, list *pb.KVList) error) (uint64, error) {
+	// Like in catchUp, the transaction keeps the versions of the snapshot around.
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	readTs := txn.readTs
+	if sinceTs > readTs {
+		return 0, errors.Errorf("Follower is at timestamp %d, ahead of the primary at %d",
+			sinceTs, readTs)
+	}
+
+	typ := replCatchUp
+	if sinceTs == 0 {
+		typ = replSnapshot
+	}
+	stream := db.NewStream()
+	stream.SinceTs = sinceTs
+	stream.LogPrefix = "Replication"
+	stream.KeyToList = func(key []byte, itr *Iterator) (*pb.KVList, error) {
+		return keyChanges(key, itr, sinceTs, readTs)
+	}
+	stream.Send = func(list *pb.KVList) error {
+		// The snapshot keeps the stream ids, for the StreamWriter of the follower.
+		out := &pb.KVList{Kv: make([]*pb.KV, 0, len(list.Kv))}
+		for _, kv := range list.Kv {
+			if !kv.StreamDone {
+				out.Kv = append(out.Kv, kv)
+			}
+		}
+		if len(out.Kv) == 0 {
+			return nil
+		}
+		return send(typ, 0, out)
+	}
+	if err := stream.Orchestrate(ctx); err != nil {
+		return 0, err
+	}
+	return readTs, nil
+}
+
+// replicatedTsKey holds the commit timestamp a follower has replicated up to.
+var replicatedTsKey = append(append([]byte{}, badgerPrefix...), "replicated-ts"...)
+
+func replicatedTsEntry(ts uint64) *Entry {
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, ts)
+	return &Entry{Key: replicatedTsKey, Value: val}
+}
+
+// ReplicatedTs returns the commit timestamp of the primary a follower has replicated up to. The
+// follower holds a consistent copy of the primary as of that timestamp, so the reads on the
+// follower should use it as their read timestamp. It is zero if the DB has never been
+// replicated.
+func (db *DB) ReplicatedTs() (uint64, error) {
+	var ts uint64
+	txn := db.newTransaction(false, true)
+	txn.readTs = math.MaxUint64
+	defer txn.Discard()
+	item, err := txn.Get(replicatedTsKey)
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	err = item.Value(func(val []byte) error {
+		if len(val) != 8 {
+			return errors.New("Invalid replicated timestamp")
+		}
+		ts = binary.BigEndian.Uint64(val)
+		return nil
+	})
+	return ts, err
+}
+
+// FollowPrimary replicates into the DB the writes of the primary reachable through the
+// transport, until ctx is done or the connection fails. The follower must be opened with
+// OpenManaged, and the writes keep the commit timestamps of the primary: the batches committed
+// on the primary are applied with Txn.CommitAt. See ReplicatedTs for reading from a follower.
+//
+// The follower resumes from ReplicatedTs, so FollowPrimary can be called again after it returns
+// to reconnect. A follower which has never been replicated first gets a snapshot of the primary,
+// written with a StreamWriter, which deletes all the data in the DB. Only the primary should
+// write to the follower.
+func (db *DB) FollowPrimary(ctx context.Context, t ReplicationTransport) error {
+	if !db.opt.managedTxns {
+		return ErrFollowerNotManaged
+	}
+	sinceTs, err := db.ReplicatedTs()
+	if err != nil {
+		return err
+	}
+
+	conn, err := t.Dial(ctx)
+	if err != nil {
+		return errors.Wrap(err, "while connecting to the primary")
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	data, err := replMsg{typ: replHello, ts: sinceTs}.encode()
+	if err != nil {
+		return err
+	}
+	if err := conn.Send(data); err != nil {
+		return err
+	}
+
+	f := &follower{db: db}
+	defer f.cancel()
+	if sinceTs == 0 {
+		f.sw = db.NewStreamWriter()
+		if err := f.sw.Prepare(); err != nil {
+			f.sw = nil
+			return err
+		}
+	}
+	for {
+		data, err := conn.Recv()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == io.EOF {
+			return errors.New("Primary closed the replication connection")
+		}
+		if err != nil {
+			return err
+		}
+		m, err := decodeReplMsg(data)
+		if err != nil {
+			return err
+		}
+		if err := f.handle(m); err != nil {
+			return err
+		}
+	}
+}
+
+// follower applies the replication messages to the DB.
+type follower struct {
+	db *DB
+	// sw writes the snapshot, and wb the changes of the catch-up.
+	sw *StreamWriter
+	wb *WriteBatch
+}
+
+func (f *follower) handle(m replMsg) error {
+	switch m.typ {
+	case replSnapshot:
+		if f.sw == nil {
+			return errors.New("Unexpected replication snapshot")
+		}
+		return f.sw.Write(m.list)
+	case replCatchUp:
+		if f.wb == nil {
+			f.wb = f.db.NewManagedWriteBatch()
+		}
+		for _, kv := range m.list.Kv {
+			if err := f.wb.SetEntryAt(replicatedEntry(kv), kv.Version); err != nil {
+				return err
+			}
+		}
+		return nil
+	case replCaughtUp:
+		if f.sw != nil {
+			sw := f.sw
+			f.sw = nil
+			if err := sw.Flush(); err != nil {
+				return err
+			}
+		}
+		if f.wb != nil {
+			wb := f.wb
+			f.wb = nil
+			if err := wb.Flush(); err != nil {
+				return err
+			}
+		}
+		txn := f.db.NewTransactionAt(math.MaxUint64, true)
+		defer txn.Discard()
+		if err := txn.addEntries(replicatedTsEntry(m.ts)); err != nil {
+			return err
+		}
+		return txn.CommitAt(m.ts, nil)
+	case replBatch:
+		return f.applyBatch(m.list)
+	default:
+		return errors.Errorf("Unexpected replication message of type %d", m.typ)
+	}
+}
+
+// applyBatch commits the KVs of each commit timestamp of the primary, in order, along with the
+// new replicated timestamp.
+func (f *follower) applyBatch(list *pb.KVList) error {
+	throttle := y.NewThrottle(16)
+	for i := 0; i < len(list.Kv); {
+		version := list.Kv[i].Version
+		txn := f.db.NewTransactionAt(math.MaxUint64, true)
+		for ; i < len(list.Kv) && list.Kv[i].Version == version; i++ {
+			if err := txn.modify(replicatedEntry(list.Kv[i])); err != nil {
+				txn.Discard()
+				_ = throttle.Finish()
+				return err
+			}
+		}
+		if err := txn.addEntries(replicatedTsEntry(version)); err != nil {
+			txn.Discard()
+			_ = throttle.Finish()
+			return err
+		}
+		if err := throttle.Do(); err != nil {
+			txn.Discard()
+			_ = throttle.Finish()
+			return err
+		}
+		// The commits go through the write pipeline in order, so a crash can't leave the
+		// replicated timestamp past a missing commit.
+		if err := txn.CommitAt(version, throttle.Done); err != nil {
+			return err
+		}
+	}
+	return throttle.Finish()
+}
+
+// cancel releases the catch-up left unfinished by a failed connection. A partial snapshot is
+// flushed, so that the DB accepts writes again, and is deleted by the next snapshot.
+func (f *follower) cancel() {
+	if f.sw != nil {
+		if err := f.sw.Flush(); err != nil {
+			f.db.opt.Warningf("While flushing a partial replication snapshot: %v", err)
+		}
+	}
+	if f.wb != nil {
+		f.wb.Cancel()
+	}
+}
+
+// replicatedEntry converts a KV shipped by the primary into an entry. The primary ships the merge
+// operands as the values they result in, so the follower doesn't need the MergeFunc.
+func replicatedEntry(kv *pb.KV) *Entry {
+	e := &Entry{Key: kv.Key, Value: kv.Value, ExpiresAt: kv.ExpiresAt}
+	if len(kv.UserMeta) > 0 {
+		e.UserMeta = kv.UserMeta[0]
+	}
+	if len(kv.Meta) > 0 {
+		e.meta = kv.Meta[0] & (bitDelete | bitDiscardEarlierVersions)
+	}
+	return e
+}
+
+// NewLoopbackTransport returns a ReplicationTransport connecting a primary to followers opened in
+// the same process, like for tests or for replicas of a DB on another disk.
+func NewLoopbackTransport() ReplicationTransport {
+	return &loopbackTransport{conns: make(chan ReplicationConn)}
+}
+
+type loopbackTransport struct {
+	conns chan ReplicationConn
+}
+
+func (t *loopbackTransport) Accept(ctx context.Context) (ReplicationConn, error) {
+	select {
+	case conn := <-t.conns:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *loopbackTransport) Dial(ctx context.Context) (ReplicationConn, error) {
+	var (
+		toPrimary  = make(chan []byte, 16)
+		toFollower = make(chan []byte, 16)
+		closed     = make(chan struct{})
+		once       = &sync.Once{}
+	)
+	primary := &loopbackConn{in: toPrimary, out: toFollower, closed: closed, once: once}
+	follower := &loopbackConn{in: toFollower, out: toPrimary, closed: closed, once: once}
+	select {
+	case t.conns <- primary:
+		return follower, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// loopbackConn is one end of a loopback connection. Closing either end closes both.
+type loopbackConn struct {
+	in     <-chan []byte
+	out    chan<- []byte
+	closed chan struct{}
+	once   *sync.Once
+}
+
+func (c *loopbackConn) Send(msg []byte) error {
+	select {
+	case c.out <- msg:
+		return nil
+	case <-c.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c *loopbackConn) Recv() ([]byte, error) {
+	select {
+	case msg := <-c.in:
+		return msg, nil
+	case <-c.closed:
+		return nil, io.EOF
+	}
+}
+
+func (c *loopbackConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// replicaContents returns the keys and values of the DB as of readTs.
+func replicaContents(t *testing.T, db *DB, readTs uint64) map[string]string {
+	out := make(map[string]string)
+	txn := db.newTransaction(false, true)
+	txn.readTs = readTs
+	defer txn.Discard()
+	itr := txn.NewIterator(DefaultIteratorOptions)
+	defer itr.Close()
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		val, err := itr.Item().ValueCopy(nil)
+		require.NoError(t, err)
+		out[string(itr.Item().Key())] = string(val)
+	}
+	return out
+}
+
+// waitReplicated waits for the follower to replicate all the commits of the primary, and checks
+// that it holds the same data.
+func waitReplicated(t *testing.T, primary, follower *DB) {
+	readTs := primary.orc.readTs()
+	var ts uint64
+	for i := 0; i < 500; i++ {
+		var err error
+		ts, err = follower.ReplicatedTs()
+		require.NoError(t, err)
+		if ts >= readTs {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, readTs, ts)
+	require.Equal(t, replicaContents(t, primary, readTs), replicaContents(t, follower, ts))
+}
+
+func TestReplication(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, primary *DB) {
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+		follower, err := OpenManaged(getTestOptions(dir))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, follower.Close()) }()
+
+		// Written before the follower connects, so shipped by the snapshot.
+		for i := 0; i < 100; i++ {
+			txnSet(t, primary, []byte(fmt.Sprintf("key%03d", i)), []byte("old"), 0)
+		}
+		txnDelete(t, primary, []byte("key000"))
+
+		transport := NewLoopbackTransport()
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() { served <- primary.ServeFollowers(ctx, transport) }()
+		follow := func(ctx context.Context) chan error {
+			followed := make(chan error, 1)
+			go func() { followed <- follower.FollowPrimary(ctx, transport) }()
+			return followed
+		}
+
+		fctx, fcancel := context.WithCancel(ctx)
+		followed := follow(fctx)
+		waitReplicated(t, primary, follower)
+
+		// Shipped as live batches.
+		for i := 0; i < 50; i++ {
+			txnSet(t, primary, []byte(fmt.Sprintf("key%03d", i)), []byte("new"), 0)
+		}
+		txn := primary.NewTransaction(true)
+		for i := 100; i < 120; i++ {
+			require.NoError(t, txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("batch")))
+		}
+		require.NoError(t, txn.Delete([]byte("key001")))
+		require.NoError(t, txn.Commit())
+		waitReplicated(t, primary, follower)
+
+		// Disconnect the follower, and catch up on the changes made meanwhile.
+		fcancel()
+		require.Equal(t, context.Canceled, <-followed)
+		for i := 50; i < 100; i++ {
+			txnSet(t, primary, []byte(fmt.Sprintf("key%03d", i)), []byte("again"), 0)
+		}
+		txnDelete(t, primary, []byte("key002"))
+		followed = follow(ctx)
+		waitReplicated(t, primary, follower)
+
+		cancel()
+		require.Equal(t, context.Canceled, <-followed)
+		require.NoError(t, <-served)
+	})
+}
+
+func TestReplicationMergeOperands(t *testing.T) {
+	opt := getTestOptions("").WithMergeFunc(add)
+	runBadgerTest(t, &opt, func(t *testing.T, primary *DB) {
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+		// The follower gets the values of the keys, so it doesn't need the MergeFunc.
+		follower, err := OpenManaged(getTestOptions(dir))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, follower.Close()) }()
+
+		merge := func(n uint64) {
+			require.NoError(t, primary.Update(func(txn *Txn) error {
+				return txn.Merge([]byte("counter"), uint64ToBytes(n))
+			}))
+		}
+		// Shipped by the snapshot.
+		txnSet(t, primary, []byte("counter"), uint64ToBytes(10), 0)
+		merge(5)
+
+		transport := NewLoopbackTransport()
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() { served <- primary.ServeFollowers(ctx, transport) }()
+		follow := func(ctx context.Context) chan error {
+			followed := make(chan error, 1)
+			go func() { followed <- follower.FollowPrimary(ctx, transport) }()
+			return followed
+		}
+		fctx, fcancel := context.WithCancel(ctx)
+		followed := follow(fctx)
+		waitReplicated(t, primary, follower)
+
+		// Shipped as a live batch.
+		merge(3)
+		waitReplicated(t, primary, follower)
+
+		// Shipped by the catch-up.
+		fcancel()
+		require.Equal(t, context.Canceled, <-followed)
+		merge(2)
+		followed = follow(ctx)
+		waitReplicated(t, primary, follower)
+		require.Equal(t, string(uint64ToBytes(20)),
+			replicaContents(t, follower, primary.orc.readTs())["counter"])
+
+		cancel()
+		require.Equal(t, context.Canceled, <-followed)
+		require.NoError(t, <-served)
+	})
+}
+
+func TestReplicationModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	db, err := OpenManaged(getTestOptions(dir))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	ctx := context.Background()
+	require.Equal(t, ErrManagedTxn, db.ServeFollowers(ctx, NewLoopbackTransport()))
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.Equal(t, ErrFollowerNotManaged, db.FollowPrimary(ctx, NewLoopbackTransport()))
+	})
+}
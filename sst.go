@@ -0,0 +1,290 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"math"
+	"os"
+
+	"github.com/dgraph-io/badger/v2/options"
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgraph-io/badger/v2/table"
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/dgraph-io/ristretto"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// sstTableOptions returns the table options used to write and read standalone SSTables. The
+// encryption key, if any, is used directly as the data key of the table, since the file isn't
+// tied to the key registry of a DB.
+func sstTableOptions(opt Options) (table.Options, error) {
+	topt := buildTableOptions(opt)
+	topt.DirectIO = false
+	if len(opt.EncryptionKey) > 0 {
+		switch len(opt.EncryptionKey) {
+		default:
+			return topt, y.Wrapf(ErrInvalidEncryptionKey, "During SSTable setup")
+		case 16, 24, 32:
+		}
+		topt.DataKey = &pb.DataKey{Data: opt.EncryptionKey}
+	}
+	return topt, nil
+}
+
+// SSTWriter writes key-value pairs into a standalone SSTable file, in the same format as the
+// tables of the LSM tree. Such files can be inspected with SSTReader, or loaded into a live DB
+// with DB.IngestExternalFiles.
+//
+// The table is built using the BlockSize, BloomFalsePositive, FilterType, Compression,
+// ZSTDCompressionLevel and EncryptionKey of the given options. The same options must be used to
+// read the file back. Note that IngestExternalFiles only accepts files written without an
+// EncryptionKey.
+//
+// Entries must be added in increasing order of keys, and in decreasing order of versions for
+// the same key. All the entries are kept in memory until Finish is called.
+type SSTWriter struct {
+	fd          *os.File
+	builder     *table.Builder
+	lastKey     []byte
+	lastVersion uint64
+	finished    bool
+}
+
+// NewSSTWriter creates the file at the given path, and returns an SSTWriter to fill it. The file
+// must not exist already.
+func NewSSTWriter(path string, opt Options) (*SSTWriter, error) {
+	topt, err := sstTableOptions(opt)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, y.Wrapf(err, "while creating SSTable: %s", path)
+	}
+	return &SSTWriter{
+		fd:      fd,
+		builder: table.NewTableBuilder(topt),
+	}, nil
+}
+
+// Set adds a key-value pair at the given version.
+func (w *SSTWriter) Set(key, value []byte, version uint64) error {
+	return w.SetEntry(NewEntry(key, value), version)
+}
+
+// SetEntry adds the key, value, user metadata, expiry and discard marker of the entry at the
+// given version.
+func (w *SSTWriter) SetEntry(e *Entry, version uint64) error {
+	return w.add(e.Key, y.ValueStruct{
+		Meta:      e.meta,
+		UserMeta:  e.UserMeta,
+		ExpiresAt: e.ExpiresAt,
+		Value:     e.Value,
+	}, version)
+}
+
+// Delete adds a deletion marker for the key at the given version.
+func (w *SSTWriter) Delete(key []byte, version uint64) error {
+	return w.add(key, y.ValueStruct{Meta: bitDelete}, version)
+}
+
+func (w *SSTWriter) add(key []byte, vs y.ValueStruct, version uint64) error {
+	switch {
+	case w.finished:
+		return errors.New("SSTWriter is already finished")
+	case len(key) == 0:
+		return ErrEmptyKey
+	case vs.Meta&bitValuePointer > 0:
+		return errors.New("SSTWriter doesn't support value pointers")
+	}
+	if w.lastKey != nil {
+		cmp := bytes.Compare(key, w.lastKey)
+		if cmp < 0 || (cmp == 0 && version >= w.lastVersion) {
+			return errors.Errorf("Key %q at version %d added out of order after key %q at "+
+				"version %d", key, version, w.lastKey, w.lastVersion)
+		}
+	}
+	w.lastKey = y.SafeCopy(w.lastKey, key)
+	w.lastVersion = version
+	w.builder.Add(y.KeyWithTs(key, version), vs, 0)
+	return nil
+}
+
+// Finish writes the table to the file and syncs it. The SSTWriter can't be used after that.
+func (w *SSTWriter) Finish() error {
+	if w.finished {
+		return errors.New("SSTWriter is already finished")
+	}
+	if w.builder.Empty() {
+		return errors.New("Cannot write an empty SSTable")
+	}
+	w.finished = true
+	defer w.builder.Close()
+
+	data := w.builder.Finish(false)
+	if _, err := w.fd.Write(data); err != nil {
+		return y.Wrapf(err, "while writing SSTable: %s", w.fd.Name())
+	}
+	if err := w.fd.Sync(); err != nil {
+		return y.Wrapf(err, "while syncing SSTable: %s", w.fd.Name())
+	}
+	return w.fd.Close()
+}
+
+// Close releases the resources held by the SSTWriter. If Finish hasn't been called, the
+// partially written file is removed.
+func (w *SSTWriter) Close() error {
+	if w.finished {
+		return nil
+	}
+	w.finished = true
+	w.builder.Close()
+	if err := w.fd.Close(); err != nil {
+		return err
+	}
+	return os.Remove(w.fd.Name())
+}
+
+// SSTReader reads a standalone SSTable file, like the ones written by SSTWriter or the tables
+// in the directory of a DB that doesn't use encryption.
+type SSTReader struct {
+	mf         *z.MmapFile
+	tbl        *table.Table
+	indexCache *ristretto.Cache
+}
+
+// OpenSSTReader opens the SSTable at the given path. The Compression and EncryptionKey of the
+// options must match the ones used to write the file. The checksum of the whole file is
+// verified if ChecksumVerificationMode asks for it on table reads.
+func OpenSSTReader(path string, opt Options) (*SSTReader, error) {
+	topt, err := sstTableOptions(opt)
+	if err != nil {
+		return nil, err
+	}
+	r := &SSTReader{}
+	if topt.DataKey != nil {
+		// The index of an encrypted table is decrypted on demand, and kept in the index cache.
+		r.indexCache, err = ristretto.NewCache(&ristretto.Config{
+			NumCounters: 100,
+			MaxCost:     1 << 30,
+			BufferItems: 64,
+		})
+		if err != nil {
+			return nil, y.Wrap(err, "failed to create index cache")
+		}
+		topt.IndexCache = r.indexCache
+	}
+	r.mf, err = z.OpenMmapFile(path, os.O_RDONLY, 0)
+	if err != nil && err != z.NewFile {
+		r.indexCache.Close()
+		return nil, y.Wrapf(err, "while opening SSTable: %s", path)
+	}
+	r.tbl, err = table.OpenInMemoryTable(r.mf.Data, 0, &topt)
+	if err == nil && (topt.ChkMode == options.OnTableRead ||
+		topt.ChkMode == options.OnTableAndBlockRead) {
+		err = r.tbl.VerifyChecksum()
+	}
+	if err != nil {
+		_ = r.mf.Close(-1)
+		r.indexCache.Close()
+		return nil, y.Wrapf(err, "while reading SSTable: %s", path)
+	}
+	return r, nil
+}
+
+// Smallest returns the smallest key in the table, and its version.
+func (r *SSTReader) Smallest() ([]byte, uint64) {
+	return y.ParseKey(r.tbl.Smallest()), y.ParseTs(r.tbl.Smallest())
+}
+
+// Biggest returns the biggest key in the table, and its version.
+func (r *SSTReader) Biggest() ([]byte, uint64) {
+	return y.ParseKey(r.tbl.Biggest()), y.ParseTs(r.tbl.Biggest())
+}
+
+// KeyCount returns the number of entries in the table, counting every version of a key.
+func (r *SSTReader) KeyCount() uint32 { return r.tbl.KeyCount() }
+
+// MaxVersion returns the highest version of any entry in the table.
+func (r *SSTReader) MaxVersion() uint64 { return r.tbl.MaxVersion() }
+
+// Size returns the size of the file in bytes.
+func (r *SSTReader) Size() int64 { return r.tbl.Size() }
+
+// VerifyChecksum verifies the checksums of all the blocks in the table.
+func (r *SSTReader) VerifyChecksum() error { return r.tbl.VerifyChecksum() }
+
+// NewIterator returns an iterator over all the entries of the table, in increasing order of keys
+// and decreasing order of versions.
+func (r *SSTReader) NewIterator() *SSTIterator {
+	return &SSTIterator{itr: r.tbl.NewIterator(0)}
+}
+
+// Close releases the table and unmaps the file. Iterators must be closed before that.
+func (r *SSTReader) Close() error {
+	if err := r.tbl.DecrRef(); err != nil {
+		return err
+	}
+	r.indexCache.Close()
+	return r.mf.Close(-1)
+}
+
+// SSTIterator iterates over the entries of an SSTable.
+type SSTIterator struct {
+	itr *table.Iterator
+}
+
+// Rewind moves the iterator to the first entry.
+func (it *SSTIterator) Rewind() { it.itr.Rewind() }
+
+// Seek moves the iterator to the newest version of the first key greater than or equal to key.
+func (it *SSTIterator) Seek(key []byte) { it.itr.Seek(y.KeyWithTs(key, math.MaxUint64)) }
+
+// Next moves the iterator to the next entry.
+func (it *SSTIterator) Next() { it.itr.Next() }
+
+// Valid returns false when the iteration is done.
+func (it *SSTIterator) Valid() bool { return it.itr.Valid() }
+
+// Key returns the key of the current entry. The slice is only valid until the iterator moves.
+func (it *SSTIterator) Key() []byte { return y.ParseKey(it.itr.Key()) }
+
+// Version returns the version of the current entry.
+func (it *SSTIterator) Version() uint64 { return y.ParseTs(it.itr.Key()) }
+
+// Value returns the value of the current entry. The slice is only valid until the iterator
+// moves.
+func (it *SSTIterator) Value() []byte { return it.itr.Value().Value }
+
+// UserMeta returns the user metadata of the current entry.
+func (it *SSTIterator) UserMeta() byte { return it.itr.Value().UserMeta }
+
+// ExpiresAt returns the Unix time at which the current entry expires, or zero if it never does.
+func (it *SSTIterator) ExpiresAt() uint64 { return it.itr.Value().ExpiresAt }
+
+// IsDeleted returns true if the current entry is a deletion marker.
+func (it *SSTIterator) IsDeleted() bool { return it.itr.Value().Meta&bitDelete > 0 }
+
+// DiscardEarlierVersions returns true if the current entry was added with the discard marker.
+func (it *SSTIterator) DiscardEarlierVersions() bool {
+	return it.itr.Value().Meta&bitDiscardEarlierVersions > 0
+}
+
+// Close closes the iterator.
+func (it *SSTIterator) Close() error { return it.itr.Close() }
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/badger/v2/options"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSTWriterReader(t *testing.T) {
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%06d", i)) }
+	test := func(t *testing.T, opt Options) {
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+		fname := filepath.Join(dir, "data.sst")
+
+		w, err := NewSSTWriter(fname, opt)
+		require.NoError(t, err)
+		for i := 0; i < 10000; i++ {
+			require.NoError(t, w.Set(key(i), []byte(fmt.Sprintf("val%d", i)), 3))
+			if i%10 == 0 {
+				require.NoError(t, w.Delete(key(i), 2))
+				require.NoError(t, w.SetEntry(NewEntry(key(i), nil).WithMeta(7).WithDiscard(), 1))
+			}
+		}
+		// Same version of the same key, and a key before the last one.
+		require.Error(t, w.Set(key(9999), nil, 3))
+		require.Error(t, w.Set(key(9998), nil, 5))
+		require.NoError(t, w.Finish())
+		require.NoError(t, w.Close())
+
+		// The writer doesn't overwrite existing files.
+		_, err = NewSSTWriter(fname, opt)
+		require.Error(t, err)
+
+		r, err := OpenSSTReader(fname, opt)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, r.Close()) }()
+		require.NoError(t, r.VerifyChecksum())
+		require.Equal(t, uint32(12000), r.KeyCount())
+		require.Equal(t, uint64(3), r.MaxVersion())
+		smallest, version := r.Smallest()
+		require.Equal(t, key(0), smallest)
+		require.Equal(t, uint64(3), version)
+		biggest, version := r.Biggest()
+		require.Equal(t, key(9999), biggest)
+		require.Equal(t, uint64(3), version)
+
+		it := r.NewIterator()
+		defer func() { require.NoError(t, it.Close()) }()
+		var n int
+		for it.Rewind(); it.Valid(); it.Next() {
+			n++
+		}
+		require.Equal(t, 12000, n)
+
+		it.Seek(key(50))
+		require.True(t, it.Valid())
+		require.Equal(t, key(50), it.Key())
+		require.Equal(t, uint64(3), it.Version())
+		require.Equal(t, []byte("val50"), it.Value())
+		it.Next()
+		require.Equal(t, uint64(2), it.Version())
+		require.True(t, it.IsDeleted())
+		it.Next()
+		require.Equal(t, uint64(1), it.Version())
+		require.False(t, it.IsDeleted())
+		require.True(t, it.DiscardEarlierVersions())
+		require.Equal(t, byte(7), it.UserMeta())
+		it.Next()
+		require.Equal(t, key(51), it.Key())
+	}
+
+	opt := DefaultOptions("")
+	t.Run("plain", func(t *testing.T) { test(t, opt) })
+	t.Run("compression", func(t *testing.T) {
+		test(t, opt.WithCompression(options.Snappy))
+	})
+	t.Run("encryption", func(t *testing.T) {
+		test(t, opt.WithEncryptionKey([]byte("1234567890123456")))
+	})
+}
+
+func TestSSTWriterIngest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+
+	fname := filepath.Join(dir, "external.sst")
+	w, err := NewSSTWriter(fname, opt)
+	require.NoError(t, err)
+	require.NoError(t, w.Set([]byte("a"), []byte("1"), 1))
+	require.NoError(t, w.Delete([]byte("b"), 1))
+	require.NoError(t, w.Finish())
+
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("b"), []byte("2"), 0)
+		require.NoError(t, db.IngestExternalFiles([]string{fname}))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("a"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("1"), getItemValue(t, item))
+			_, err = txn.Get([]byte("b"))
+			require.Equal(t, ErrKeyNotFound, err)
+			return nil
+		}))
+	})
+}
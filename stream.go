@@ -19,7 +19,9 @@ package badger
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"math"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -29,6 +31,7 @@ import (
 	"github.com/dgraph-io/ristretto/z"
 	humanize "github.com/dustin/go-humanize"
 	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
 )
 
 const batchSize = 16 << 20 // 16 MB
@@ -41,16 +44,29 @@ var maxStreamSize = uint64(100 << 20) // 100MB
 
 // Stream provides a framework to concurrently iterate over a snapshot of Badger, pick up
 // key-values, batch them up and call Send. Stream does concurrent iteration over many smaller key
-// ranges. It does NOT send keys in lexicographical sorted order. To get keys in sorted
-// order, use Iterator.
+// ranges. It does NOT send keys in lexicographical sorted order, unless Ordered is set. To get
+// keys in sorted order from a single goroutine, use Iterator.
 type Stream struct {
 	// Prefix to only iterate over certain range of keys. If set to nil (default), Stream would
 	// iterate over the entire DB.
 	Prefix []byte
 
+	// SinceTs can be used to only pick up the versions committed after it. Keys with no version
+	// newer than SinceTs are skipped, and tables with no such version aren't read at all. If set
+	// to zero (default), all the versions are considered.
+	SinceTs uint64
+
 	// Number of goroutines to use for iterating over key ranges. Defaults to 16.
 	NumGo int
 
+	// Ordered makes Stream send the keys in lexicographical sorted order. The key ranges are still
+	// iterated over concurrently, but the KV lists of a key range are held back until all the key
+	// ranges before it have been sent. To keep the memory bounded, a goroutine stops iterating
+	// once it is two lists ahead, and at most NumGo key ranges are in flight. The DB is split into
+	// more, smaller key ranges than in the unordered mode, so that the goroutines seldom wait on
+	// each other. False by default.
+	Ordered bool
+
 	// Badger would produce log entries in Infof to indicate the progress of Stream. LogPrefix can
 	// be used to help differentiate them from other activities. Default is "Badger.Stream".
 	LogPrefix string
@@ -82,13 +98,34 @@ type Stream struct {
 	// single goroutine, i.e. logic within Send method can expect single threaded execution.
 	Send func(*pb.KVList) error
 
+	// Checkpoint, if set, is called after each Send that completes one or more key ranges, with a
+	// token recording the key ranges that are left. If the stream fails, a new Stream at the same
+	// readTs, with the last token as its ResumeToken, picks up from there. The keys of the key
+	// ranges that weren't completed may be sent again. Checkpoint is called by the goroutine
+	// calling Send, and an error it returns stops the stream. Only supported in managed mode.
+	Checkpoint func(token []byte) error
+
+	// ResumeToken, if set, is a token passed to Checkpoint by an earlier Stream with the same
+	// readTs, Prefix and SinceTs. Only the key ranges left in the token are iterated over. The
+	// caller must keep the versions visible at readTs, by not moving the discard timestamp past
+	// it, until the stream is done. Only supported in managed mode.
+	ResumeToken []byte
+
 	readTs       uint64
+	txn          *Txn // Set for the streams of a Snapshot.
 	db           *DB
-	rangeCh      chan keyRange
+	rangeCh      chan streamRange
 	kvChan       chan *pb.KVList
+	orderCh      chan chan *pb.KVList
 	nextStreamId uint32
 	doneMarkers  bool
 
+	// The key ranges not sent yet, by their start key, and the start key of the range of each
+	// stream id. Only used with Checkpoint.
+	rangesMu    sync.Mutex
+	rangesLeft  map[string]keyRange
+	streamRange map[uint32]string
+
 	// Use allocators to generate KVs.
 	allocatorsMu sync.RWMutex
 	allocators   map[int]*z.Allocator
@@ -106,7 +143,8 @@ func (st *Stream) SendDoneMarkers(done bool) {
 }
 
 // ToList is a default implementation of KeyToList. It picks up all valid versions of the key,
-// skipping over deleted or expired keys.
+// skipping over deleted or expired keys. The merge operands are sent as the value of the key at
+// their version, since the KVs don't tell them apart from values.
 func (st *Stream) ToList(key []byte, itr *Iterator) (*pb.KVList, error) {
 	alloc := st.Allocator(itr.ThreadId)
 	ka := alloc.Copy(key)
@@ -121,10 +159,16 @@ func (st *Stream) ToList(key []byte, itr *Iterator) (*pb.KVList, error) {
 			// Break out on the first encounter with another key.
 			break
 		}
+		if item.Version() <= st.SinceTs {
+			break
+		}
 
 		kv := y.NewKV(alloc)
 		kv.Key = ka
 
+		if item.meta&bitMergeOperand > 0 {
+			item.resolveMerge(item.Version() - 1)
+		}
 		if err := item.Value(func(val []byte) error {
 			kv.Value = alloc.Copy(val)
 			return nil
@@ -148,14 +192,21 @@ func (st *Stream) ToList(key []byte, itr *Iterator) (*pb.KVList, error) {
 	return list, nil
 }
 
-// keyRange is [start, end), including start, excluding end. Do ensure that the start,
-// end byte slices are owned by keyRange struct.
-func (st *Stream) produceRanges(ctx context.Context) {
+// streamRange is a key range, along with the channel its KV lists are sent to.
+type streamRange struct {
+	kr  keyRange
+	out chan *pb.KVList
+}
+
+// keyRanges returns the key ranges to iterate over. keyRange is [start, end), including start,
+// excluding end. Do ensure that the start, end byte slices are owned by keyRange struct.
+func (st *Stream) keyRanges() []keyRange {
 	splits := st.db.KeySplits(st.Prefix)
 
 	// We don't need to create more key ranges than NumGo goroutines. This way, we will have limited
-	// number of "streams" coming out, which then helps limit the memory used by SSWriter.
-	{
+	// number of "streams" coming out, which then helps limit the memory used by SSWriter. In the
+	// ordered mode, only a few streams are in flight at any time anyway.
+	if !st.Ordered {
 		pickEvery := int(math.Floor(float64(len(splits)) / float64(st.NumGo)))
 		if pickEvery < 1 {
 			pickEvery = 1
@@ -169,15 +220,153 @@ func (st *Stream) produceRanges(ctx context.Context) {
 		splits = filtered
 	}
 
+	var ranges []keyRange
 	start := y.SafeCopy(nil, st.Prefix)
 	for _, key := range splits {
-		st.rangeCh <- keyRange{left: start, right: y.SafeCopy(nil, []byte(key))}
+		if bytes.Compare([]byte(key), start) <= 0 {
+			// Skip the empty ranges, so that the start keys are unique.
+			continue
+		}
+		ranges = append(ranges, keyRange{left: start, right: y.SafeCopy(nil, []byte(key))})
 		start = y.SafeCopy(nil, []byte(key))
 	}
 	// Edge case: prefix is empty and no splits exist. In that case, we should have at least one
 	// keyRange output.
-	st.rangeCh <- keyRange{left: start}
-	close(st.rangeCh)
+	return append(ranges, keyRange{left: start})
+}
+
+// produceRanges sends the key ranges to rangeCh. In the ordered mode, each key range gets its own
+// channel for its KV lists, which is also sent to orderCh, in the order of the key ranges.
+func (st *Stream) produceRanges(ctx context.Context, ranges []keyRange) {
+	defer close(st.rangeCh)
+	if st.Ordered {
+		defer close(st.orderCh)
+	}
+	for _, kr := range ranges {
+		sr := streamRange{kr: kr, out: st.kvChan}
+		if st.Ordered {
+			sr.out = make(chan *pb.KVList, 1)
+			select {
+			case st.orderCh <- sr.out:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case st.rangeCh <- sr:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// orderKVs forwards the KV lists of the key ranges to kvChan, one key range after the other, and
+// closes kvChan at the end.
+func (st *Stream) orderKVs(ctx context.Context) {
+	defer close(st.kvChan)
+	for out := range st.orderCh {
+		for {
+			var kvs *pb.KVList
+			var ok bool
+			select {
+			case kvs, ok = <-out:
+			case <-ctx.Done():
+				return
+			}
+			if !ok {
+				break
+			}
+			select {
+			case st.kvChan <- kvs:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// The version of the encoding of the stream resume tokens.
+const streamTokenVersion = 1
+
+// encodeToken returns a resume token holding the key ranges left.
+func (st *Stream) encodeToken() []byte {
+	st.rangesMu.Lock()
+	ranges := make([]keyRange, 0, len(st.rangesLeft))
+	for _, kr := range st.rangesLeft {
+		ranges = append(ranges, kr)
+	}
+	st.rangesMu.Unlock()
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].left, ranges[j].left) < 0
+	})
+
+	var buf bytes.Buffer
+	var lbuf [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		buf.Write(lbuf[:binary.PutUvarint(lbuf[:], v)])
+	}
+	putBytes := func(b []byte) {
+		putUvarint(uint64(len(b)))
+		buf.Write(b)
+	}
+	buf.WriteByte(streamTokenVersion)
+	putUvarint(st.readTs)
+	putUvarint(st.SinceTs)
+	putBytes(st.Prefix)
+	putUvarint(uint64(len(ranges)))
+	for _, kr := range ranges {
+		putBytes(kr.left)
+		putBytes(kr.right)
+	}
+	return buf.Bytes()
+}
+
+// decodeToken returns the key ranges left in the resume token. It returns ErrInvalidResumeToken if
+// the token is malformed, or doesn't match the readTs, the Prefix or the SinceTs of the stream.
+func (st *Stream) decodeToken(token []byte) ([]keyRange, error) {
+	if len(token) == 0 || token[0] != streamTokenVersion {
+		return nil, ErrInvalidResumeToken
+	}
+	b := token[1:]
+	getUvarint := func() (uint64, bool) {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, false
+		}
+		b = b[n:]
+		return v, true
+	}
+	getBytes := func() ([]byte, bool) {
+		l, ok := getUvarint()
+		if !ok || uint64(len(b)) < l {
+			return nil, false
+		}
+		v := y.SafeCopy(nil, b[:l])
+		b = b[l:]
+		return v, true
+	}
+
+	readTs, ok1 := getUvarint()
+	sinceTs, ok2 := getUvarint()
+	prefix, ok3 := getBytes()
+	n, ok4 := getUvarint()
+	if !(ok1 && ok2 && ok3 && ok4) || readTs != st.readTs || sinceTs != st.SinceTs ||
+		!bytes.Equal(prefix, st.Prefix) {
+		return nil, ErrInvalidResumeToken
+	}
+	var ranges []keyRange
+	for i := uint64(0); i < n; i++ {
+		left, ok1 := getBytes()
+		right, ok2 := getBytes()
+		if !ok1 || !ok2 {
+			return nil, ErrInvalidResumeToken
+		}
+		ranges = append(ranges, keyRange{left: left, right: right})
+	}
+	if len(b) > 0 {
+		return nil, ErrInvalidResumeToken
+	}
+	return ranges, nil
 }
 
 func (st *Stream) newAllocator(threadId int) *z.Allocator {
@@ -199,31 +388,42 @@ func (st *Stream) newAllocator(threadId int) *z.Allocator {
 func (st *Stream) produceKVs(ctx context.Context, threadId int) error {
 	var size int
 	var txn *Txn
-	if st.readTs > 0 {
+	switch {
+	case st.txn != nil:
+		// The transaction of a snapshot is shared by the goroutines, and discarded by its owner.
+		txn = st.txn
+	case st.readTs > 0:
 		txn = st.db.NewTransactionAt(st.readTs, false)
-	} else {
+		defer txn.Discard()
+	default:
 		txn = st.db.NewTransaction(false)
+		defer txn.Discard()
 	}
-	defer txn.Discard()
 
-	iterate := func(kr keyRange) error {
+	iterate := func(kr keyRange, out chan *pb.KVList) error {
 		iterOpts := DefaultIteratorOptions
 		iterOpts.AllVersions = true
 		iterOpts.Prefix = st.Prefix
 		iterOpts.PrefetchValues = false
+		iterOpts.sinceTs = st.SinceTs
 		itr := txn.NewIterator(iterOpts)
 		itr.ThreadId = threadId
 		defer itr.Close()
 
 		// This unique stream id is used to identify all the keys from this iteration.
 		streamId := atomic.AddUint32(&st.nextStreamId, 1)
+		if st.Checkpoint != nil {
+			st.rangesMu.Lock()
+			st.streamRange[streamId] = string(kr.left)
+			st.rangesMu.Unlock()
+		}
 
 		outList := new(pb.KVList)
 		outList.AllocRef = st.newAllocator(threadId).Ref
 
 		sendIt := func() error {
 			select {
-			case st.kvChan <- outList:
+			case out <- outList:
 			case <-ctx.Done():
 				return ctx.Err()
 			}
@@ -247,6 +447,10 @@ func (st *Stream) produceKVs(ctx context.Context, threadId int) error {
 			if len(kr.right) > 0 && bytes.Compare(item.Key(), kr.right) >= 0 {
 				break
 			}
+			// Versions are sorted in decreasing order, so this key has no newer version.
+			if item.Version() <= st.SinceTs {
+				continue
+			}
 			// Check if we should pick this key.
 			if st.ChooseKey != nil && !st.ChooseKey(item) {
 				continue
@@ -273,8 +477,9 @@ func (st *Stream) produceKVs(ctx context.Context, threadId int) error {
 				}
 			}
 		}
-		// Mark the stream as done.
-		if st.doneMarkers {
+		// Mark the stream as done. With Checkpoint, the done marker tells streamKVs that the key
+		// range has been sent.
+		if st.doneMarkers || st.Checkpoint != nil {
 			outList.Kv = append(outList.Kv, &pb.KV{
 				StreamId:   streamId,
 				StreamDone: true,
@@ -288,12 +493,16 @@ func (st *Stream) produceKVs(ctx context.Context, threadId int) error {
 
 	for {
 		select {
-		case kr, ok := <-st.rangeCh:
+		case sr, ok := <-st.rangeCh:
 			if !ok {
 				// Done with the keys.
 				return nil
 			}
-			if err := iterate(kr); err != nil {
+			err := iterate(sr.kr, sr.out)
+			if st.Ordered {
+				close(sr.out)
+			}
+			if err != nil {
 				return err
 			}
 		case <-ctx.Done():
@@ -317,21 +526,48 @@ func (st *Stream) streamKVs(ctx context.Context) error {
 	}()
 
 	sendBatch := func(batch *pb.KVList) error {
-		sz := uint64(proto.Size(batch))
-		bytesSent += sz
-		count += len(batch.Kv)
-		t := time.Now()
-		if err := st.Send(batch); err != nil {
-			return err
+		var done []uint32
+		if st.Checkpoint != nil {
+			kvs := batch.Kv[:0]
+			for _, kv := range batch.Kv {
+				if kv.StreamDone {
+					done = append(done, kv.StreamId)
+					if !st.doneMarkers {
+						continue
+					}
+				}
+				kvs = append(kvs, kv)
+			}
+			batch.Kv = kvs
+		}
+
+		if len(batch.Kv) > 0 {
+			sz := uint64(proto.Size(batch))
+			bytesSent += sz
+			count += len(batch.Kv)
+			t := time.Now()
+			if err := st.Send(batch); err != nil {
+				return err
+			}
+			st.db.opt.Infof("%s Created batch of size: %s in %s.\n",
+				st.LogPrefix, humanize.Bytes(sz), time.Since(t))
 		}
-		st.db.opt.Infof("%s Created batch of size: %s in %s.\n",
-			st.LogPrefix, humanize.Bytes(sz), time.Since(t))
 
 		for _, a := range allocs {
 			a.Release()
 		}
 		allocs = allocs[:0]
-		return nil
+
+		if len(done) == 0 {
+			return nil
+		}
+		st.rangesMu.Lock()
+		for _, id := range done {
+			delete(st.rangesLeft, st.streamRange[id])
+			delete(st.streamRange, id)
+		}
+		st.rangesMu.Unlock()
+		return st.Checkpoint(st.encodeToken())
 	}
 
 	slurp := func(batch *pb.KVList) error {
@@ -404,7 +640,7 @@ outer:
 // are serial. In case any of these steps encounter an error, Orchestrate would stop execution and
 // return that error. Orchestrate can be called multiple times, but in serial order.
 func (st *Stream) Orchestrate(ctx context.Context) error {
-	st.rangeCh = make(chan keyRange, 3) // Contains keys for posting lists.
+	st.rangeCh = make(chan streamRange, 3) // Contains keys for posting lists.
 
 	// kvChan should only have a small capacity to ensure that we don't buffer up too much data if
 	// sending is slow. Page size is set to 4MB, which is used to lazily cap the size of each
@@ -415,10 +651,47 @@ func (st *Stream) Orchestrate(ctx context.Context) error {
 		st.KeyToList = st.ToList
 	}
 
+	if (st.Checkpoint != nil || st.ResumeToken != nil) && !st.db.opt.managedTxns {
+		return errors.New("Stream can only be resumed in managed mode, see NewStreamAt")
+	}
+	var ranges []keyRange
+	if st.ResumeToken != nil {
+		var err error
+		if ranges, err = st.decodeToken(st.ResumeToken); err != nil {
+			return err
+		}
+	} else {
+		ranges = st.keyRanges()
+	}
+	if st.Checkpoint != nil {
+		st.rangesLeft = make(map[string]keyRange, len(ranges))
+		st.streamRange = make(map[uint32]string)
+		for _, kr := range ranges {
+			st.rangesLeft[string(kr.left)] = kr
+		}
+	}
+
+	// The first error stops all the goroutines, which could otherwise block on a channel nobody
+	// reads from anymore.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var errOnce sync.Once
+	var firstErr error
+	setErr := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	if st.Ordered {
+		// Bounds the number of key ranges in flight.
+		st.orderCh = make(chan chan *pb.KVList, st.NumGo)
+		go st.orderKVs(ctx)
+	}
 	// Picks up ranges from Badger, and sends them to rangeCh.
-	go st.produceRanges(ctx)
+	go st.produceRanges(ctx, ranges)
 
-	errCh := make(chan error, 1) // Stores error by consumeKeys.
 	var wg sync.WaitGroup
 	for i := 0; i < st.NumGo; i++ {
 		wg.Add(1)
@@ -427,10 +700,7 @@ func (st *Stream) Orchestrate(ctx context.Context) error {
 			defer wg.Done()
 			// Picks up ranges from rangeCh, generates KV lists, and sends them to kvChan.
 			if err := st.produceKVs(ctx, threadId); err != nil {
-				select {
-				case errCh <- err:
-				default:
-				}
+				setErr(err)
 			}
 		}(i)
 	}
@@ -439,19 +709,20 @@ func (st *Stream) Orchestrate(ctx context.Context) error {
 	kvErr := make(chan error, 1)
 	go func() {
 		// Picks up KV lists from kvChan, and sends them to Output.
-		kvErr <- st.streamKVs(ctx)
+		err := st.streamKVs(ctx)
+		if err != nil {
+			setErr(err)
+		}
+		kvErr <- err
 	}()
-	wg.Wait()        // Wait for produceKVs to be over.
-	close(st.kvChan) // Now we can close kvChan.
-
-	select {
-	case err := <-errCh: // Check error from produceKVs.
-		return err
-	default:
+	wg.Wait() // Wait for produceKVs to be over.
+	if !st.Ordered {
+		close(st.kvChan) // Now we can close kvChan. orderKVs closes it in the ordered mode.
 	}
 
 	// Wait for key streaming to be over.
-	err := <-kvErr
+	<-kvErr
+	err := firstErr
 
 	for _, a := range st.allocators {
 		a.Release()
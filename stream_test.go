@@ -17,13 +17,16 @@
 package badger
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	bpb "github.com/dgraph-io/badger/v2/pb"
 	"github.com/dgraph-io/badger/v2/y"
@@ -263,3 +266,156 @@ func TestBigStream(t *testing.T) {
 	}
 	require.NoError(t, db.Close())
 }
+
+func TestStreamSinceTs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := OpenManaged(DefaultOptions(dir))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	for ts := uint64(1); ts <= 3; ts++ {
+		txn := db.NewTransactionAt(math.MaxUint64, true)
+		for i := 1; i <= 100; i++ {
+			if i%int(ts) != 0 {
+				continue
+			}
+			require.NoError(t, txn.SetEntry(NewEntry(keyWithPrefix("p", i), value(i))))
+		}
+		require.NoError(t, txn.CommitAt(ts, nil))
+	}
+
+	stream := db.NewStreamAt(math.MaxUint64)
+	stream.SinceTs = 1
+	c := &collector{}
+	stream.Send = c.Send
+	require.NoError(t, stream.Orchestrate(ctxb))
+	// The keys written at version 2 or 3.
+	require.Len(t, c.kv, 67)
+	for _, kv := range c.kv {
+		require.True(t, kv.Version > 1)
+	}
+}
+
+func TestStreamResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := OpenManaged(DefaultOptions(dir))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	n := 30000
+	for i := 0; i < n; i += 1000 {
+		txn := db.NewTransactionAt(math.MaxUint64, true)
+		for j := i; j < i+1000; j++ {
+			require.NoError(t, txn.SetEntry(NewEntry(keyWithPrefix("p", j), value(j))))
+		}
+		require.NoError(t, txn.CommitAt(5, nil))
+	}
+
+	// The stream fails on its second Send. Pausing the iteration now and then lets the first
+	// key ranges get sent in separate batches.
+	var token []byte
+	first := &collector{}
+	stream := db.NewStreamAt(10)
+	stream.NumGo = 1
+	var chosen int
+	stream.ChooseKey = func(*Item) bool {
+		if chosen++; chosen%1000 == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return true
+	}
+	stream.Send = func(list *bpb.KVList) error {
+		if first.kv != nil {
+			return errors.New("network error")
+		}
+		return first.Send(list)
+	}
+	stream.Checkpoint = func(tok []byte) error {
+		token = tok
+		return nil
+	}
+	require.Error(t, stream.Orchestrate(ctxb))
+	require.NotNil(t, token)
+
+	// The token is bound to the readTs of the stream.
+	stream = db.NewStreamAt(11)
+	stream.ResumeToken = token
+	stream.Send = func(*bpb.KVList) error { return nil }
+	require.Equal(t, ErrInvalidResumeToken, stream.Orchestrate(ctxb))
+
+	var last []byte
+	rest := &collector{}
+	stream = db.NewStreamAt(10)
+	stream.ResumeToken = token
+	stream.Send = rest.Send
+	stream.Checkpoint = func(tok []byte) error {
+		last = tok
+		return nil
+	}
+	require.NoError(t, stream.Orchestrate(ctxb))
+
+	// The completed key ranges aren't sent again, and the keys left are.
+	seen := make(map[string]struct{})
+	for _, kv := range first.kv {
+		seen[string(kv.Key)] = struct{}{}
+	}
+	require.NotEmpty(t, seen)
+	for _, kv := range rest.kv {
+		_, ok := seen[string(kv.Key)]
+		require.False(t, ok, "key %s sent twice", kv.Key)
+		seen[string(kv.Key)] = struct{}{}
+	}
+	require.Len(t, seen, n)
+
+	// Resuming from the last token sends nothing.
+	rest.kv = nil
+	stream = db.NewStreamAt(10)
+	stream.ResumeToken = last
+	stream.Send = rest.Send
+	require.NoError(t, stream.Orchestrate(ctxb))
+	require.Empty(t, rest.kv)
+}
+
+func TestStreamOrdered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := OpenManaged(DefaultOptions(dir))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	n := 50000
+	for i := 0; i < n; i += 1000 {
+		txn := db.NewTransactionAt(math.MaxUint64, true)
+		for j := i; j < i+1000; j++ {
+			require.NoError(t, txn.SetEntry(NewEntry(keyWithPrefix("p", j), value(j))))
+		}
+		require.NoError(t, txn.CommitAt(5, nil))
+	}
+
+	stream := db.NewStreamAt(math.MaxUint64)
+	stream.Ordered = true
+	stream.NumGo = 8
+	c := &collector{}
+	stream.Send = c.Send
+	require.NoError(t, stream.Orchestrate(ctxb))
+	require.Len(t, c.kv, n)
+	for i := 1; i < len(c.kv); i++ {
+		require.True(t, bytes.Compare(c.kv[i-1].Key, c.kv[i].Key) < 0,
+			"%s sent before %s", c.kv[i-1].Key, c.kv[i].Key)
+	}
+
+	// An error from Send stops the stream, and is returned as is.
+	sendErr := errors.New("network error")
+	stream = db.NewStreamAt(math.MaxUint64)
+	stream.Ordered = true
+	stream.Send = func(*bpb.KVList) error { return sendErr }
+	require.Equal(t, sendErr, stream.Orchestrate(ctxb))
+}
@@ -19,6 +19,7 @@ package badger
 import (
 	"encoding/hex"
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/dgraph-io/badger/v2/pb"
@@ -38,8 +39,8 @@ import (
 // bootstrapped. Existing data would get deleted when using this writer. So, this is only useful
 // when restoring from backup or replicating DB across servers.
 //
-// StreamWriter should not be called on in-use DB instances. It is designed only to bootstrap new
-// DBs.
+// StreamWriter should not be called on in-use DB instances, unless it's prepared with
+// PrepareIncremental. Otherwise, it is designed only to bootstrap new DBs.
 type StreamWriter struct {
 	writeLock  sync.Mutex
 	db         *DB
@@ -47,6 +48,16 @@ type StreamWriter struct {
 	throttle   *y.Throttle
 	maxVersion uint64
 	writers    map[uint32]*sortedWriter
+
+	// incremental is set by PrepareIncremental. The tables are then only added to the LSM tree
+	// by Flush, all at once.
+	incremental bool
+	tablesLock  sync.Mutex
+	tables      []*table.Table
+
+	// The applied index set by SetAppliedIndex.
+	appliedIndex    uint64
+	hasAppliedIndex bool
 }
 
 // NewStreamWriter creates a StreamWriter. Right after creating StreamWriter, Prepare must be
@@ -76,6 +87,40 @@ func (sw *StreamWriter) Prepare() error {
 	return err
 }
 
+// PrepareIncremental can be called instead of Prepare, to write into a DB that already holds data
+// without deleting it. The DB stays in use: reads, writes and compactions go on while the streams
+// are written. It is meant to bulk-load new key ranges, like the keys of a new tenant, into a live
+// DB.
+//
+// The written tables are only added to the LSM tree by Flush, all at once, at the deepest level.
+// Flush fails with ErrOverlappingKeyRange, and adds none of the tables, if any of them overlaps
+// with the keys in the DB, or with the tables of another stream. The key range of a table spans
+// from its first key to its last key, so the keys of a stream shouldn't interleave with the
+// existing keys.
+//
+// The keys keep the versions they are written with. In normal mode, the timestamps of the DB are
+// moved past the highest version, so that all the keys are visible once Flush returns.
+//
+// The value log GC is blocked until Flush returns, so Flush must always be called.
+func (sw *StreamWriter) PrepareIncremental() error {
+	sw.writeLock.Lock()
+	defer sw.writeLock.Unlock()
+
+	if sw.db.opt.ReadOnly {
+		return errors.New("Cannot write into a DB opened in read-only mode")
+	}
+	sw.incremental = true
+	sw.done = func() {}
+	if !sw.db.opt.InMemory {
+		// The values written to the value log are only referenced by the LSM tree once Flush adds
+		// the tables, so the GC would take them for stale until then. Wait for any GC in progress
+		// to finish, and block the next ones until Flush.
+		sw.db.vlog.garbageCh <- struct{}{}
+		sw.done = func() { <-sw.db.vlog.garbageCh }
+	}
+	return nil
+}
+
 // Write writes KVList to DB. Each KV within the list contains the stream id which StreamWriter
 // would use to demux the writes. Write is thread safe and can be called concurrently by multiple
 // goroutines.
@@ -182,6 +227,14 @@ func (sw *StreamWriter) Write(kvs *pb.KVList) error {
 // Flush is called once we are done writing all the entries. It syncs DB directories. It also
 // updates Oracle with maxVersion found in all entries (if DB is not managed).
 func (sw *StreamWriter) Flush() error {
+	if err := sw.flush(); err != nil {
+		return err
+	}
+	// The writes to the DB are only resumed once flush is done.
+	return sw.writeAppliedIndex()
+}
+
+func (sw *StreamWriter) flush() error {
 	sw.writeLock.Lock()
 	defer sw.writeLock.Unlock()
 
@@ -193,14 +246,21 @@ func (sw *StreamWriter) Flush() error {
 		}
 	}
 
+	var err error
 	for _, writer := range sw.writers {
 		if writer == nil {
 			continue
 		}
-		if err := writer.Done(); err != nil {
-			return err
+		if err = writer.Done(); err != nil {
+			break
 		}
 	}
+	if sw.incremental {
+		return sw.flushIncremental(err)
+	}
+	if err != nil {
+		return err
+	}
 
 	if !sw.db.opt.managedTxns {
 		if sw.db.orc != nil {
@@ -235,8 +295,119 @@ func (sw *StreamWriter) Flush() error {
 	return sw.db.lc.validate()
 }
 
+// flushIncremental adds the written tables to the LSM tree, after checking that they don't overlap
+// with the existing keys. If err isn't nil, the tables are deleted and err is returned.
+func (sw *StreamWriter) flushIncremental(err error) error {
+	if ferr := sw.throttle.Finish(); err == nil {
+		err = ferr
+	}
+	if err == nil && !sw.db.opt.managedTxns {
+		// Reserve a commit timestamp past the written versions. Readers at this timestamp wait on
+		// the txnMark until the tables have been added.
+		orc := sw.db.orc
+		orc.Lock()
+		ts := orc.nextTxnTs
+		if ts <= sw.maxVersion {
+			ts = sw.maxVersion
+		}
+		orc.nextTxnTs = ts + 1
+		orc.txnMark.Begin(ts)
+		orc.Unlock()
+		defer orc.doneCommit(ts)
+	}
+	if err == nil {
+		err = sw.db.lc.addStreamedTables(sw.tables)
+	}
+	// On success, the levels hold their own references to the tables. Otherwise, releasing the
+	// references deletes the tables.
+	for _, t := range sw.tables {
+		_ = t.DecrRef()
+	}
+	sw.tables = nil
+	if err != nil {
+		return err
+	}
+
+	if sw.db.opt.ValueDir != sw.db.opt.Dir {
+		if err := sw.db.syncDir(sw.db.opt.ValueDir); err != nil {
+			return err
+		}
+	}
+	if err := sw.db.syncDir(sw.db.opt.Dir); err != nil {
+		return err
+	}
+	return sw.db.lc.validate()
+}
+
+// addStreamedTables adds the tables to the deepest level, with a single change to the MANIFEST.
+// It returns ErrOverlappingKeyRange if the tables overlap with each other, or with the memtables,
+// a level or a running compaction.
+func (s *levelsController) addStreamedTables(tables []*table.Table) error {
+	if len(tables) == 0 {
+		return nil
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		return y.CompareKeys(tables[i].Smallest(), tables[j].Smallest()) < 0
+	})
+	for i := 1; i < len(tables); i++ {
+		if getKeyRange(tables[i-1]).overlapsWith(getKeyRange(tables[i])) {
+			return ErrOverlappingKeyRange
+		}
+	}
+	// The memtables are checked first. A memtable that gets flushed in the meantime is added to
+	// level 0 before it's removed from the memtables.
+	for _, t := range tables {
+		if s.kv.memTablesOverlapWith(getKeyRange(t)) {
+			return ErrOverlappingKeyRange
+		}
+	}
+
+	// Holding the cstatus lock keeps new compactions from picking up the key ranges until the
+	// tables are added.
+	s.cstatus.Lock()
+	defer s.cstatus.Unlock()
+	for _, t := range tables {
+		kr := getKeyRange(t)
+		for l := 0; l < len(s.levels); l++ {
+			if s.cstatus.levels[l].overlapsWith(kr) || s.levels[l].overlapsWith(kr) {
+				return ErrOverlappingKeyRange
+			}
+		}
+	}
+
+	level := len(s.levels) - 1
+	if !tables[0].IsInmemory {
+		changes := make([]*pb.ManifestChange, 0, len(tables))
+		for _, t := range tables {
+			changes = append(changes,
+				newCreateChange(t.ID(), level, t.KeyID(), t.CompressionType()))
+		}
+		if err := s.kv.manifest.addChanges(changes); err != nil {
+			return err
+		}
+	}
+	return s.levels[level].replaceTables(nil, tables)
+}
+
+// memTablesOverlapWith returns true if any of the memtables holds a key in the key range.
+func (db *DB) memTablesOverlapWith(kr keyRange) bool {
+	mts, decr := db.getMemTables()
+	defer decr()
+	for _, mt := range mts {
+		it := mt.sl.NewIterator()
+		it.Seek(kr.left)
+		overlaps := it.Valid() && y.CompareKeys(it.Key(), kr.right) <= 0
+		_ = it.Close()
+		if overlaps {
+			return true
+		}
+	}
+	return false
+}
+
 type sortedWriter struct {
 	db       *DB
+	sw       *StreamWriter
 	throttle *y.Throttle
 
 	builder  *table.Builder
@@ -255,8 +426,10 @@ func (sw *StreamWriter) newWriter(streamID uint32) (*sortedWriter, error) {
 
 	bopts := buildTableOptions(sw.db.opt)
 	bopts.DataKey = dk
+	bopts.TableID = sw.db.lc.reserveFileID()
 	w := &sortedWriter{
 		db:       sw.db,
+		sw:       sw,
 		streamID: streamID,
 		throttle: sw.throttle,
 		builder:  table.NewTableBuilder(bopts),
@@ -357,6 +530,7 @@ func (w *sortedWriter) send(done bool) error {
 	}
 	bopts := buildTableOptions(w.db.opt)
 	bopts.DataKey = dk
+	bopts.TableID = w.db.lc.reserveFileID()
 	w.builder = table.NewTableBuilder(bopts)
 	return nil
 }
@@ -379,7 +553,7 @@ func (w *sortedWriter) createTable(builder *table.Builder) error {
 	if len(data) == 0 {
 		return nil
 	}
-	fileID := w.db.lc.reserveFileID()
+	fileID := builder.TableID()
 	opts := buildTableOptions(w.db.opt)
 	opts.DataKey = builder.DataKey()
 	opts.BlockCache = w.db.blockCache
@@ -397,6 +571,15 @@ func (w *sortedWriter) createTable(builder *table.Builder) error {
 			return err
 		}
 	}
+	if w.sw.incremental {
+		// The table keeps the ref held by OpenTable until Flush adds it to the LSM tree.
+		w.sw.tablesLock.Lock()
+		w.sw.tables = append(w.sw.tables, tbl)
+		w.sw.tablesLock.Unlock()
+		w.db.opt.Infof("Table created: %d for stream: %d. Size: %s\n",
+			fileID, w.streamID, humanize.Bytes(uint64(tbl.Size())))
+		return nil
+	}
 	lc := w.db.lc
 
 	var lhandler *levelHandler
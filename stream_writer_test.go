@@ -527,3 +527,150 @@ func TestStreamWriterEncrypted(t *testing.T) {
 	require.NoError(t, db.Close())
 
 }
+
+func TestStreamWriterIncremental(t *testing.T) {
+	streamKeys := func(prefix string, n int, version uint64) *pb.KVList {
+		list := &pb.KVList{}
+		for i := 0; i < n; i++ {
+			list.Kv = append(list.Kv, &pb.KV{
+				Key:      []byte(fmt.Sprintf("%s%05d", prefix, i)),
+				Value:    []byte(fmt.Sprintf("%0128d", i)),
+				Version:  version,
+				StreamId: uint32(i * 2 / n),
+			})
+		}
+		return list
+	}
+	check := func(t *testing.T, db *DB, prefix string, n int) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("%s%05d", prefix, i)))
+				require.NoError(t, err)
+				v, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("%0128d", i), string(v))
+			}
+			return nil
+		}))
+	}
+	test := func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("existing"), []byte("value"))
+		}))
+
+		sw := db.NewStreamWriter()
+		require.NoError(t, sw.PrepareIncremental())
+		require.NoError(t, sw.Write(streamKeys("tenant1/", 1000, 20)))
+		require.NoError(t, sw.Flush())
+		check(t, db, "tenant1/", 1000)
+
+		// The existing data and the regular writes are untouched.
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			item, err := txn.Get([]byte("existing"))
+			require.NoError(t, err)
+			require.NoError(t, item.Value(func(v []byte) error {
+				require.Equal(t, []byte("value"), v)
+				return nil
+			}))
+			return txn.Set([]byte("tenant1/00010"), []byte("updated"))
+		}))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("tenant1/00010"))
+			require.NoError(t, err)
+			require.NoError(t, item.Value(func(v []byte) error {
+				require.Equal(t, []byte("updated"), v)
+				return nil
+			}))
+			return nil
+		}))
+
+		// Key ranges overlapping with the tables or the memtable are rejected.
+		sw = db.NewStreamWriter()
+		require.NoError(t, sw.PrepareIncremental())
+		require.NoError(t, sw.Write(streamKeys("tenant1/", 100, 30)))
+		require.Equal(t, ErrOverlappingKeyRange, sw.Flush())
+
+		sw = db.NewStreamWriter()
+		require.NoError(t, sw.PrepareIncremental())
+		require.NoError(t, sw.Write(&pb.KVList{Kv: []*pb.KV{
+			{Key: []byte("a"), Value: []byte("a"), Version: 30},
+			{Key: []byte("f"), Value: []byte("f"), Version: 30},
+		}}))
+		require.Equal(t, ErrOverlappingKeyRange, sw.Flush())
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte("a"))
+			require.Equal(t, ErrKeyNotFound, err)
+			return nil
+		}))
+
+		sw = db.NewStreamWriter()
+		require.NoError(t, sw.PrepareIncremental())
+		require.NoError(t, sw.Write(streamKeys("tenant2/", 500, 5)))
+		require.NoError(t, sw.Flush())
+		check(t, db, "tenant2/", 500)
+	}
+
+	t.Run("Normal mode", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+		opt := getTestOptions(dir)
+		db, err := Open(opt)
+		require.NoError(t, err)
+		test(t, db)
+		require.NoError(t, db.Close())
+
+		// The streamed tables are recorded in the MANIFEST.
+		db, err = Open(opt)
+		require.NoError(t, err)
+		check(t, db, "tenant2/", 500)
+		require.NoError(t, db.Close())
+	})
+	t.Run("InMemory mode", func(t *testing.T) {
+		opt := getTestOptions("")
+		opt.InMemory = true
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			test(t, db)
+		})
+	})
+}
+
+func TestStreamWriterIncrementalValueLogGC(t *testing.T) {
+	opt := getTestOptions("")
+	opt.ValueThreshold = 32
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		list := &pb.KVList{}
+		for i := 0; i < 100; i++ {
+			list.Kv = append(list.Kv, &pb.KV{
+				Key:     []byte(fmt.Sprintf("key%03d", i)),
+				Value:   []byte(fmt.Sprintf("%0128d", i)),
+				Version: 1,
+			})
+		}
+
+		// The values in the value log aren't referenced by the LSM tree until Flush, so the GC
+		// must not run in between.
+		sw := db.NewStreamWriter()
+		require.NoError(t, sw.PrepareIncremental())
+		require.NoError(t, sw.Write(list))
+		require.Equal(t, ErrRejected, db.RunValueLogGC(0.5))
+		require.NoError(t, sw.Flush())
+		require.NotEqual(t, ErrRejected, db.RunValueLogGC(0.5))
+
+		// A failed Flush unblocks the GC too.
+		sw = db.NewStreamWriter()
+		require.NoError(t, sw.PrepareIncremental())
+		require.NoError(t, sw.Write(list))
+		require.Equal(t, ErrOverlappingKeyRange, sw.Flush())
+		require.NotEqual(t, ErrRejected, db.RunValueLogGC(0.5))
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 100; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+				require.NoError(t, err)
+				require.Equal(t, []byte(fmt.Sprintf("%0128d", i)), getItemValue(t, item))
+			}
+			return nil
+		}))
+	})
+}
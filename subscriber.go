@@ -0,0 +1,281 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/pkg/errors"
+)
+
+// SlowSubscriberPolicy tells the publisher what to do when a subscriber doesn't keep up with the
+// writes, and its buffer is full.
+type SlowSubscriberPolicy int
+
+const (
+	// BlockSlowSubscriber makes the publisher wait for the subscriber. This stalls the updates of
+	// all the other subscribers, and eventually the writes to the DB. It is the default.
+	BlockSlowSubscriber SlowSubscriberPolicy = iota
+	// SpillSlowSubscriber queues the updates in a temporary file until the subscriber catches up.
+	// No update is lost, at the cost of disk space.
+	SpillSlowSubscriber
+	// DropSlowSubscriber drops the updates, and notifies the subscriber of the gap through
+	// SubscribeOptions.OnGap before the next updates it gets.
+	DropSlowSubscriber
+	// DisconnectSlowSubscriber stops the subscription, which returns ErrSlowSubscriber.
+	DisconnectSlowSubscriber
+)
+
+// SubscriberGap describes the updates dropped for a subscriber with the DropSlowSubscriber
+// policy.
+type SubscriberGap struct {
+	// Count is the number of dropped KVs.
+	Count uint64
+	// MinVersion and MaxVersion are the lowest and the highest commit timestamp of the dropped
+	// KVs.
+	MinVersion uint64
+	MaxVersion uint64
+}
+
+func (g *SubscriberGap) add(list *pb.KVList) {
+	for _, kv := range list.Kv {
+		if g.Count == 0 || kv.Version < g.MinVersion {
+			g.MinVersion = kv.Version
+		}
+		if kv.Version > g.MaxVersion {
+			g.MaxVersion = kv.Version
+		}
+		g.Count++
+	}
+}
+
+// KeyRange is a range of keys, from Start included to End excluded. An empty End means no upper
+// bound.
+type KeyRange struct {
+	Start, End []byte
+}
+
+func (r KeyRange) contains(key []byte) bool {
+	return bytes.Compare(key, r.Start) >= 0 && (len(r.End) == 0 || bytes.Compare(key, r.End) < 0)
+}
+
+// SubscribeOptions configures a subscription made with DB.SubscribeWith.
+//
+// A key is watched if it has one of the Prefixes or falls in one of the Ranges. The updates of
+// the watched keys are then filtered with UserMetaMask and Match, before being sent.
+type SubscribeOptions struct {
+	// Prefixes of the keys to watch. An empty prefix watches all the keys.
+	Prefixes [][]byte
+	// Ranges of the keys to watch.
+	Ranges []KeyRange
+	// UserMetaMask, if not zero, only lets through the updates with at least one of its bits set
+	// in their user metadata.
+	UserMetaMask byte
+	// Match, if set, only lets through the updates it returns true for. It is called by the
+	// publisher with its lock held, so it must be fast, and must not modify the KV, which is
+	// shared with the other subscribers.
+	Match func(kv *pb.KV) bool
+	// KeysOnly leaves the values out of the updates, for the subscribers that only need to know
+	// which keys changed. Match still gets the values.
+	KeysOnly bool
+	// Name identifies the subscriber in SubscriberStats and in the badger_v2_subscriber_lag
+	// metric, where it is prefixed by "db-<n>/", n numbering the DBs opened by the process. It
+	// defaults to "subscriber-<id>".
+	Name string
+	// BufferSize is the number of batches of updates buffered in memory for the subscriber.
+	// It defaults to 1000.
+	BufferSize int
+	// SlowPolicy applies when the buffer is full.
+	SlowPolicy SlowSubscriberPolicy
+	// SpillDir is the directory of the temporary file used by SpillSlowSubscriber. It defaults
+	// to the directory returned by os.TempDir.
+	SpillDir string
+	// OnGap is called with the updates dropped under DropSlowSubscriber, after the callback
+	// has been called with all the updates that came before them. It is required with that
+	// policy. Returning an error stops the subscription.
+	OnGap func(gap SubscriberGap) error
+}
+
+// SubscriberStats holds the statistics of a subscriber.
+type SubscriberStats struct {
+	ID         uint64
+	Name       string
+	SlowPolicy SlowSubscriberPolicy
+	// Buffered is the number of batches of updates buffered in memory.
+	Buffered int
+	// Spilled is the number of batches of updates queued on disk.
+	Spilled int
+	// PublishedVersion is the commit timestamp of the latest update published to the
+	// subscriber, and DeliveredVersion the one of the latest update it has processed.
+	PublishedVersion uint64
+	DeliveredVersion uint64
+	// Lag is the difference between PublishedVersion and DeliveredVersion.
+	Lag uint64
+	// Dropped is the number of KVs dropped under DropSlowSubscriber.
+	Dropped uint64
+}
+
+// SubscriberStats returns the statistics of the active subscribers, ordered by ID.
+func (db *DB) SubscriberStats() []SubscriberStats {
+	return db.pub.stats()
+}
+
+// spillQueue buffers the updates of a SpillSlowSubscriber in a temporary file, and forwards them
+// to the subscriber in order.
+//
+// Each batch is stored as its length, on 4 bytes, followed by the marshaled KVList.
+type spillQueue struct {
+	sync.Mutex
+	cond    *sync.Cond
+	fd      *os.File
+	sendCh  chan<- subscriberUpdate
+	done    <-chan struct{}
+	onError func(err error)
+
+	readOff, writeOff int64
+	pending           int
+	closed            bool
+}
+
+func newSpillQueue(dir string, sendCh chan<- subscriberUpdate, done <-chan struct{},
+	onError func(err error)) (*spillQueue, error) {
+	fd, err := ioutil.TempFile(dir, "badger-subscriber-*.spill")
+	if err != nil {
+		return nil, errors.Wrap(err, "while creating spill file")
+	}
+	q := &spillQueue{
+		fd:      fd,
+		sendCh:  sendCh,
+		done:    done,
+		onError: onError,
+	}
+	q.cond = sync.NewCond(&q.Mutex)
+	go q.forward()
+	return q, nil
+}
+
+// push sends the updates to the subscriber if nothing is queued before them and it has room
+// for them, and queues them on disk otherwise.
+func (q *spillQueue) push(list *pb.KVList) error {
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return nil
+	}
+	if q.pending == 0 {
+		select {
+		case q.sendCh <- subscriberUpdate{list: list}:
+			return nil
+		default:
+		}
+	}
+	data, err := list.Marshal()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	if _, err := q.fd.WriteAt(buf, q.writeOff); err != nil {
+		return err
+	}
+	q.writeOff += int64(len(buf))
+	q.pending++
+	q.cond.Signal()
+	return nil
+}
+
+// read reads the batch at the head of the queue, and returns it with its size on disk.
+func (q *spillQueue) read() (*pb.KVList, int64, error) {
+	var lbuf [4]byte
+	if _, err := q.fd.ReadAt(lbuf[:], q.readOff); err != nil {
+		return nil, 0, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(lbuf[:]))
+	if _, err := q.fd.ReadAt(data, q.readOff+4); err != nil {
+		return nil, 0, err
+	}
+	list := &pb.KVList{}
+	if err := list.Unmarshal(data); err != nil {
+		return nil, 0, err
+	}
+	return list, int64(4 + len(data)), nil
+}
+
+// forward sends the queued batches to the subscriber until the queue is closed.
+func (q *spillQueue) forward() {
+	defer func() {
+		_ = q.fd.Close()
+		_ = os.Remove(q.fd.Name())
+	}()
+	for {
+		q.Lock()
+		for q.pending == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.Unlock()
+			return
+		}
+		list, n, err := q.read()
+		q.Unlock()
+		if err != nil {
+			q.onError(errors.Wrap(err, "while reading spill file"))
+			return
+		}
+
+		select {
+		case q.sendCh <- subscriberUpdate{list: list}:
+		case <-q.done:
+			return
+		}
+
+		q.Lock()
+		q.readOff += n
+		q.pending--
+		if q.pending == 0 {
+			// Reclaim the space once the subscriber has caught up.
+			q.readOff, q.writeOff = 0, 0
+			err = q.fd.Truncate(0)
+		}
+		q.Unlock()
+		if err != nil {
+			q.onError(errors.Wrap(err, "while truncating spill file"))
+			return
+		}
+	}
+}
+
+// len returns the number of queued batches.
+func (q *spillQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.pending
+}
+
+// close stops the forwarding, and removes the file.
+func (q *spillQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
@@ -18,6 +18,7 @@ package table
 
 import (
 	"crypto/aes"
+	"encoding/binary"
 	"math"
 	"runtime"
 	"sync"
@@ -43,6 +44,14 @@ const (
 	// When a block is encrypted, it's length increases. We add 256 bytes of padding to
 	// handle cases when block size increases. This is an approximate number.
 	padding = 256
+
+	// Values of the hash index buckets with no key and with more than one key respectively.
+	hashIndexEmpty     = math.MaxUint16
+	hashIndexCollision = math.MaxUint16 - 1
+
+	// The ZSTD dictionary of a table is built once the size of the blocks held back for it is
+	// dictSampleRatio times the size of the dictionary.
+	dictSampleRatio = 8
 )
 
 type header struct {
@@ -72,6 +81,7 @@ type bblock struct {
 	data  []byte
 	start uint32 // Points to the starting offset of the block.
 	end   uint32 // Points to the end offset of the block.
+	idx   int    // Index of the block in the table.
 }
 
 // Builder is used in building a table.
@@ -86,6 +96,7 @@ type Builder struct {
 	baseOffset uint32 // Offset for the current block.
 
 	entryOffsets  []uint32 // Offsets of entries present in current block.
+	entryHashes   []uint32 // Hashes of the keys present in current block. Used for the hash index.
 	offsets       *z.Buffer
 	estimatedSize uint32
 	keyHashes     []uint32 // Used for building the bloomfilter.
@@ -96,6 +107,14 @@ type Builder struct {
 	wg        sync.WaitGroup
 	blockChan chan *bblock
 	blockList []*bblock
+
+	// Used to build the ZSTD dictionary. The blocks are held back in pendingBlocks until the
+	// dictionary is trained on them. zstdEnc compresses all the blocks with the dictionary.
+	dict          []byte
+	zstdEnc       *y.ZSTDEncoder
+	dictBuilt     bool
+	pendingBlocks []*bblock
+	pendingSize   uint32
 }
 
 // NewTableBuilder makes a new TableBuilder.
@@ -139,7 +158,7 @@ func (b *Builder) handleBlock() {
 			y.Check(err)
 		}
 		if b.shouldEncrypt() {
-			eBlock, err := b.encrypt(blockBuf, doCompress)
+			eBlock, err := b.encrypt(blockBuf, doCompress, uint64(item.idx))
 			y.Check(y.Wrapf(err, "Error while encrypting block in table builder."))
 			blockBuf = eBlock
 		}
@@ -191,7 +210,11 @@ func (b *Builder) keyDiff(newKey []byte) []byte {
 }
 
 func (b *Builder) addHelper(key []byte, v y.ValueStruct, vpLen uint32) {
-	b.keyHashes = append(b.keyHashes, y.Hash(y.ParseKey(key)))
+	hash := y.Hash(y.ParseKey(key))
+	b.keyHashes = append(b.keyHashes, hash)
+	if b.opt.BlockHashIndex {
+		b.entryHashes = append(b.entryHashes, hash)
+	}
 
 	if version := y.ParseTs(key); version > b.maxVersion {
 		b.maxVersion = version
@@ -277,10 +300,18 @@ Structure of Block.
 +-----------------------------------------+--------------------+--------------+------------------+
 */
 // In case the data is encrypted, the "IV" is added to the end of the block.
+//
+// If BlockHashIndex is set, the hash index of the block and its number of buckets (4 Bytes) are
+// added between the last entry and the block meta.
 func (b *Builder) finishBlock() {
 	if len(b.entryOffsets) == 0 {
 		return
 	}
+	if b.opt.BlockHashIndex {
+		buckets := buildHashIndex(b.entryHashes)
+		b.append(buckets)
+		b.append(y.U32ToBytes(uint32(len(buckets) / 2)))
+	}
 	b.append(y.U32SliceToBytes(b.entryOffsets))
 	b.append(y.U32ToBytes(uint32(len(b.entryOffsets))))
 
@@ -297,30 +328,132 @@ func (b *Builder) finishBlock() {
 	b.addPadding(padding)
 
 	// Block end is the actual end of the block ignoring the padding.
-	block := &bblock{start: b.baseOffset, end: uint32(b.sz - padding), data: b.buf}
+	block := &bblock{
+		start: b.baseOffset,
+		end:   uint32(b.sz - padding),
+		data:  b.buf,
+		idx:   len(b.blockList),
+	}
 	b.blockList = append(b.blockList, block)
 
 	b.addBlockToIndex()
+	if b.shouldBuildDict() {
+		// Hold the block back until there's enough data to build the dictionary.
+		b.pendingBlocks = append(b.pendingBlocks, block)
+		b.pendingSize += block.end - block.start
+		if b.pendingSize >= uint32(dictSampleRatio*b.opt.ZSTDDictSize) {
+			b.initDict()
+		}
+		return
+	}
 	// Push to the block handler.
 	b.blockChan <- block
 }
 
+// shouldBuildDict tells whether the ZSTD dictionary should be built and isn't built yet.
+func (b *Builder) shouldBuildDict() bool {
+	return b.opt.Compression == options.ZSTD && b.opt.ZSTDDictSize > 0 && !b.dictBuilt
+}
+
+// buildDict trains the ZSTD dictionary on the pending blocks and pushes them to the block handler.
+// Each block is a sample, as the blocks are compressed separately. If there aren't enough samples
+// to train a dictionary, the blocks are compressed without one. If the dictionary can't be used,
+// the blocks are compressed with plain ZSTD too, and the error is returned.
+func (b *Builder) buildDict() error {
+	var err error
+	if len(b.pendingBlocks) > 0 {
+		samples := make([][]byte, 0, len(b.pendingBlocks))
+		for _, bl := range b.pendingBlocks {
+			samples = append(samples, bl.data[bl.start:bl.end])
+		}
+		if dict, terr := y.ZSTDTrainDict(samples, b.opt.ZSTDDictSize); terr == nil {
+			// Without an encoder, the blocks are compressed with plain ZSTD.
+			var enc *y.ZSTDEncoder
+			if enc, err = newZSTDEncoder(dict, b.opt.ZSTDCompressionLevel); err == nil {
+				b.dict, b.zstdEnc = dict, enc
+			}
+		}
+	}
+	// The blocks are pushed only after the encoder is set, so the block handlers always see it.
+	b.dictBuilt = true
+	for _, bl := range b.pendingBlocks {
+		b.blockChan <- bl
+	}
+	b.pendingBlocks = nil
+	b.pendingSize = 0
+	return y.Wrapf(err, "while creating the ZSTD encoder")
+}
+
+// newZSTDEncoder is replaced in tests.
+var newZSTDEncoder = y.NewZSTDEncoder
+
+// initDict builds the ZSTD dictionary, and logs the error if it can't be used.
+func (b *Builder) initDict() {
+	if err := b.buildDict(); err != nil && b.opt.Warningf != nil {
+		b.opt.Warningf("Building the table without a ZSTD dictionary: %v", err)
+	}
+}
+
+// buildHashIndex returns the hash index for the given hashes of the keys in a block. Each bucket
+// holds the index of the first entry of a key (2 Bytes), or hashIndexEmpty if there's no key in the
+// bucket, or hashIndexCollision if there are many.
+func buildHashIndex(hashes []uint32) []byte {
+	// Consecutive entries with the same hash are versions of the same key.
+	numKeys := 0
+	for i, h := range hashes {
+		if i == 0 || h != hashes[i-1] {
+			numKeys++
+		}
+	}
+	numBuckets := numHashIndexBuckets(numKeys)
+	buckets := make([]uint16, numBuckets)
+	for i := range buckets {
+		buckets[i] = hashIndexEmpty
+	}
+	for i, h := range hashes {
+		if i > 0 && h == hashes[i-1] {
+			continue
+		}
+		bucket := &buckets[h%uint32(numBuckets)]
+		if *bucket == hashIndexEmpty && i < hashIndexCollision {
+			*bucket = uint16(i)
+		} else {
+			*bucket = hashIndexCollision
+		}
+	}
+	buf := make([]byte, 2*numBuckets)
+	for i, bucket := range buckets {
+		binary.BigEndian.PutUint16(buf[2*i:], bucket)
+	}
+	return buf
+}
+
+// numHashIndexBuckets returns the number of buckets in the hash index of a block with numKeys keys.
+// The buckets are kept at most 75% full, to avoid collisions.
+func numHashIndexBuckets(numKeys int) int {
+	return numKeys*4/3 + 1
+}
+
 func (b *Builder) addBlockToIndex() {
 	blockBuf := b.buf[b.baseOffset:b.sz]
 	// Add key to the block index.
+	out := newBlockOffset(b.baseKey, b.baseOffset, uint32(len(blockBuf)))
+	dst := b.offsets.SliceAllocate(len(out))
+	copy(dst, out)
+}
+
+// newBlockOffset returns the serialized blockOffset for the given key, offset and length.
+func newBlockOffset(key []byte, offset, length uint32) []byte {
 	builder := fbs.NewBuilder(64)
-	off := builder.CreateByteVector(b.baseKey)
+	off := builder.CreateByteVector(key)
 
 	fb.BlockOffsetStart(builder)
 	fb.BlockOffsetAddKey(builder, off)
-	fb.BlockOffsetAddOffset(builder, b.baseOffset)
-	fb.BlockOffsetAddLen(builder, uint32(len(blockBuf)))
+	fb.BlockOffsetAddOffset(builder, offset)
+	fb.BlockOffsetAddLen(builder, length)
 	uoff := fb.BlockOffsetEnd(builder)
 	builder.Finish(uoff)
-
-	out := builder.FinishedBytes()
-	dst := b.offsets.SliceAllocate(len(out))
-	copy(dst, out)
+	return builder.FinishedBytes()
 }
 
 func (b *Builder) shouldFinishBlock(key []byte, value y.ValueStruct) bool {
@@ -339,10 +472,15 @@ func (b *Builder) shouldFinishBlock(key []byte, value y.ValueStruct) bool {
 	estimatedSize := uint32(b.sz) - b.baseOffset + uint32(6 /*header size for entry*/) +
 		uint32(len(key)) + uint32(value.EncodedSize()) + entriesOffsetsSize
 
+	if b.opt.BlockHashIndex {
+		// Buckets of the hash index and the number of buckets.
+		estimatedSize += uint32(2*numHashIndexBuckets(len(b.entryOffsets)+1) + 4)
+	}
+
 	if b.shouldEncrypt() {
 		// IV is added at the end of the block, while encrypting.
 		// So, size of IV is added to estimatedSize.
-		estimatedSize += aes.BlockSize
+		estimatedSize += uint32(encryptionOverhead(b.DataKey()))
 	}
 	// Integer overflow check for table size.
 	y.AssertTrue(uint64(b.sz)+uint64(estimatedSize) < math.MaxUint32)
@@ -359,6 +497,7 @@ func (b *Builder) Add(key []byte, value y.ValueStruct, valueLen uint32) {
 		y.AssertTrue(uint32(b.sz) < math.MaxUint32)
 		b.baseOffset = uint32((b.sz))
 		b.entryOffsets = b.entryOffsets[:0]
+		b.entryHashes = b.entryHashes[:0]
 	}
 	b.addHelper(key, value, valueLen)
 }
@@ -372,6 +511,7 @@ func (b *Builder) Add(key []byte, value y.ValueStruct, valueLen uint32) {
 // ReachedCapacity returns true if we... roughly (?) reached capacity?
 func (b *Builder) ReachedCapacity(capacity uint64) bool {
 	blocksSize := atomic.LoadUint32(&b.actualSize) + // actual length of current buffer
+		b.pendingSize + // length of blocks held back for the dictionary
 		uint32(len(b.entryOffsets)*4) + // all entry offsets size
 		4 + // count of all entry offsets
 		8 + // checksum bytes
@@ -398,6 +538,10 @@ The table structure looks like
 // In case the data is encrypted, the "IV" is added to the end of the index.
 func (b *Builder) Finish(allocate bool) []byte {
 	b.finishBlock() // This will never start a new block.
+	if b.shouldBuildDict() {
+		// The table is too small to have filled up the samples. Build the dictionary anyway.
+		b.initDict()
+	}
 	if b.blockChan != nil {
 		close(b.blockChan)
 	}
@@ -406,6 +550,10 @@ func (b *Builder) Finish(allocate bool) []byte {
 	}
 	// Wait for block handler to finish.
 	b.wg.Wait()
+	if b.zstdEnc != nil {
+		b.zstdEnc.Close()
+		b.zstdEnc = nil
+	}
 
 	// We have added padding after each block so we should minus the
 	// padding from the actual table size. len(blocklist) would be zero if
@@ -437,16 +585,32 @@ func (b *Builder) Finish(allocate bool) []byte {
 		b.sz = dstLen
 	}
 
-	var f y.Filter
+	offsets := b.blockOffsets()
+	numBlocks := len(offsets)
+	partitionSize := b.opt.IndexPartitionSize
+	if partitionSize > 0 && numBlocks > partitionSize {
+		// The index is big enough to be partitioned. The top level index would point to the
+		// partitions instead of the blocks.
+		offsets = b.writeIndexPartitions(offsets, partitionSize)
+	} else {
+		partitionSize = 0
+	}
+
+	var f []byte
 	if b.opt.BloomFalsePositive > 0 {
-		bits := y.BloomBitsPerKey(len(b.keyHashes), b.opt.BloomFalsePositive)
-		f = y.NewFilter(b.keyHashes, bits)
+		switch b.opt.FilterType {
+		case options.RibbonFilter:
+			f = y.NewRibbonFilter(b.keyHashes, y.RibbonBitsPerKey(b.opt.BloomFalsePositive))
+		default:
+			bits := y.BloomBitsPerKey(len(b.keyHashes), b.opt.BloomFalsePositive)
+			f = y.NewFilter(b.keyHashes, bits)
+		}
 	}
-	index := b.buildIndex(f, uncompressedSize)
+	index := b.buildIndex(f, uncompressedSize, offsets, numBlocks, partitionSize)
 
 	var err error
 	if b.shouldEncrypt() {
-		index, err = b.encrypt(index, false)
+		index, err = b.encrypt(index, false, indexPosition)
 		y.Check(err)
 	}
 	// Write index the buffer.
@@ -490,9 +654,44 @@ func (b *Builder) DataKey() *pb.DataKey {
 	return b.opt.DataKey
 }
 
-// encrypt will encrypt the given data and appends IV to the end of the encrypted data.
+// TableID returns the ID of the table being built.
+func (b *Builder) TableID() uint64 {
+	return b.opt.TableID
+}
+
+// encryptionOverhead returns the number of bytes added to the data encrypted with the given data
+// key: the IV with AES-CTR, and the authentication tag and the nonce with AES-GCM.
+func encryptionOverhead(dk *pb.DataKey) int {
+	if dk.EncryptionAlgo == pb.EncryptionAlgo_aes_gcm {
+		return y.GCMTagSize + y.GCMNonceSize
+	}
+	return aes.BlockSize
+}
+
+// Positions of the index and of the index partitions in the table, authenticated along with them
+// with AES-GCM. The position of a block is its index.
+const (
+	indexPosition     = math.MaxUint64
+	partitionPosition = 1 << 32 // Plus the index of the partition.
+)
+
+// gcmAAD returns the additional data authenticated along with the data encrypted with AES-GCM at
+// the given position of the table with the given ID. It prevents the encrypted blocks and index
+// from being moved within a table or to another table.
+func gcmAAD(tableID, pos uint64) []byte {
+	aad := make([]byte, 16)
+	binary.BigEndian.PutUint64(aad, tableID)
+	binary.BigEndian.PutUint64(aad[8:], pos)
+	return aad
+}
+
+// encrypt will encrypt the given data and appends IV to the end of the encrypted data. With
+// AES-GCM, the data is authenticated along with its position in the table (see gcmAAD).
 // This should be only called only after checking shouldEncrypt method.
-func (b *Builder) encrypt(data []byte, viaC bool) ([]byte, error) {
+func (b *Builder) encrypt(data []byte, viaC bool, pos uint64) ([]byte, error) {
+	if b.DataKey().EncryptionAlgo == pb.EncryptionAlgo_aes_gcm {
+		return b.encryptGCM(data, viaC, pos)
+	}
 	iv, err := y.GenerateIV()
 	if err != nil {
 		return data, y.Wrapf(err, "Error while generating IV in Builder.encrypt")
@@ -520,6 +719,36 @@ func (b *Builder) encrypt(data []byte, viaC bool) ([]byte, error) {
 	return append(dst, iv...), nil
 }
 
+// encryptGCM encrypts the given data with AES-GCM and appends the authentication tag and the
+// nonce to the end of the encrypted data.
+func (b *Builder) encryptGCM(data []byte, viaC bool, pos uint64) ([]byte, error) {
+	nonce, err := y.GenerateGCMNonce()
+	if err != nil {
+		return data, y.Wrapf(err, "Error while generating nonce in Builder.encrypt")
+	}
+	needSz := len(data) + y.GCMTagSize + len(nonce)
+	var dst []byte
+	if viaC {
+		dst = z.Calloc(needSz)
+	} else {
+		dst = make([]byte, needSz)
+	}
+	sealed, err := y.SealGCM(dst[:0], data, b.DataKey().Data, nonce, gcmAAD(b.opt.TableID, pos))
+	if err != nil {
+		if viaC {
+			z.Free(dst)
+		}
+		return data, y.Wrapf(err, "Error while encrypting in Builder.encrypt")
+	}
+	dst = sealed
+	if viaC {
+		z.Free(data)
+	}
+
+	y.AssertTrue(cap(dst)-len(dst) >= len(nonce))
+	return append(dst, nonce...), nil
+}
+
 // shouldEncrypt tells us whether to encrypt the data or not.
 // We encrypt only if the data key exist. Otherwise, not.
 func (b *Builder) shouldEncrypt() bool {
@@ -538,15 +767,19 @@ func (b *Builder) compressData(data []byte) ([]byte, error) {
 	case options.ZSTD:
 		sz := y.ZSTDCompressBound(len(data))
 		dst := z.Calloc(sz)
+		if b.zstdEnc != nil {
+			return b.zstdEnc.Compress(dst, data)
+		}
 		return y.ZSTDCompress(dst, data, b.opt.ZSTDCompressionLevel)
 	}
 	return nil, errors.New("Unsupported compression type")
 }
 
-func (b *Builder) buildIndex(bloom []byte, tableSz uint32) []byte {
+func (b *Builder) buildIndex(bloom []byte, tableSz uint32, offsets [][]byte,
+	numBlocks, partitionSize int) []byte {
 	builder := fbs.NewBuilder(3 << 20)
 
-	boList := b.writeBlockOffsets(builder)
+	boList := b.writeBlockOffsets(builder, offsets)
 	// Write block offset vector the the idxBuilder.
 	fb.TableIndexStartOffsetsVector(builder, len(boList))
 
@@ -561,6 +794,11 @@ func (b *Builder) buildIndex(bloom []byte, tableSz uint32) []byte {
 	if len(bloom) > 0 {
 		bfoff = builder.CreateByteVector(bloom)
 	}
+	var dictoff fbs.UOffsetT
+	// Write the compression dictionary.
+	if len(b.dict) > 0 {
+		dictoff = builder.CreateByteVector(b.dict)
+	}
 
 	fb.TableIndexStart(builder)
 	fb.TableIndexAddOffsets(builder, boEnd)
@@ -569,20 +807,83 @@ func (b *Builder) buildIndex(bloom []byte, tableSz uint32) []byte {
 	fb.TableIndexAddMaxVersion(builder, b.maxVersion)
 	fb.TableIndexAddUncompressedSize(builder, tableSz)
 	fb.TableIndexAddKeyCount(builder, uint32(len(b.keyHashes)))
+	fb.TableIndexAddFilterType(builder, uint32(b.opt.FilterType))
+	fb.TableIndexAddBlockHashIndex(builder, b.opt.BlockHashIndex)
+	fb.TableIndexAddCompressionDict(builder, dictoff)
+	if partitionSize > 0 {
+		fb.TableIndexAddNumBlocks(builder, uint32(numBlocks))
+		fb.TableIndexAddPartitionSize(builder, uint32(partitionSize))
+	}
 	builder.Finish(fb.TableIndexEnd(builder))
 
 	return builder.FinishedBytes()
 }
 
-// writeBlockOffsets writes all the blockOffets in b.offsets and returns the
-// offsets for the newly written items.
-func (b *Builder) writeBlockOffsets(builder *fbs.Builder) []fbs.UOffsetT {
+// blockOffsets returns the serialized blockOffsets of all the blocks, in order.
+func (b *Builder) blockOffsets() [][]byte {
 	so := b.offsets.SliceOffsets()
+	offsets := make([][]byte, 0, len(so))
+	for _, off := range so {
+		data, _ := b.offsets.Slice(off)
+		offsets = append(offsets, data)
+	}
+	return offsets
+}
+
+/*
+Structure of an index partition.
++-------------------------------------+---------------+------------+---------------+
+| Index (offsets of partitionSize     | Index Size    | Checksum   | Checksum Size |
+| consecutive blocks)                 | (4 Bytes)     |            | (4 Bytes)     |
++-------------------------------------+---------------+------------+---------------+
+*/
+// In case the data is encrypted, the "IV" is added to the end of the index.
+//
+// writeIndexPartitions appends the index partitions for the given block offsets to the table, and
+// returns the blockOffsets pointing to the partitions.
+func (b *Builder) writeIndexPartitions(offsets [][]byte, partitionSize int) [][]byte {
+	var partitions [][]byte
+	for start := 0; start < len(offsets); start += partitionSize {
+		end := start + partitionSize
+		if end > len(offsets) {
+			end = len(offsets)
+		}
+		builder := fbs.NewBuilder(64 * (end - start))
+		boList := b.writeBlockOffsets(builder, offsets[start:end])
+		fb.TableIndexStartOffsetsVector(builder, len(boList))
+		for i := 0; i < len(boList); i++ {
+			builder.PrependUOffsetT(boList[i])
+		}
+		boEnd := builder.EndVector(len(boList))
+		fb.TableIndexStart(builder)
+		fb.TableIndexAddOffsets(builder, boEnd)
+		builder.Finish(fb.TableIndexEnd(builder))
+		index := builder.FinishedBytes()
+
+		if b.shouldEncrypt() {
+			var err error
+			index, err = b.encrypt(index, false, partitionPosition+uint64(start/partitionSize))
+			y.Check(err)
+		}
+		partitionOffset := b.sz
+		b.append(index)
+		b.append(y.U32ToBytes(uint32(len(index))))
+		b.writeChecksum(index)
+
+		first := fb.GetRootAsBlockOffset(offsets[start], 0)
+		partitions = append(partitions,
+			newBlockOffset(first.KeyBytes(), partitionOffset, b.sz-partitionOffset))
+	}
+	return partitions
+}
+
+// writeBlockOffsets writes all the given blockOffets and returns the offsets for the newly
+// written items.
+func (b *Builder) writeBlockOffsets(builder *fbs.Builder, offsets [][]byte) []fbs.UOffsetT {
 	var uoffs []fbs.UOffsetT
-	for i := len(so) - 1; i >= 0; i-- {
+	for i := len(offsets) - 1; i >= 0; i-- {
 		// We add these in reverse order.
-		data, _ := b.offsets.Slice(so[i])
-		uoff := b.writeBlockOffset(builder, data)
+		uoff := b.writeBlockOffset(builder, offsets[i])
 		uoffs = append(uoffs, uoff)
 	}
 	return uoffs
@@ -91,13 +91,51 @@ func TestTableIndex(t *testing.T) {
 				IndexCache:           cache,
 			},
 		},
+		{
+			// Authenticated encryption mode.
+			name: "Only GCM encryption",
+			opts: Options{
+				BlockSize:          4 * 1024,
+				BloomFalsePositive: 0.01,
+				TableSize:          30 << 20,
+				DataKey:            &pb.DataKey{Data: key, EncryptionAlgo: pb.EncryptionAlgo_aes_gcm},
+				IndexCache:         cache,
+			},
+		},
+		{
+			// Partitioned index.
+			name: "Partitioned index",
+			opts: Options{
+				BlockSize:          4 * 1024,
+				BloomFalsePositive: 0.01,
+				TableSize:          30 << 20,
+				IndexPartitionSize: 16,
+				BlockCache:         cache,
+			},
+		},
+		{
+			// Partitioned index along with compression and encryption.
+			name: "Partitioned index with compression and encryption",
+			opts: Options{
+				BlockSize:            4 * 1024,
+				BloomFalsePositive:   0.01,
+				TableSize:            30 << 20,
+				Compression:          options.ZSTD,
+				ZSTDCompressionLevel: 3,
+				DataKey:              &pb.DataKey{Data: key},
+				IndexCache:           cache,
+				IndexPartitionSize:   16,
+				BlockCache:           cache,
+			},
+		},
 	}
 
 	for _, tt := range subTest {
 		t.Run(tt.name, func(t *testing.T) {
 			opt := tt.opts
+			opt.TableID = uint64(rand.Uint32())
 			builder := NewTableBuilder(opt)
-			filename := fmt.Sprintf("%s%c%d.sst", os.TempDir(), os.PathSeparator, rand.Uint32())
+			filename := NewFilename(opt.TableID, os.TempDir())
 
 			blockFirstKeys := make([][]byte, 0)
 			blockCount := 0
@@ -124,13 +162,19 @@ func TestTableIndex(t *testing.T) {
 
 			// Ensure index is built correctly
 			require.Equal(t, blockCount, tbl.offsetsLength())
-			idx, err := tbl.readTableIndex()
-			require.NoError(t, err)
-			for i := 0; i < idx.OffsetsLength(); i++ {
+			for i := 0; i < tbl.offsetsLength(); i++ {
 				var bo fb.BlockOffset
-				require.True(t, idx.Offsets(&bo, i))
+				require.NoError(t, tbl.offsets(&bo, i))
 				require.Equal(t, blockFirstKeys[i], bo.KeyBytes())
 			}
+			idx, err := tbl.readTableIndex()
+			require.NoError(t, err)
+			if opt.IndexPartitionSize > 0 {
+				numPartitions := (blockCount + opt.IndexPartitionSize - 1) / opt.IndexPartitionSize
+				require.Equal(t, numPartitions, idx.OffsetsLength())
+			} else {
+				require.Equal(t, blockCount, idx.OffsetsLength())
+			}
 			require.Equal(t, keysCount, int(tbl.MaxVersion()))
 			tbl.Close(-1)
 			require.NoError(t, os.RemoveAll(filename))
@@ -155,6 +199,66 @@ func TestInvalidCompression(t *testing.T) {
 	})
 }
 
+func TestTamperedGCMBlock(t *testing.T) {
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1000,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	key := make([]byte, 32)
+	rand.Read(key)
+	opts := Options{
+		BlockSize:  4 << 10,
+		DataKey:    &pb.DataKey{Data: key, EncryptionAlgo: pb.EncryptionAlgo_aes_gcm},
+		IndexCache: cache,
+	}
+	tbl := buildTestTable(t, "key", 1000, opts)
+	defer func() { require.NoError(t, tbl.DecrRef()) }()
+
+	_, err = tbl.block(0, false)
+	require.NoError(t, err)
+	// Flip a bit of the first block.
+	tbl.MmapFile.Data[1] ^= 1
+	_, err = tbl.block(0, false)
+	require.Equal(t, y.ErrDecryptionFailed, err)
+}
+
+func TestMovedGCMBlock(t *testing.T) {
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1000,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	key := make([]byte, 32)
+	rand.Read(key)
+	opts := Options{
+		BlockSize:  4 << 10,
+		DataKey:    &pb.DataKey{Data: key, EncryptionAlgo: pb.EncryptionAlgo_aes_gcm},
+		IndexCache: cache,
+	}
+	tbl := buildTestTable(t, "key", 1000, opts)
+	defer func() { require.NoError(t, tbl.DecrRef()) }()
+	other := buildTestTable(t, "key", 1000, opts)
+	defer func() { require.NoError(t, other.DecrRef()) }()
+
+	var ko fb.BlockOffset
+	require.NoError(t, tbl.offsets(&ko, 1))
+	data, err := tbl.read(int(ko.Offset()), int(ko.Len()))
+	require.NoError(t, err)
+	_, err = tbl.decrypt(data, false, 1)
+	require.NoError(t, err)
+
+	// The block can't be read at another position of the table, nor in another table.
+	_, err = tbl.decrypt(data, false, 0)
+	require.Equal(t, y.ErrDecryptionFailed, err)
+	_, err = tbl.decrypt(data, false, indexPosition)
+	require.Equal(t, y.ErrDecryptionFailed, err)
+	_, err = other.decrypt(data, false, 1)
+	require.Equal(t, y.ErrDecryptionFailed, err)
+}
+
 func BenchmarkBuilder(b *testing.B) {
 	rand.Seed(time.Now().Unix())
 	key := func(i int) []byte {
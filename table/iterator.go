@@ -18,6 +18,7 @@ package table
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
 	"sort"
 
@@ -33,6 +34,7 @@ type blockIterator struct {
 	key          []byte
 	val          []byte
 	entryOffsets []uint32
+	hashIndex    []byte
 	block        *block
 
 	// prevOverlap stores the overlap of the previous key with the base key.
@@ -55,6 +57,7 @@ func (itr *blockIterator) setBlock(b *block) {
 	// Drop the index from the block. We don't need it anymore.
 	itr.data = b.data[:b.entriesIndexStart]
 	itr.entryOffsets = b.entryOffsets
+	itr.hashIndex = b.hashIndex
 }
 
 // setIdx sets the iterator to the entry at index i and set it's key and value.
@@ -140,6 +143,43 @@ func (itr *blockIterator) seek(key []byte, whence int) {
 	itr.setIdx(foundEntryIdx)
 }
 
+// hashIndexResult is the outcome of a lookup in the hash index of a block.
+type hashIndexResult int
+
+const (
+	// hashIndexFound means that the iterator has been positioned using the hash index.
+	hashIndexFound hashIndexResult = iota
+	// hashIndexMissing means that the key is not present in the block.
+	hashIndexMissing
+	// hashIndexUnknown means that the hash index can't tell where the key is, either because the
+	// block has no hash index or because of a collision.
+	hashIndexUnknown
+)
+
+// seekHash brings us to the first block element that is >= input key, using the hash index of the
+// block. hash is the hash of the key without its timestamp. The iterator is not moved unless the
+// result is hashIndexFound.
+func (itr *blockIterator) seekHash(key []byte, hash uint32) hashIndexResult {
+	numBuckets := uint32(len(itr.hashIndex) / 2)
+	if numBuckets == 0 {
+		return hashIndexUnknown
+	}
+	bucket := hash % numBuckets
+	switch idx := binary.BigEndian.Uint16(itr.hashIndex[2*bucket:]); idx {
+	case hashIndexEmpty:
+		return hashIndexMissing
+	case hashIndexCollision:
+		return hashIndexUnknown
+	default:
+		// idx points to the newest version of the key. Skip the versions newer than the
+		// input key.
+		for itr.setIdx(int(idx)); itr.Valid() && y.CompareKeys(itr.key, key) < 0; {
+			itr.next()
+		}
+		return hashIndexFound
+	}
+}
+
 // seekToFirst brings us to the first element.
 func (itr *blockIterator) seekToFirst() {
 	itr.setIdx(0)
@@ -252,12 +292,11 @@ func (itr *Iterator) seekFrom(key []byte, whence int) {
 	case current:
 	}
 
-	var ko fb.BlockOffset
-	idx := sort.Search(itr.t.offsetsLength(), func(idx int) bool {
-		// Offsets should never return false since we're iterating within the OffsetsLength.
-		y.AssertTrue(itr.t.offsets(&ko, idx))
-		return y.CompareKeys(ko.KeyBytes(), key) > 0
-	})
+	idx, err := itr.searchBlock(key)
+	if err != nil {
+		itr.err = err
+		return
+	}
 	if idx == 0 {
 		// The smallest key in our table is already strictly > key. We can return that.
 		// This is like a SeekToFirst.
@@ -285,6 +324,65 @@ func (itr *Iterator) seekFrom(key []byte, whence int) {
 	// Case 2: No need to do anything. We already did the seek in block[idx-1].
 }
 
+// searchBlock returns the index of the first block whose smallest key is > key. It fails if a
+// partition of the index can't be read.
+func (itr *Iterator) searchBlock(key []byte) (int, error) {
+	var ko fb.BlockOffset
+	var err error
+	idx := sort.Search(itr.t.offsetsLength(), func(idx int) bool {
+		if err != nil {
+			return true
+		}
+		if err = itr.t.offsets(&ko, idx); err != nil {
+			return true
+		}
+		return y.CompareKeys(ko.KeyBytes(), key) > 0
+	})
+	return idx, err
+}
+
+// seekPoint is like seek, but it's meant for point lookups. It uses the hash index of the blocks
+// if the table has one. In that case, if the table doesn't have the key, the iterator may be
+// positioned at any key > input key instead of the first one.
+func (itr *Iterator) seekPoint(key []byte, hash uint32) {
+	if !itr.t.blockHashIndex {
+		itr.seek(key)
+		return
+	}
+	itr.reset()
+
+	idx, err := itr.searchBlock(key)
+	if err != nil {
+		itr.err = err
+		return
+	}
+	if idx == 0 {
+		// The smallest key in our table is already strictly > key.
+		itr.seekHelper(0, key)
+		return
+	}
+
+	itr.bpos = idx - 1
+	block, err := itr.t.block(itr.bpos, itr.useCache())
+	if err != nil {
+		itr.err = err
+		return
+	}
+	itr.bi.setBlock(block)
+	switch itr.bi.seekHash(key, hash) {
+	case hashIndexMissing:
+		// The key is not in block[idx-1]. If the table has it, it can only be at the start
+		// of block[idx].
+		itr.bi.err = io.EOF
+	case hashIndexUnknown:
+		itr.bi.seek(key, origin)
+	}
+	itr.err = itr.bi.Error()
+	if itr.err == io.EOF && idx < itr.t.offsetsLength() {
+		itr.seekHelper(idx, key)
+	}
+}
+
 // seek will reset iterator and seek to >= key.
 func (itr *Iterator) seek(key []byte) {
 	itr.seekFrom(key, origin)
@@ -403,6 +501,18 @@ func (itr *Iterator) Seek(key []byte) {
 	}
 }
 
+// SeekPoint is like Seek, but it is meant for point lookups of the given key, and hash must be the
+// hash of the key without its timestamp. If the table was built with a block hash index, it is
+// used to find the key within its block. If the table doesn't have the key, the iterator is
+// positioned at some key greater than it, not necessarily the next one.
+func (itr *Iterator) SeekPoint(key []byte, hash uint32) {
+	if itr.opt&REVERSED == 0 {
+		itr.seekPoint(key, hash)
+	} else {
+		itr.seekForPrev(key)
+	}
+}
+
 var (
 	REVERSED int = 2
 	NOCACHE  int = 4
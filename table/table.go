@@ -80,6 +80,33 @@ type Options struct {
 
 	// ZSTDCompressionLevel is the ZSTD compression level used for compressing blocks.
 	ZSTDCompressionLevel int
+
+	// ZSTDDictSize is the size of the ZSTD dictionary trained for each table on its first blocks.
+	// No dictionary is used if it is zero.
+	ZSTDDictSize int
+
+	// DirectIO makes the table files get written and read using direct I/O instead of mmap.
+	DirectIO bool
+
+	// IndexPartitionSize is the number of block offsets stored in each index partition. The index
+	// isn't partitioned if it is zero.
+	IndexPartitionSize int
+
+	// FilterType is the type of the filter built for each table.
+	FilterType options.FilterType
+
+	// BlockHashIndex makes the builder add a hash index of the keys to each block, which is used
+	// to find the position of a key in a block without a binary search.
+	BlockHashIndex bool
+
+	// TableID is the ID of the table being built. With AES-GCM, the blocks and the index are
+	// authenticated along with the ID of their table, so it must match the ID the table is
+	// opened with.
+	TableID uint64
+
+	// Warningf logs the problems the builder works around, like a ZSTD dictionary that can't be
+	// used. Nothing is logged if it is nil.
+	Warningf func(format string, args ...interface{})
 }
 
 // TableInterface is useful for testing.
@@ -109,6 +136,9 @@ type Table struct {
 	indexStart     int
 	indexLen       int
 	hasBloomFilter bool
+	filterType     options.FilterType
+	blockHashIndex bool
+	zstdDec        *y.ZSTDDecoder // Set if the blocks are compressed with a ZSTD dictionary.
 
 	IsInmemory bool // Set to true if the table is on level 0 and opened in memory.
 	opt        *Options
@@ -140,6 +170,13 @@ func (t *Table) DecrRef() error {
 		for i := 0; i < t.offsetsLength(); i++ {
 			t.opt.BlockCache.Del(t.blockCacheKey(i))
 		}
+		for i := 0; i < t.numPartitions(); i++ {
+			t.opt.BlockCache.Del(t.partitionCacheKey(i))
+		}
+		// A table opened in read only mode belongs to another process, which deletes it.
+		if t.opt.ReadOnly {
+			return t.Close(-1)
+		}
 		if err := t.Delete(); err != nil {
 			return err
 		}
@@ -158,8 +195,9 @@ type block struct {
 	offset            int
 	data              []byte
 	checksum          []byte
-	entriesIndexStart int      // start index of entryOffsets list
+	entriesIndexStart int      // start index of entryOffsets list (or of hashIndex, if any)
 	entryOffsets      []uint32 // used to binary search an entry in the block.
+	hashIndex         []byte   // used to find an entry in the block by the hash of its key.
 	chkLen            int      // checksum length.
 	freeMe            bool     // used to determine if the blocked should be reused.
 	ref               int32
@@ -214,7 +252,7 @@ func (b *block) decrRef() {
 }
 func (b *block) size() int64 {
 	return int64(3*intSize /* Size of the offset, entriesIndexStart and chkLen */ +
-		cap(b.data) + cap(b.checksum) + cap(b.entryOffsets)*4)
+		cap(b.data) + cap(b.checksum) + cap(b.entryOffsets)*4 + cap(b.hashIndex))
 }
 
 func (b block) verifyCheckSum() error {
@@ -226,6 +264,9 @@ func (b block) verifyCheckSum() error {
 }
 
 func CreateTable(fname string, data []byte, opts Options) (*Table, error) {
+	if opts.DirectIO {
+		return createDirectTable(fname, data, opts)
+	}
 	mf, err := z.OpenMmapFile(fname, os.O_CREATE|os.O_RDWR|os.O_EXCL, len(data))
 	if err == z.NewFile {
 		// Expected.
@@ -244,6 +285,36 @@ func CreateTable(fname string, data []byte, opts Options) (*Table, error) {
 	return OpenTable(mf, opts)
 }
 
+func createDirectTable(fname string, data []byte, opts Options) (*Table, error) {
+	fd, err := y.OpenDirectFile(fname, os.O_CREATE|os.O_RDWR|os.O_EXCL)
+	if err != nil {
+		return nil, y.Wrapf(err, "while creating table: %s", fname)
+	}
+	if err := y.WriteDirect(fd, data); err != nil {
+		fd.Close()
+		return nil, y.Wrapf(err, "while writing table: %s", fname)
+	}
+	if opts.SyncWrites {
+		if err := fd.Sync(); err != nil {
+			fd.Close()
+			return nil, y.Wrapf(err, "while calling fsync on %s", fname)
+		}
+	}
+	return OpenTable(&z.MmapFile{Fd: fd}, opts)
+}
+
+// OpenDirectTable opens the table file at the given path using direct I/O. The file is not memory
+// mapped. Instead, the blocks are read from the disk on demand, bypassing the page cache, so a
+// block cache should be used along with it.
+func OpenDirectTable(fname string, flag int, opts Options) (*Table, error) {
+	fd, err := y.OpenDirectFile(fname, flag)
+	if err != nil {
+		return nil, y.Wrapf(err, "while opening table: %s", fname)
+	}
+	opts.DirectIO = true
+	return OpenTable(&z.MmapFile{Fd: fd}, opts)
+}
+
 // OpenTable assumes file has only one table and opens it. Takes ownership of fd upon function
 // entry. Returns a table with one reference count on it (decrementing which may delete the file!
 // -- consider t.Close() instead). The fd has to writeable because we call Truncate on it before
@@ -256,14 +327,14 @@ func OpenTable(mf *z.MmapFile, opts Options) (*Table, error) {
 	}
 	fileInfo, err := mf.Fd.Stat()
 	if err != nil {
-		mf.Close(-1)
+		closeFile(mf, opts, -1)
 		return nil, y.Wrap(err, "")
 	}
 
 	filename := fileInfo.Name()
 	id, ok := ParseFileID(filename)
 	if !ok {
-		mf.Close(-1)
+		closeFile(mf, opts, -1)
 		return nil, errors.Errorf("Invalid filename: %s", filename)
 	}
 	t := &Table{
@@ -276,12 +347,13 @@ func OpenTable(mf *z.MmapFile, opts Options) (*Table, error) {
 	}
 
 	if err := t.initBiggestAndSmallest(); err != nil {
+		t.Close(-1)
 		return nil, y.Wrapf(err, "failed to initialize table")
 	}
 
 	if opts.ChkMode == options.OnTableRead || opts.ChkMode == options.OnTableAndBlockRead {
 		if err := t.VerifyChecksum(); err != nil {
-			mf.Close(-1)
+			t.Close(-1)
 			return nil, y.Wrapf(err, "failed to verify checksum")
 		}
 	}
@@ -311,6 +383,45 @@ func OpenInMemoryTable(data []byte, id uint64, opt *Options) (*Table, error) {
 	return t, nil
 }
 
+// closeFile closes the file backing a table. The file isn't memory mapped if it was opened using
+// direct I/O.
+func closeFile(mf *z.MmapFile, opts Options, maxSz int64) error {
+	if !opts.DirectIO || mf.Fd == nil {
+		return mf.Close(maxSz)
+	}
+	if maxSz >= 0 {
+		if err := mf.Fd.Truncate(maxSz); err != nil {
+			return y.Wrapf(err, "while truncating file: %s", mf.Fd.Name())
+		}
+	}
+	return mf.Fd.Close()
+}
+
+// Close closes the table file, truncating it to maxSz if maxSz is not negative.
+func (t *Table) Close(maxSz int64) error {
+	t.closeDecoder()
+	return closeFile(t.MmapFile, *t.opt, maxSz)
+}
+
+// Delete removes the table file.
+func (t *Table) Delete() error {
+	t.closeDecoder()
+	if !t.opt.DirectIO || t.Fd == nil {
+		return y.DeleteMmapFile(t.MmapFile)
+	}
+	if err := t.Fd.Close(); err != nil {
+		return y.Wrapf(err, "while closing file: %s", t.Fd.Name())
+	}
+	return os.Remove(t.Fd.Name())
+}
+
+func (t *Table) closeDecoder() {
+	if t.zstdDec != nil {
+		t.zstdDec.Close()
+		t.zstdDec = nil
+	}
+}
+
 func (t *Table) initBiggestAndSmallest() error {
 	var err error
 	var ko *fb.BlockOffset
@@ -331,15 +442,12 @@ func (t *Table) initBiggestAndSmallest() error {
 }
 
 func (t *Table) read(off, sz int) ([]byte, error) {
+	if t.opt.DirectIO && !t.IsInmemory {
+		return y.ReadDirect(t.Fd, off, sz)
+	}
 	return t.Bytes(off, sz)
 }
 
-func (t *Table) readNoFail(off, sz int) []byte {
-	res, err := t.read(off, sz)
-	y.Check(err)
-	return res
-}
-
 // initIndex reads the index and populate the necessary table fields and returns
 // first block offset
 func (t *Table) initIndex() (*fb.BlockOffset, error) {
@@ -347,7 +455,10 @@ func (t *Table) initIndex() (*fb.BlockOffset, error) {
 
 	// Read checksum len from the last 4 bytes.
 	readPos -= 4
-	buf := t.readNoFail(readPos, 4)
+	buf, err := t.read(readPos, 4)
+	if err != nil {
+		return nil, y.Wrapf(err, "failed to read checksum length of table: %s", t.Filename())
+	}
 	checksumLen := int(y.BytesToU32(buf))
 	if checksumLen < 0 {
 		return nil, errors.New("checksum length less than zero. Data corrupted")
@@ -356,20 +467,27 @@ func (t *Table) initIndex() (*fb.BlockOffset, error) {
 	// Read checksum.
 	expectedChk := &pb.Checksum{}
 	readPos -= checksumLen
-	buf = t.readNoFail(readPos, checksumLen)
+	if buf, err = t.read(readPos, checksumLen); err != nil {
+		return nil, y.Wrapf(err, "failed to read checksum of table: %s", t.Filename())
+	}
 	if err := proto.Unmarshal(buf, expectedChk); err != nil {
 		return nil, err
 	}
 
 	// Read index size from the footer.
 	readPos -= 4
-	buf = t.readNoFail(readPos, 4)
+	if buf, err = t.read(readPos, 4); err != nil {
+		return nil, y.Wrapf(err, "failed to read index length of table: %s", t.Filename())
+	}
 	t.indexLen = int(y.BytesToU32(buf))
 
 	// Read index.
 	readPos -= t.indexLen
 	t.indexStart = readPos
-	data := t.readNoFail(readPos, t.indexLen)
+	data, err := t.read(readPos, t.indexLen)
+	if err != nil {
+		return nil, y.Wrapf(err, "failed to read index of table: %s", t.Filename())
+	}
 
 	if err := y.VerifyChecksum(data, expectedChk); err != nil {
 		return nil, y.Wrapf(err, "failed to verify checksum for table: %s", t.Filename())
@@ -396,6 +514,14 @@ func (t *Table) initIndex() (*fb.BlockOffset, error) {
 		t.estimatedSize = uint32(t.tableSize)
 	}
 	t.hasBloomFilter = len(index.BloomFilterBytes()) > 0
+	t.filterType = options.FilterType(index.FilterType())
+	t.blockHashIndex = index.BlockHashIndex()
+	if dict := index.CompressionDictBytes(); len(dict) > 0 {
+		if t.zstdDec, err = y.NewZSTDDecoder(dict); err != nil {
+			return nil, y.Wrapf(err, "failed to read compression dictionary of table: %s",
+				t.Filename())
+		}
+	}
 
 	var bo fb.BlockOffset
 	y.AssertTrue(index.Offsets(&bo, 0))
@@ -420,7 +546,11 @@ func (t *Table) KeySplits(n int, prefix []byte) []string {
 		if i >= oLen {
 			i = oLen - 1
 		}
-		y.AssertTrue(t.offsets(&bo, i))
+		if err := t.offsets(&bo, i); err != nil {
+			// The splits are only hints, so return the ones found so far. The error shows up
+			// again when the blocks are read.
+			break
+		}
 		if bytes.HasPrefix(bo.KeyBytes(), prefix) {
 			res = append(res, string(bo.KeyBytes()))
 		}
@@ -446,12 +576,110 @@ func (t *Table) fetchIndex() *fb.TableIndex {
 	return index
 }
 
+// offsetsLength returns the number of blocks in the table.
 func (t *Table) offsetsLength() int {
-	return t.fetchIndex().OffsetsLength()
+	index := t.fetchIndex()
+	if index.PartitionSize() > 0 {
+		return int(index.NumBlocks())
+	}
+	return index.OffsetsLength()
+}
+
+// offsets reads the blockOffset of the i-th block into ko. If the index is partitioned, the
+// partition holding the blockOffset is loaded first, and an error is returned if it can't be read.
+func (t *Table) offsets(ko *fb.BlockOffset, i int) error {
+	index := t.fetchIndex()
+	partitionSize := int(index.PartitionSize())
+	if partitionSize == 0 {
+		if !index.Offsets(ko, i) {
+			return errors.Errorf("block %d out of index", i)
+		}
+		return nil
+	}
+	if i < 0 || i >= int(index.NumBlocks()) {
+		return errors.Errorf("block %d out of index", i)
+	}
+	partition, err := t.indexPartition(index, i/partitionSize)
+	if err != nil {
+		return err
+	}
+	if !partition.Offsets(ko, i%partitionSize) {
+		return errors.Errorf("block %d out of index partition %d", i, i/partitionSize)
+	}
+	return nil
 }
 
-func (t *Table) offsets(ko *fb.BlockOffset, i int) bool {
-	return t.fetchIndex().Offsets(ko, i)
+// numPartitions returns the number of index partitions in the table. It is zero if the index isn't
+// partitioned.
+func (t *Table) numPartitions() int {
+	index := t.fetchIndex()
+	if index.PartitionSize() == 0 {
+		return 0
+	}
+	return index.OffsetsLength()
+}
+
+// indexPartition returns the idx-th partition of the given partitioned index. The partitions are
+// stored in the block cache along with the blocks.
+func (t *Table) indexPartition(index *fb.TableIndex, idx int) (*fb.TableIndex, error) {
+	if t.opt.BlockCache != nil {
+		if val, ok := t.opt.BlockCache.Get(t.partitionCacheKey(idx)); ok && val != nil {
+			return val.(*fb.TableIndex), nil
+		}
+	}
+
+	var po fb.BlockOffset
+	if !index.Offsets(&po, idx) {
+		return nil, errors.Errorf("index partition %d out of index", idx)
+	}
+	data, err := t.read(int(po.Offset()), int(po.Len()))
+	if err != nil {
+		return nil, y.Wrapf(err, "failed to read index partition from file: %s at offset: %d, len: %d",
+			t.Filename(), po.Offset(), po.Len())
+	}
+
+	// Read checksum len from the last 4 bytes.
+	readPos := len(data) - 4
+	if readPos < 0 {
+		return nil, errors.Errorf("invalid index partition %d in table: %s", idx, t.Filename())
+	}
+	checksumLen := int(y.BytesToU32(data[readPos:]))
+	if checksumLen > readPos-4 {
+		return nil, errors.New("invalid checksum length. Either the data is " +
+			"corrupted or the table options are incorrectly set")
+	}
+	expectedChk := &pb.Checksum{}
+	readPos -= checksumLen
+	if err := proto.Unmarshal(data[readPos:readPos+checksumLen], expectedChk); err != nil {
+		return nil, err
+	}
+	readPos -= 4
+	partitionLen := int(y.BytesToU32(data[readPos : readPos+4]))
+	if partitionLen != readPos {
+		return nil, errors.Errorf("invalid length of index partition %d in table: %s",
+			idx, t.Filename())
+	}
+	data = data[:partitionLen]
+	if err := y.VerifyChecksum(data, expectedChk); err != nil {
+		return nil, y.Wrapf(err, "failed to verify checksum of index partition %d for table: %s",
+			idx, t.Filename())
+	}
+
+	if t.shouldDecrypt() {
+		if data, err = t.decrypt(data, false, partitionPosition+uint64(idx)); err != nil {
+			return nil, y.Wrapf(err,
+				"Error while decrypting index partition %d for the table %d", idx, t.id)
+		}
+	}
+	if t.opt.BlockCache != nil && !t.shouldDecrypt() {
+		// The cached partition can outlive the table, so it can't point into its mmap.
+		data = y.Copy(data)
+	}
+	partition := fb.GetRootAsTableIndex(data, 0)
+	if t.opt.BlockCache != nil {
+		t.opt.BlockCache.Set(t.partitionCacheKey(idx), partition, int64(len(data)))
+	}
+	return partition, nil
 }
 
 // block function return a new block. Each block holds a ref and the byte
@@ -476,7 +704,10 @@ func (t *Table) block(idx int, useCache bool) (*block, error) {
 	}
 
 	var ko fb.BlockOffset
-	y.AssertTrue(t.offsets(&ko, idx))
+	if err := t.offsets(&ko, idx); err != nil {
+		return nil, y.Wrapf(err, "failed to read offset of block %d in table: %s",
+			idx, t.Filename())
+	}
 	blk := &block{
 		offset: int(ko.Offset()),
 		ref:    1,
@@ -493,7 +724,7 @@ func (t *Table) block(idx int, useCache bool) (*block, error) {
 
 	if t.shouldDecrypt() {
 		// Decrypt the block if it is encrypted.
-		if blk.data, err = t.decrypt(blk.data, true); err != nil {
+		if blk.data, err = t.decrypt(blk.data, true, uint64(idx)); err != nil {
 			return nil, err
 		}
 		// blk.data is allocated via Calloc. So, do free.
@@ -530,6 +761,18 @@ func (t *Table) block(idx int, useCache bool) (*block, error) {
 
 	blk.entriesIndexStart = entriesIndexStart
 
+	if t.blockHashIndex {
+		// The hash index and its number of buckets are stored right before the entry offsets.
+		numBuckets := int(y.BytesToU32(blk.data[entriesIndexStart-4 : entriesIndexStart]))
+		hashIndexStart := entriesIndexStart - 4 - 2*numBuckets
+		if hashIndexStart < 0 {
+			return nil, errors.New("invalid hash index size. Either the data is " +
+				"corrupted or the table options are incorrectly set")
+		}
+		blk.hashIndex = blk.data[hashIndexStart : entriesIndexStart-4]
+		blk.entriesIndexStart = hashIndexStart
+	}
+
 	// Drop checksum and checksum length.
 	// The checksum is calculated for actual data + entry index + index length
 	blk.data = blk.data[:readPos+4]
@@ -570,6 +813,15 @@ func (t *Table) blockCacheKey(idx int) []byte {
 	return buf
 }
 
+// partitionCacheKey is used to store index partitions in the block cache. The key is one byte
+// longer than the block cache keys so that they never collide.
+func (t *Table) partitionCacheKey(idx int) []byte {
+	buf := make([]byte, 9)
+	buf[0] = 'p'
+	copy(buf[1:], t.blockCacheKey(idx))
+	return buf
+}
+
 // indexKey returns the cache key for block offsets. blockOffsets
 // are stored in the index cache.
 func (t *Table) indexKey() uint64 {
@@ -616,7 +868,7 @@ func (t *Table) Filename() string { return t.Fd.Name() }
 func (t *Table) ID() uint64 { return t.id }
 
 // DoesNotHave returns true if and only if the table does not have the key hash.
-// It does a bloom filter lookup.
+// It does a lookup in the filter of the table, bloom or ribbon.
 func (t *Table) DoesNotHave(hash uint32) bool {
 	if !t.hasBloomFilter {
 		return false
@@ -624,7 +876,12 @@ func (t *Table) DoesNotHave(hash uint32) bool {
 
 	index := t.fetchIndex()
 	bf := index.BloomFilterBytes()
-	return !y.Filter(bf).MayContain(hash)
+	switch t.filterType {
+	case options.RibbonFilter:
+		return !y.RibbonFilter(bf).MayContain(hash)
+	default:
+		return !y.Filter(bf).MayContain(hash)
+	}
 }
 
 // readBloomFilter reads the bloom filter from the SST and returns its length
@@ -639,11 +896,13 @@ func (t *Table) readBloomFilter() (*z.Bloom, int) {
 
 // readTableIndex reads table index from the sst and returns its pb format.
 func (t *Table) readTableIndex() (*fb.TableIndex, error) {
-	data := t.readNoFail(t.indexStart, t.indexLen)
-	var err error
+	data, err := t.read(t.indexStart, t.indexLen)
+	if err != nil {
+		return nil, y.Wrapf(err, "failed to read index of table: %s", t.Filename())
+	}
 	// Decrypt the table index if it is encrypted.
 	if t.shouldDecrypt() {
-		if data, err = t.decrypt(data, false); err != nil {
+		if data, err = t.decrypt(data, false, indexPosition); err != nil {
 			return nil, y.Wrapf(err,
 				"Error while decrypting table index for the table %d in readTableIndex", t.id)
 		}
@@ -654,12 +913,11 @@ func (t *Table) readTableIndex() (*fb.TableIndex, error) {
 // VerifyChecksum verifies checksum for all blocks of table. This function is called by
 // OpenTable() function. This function is also called inside levelsController.VerifyChecksum().
 func (t *Table) VerifyChecksum() error {
-	ti := t.fetchIndex()
-	for i := 0; i < ti.OffsetsLength(); i++ {
+	for i := 0; i < t.offsetsLength(); i++ {
 		b, err := t.block(i, true)
 		if err != nil {
-			return y.Wrapf(err, "checksum validation failed for table: %s, block: %d, offset:%d",
-				t.Filename(), i, b.offset)
+			return y.Wrapf(err, "checksum validation failed for table: %s, block: %d",
+				t.Filename(), i)
 		}
 		// We should not call incrRef here, because the block already has one ref when created.
 		defer b.decrRef()
@@ -691,8 +949,12 @@ func (t *Table) KeyID() uint64 {
 	return 0
 }
 
-// decrypt decrypts the given data. It should be called only after checking shouldDecrypt.
-func (t *Table) decrypt(data []byte, viaCalloc bool) ([]byte, error) {
+// decrypt decrypts the given data, found at the given position in the table (see gcmAAD). It
+// should be called only after checking shouldDecrypt.
+func (t *Table) decrypt(data []byte, viaCalloc bool, pos uint64) ([]byte, error) {
+	if t.opt.DataKey.EncryptionAlgo == pb.EncryptionAlgo_aes_gcm {
+		return t.decryptGCM(data, viaCalloc, pos)
+	}
 	// Last BlockSize bytes of the data is the IV.
 	iv := data[len(data)-aes.BlockSize:]
 	// Rest all bytes are data.
@@ -710,6 +972,34 @@ func (t *Table) decrypt(data []byte, viaCalloc bool) ([]byte, error) {
 	return dst, nil
 }
 
+// decryptGCM authenticates and decrypts the given data, encrypted with AES-GCM at the given
+// position of this table.
+func (t *Table) decryptGCM(data []byte, viaCalloc bool, pos uint64) ([]byte, error) {
+	if len(data) < y.GCMTagSize+y.GCMNonceSize {
+		return nil, y.ErrDecryptionFailed
+	}
+	// Last GCMNonceSize bytes of the data is the nonce.
+	nonce := data[len(data)-y.GCMNonceSize:]
+	// Rest all bytes are the data followed by the authentication tag.
+	data = data[:len(data)-y.GCMNonceSize]
+
+	sz := len(data) - y.GCMTagSize
+	var dst []byte
+	if viaCalloc {
+		dst = z.Calloc(sz)
+	} else {
+		dst = make([]byte, sz)
+	}
+	out, err := y.OpenGCM(dst[:0], data, t.opt.DataKey.Data, nonce, gcmAAD(t.id, pos))
+	if err != nil {
+		if viaCalloc {
+			z.Free(dst)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
 // ParseFileID reads the file id out of a filename.
 func ParseFileID(name string) (uint64, bool) {
 	name = path.Base(name)
@@ -763,7 +1053,11 @@ func (t *Table) decompress(b *block) error {
 	case options.ZSTD:
 		sz := int(float64(t.opt.BlockSize) * 1.2)
 		dst = z.Calloc(sz)
-		b.data, err = y.ZSTDDecompress(dst, b.data)
+		if t.zstdDec != nil {
+			b.data, err = t.zstdDec.Decompress(dst, b.data)
+		} else {
+			b.data, err = y.ZSTDDecompress(dst, b.data)
+		}
 		if err != nil {
 			z.Free(dst)
 			return y.Wrap(err, "failed to decompress")
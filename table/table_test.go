@@ -19,6 +19,8 @@ package table
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"math/rand"
@@ -28,8 +30,10 @@ import (
 	"sync"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/cespare/xxhash"
+	"github.com/dgraph-io/badger/v2/fb"
 	"github.com/dgraph-io/badger/v2/options"
 	"github.com/dgraph-io/badger/v2/y"
 	"github.com/dgraph-io/ristretto"
@@ -65,11 +69,11 @@ func buildTestTable(t *testing.T, prefix string, n int, opts Options) *Table {
 
 // keyValues is n by 2 where n is number of pairs.
 func buildTable(t *testing.T, keyValues [][]string, opts Options) *Table {
+	// TODO: Add test for file garbage collection here. No files should be left after the tests here.
+	opts.TableID = uint64(rand.Uint32())
+	filename := NewFilename(opts.TableID, os.TempDir())
 	b := NewTableBuilder(opts)
 	defer b.Close()
-	// TODO: Add test for file garbage collection here. No files should be left after the tests here.
-
-	filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Uint32())
 
 	sort.Slice(keyValues, func(i, j int) bool {
 		return keyValues[i][0] < keyValues[j][0]
@@ -918,3 +922,268 @@ func TestMaxVersion(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, N, int(table.MaxVersion()))
 }
+
+func TestDirectIOTable(t *testing.T) {
+	if !y.DirectIOSupported() {
+		t.Skip("Direct I/O is not supported")
+	}
+	for _, compression := range []options.CompressionType{options.None, options.ZSTD} {
+		t.Run(fmt.Sprintf("compression=%d", compression), func(t *testing.T) {
+			opts := getTestTableOptions()
+			opts.Compression = compression
+			opts.DirectIO = true
+			tbl := buildTestTable(t, "key", 10000, opts)
+			fname := tbl.Filename()
+			require.NoError(t, tbl.Close(-1))
+
+			tbl, err := OpenDirectTable(fname, os.O_RDWR, opts)
+			require.NoError(t, err)
+			defer tbl.DecrRef()
+			require.Nil(t, tbl.Data)
+
+			it := tbl.NewIterator(0)
+			defer it.Close()
+			count := 0
+			for it.Rewind(); it.Valid(); it.Next() {
+				require.EqualValues(t, y.KeyWithTs([]byte(key("key", count)), 0), it.Key())
+				require.EqualValues(t, fmt.Sprintf("%d", count), string(it.Value().Value))
+				count++
+			}
+			require.Equal(t, 10000, count)
+		})
+	}
+}
+
+func TestDirectIOTableTruncated(t *testing.T) {
+	if !y.DirectIOSupported() {
+		t.Skip("Direct I/O is not supported")
+	}
+	opts := getTestTableOptions()
+	opts.DirectIO = true
+	tbl := buildTestTable(t, "key", 1000, opts)
+	fname := tbl.Filename()
+	require.NoError(t, tbl.Close(-1))
+	defer os.Remove(fname)
+	require.NoError(t, os.Truncate(fname, 100))
+
+	// The read of the index fails, instead of panicking.
+	_, err := OpenDirectTable(fname, os.O_RDWR, opts)
+	require.Error(t, err)
+}
+
+func TestPartitionedIndex(t *testing.T) {
+	opts := getTestTableOptions()
+	opts.IndexPartitionSize = 4
+	tbl := buildTestTable(t, "key", 10000, opts)
+	defer tbl.DecrRef()
+
+	index := tbl.fetchIndex()
+	require.Equal(t, uint32(4), index.PartitionSize())
+	require.Equal(t, tbl.offsetsLength(), int(index.NumBlocks()))
+	require.Greater(t, tbl.numPartitions(), 1)
+
+	it := tbl.NewIterator(0)
+	defer it.Close()
+	for _, i := range []int{0, 1, 4999, 9998, 9999} {
+		k := y.KeyWithTs([]byte(key("key", i)), 0)
+		it.Seek(k)
+		require.True(t, it.Valid())
+		require.EqualValues(t, k, it.Key())
+		require.EqualValues(t, fmt.Sprintf("%d", i), string(it.Value().Value))
+	}
+	count := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		count++
+	}
+	require.Equal(t, 10000, count)
+	require.NoError(t, tbl.VerifyChecksum())
+}
+
+func TestCachedIndexPartition(t *testing.T) {
+	cache, err := ristretto.NewCache(&cacheConfig)
+	require.NoError(t, err)
+	defer cache.Close()
+	opts := getTestTableOptions()
+	opts.IndexPartitionSize = 4
+	opts.BlockCache = cache
+	tbl := buildTestTable(t, "key", 10000, opts)
+	defer tbl.DecrRef()
+
+	_, err = tbl.indexPartition(tbl.fetchIndex(), 1)
+	require.NoError(t, err)
+	cache.Wait()
+	val, ok := cache.Get(tbl.partitionCacheKey(1))
+	require.True(t, ok)
+
+	// The cached partition doesn't point into the mmap of the table, which is unmapped once the
+	// table is closed.
+	buf := val.(*fb.TableIndex).Table().Bytes
+	start := uintptr(unsafe.Pointer(&tbl.Data[0]))
+	end := start + uintptr(len(tbl.Data))
+	ptr := uintptr(unsafe.Pointer(&buf[0]))
+	require.False(t, ptr >= start && ptr < end)
+}
+
+func TestCorruptIndexPartition(t *testing.T) {
+	opts := getTestTableOptions()
+	opts.IndexPartitionSize = 4
+	opts.ChkMode = options.OnTableRead
+	tbl := buildTestTable(t, "key", 10000, opts)
+	// The failed OpenTable closes the file of the table.
+	defer os.Remove(tbl.Filename())
+
+	var po fb.BlockOffset
+	require.True(t, tbl.fetchIndex().Offsets(&po, 1))
+	tbl.Data[po.Offset()] ^= 0xff
+
+	// The checksum failure of the partition is returned, instead of panicking.
+	_, err := OpenTable(tbl.MmapFile, opts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "index partition 1")
+}
+
+func TestFilterType(t *testing.T) {
+	for _, filterType := range []options.FilterType{options.BloomFilter, options.RibbonFilter} {
+		t.Run(fmt.Sprintf("filter=%d", filterType), func(t *testing.T) {
+			opts := getTestTableOptions()
+			opts.FilterType = filterType
+			tbl := buildTestTable(t, "key", 10000, opts)
+			defer tbl.DecrRef()
+
+			require.Equal(t, uint32(filterType), tbl.fetchIndex().FilterType())
+			for i := 0; i < 10000; i++ {
+				require.False(t, tbl.DoesNotHave(y.Hash([]byte(key("key", i)))))
+			}
+			falsePositives := 0
+			for i := 0; i < 10000; i++ {
+				if !tbl.DoesNotHave(y.Hash([]byte(key("absent", i)))) {
+					falsePositives++
+				}
+			}
+			require.Less(t, falsePositives, 500)
+		})
+	}
+}
+
+func TestBlockHashIndex(t *testing.T) {
+	for _, compression := range []options.CompressionType{options.None, options.ZSTD} {
+		t.Run(fmt.Sprintf("compression=%d", compression), func(t *testing.T) {
+			opts := getTestTableOptions()
+			opts.Compression = compression
+			opts.BlockHashIndex = true
+			b := NewTableBuilder(opts)
+			defer b.Close()
+
+			// Each key has versions 3, 2 and 1, so that some keys span two blocks.
+			n := 5000
+			for i := 0; i < n; i++ {
+				for version := uint64(3); version > 0; version-- {
+					b.Add(y.KeyWithTs([]byte(key("key", i)), version),
+						y.ValueStruct{Value: []byte(fmt.Sprintf("%d-%d", i, version))}, 0)
+				}
+			}
+			filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator),
+				rand.Uint32())
+			tbl, err := CreateTable(filename, b.Finish(false), opts)
+			require.NoError(t, err)
+			defer tbl.DecrRef()
+			require.True(t, tbl.fetchIndex().BlockHashIndex())
+
+			it := tbl.NewIterator(0)
+			defer it.Close()
+			count := 0
+			for it.Rewind(); it.Valid(); it.Next() {
+				count++
+			}
+			require.Equal(t, 3*n, count)
+
+			for i := 0; i < n; i++ {
+				k := []byte(key("key", i))
+				for readTs := uint64(1); readTs <= 4; readTs++ {
+					version := readTs
+					if version > 3 {
+						version = 3
+					}
+					it.SeekPoint(y.KeyWithTs(k, readTs), y.Hash(k))
+					require.True(t, it.Valid())
+					require.EqualValues(t, y.KeyWithTs(k, version), it.Key())
+					require.EqualValues(t, fmt.Sprintf("%d-%d", i, version), string(it.Value().Value))
+				}
+				// Absent keys fall between the keys of the table.
+				absent := []byte(key("key", i) + "x")
+				it.SeekPoint(y.KeyWithTs(absent, 1), y.Hash(absent))
+				require.False(t, it.Valid() && y.SameKey(absent, it.Key()))
+			}
+		})
+	}
+}
+
+func TestZSTDDictionary(t *testing.T) {
+	if !y.CgoEnabled {
+		t.Skip("ZSTD requires cgo")
+	}
+	build := func(dictSize int) *Table {
+		opts := getTestTableOptions()
+		opts.BlockSize = 1024
+		opts.ZSTDCompressionLevel = 1
+		opts.ZSTDDictSize = dictSize
+		return buildTestTable(t, "some-fairly-long-key-prefix-", 10000, opts)
+	}
+	plain := build(0)
+	defer plain.DecrRef()
+	tbl := build(16 << 10)
+	defer tbl.DecrRef()
+
+	dict := tbl.fetchIndex().CompressionDictBytes()
+	require.NotEmpty(t, dict)
+	require.True(t, len(dict) <= 16<<10)
+	// A trained dictionary starts with the magic number of the ZSTD dictionaries.
+	require.Equal(t, uint32(0xEC30A437), binary.LittleEndian.Uint32(dict))
+	require.Empty(t, plain.fetchIndex().CompressionDictBytes())
+	require.Less(t, tbl.Size(), plain.Size())
+
+	it := tbl.NewIterator(0)
+	defer it.Close()
+	count := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		k := y.KeyWithTs([]byte(key("some-fairly-long-key-prefix-", count)), 0)
+		require.EqualValues(t, k, it.Key())
+		require.EqualValues(t, fmt.Sprintf("%d", count), string(it.Value().Value))
+		count++
+	}
+	require.Equal(t, 10000, count)
+}
+
+func TestZSTDDictionaryEncoderError(t *testing.T) {
+	if !y.CgoEnabled {
+		t.Skip("ZSTD requires cgo")
+	}
+	defer func(f func([]byte, int) (*y.ZSTDEncoder, error)) { newZSTDEncoder = f }(newZSTDEncoder)
+	newZSTDEncoder = func([]byte, int) (*y.ZSTDEncoder, error) {
+		return nil, errors.New("no encoder")
+	}
+
+	var warnings []string
+	opts := getTestTableOptions()
+	opts.BlockSize = 1024
+	opts.ZSTDCompressionLevel = 1
+	opts.ZSTDDictSize = 16 << 10
+	opts.Warningf = func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	// The table is built with plain ZSTD, instead of panicking.
+	tbl := buildTestTable(t, "key", 10000, opts)
+	defer tbl.DecrRef()
+	require.Empty(t, tbl.fetchIndex().CompressionDictBytes())
+	require.Len(t, warnings, 1)
+	require.Contains(t, warnings[0], "no encoder")
+
+	it := tbl.NewIterator(0)
+	defer it.Close()
+	count := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		require.EqualValues(t, fmt.Sprintf("%d", count), string(it.Value().Value))
+		count++
+	}
+	require.Equal(t, 10000, count)
+}
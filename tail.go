@@ -0,0 +1,467 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2/skl"
+	"github.com/dgraph-io/badger/v2/table"
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// tailer follows the writes of the process writing to the directory of a DB opened with
+// Options.TailInterval. On every refresh, it reads the entries appended to the memtable WALs of the
+// writer, and picks up the tables its flushes and compactions added to the MANIFEST. The value log
+// files are opened on demand, by getTailedFileRLocked.
+type tailer struct {
+	sync.Mutex // Serializes the refreshes.
+	db         *DB
+	mts        map[int]*tailedMemTable
+}
+
+// tailedMemTable is a memtable of the writer, loaded from its WAL up to offset.
+type tailedMemTable struct {
+	mt     *memTable
+	offset uint32
+}
+
+// errTableGone is returned by syncLevels if a table of the MANIFEST was deleted by a compaction of
+// the writer before it could be opened.
+var errTableGone = errors.New("Table deleted while tailing the MANIFEST")
+
+func newTailer(db *DB) *tailer {
+	return &tailer{db: db, mts: make(map[int]*tailedMemTable)}
+}
+
+// newTailedMutableMemTable returns the mutable memtable of a DB tailing another process. The DB
+// being read only, it stays empty, so it doesn't need a WAL.
+func newTailedMutableMemTable(opt Options) *memTable {
+	return &memTable{
+		sl:  skl.NewSkiplist(1 << 20),
+		opt: opt,
+		buf: &bytes.Buffer{},
+	}
+}
+
+func (t *tailer) run(lc *z.Closer) {
+	defer lc.Done()
+
+	ticker := time.NewTicker(t.db.opt.TailInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lc.HasBeenClosed():
+			t.close()
+			return
+		case <-ticker.C:
+			if err := t.refresh(); err != nil {
+				t.db.opt.Warningf("While tailing %s: %v", t.db.opt.Dir, err)
+			}
+		}
+	}
+}
+
+// refresh loads the writes made to the directory since the last refresh, and then makes them
+// visible to the new transactions.
+func (t *tailer) refresh() error {
+	t.Lock()
+	defer t.Unlock()
+
+	// The data keys are written to the registry before any file uses them.
+	if err := t.db.registry.reload(); err != nil {
+		return y.Wrapf(err, "while reloading the key registry")
+	}
+	// The memtables must be tailed before the MANIFEST is read, so that a memtable whose WAL is
+	// gone has been flushed to a table we will find in it.
+	listed, err := t.tailMemTables()
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err = t.syncLevels()
+		if err != errTableGone || attempt == 2 {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	t.dropMemTables(listed)
+	t.db.vlog.dropTailedFiles()
+
+	if !t.db.opt.managedTxns {
+		t.publish(t.db.MaxVersion())
+	}
+	return nil
+}
+
+// publish makes the versions up to maxVersion visible to the transactions.
+func (t *tailer) publish(maxVersion uint64) {
+	orc := t.db.orc
+	orc.Lock()
+	defer orc.Unlock()
+	if maxVersion < orc.nextTxnTs {
+		return
+	}
+	orc.nextTxnTs = maxVersion + 1
+	orc.txnMark.Done(maxVersion)
+}
+
+// tailMemTables reads the new entries of the WALs of the writer, and returns the ids of the WALs
+// found in the directory.
+func (t *tailer) tailMemTables() (map[int]struct{}, error) {
+	db := t.db
+	files, err := ioutil.ReadDir(db.opt.Dir)
+	if err != nil {
+		return nil, errFile(err, db.opt.Dir, "Unable to open mem dir.")
+	}
+	var fids []int
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), memFileExt) {
+			continue
+		}
+		fsz := len(file.Name())
+		fid, err := strconv.ParseInt(file.Name()[:fsz-len(memFileExt)], 10, 64)
+		if err != nil {
+			return nil, errFile(err, file.Name(), "Unable to parse log id.")
+		}
+		fids = append(fids, int(fid))
+	}
+	sort.Ints(fids)
+
+	listed := make(map[int]struct{}, len(fids))
+	for _, fid := range fids {
+		listed[fid] = struct{}{}
+		tm, ok := t.mts[fid]
+		if !ok {
+			mt, err := t.openMemTable(fid)
+			if err != nil {
+				return nil, y.Wrapf(err, "while opening fid: %d", fid)
+			}
+			if mt == nil {
+				// Not bootstrapped by the writer yet.
+				continue
+			}
+			tm = &tailedMemTable{mt: mt, offset: vlogHeaderSize}
+		}
+		if err := t.tailMemTable(tm); err != nil {
+			if !ok {
+				tm.mt.DecrRef()
+			}
+			return nil, err
+		}
+		if !ok {
+			t.mts[fid] = tm
+			db.Lock()
+			db.imm = append(db.imm, tm.mt)
+			db.Unlock()
+		}
+	}
+	return listed, nil
+}
+
+// openMemTable maps the WAL of a memtable of the writer. It returns nil if the writer hasn't
+// written its header yet.
+func (t *tailer) openMemTable(fid int) (*memTable, error) {
+	db := t.db
+	path := db.mtFilePath(fid)
+	if fi, err := os.Stat(path); os.IsNotExist(err) || (err == nil && fi.Size() < vlogHeaderSize) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	wal := &logFile{
+		fid:      uint32(fid),
+		path:     path,
+		registry: db.registry,
+	}
+	if err := wal.open(path, os.O_RDONLY, db.opt); err != nil {
+		return nil, y.Wrapf(err, "While opening memtable: %s", path)
+	}
+	if wal.size < vlogHeaderSize ||
+		bytes.Equal(wal.Data[:vlogHeaderSize], make([]byte, vlogHeaderSize)) {
+		return nil, wal.Close(-1)
+	}
+	mt := &memTable{
+		sl:  skl.NewSkiplist(arenaSize(db.opt)),
+		wal: wal,
+		opt: db.opt,
+		buf: &bytes.Buffer{},
+	}
+	// The WAL belongs to the writer, which deletes it once the memtable is flushed.
+	mt.sl.OnClose = func() {
+		if err := wal.Close(-1); err != nil {
+			db.opt.Errorf("while closing file: %s, err: %v", path, err)
+		}
+	}
+	return mt, nil
+}
+
+// tailMemTable adds the entries appended to the WAL since the last call to the memtable.
+func (t *tailer) tailMemTable(tm *tailedMemTable) error {
+	wal := tm.mt.wal
+	fi, err := wal.Fd.Stat()
+	if err != nil {
+		return y.Wrapf(err, "while tailing %s", wal.path)
+	}
+	// Don't read past the end of the file, which the writer truncates when it reopens the WAL.
+	size := fi.Size()
+	if size > int64(len(wal.Data)) {
+		size = int64(len(wal.Data))
+	}
+	if int64(tm.offset) >= size {
+		return nil
+	}
+	lf := &logFile{
+		MmapFile: &z.MmapFile{Data: wal.Data[:size], Fd: wal.Fd},
+		path:     wal.path,
+		fid:      wal.fid,
+		size:     uint32(size),
+		dataKey:  wal.dataKey,
+		baseIV:   wal.baseIV,
+		registry: wal.registry,
+		opt:      wal.opt,
+	}
+	var maxVersion uint64
+	end, err := lf.iterate(true, tm.offset, func(e Entry, _ valuePointer) error {
+		if ts := y.ParseTs(e.Key); ts > maxVersion {
+			maxVersion = ts
+		}
+		tm.mt.sl.Put(e.Key, y.ValueStruct{
+			Value:     e.Value,
+			Meta:      e.meta,
+			UserMeta:  e.UserMeta,
+			ExpiresAt: e.ExpiresAt,
+		})
+		return nil
+	})
+	if err != nil {
+		return y.Wrapf(err, "while tailing %s", wal.path)
+	}
+	tm.offset = end
+
+	t.db.Lock()
+	if maxVersion > tm.mt.maxVersion {
+		tm.mt.maxVersion = maxVersion
+	}
+	t.db.Unlock()
+	return nil
+}
+
+// dropMemTables releases the memtables whose WAL wasn't listed, as the writer flushed them.
+func (t *tailer) dropMemTables(listed map[int]struct{}) {
+	var dropped []*memTable
+	for fid, tm := range t.mts {
+		if _, ok := listed[fid]; !ok {
+			dropped = append(dropped, tm.mt)
+			delete(t.mts, fid)
+		}
+	}
+	if len(dropped) == 0 {
+		return
+	}
+	db := t.db
+	db.Lock()
+	imm := db.imm[:0]
+	for _, mt := range db.imm {
+		keep := true
+		for _, d := range dropped {
+			keep = keep && mt != d
+		}
+		if keep {
+			imm = append(imm, mt)
+		}
+	}
+	db.imm = imm
+	db.Unlock()
+
+	for _, mt := range dropped {
+		mt.DecrRef()
+	}
+}
+
+// syncLevels replays the MANIFEST, and updates the levels to match it.
+func (t *tailer) syncLevels() error {
+	db := t.db
+	fp, err := os.Open(filepath.Join(db.opt.Dir, ManifestFilename))
+	if err != nil {
+		return y.Wrapf(err, "while opening the MANIFEST")
+	}
+	mf, _, err := ReplayManifestFile(fp)
+	_ = fp.Close()
+	if err != nil {
+		return y.Wrapf(err, "while replaying the MANIFEST")
+	}
+
+	s := db.lc
+	current := make(map[uint64]*table.Table)
+	changed := false
+	for _, l := range s.levels {
+		l.RLock()
+		for _, tbl := range l.tables {
+			current[tbl.ID()] = tbl
+			if tm, ok := mf.Tables[tbl.ID()]; !ok || int(tm.Level) != l.level {
+				changed = true
+			}
+		}
+		l.RUnlock()
+	}
+	if !changed && len(current) == len(mf.Tables) {
+		return nil
+	}
+
+	var opened []*table.Table
+	tables := make([][]*table.Table, len(s.levels))
+	for id, tm := range mf.Tables {
+		if int(tm.Level) >= len(tables) {
+			closeAllTables([][]*table.Table{opened})
+			return errors.Errorf("Table %d is at level %d, but MaxLevels is %d",
+				id, tm.Level, len(tables))
+		}
+		tbl, ok := current[id]
+		if !ok {
+			fname := table.NewFilename(id, db.opt.Dir)
+			if _, err := os.Stat(fname); os.IsNotExist(err) {
+				closeAllTables([][]*table.Table{opened})
+				return errTableGone
+			}
+			if tbl, err = openTable(db, fname, tm); err != nil {
+				closeAllTables([][]*table.Table{opened})
+				return y.Wrapf(err, "while opening table: %d", id)
+			}
+			opened = append(opened, tbl)
+		}
+		tables[tm.Level] = append(tables[tm.Level], tbl)
+	}
+
+	// Tables move down the levels. Updating the deepest levels first, the keys of a table being
+	// compacted can show up in two levels for a moment, but never in none.
+	for i := len(s.levels) - 1; i >= 0; i-- {
+		s.levels[i].initTables(tables[i])
+	}
+	for id, tbl := range current {
+		if _, ok := mf.Tables[id]; !ok {
+			if err := tbl.DecrRef(); err != nil {
+				db.opt.Warningf("While closing table %d: %v", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// close releases the memtables of the writer.
+func (t *tailer) close() {
+	t.Lock()
+	defer t.Unlock()
+	listed := make(map[int]struct{})
+	t.dropMemTables(listed)
+}
+
+// getTailedFileRLocked is getFileRLocked for a DB tailing the directory, which opens the value log
+// files as their value pointers show up.
+func (vlog *valueLog) getTailedFileRLocked(vp valuePointer) (*logFile, error) {
+	for {
+		vlog.filesLock.RLock()
+		if lf, ok := vlog.filesMap[vp.Fid]; ok {
+			lf.lock.RLock()
+			vlog.filesLock.RUnlock()
+			return lf, nil
+		}
+		vlog.filesLock.RUnlock()
+
+		if err := vlog.openTailedFile(vp.Fid); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// openTailedFile maps the value log file of the writer.
+func (vlog *valueLog) openTailedFile(fid uint32) error {
+	vlog.filesLock.Lock()
+	defer vlog.filesLock.Unlock()
+	if _, ok := vlog.filesMap[fid]; ok {
+		return nil
+	}
+
+	path := vlog.fpath(fid)
+	if fi, err := os.Stat(path); err != nil || fi.Size() < vlogHeaderSize {
+		// log file has gone away, we can't do anything. Return.
+		return errors.Errorf("file with ID: %d not found", fid)
+	}
+	if err := vlog.db.registry.reload(); err != nil {
+		return y.Wrapf(err, "while reloading the key registry")
+	}
+	lf := &logFile{
+		fid:      fid,
+		path:     path,
+		registry: vlog.db.registry,
+	}
+	if err := lf.open(path, os.O_RDONLY, vlog.opt); err != nil {
+		return y.Wrapf(err, "Open existing file: %q", path)
+	}
+	vlog.filesMap[fid] = lf
+	return nil
+}
+
+// dropTailedFiles closes the value log files deleted by the value log GC of the writer. Their
+// values can still be read by the iterators, so it waits for them to be closed.
+func (vlog *valueLog) dropTailedFiles() {
+	if vlog.iteratorCount() > 0 {
+		return
+	}
+	var lfs []*logFile
+	vlog.filesLock.Lock()
+	for fid, lf := range vlog.filesMap {
+		if _, err := os.Stat(lf.path); os.IsNotExist(err) {
+			lfs = append(lfs, lf)
+			delete(vlog.filesMap, fid)
+		}
+	}
+	vlog.filesLock.Unlock()
+
+	for _, lf := range lfs {
+		lf.lock.Lock()
+		if err := lf.Close(-1); err != nil {
+			vlog.opt.Warningf("While closing %s: %v", lf.path, err)
+		}
+		lf.lock.Unlock()
+	}
+}
+
+// Refresh picks up the writes made since the last refresh by the process writing to the
+// directory, for a DB opened in ReadOnly mode with Options.TailInterval. The transactions started
+// after it returns see them.
+func (db *DB) Refresh() error {
+	if db.tail == nil {
+		return ErrNotTailing
+	}
+	if db.IsClosed() {
+		return ErrDBClosed
+	}
+	return db.tail.refresh()
+}
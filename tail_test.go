@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// dbContents returns the latest keys and values of the DB.
+func dbContents(t *testing.T, db *DB) map[string]string {
+	out := make(map[string]string)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		itr := txn.NewIterator(DefaultIteratorOptions)
+		defer itr.Close()
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			val, err := itr.Item().ValueCopy(nil)
+			require.NoError(t, err)
+			out[string(itr.Item().Key())] = string(val)
+		}
+		return nil
+	}))
+	return out
+}
+
+func TestTailReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opt := getTestOptions(dir).WithValueThreshold(1 << 10)
+	writer, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, writer.Close()) }()
+	require.Equal(t, ErrNotTailing, writer.Refresh())
+
+	_, err = Open(opt.WithTailInterval(time.Second))
+	require.Error(t, err)
+
+	txnSet(t, writer, []byte("before"), []byte("open"), 0)
+	reader, err := Open(opt.WithReadOnly(true).WithTailInterval(10 * time.Millisecond))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+	require.Equal(t, dbContents(t, writer), dbContents(t, reader))
+
+	big := bytes.Repeat([]byte("v"), 2<<10)
+	for round := 0; round < 5; round++ {
+		// Enough data to flush memtables and run compactions, with values in the value log.
+		for i := 0; i < 500; i++ {
+			val := []byte(fmt.Sprintf("round%d-%s", round, bytes.Repeat([]byte("v"), 100)))
+			if i%10 == 0 {
+				val = big
+			}
+			txnSet(t, writer, []byte(fmt.Sprintf("key%04d", i+100*round)), val, 0)
+		}
+		txnDelete(t, writer, []byte(fmt.Sprintf("key%04d", round)))
+		require.NoError(t, reader.Refresh())
+		require.Equal(t, dbContents(t, writer), dbContents(t, reader))
+	}
+
+	require.NotEmpty(t, reader.Tables())
+
+	// Picked up every TailInterval, without calling Refresh.
+	txnSet(t, writer, []byte("after"), []byte("refresh"), 0)
+	var contents map[string]string
+	for i := 0; i < 500; i++ {
+		if contents = dbContents(t, reader); contents["after"] != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, dbContents(t, writer), contents)
+}
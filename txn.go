@@ -265,6 +265,7 @@ type Txn struct {
 	discarded    bool
 	doneRead     bool
 	update       bool // update is used to conditionally keep track of reads.
+	inBatch      bool // inBatch is set on the transactions of a WriteBatch.
 }
 
 type pendingWritesIterator struct {
@@ -381,23 +382,45 @@ func (txn *Txn) modify(e *Entry) error {
 		return exceedsSize("Value", int64(txn.db.opt.ValueThreshold), e.Value)
 	}
 
-	if err := txn.checkSize(e); err != nil {
+	if e.meta&bitMergeOperand > 0 {
+		var err error
+		if e, err = txn.prepareMerge(e); err != nil {
+			return err
+		}
+	}
+	indexEntries, err := txn.indexEntries(e)
+	if err != nil {
 		return err
 	}
+	return txn.addEntries(append(indexEntries, e)...)
+}
 
-	// The txn.conflictKeys is used for conflict detection. If conflict detection
-	// is disabled, we don't need to store key hashes in this map.
-	if txn.db.opt.DetectConflicts {
-		fp := z.MemHash(e.Key) // Avoid dealing with byte arrays.
-		txn.conflictKeys[fp] = struct{}{}
+// addEntries adds the entries to the pending writes of the transaction, without validating their
+// keys. Either all or none of the entries are added.
+func (txn *Txn) addEntries(entries ...*Entry) error {
+	count, size := txn.count, txn.size
+	for _, e := range entries {
+		if err := txn.checkSize(e); err != nil {
+			txn.count, txn.size = count, size
+			return err
+		}
 	}
-	// If a duplicate entry was inserted in managed mode, move it to the duplicate writes slice.
-	// Add the entry to duplicateWrites only if both the entries have different versions. For
-	// same versions, we will overwrite the existing entry.
-	if oldEntry, ok := txn.pendingWrites[string(e.Key)]; ok && oldEntry.version != e.version {
-		txn.duplicateWrites = append(txn.duplicateWrites, oldEntry)
+
+	for _, e := range entries {
+		// The txn.conflictKeys is used for conflict detection. If conflict detection
+		// is disabled, we don't need to store key hashes in this map.
+		if txn.db.opt.DetectConflicts {
+			fp := z.MemHash(e.Key) // Avoid dealing with byte arrays.
+			txn.conflictKeys[fp] = struct{}{}
+		}
+		// If a duplicate entry was inserted in managed mode, move it to the duplicate writes
+		// slice. Add the entry to duplicateWrites only if both the entries have different
+		// versions. For same versions, we will overwrite the existing entry.
+		if oldEntry, ok := txn.pendingWrites[string(e.Key)]; ok && oldEntry.version != e.version {
+			txn.duplicateWrites = append(txn.duplicateWrites, oldEntry)
+		}
+		txn.pendingWrites[string(e.Key)] = e
 	}
-	txn.pendingWrites[string(e.Key)] = e
 	return nil
 }
 
@@ -458,6 +481,14 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 			item.status = prefetched
 			item.version = txn.readTs
 			item.expiresAt = e.ExpiresAt
+			if e.meta&bitMergeOperand > 0 {
+				// The operand applies on top of what the transaction reads.
+				item.txn = txn
+				item.resolveMerge(txn.readTs)
+				if item.err != nil {
+					return nil, item.err
+				}
+			}
 			// We probably don't need to set db on item here.
 			return item, nil
 		}
@@ -485,6 +516,12 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 	item.vptr = y.SafeCopy(item.vptr, vs.Value)
 	item.txn = txn
 	item.expiresAt = vs.ExpiresAt
+	if vs.Meta&bitMergeOperand > 0 {
+		item.resolveMerge(vs.Version - 1)
+		if item.err != nil {
+			return nil, y.Wrapf(item.err, "DB::Get key: %q", key)
+		}
+	}
 	return item, nil
 }
 
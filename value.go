@@ -48,6 +48,8 @@ const (
 	bitDiscardEarlierVersions byte = 1 << 2 // Set if earlier versions can be discarded.
 	// Set if item shouldn't be discarded via compactions (used by merge operator)
 	bitMergeEntry byte = 1 << 3
+	// Set if the value is an operand of Options.MergeFunc.
+	bitMergeOperand byte = 1 << 4
 	// The MSB 2 bits are for transactions.
 	bitTxn    byte = 1 << 6 // Set if the entry is part of a txn.
 	bitFinTxn byte = 1 << 7 // Set if the entry is to indicate end of txn in value log.
@@ -137,20 +139,13 @@ func (r *safeRead) Entry(reader io.Reader) (*Entry, error) {
 	e := &Entry{}
 	e.offset = r.recordOffset
 	e.hlen = hlen
-	buf := make([]byte, h.klen+h.vlen)
+	buf := make([]byte, h.klen+h.vlen+r.lf.encryptionOverhead())
 	if _, err := io.ReadFull(tee, buf[:]); err != nil {
 		if err == io.EOF {
 			err = errTruncate
 		}
 		return nil, err
 	}
-	if r.lf.encryptionEnabled() {
-		if buf, err = r.lf.decryptKV(buf[:], r.recordOffset); err != nil {
-			return nil, err
-		}
-	}
-	e.Key = buf[:h.klen]
-	e.Value = buf[h.klen:]
 	var crcBuf [crc32.Size]byte
 	if _, err := io.ReadFull(reader, crcBuf[:]); err != nil {
 		if err == io.EOF {
@@ -162,6 +157,15 @@ func (r *safeRead) Entry(reader io.Reader) (*Entry, error) {
 	if crc != tee.Sum32() {
 		return nil, errTruncate
 	}
+	// The checksum is verified first, so that a truncated entry isn't reported as a decryption
+	// failure.
+	if r.lf.encryptionEnabled() {
+		if buf, err = r.lf.decryptKV(buf[:], h, r.recordOffset); err != nil {
+			return nil, err
+		}
+	}
+	e.Key = buf[:h.klen]
+	e.Value = buf[h.klen:]
 	e.meta = h.meta
 	e.UserMeta = h.userMeta
 	e.ExpiresAt = h.expiresAt
@@ -224,7 +228,9 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 			moved++
 			// This new entry only contains the key, and a pointer to the value.
 			ne := new(Entry)
-			ne.meta = 0 // Remove all bits. Different keyspace doesn't need these bits.
+			// Remove all bits but the merge operand one, which tells how to read the value.
+			// Different keyspace doesn't need the other bits.
+			ne.meta = e.meta & bitMergeOperand
 			ne.UserMeta = e.UserMeta
 			ne.ExpiresAt = e.ExpiresAt
 			ne.Key = append([]byte{}, e.Key...)
@@ -452,6 +458,9 @@ type valueLog struct {
 
 	garbageCh    chan struct{}
 	discardStats *discardStats
+
+	// writeLock serializes the writes of the DB and of an incremental StreamWriter.
+	writeLock sync.Mutex
 }
 
 func vlogFilePath(dirPath string, fid uint32) string {
@@ -543,6 +552,10 @@ func (vlog *valueLog) init(db *DB) {
 	vlog.dirPath = vlog.opt.ValueDir
 
 	vlog.garbageCh = make(chan struct{}, 1) // Only allow one GC at a time.
+	// The discard stats are kept by the process we are tailing.
+	if vlog.opt.tailing() {
+		return
+	}
 	lf, err := initDiscardStats(vlog.opt)
 	y.Check(err)
 	vlog.discardStats = lf
@@ -555,6 +568,11 @@ func (vlog *valueLog) open(db *DB) error {
 		return nil
 	}
 
+	// When tailing another process, its files are opened as they are needed.
+	if db.opt.tailing() {
+		vlog.filesMap = make(map[uint32]*logFile)
+		return nil
+	}
 	if err := vlog.populateFilesMap(); err != nil {
 		return err
 	}
@@ -597,6 +615,12 @@ func (vlog *valueLog) open(db *DB) error {
 	if err := last.Truncate(int64(lastOff)); err != nil {
 		return y.Wrapf(err, "while truncating last value log file: %s", last.path)
 	}
+	// None of the existing files would be written to. So, they can be read via direct I/O.
+	for _, lf := range vlog.filesMap {
+		if err := lf.openDirect(); err != nil {
+			return err
+		}
+	}
 
 	// Don't write to the old log file. Always create a new one.
 	if _, err := vlog.createVlogFile(); err != nil {
@@ -760,7 +784,8 @@ func (vlog *valueLog) validateWrites(reqs []*request) error {
 func estimateRequestSize(req *request) uint64 {
 	size := uint64(0)
 	for _, e := range req.Entries {
-		size += uint64(maxHeaderSize + len(e.Key) + len(e.Value) + crc32.Size)
+		// The authentication tag of AES-GCM is counted even when it isn't written.
+		size += uint64(maxHeaderSize + len(e.Key) + len(e.Value) + y.GCMTagSize + crc32.Size)
 	}
 	return size
 }
@@ -775,6 +800,8 @@ func (vlog *valueLog) write(reqs []*request) error {
 	if err := vlog.validateWrites(reqs); err != nil {
 		return y.Wrapf(err, "while validating writes")
 	}
+	vlog.writeLock.Lock()
+	defer vlog.writeLock.Unlock()
 
 	vlog.filesLock.RLock()
 	maxFid := vlog.maxFid
@@ -882,6 +909,9 @@ func (vlog *valueLog) write(reqs []*request) error {
 // Gets the logFile and acquires and RLock() for the mmap. You must call RUnlock on the file
 // (if non-nil)
 func (vlog *valueLog) getFileRLocked(vp valuePointer) (*logFile, error) {
+	if vlog.opt.tailing() {
+		return vlog.getTailedFileRLocked(vp)
+	}
 	vlog.filesLock.RLock()
 	defer vlog.filesLock.RUnlock()
 	ret, ok := vlog.filesMap[vp.Fid]
@@ -933,7 +963,7 @@ func (vlog *valueLog) Read(vp valuePointer, s *y.Slice) ([]byte, func(), error)
 	headerLen := h.Decode(buf)
 	kv := buf[headerLen:]
 	if lf.encryptionEnabled() {
-		kv, err = lf.decryptKV(kv, vp.Offset)
+		kv, err = lf.decryptKV(lf.encryptedKV(kv, h), h, vp.Offset)
 		if err != nil {
 			return nil, cb, err
 		}
@@ -1072,6 +1102,63 @@ func (vlog *valueLog) runGC(discardRatio float64) error {
 	}
 }
 
+// rotateDataKey moves the writes to a new value log file if the current one is encrypted with a
+// data key older than keyID. It must be called while the writes are blocked.
+func (vlog *valueLog) rotateDataKey(keyID uint64) error {
+	vlog.writeLock.Lock()
+	defer vlog.writeLock.Unlock()
+	vlog.filesLock.RLock()
+	curlf, ok := vlog.filesMap[vlog.maxFid]
+	vlog.filesLock.RUnlock()
+	if !ok || curlf.keyID() >= keyID {
+		return nil
+	}
+	if err := curlf.doneWriting(vlog.woffset()); err != nil {
+		return err
+	}
+	_, err := vlog.createVlogFile()
+	return err
+}
+
+// reencrypt rewrites the value log files encrypted with a data key older than keyID, like the
+// value log GC does, so that their values get written again with the latest data key. The files
+// still being read by iterators are only deleted once the iterators are closed.
+func (vlog *valueLog) reencrypt(keyID uint64) (int, error) {
+	select {
+	case vlog.garbageCh <- struct{}{}:
+		defer func() {
+			<-vlog.garbageCh
+		}()
+	default:
+		return 0, ErrRejected
+	}
+
+	vlog.filesLock.RLock()
+	var lfs []*logFile
+	for _, fid := range vlog.sortedFids() {
+		if lf := vlog.filesMap[fid]; fid < vlog.maxFid && lf.keyID() < keyID {
+			lfs = append(lfs, lf)
+		}
+	}
+	vlog.filesLock.RUnlock()
+
+	for _, lf := range lfs {
+		if err := vlog.doRunGC(lf); err != nil {
+			return 0, y.Wrapf(err, "while rewriting value log file %d", lf.fid)
+		}
+	}
+	return len(lfs), nil
+}
+
+// keyIDs adds the IDs of the data keys used by the value log files to ids.
+func (vlog *valueLog) keyIDs(ids map[uint64]struct{}) {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+	for _, lf := range vlog.filesMap {
+		ids[lf.keyID()] = struct{}{}
+	}
+}
+
 func (vlog *valueLog) updateDiscardStats(stats map[uint32]int64) {
 	if vlog.opt.InMemory {
 		return
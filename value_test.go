@@ -19,6 +19,7 @@ package badger
 import (
 	"bytes"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"math"
 	"math/rand"
@@ -28,8 +29,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v2/options"
 	"github.com/dgraph-io/badger/v2/y"
 	humanize "github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -94,6 +97,55 @@ func TestValueBasic(t *testing.T) {
 
 }
 
+func TestValueTamperedGCMEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	require.NoError(t, err)
+	opt := getTestOptions(dir).
+		WithValueThreshold(32).
+		WithEncryptionKey(key).
+		WithEncryptionAlgo(options.AESGCM).
+		WithBlockCacheSize(1 << 20).
+		WithIndexCacheSize(1 << 20)
+	kv, err := Open(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	log := &kv.vlog
+
+	val := make([]byte, 64)
+	b := new(request)
+	b.Entries = []*Entry{{Key: []byte("samplekey"), Value: val, meta: bitValuePointer}}
+	require.NoError(t, log.write([]*request{b}))
+	require.Len(t, b.Ptrs, 1)
+	vp := b.Ptrs[0]
+	// The authentication tag is written along with the encrypted key and value.
+	var h header
+	hlen := h.Decode(log.filesMap[vp.Fid].Data[vp.Offset:])
+	require.Equal(t, uint32(hlen+len("samplekey")+len(val)+y.GCMTagSize+crc32.Size), vp.Len)
+
+	v, cb, err := log.Read(vp, new(y.Slice))
+	require.NoError(t, err)
+	require.Equal(t, val, v)
+	runCallback(cb)
+
+	// Flip a bit of the encrypted value.
+	log.filesMap[vp.Fid].Data[vp.Offset+vp.Len-crc32.Size-1] ^= 1
+	_, cb, err = log.Read(vp, new(y.Slice))
+	require.Equal(t, y.ErrDecryptionFailed, err)
+	runCallback(cb)
+	log.filesMap[vp.Fid].Data[vp.Offset+vp.Len-crc32.Size-1] ^= 1
+
+	// The tag covers the header too. Flip a bit of the user meta.
+	log.filesMap[vp.Fid].Data[vp.Offset+1] ^= 1
+	_, cb, err = log.Read(vp, new(y.Slice))
+	require.Equal(t, y.ErrDecryptionFailed, err)
+	runCallback(cb)
+}
+
 func TestValueGCManaged(t *testing.T) {
 	dir, err := ioutil.TempDir("", "badger-test")
 	require.NoError(t, err)
@@ -800,6 +852,124 @@ func TestPenultimateMemCorruption(t *testing.T) {
 	require.NoError(t, db1.Close())
 }
 
+func TestWALRecoveryModes(t *testing.T) {
+	var (
+		k0 = []byte("k0")
+		k1 = []byte("k1")
+		k2 = []byte("k2")
+		v0 = []byte("value0-012345678901234567890123012345678901234567890123")
+		v1 = []byte("value1-012345678901234567890123012345678901234567890123")
+		v2 = []byte("value2-012345678901234567890123012345678901234567890123")
+	)
+	// k0 is written in the first transaction, k1 and k2 in the second one.
+	buf, offset := createMemFile(t, []*Entry{
+		{Key: k0, Value: v0},
+		{Key: k1, Value: v1},
+		{Key: k2, Value: v2},
+	})
+	// Corrupt the value of k0.
+	corruptAt := vlogHeaderSize + 10
+	buf[corruptAt]++
+
+	run := func(t *testing.T, mode options.WALRecoveryMode, wal []byte,
+		check func(db *DB, err error)) {
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+
+		opts := getTestOptions(dir).WithWALRecoveryMode(mode)
+		opts.ValueLogFileSize = 100 * 1024 * 1024 // 100Mb
+		kv, err := Open(opts)
+		require.NoError(t, err)
+		require.NoError(t, kv.Close())
+
+		require.NoError(t, ioutil.WriteFile(kv.mtFilePath(1), wal, 0777))
+		db, err := Open(opts)
+		check(db, err)
+		if err == nil {
+			require.NoError(t, db.Close())
+		}
+	}
+	exists := func(db *DB, key []byte) bool {
+		err := db.View(func(txn *Txn) error {
+			_, err := txn.Get(key)
+			return err
+		})
+		if err == ErrKeyNotFound {
+			return false
+		}
+		require.NoError(t, err)
+		return true
+	}
+
+	t.Run("point in time", func(t *testing.T) {
+		run(t, options.PointInTime, buf, func(db *DB, err error) {
+			require.NoError(t, err)
+			require.False(t, exists(db, k0))
+			require.False(t, exists(db, k1))
+			require.False(t, exists(db, k2))
+
+			report := db.WALRecoveryReport()
+			require.Equal(t, options.PointInTime, report.Mode)
+			require.Len(t, report.Files, 1)
+			require.Equal(t, []WALTruncation{{Offset: vlogHeaderSize,
+				Length: offset - vlogHeaderSize}}, report.Files[0].Truncated)
+			require.Equal(t, uint64(offset-vlogHeaderSize), report.LostBytes())
+		})
+	})
+	t.Run("absolute consistency", func(t *testing.T) {
+		run(t, options.AbsoluteConsistency, buf, func(db *DB, err error) {
+			require.Error(t, err)
+			require.Contains(t, err.Error(), ErrWALCorrupted.Error())
+			require.Equal(t, ErrWALCorrupted, errors.Cause(err))
+
+			// The report is carried by the error, since there is no DB to get it from.
+			werr, ok := err.(*WALCorruptedError)
+			require.True(t, ok)
+			require.Equal(t, options.AbsoluteConsistency, werr.Report.Mode)
+			require.Len(t, werr.Report.Files, 1)
+			require.Equal(t, []WALTruncation{{Offset: vlogHeaderSize,
+				Length: offset - vlogHeaderSize}}, werr.Report.Files[0].Truncated)
+		})
+	})
+	t.Run("skip corrupted", func(t *testing.T) {
+		run(t, options.SkipCorrupted, buf, func(db *DB, err error) {
+			require.NoError(t, err)
+			require.False(t, exists(db, k0))
+			require.True(t, exists(db, k1))
+			require.True(t, exists(db, k2))
+
+			report := db.WALRecoveryReport()
+			require.Len(t, report.Files, 1)
+			require.Len(t, report.Files[0].Truncated, 1)
+			tr := report.Files[0].Truncated[0]
+			require.Equal(t, uint32(vlogHeaderSize), tr.Offset)
+			require.True(t, tr.Length > 0 && tr.Offset+tr.Length < offset)
+		})
+	})
+	t.Run("skip corrupted, then point in time", func(t *testing.T) {
+		// The skipped range is dropped from the WAL, so the entries after it survive a replay in
+		// another mode.
+		var rewritten []byte
+		run(t, options.SkipCorrupted, buf, func(db *DB, err error) {
+			require.NoError(t, err)
+			require.NoError(t, ioutil.WriteFile(db.mtFilePath(100), buf, 0777))
+			mt, err := db.openMemTable(100)
+			require.NoError(t, err)
+			rewritten, err = ioutil.ReadFile(db.mtFilePath(100))
+			require.NoError(t, err)
+			mt.DecrRef()
+		})
+		run(t, options.PointInTime, rewritten, func(db *DB, err error) {
+			require.NoError(t, err)
+			require.False(t, exists(db, k0))
+			require.True(t, exists(db, k1))
+			require.True(t, exists(db, k2))
+			require.Empty(t, db.WALRecoveryReport().Files)
+		})
+	})
+}
+
 func checkKeys(t *testing.T, kv *DB, keys [][]byte) {
 	i := 0
 	txn := kv.NewTransaction(false)
@@ -0,0 +1,330 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"hash/crc32"
+	"os"
+
+	"github.com/dgraph-io/badger/v2/options"
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// WALTruncation is a range of a memtable WAL file which was discarded during replay.
+type WALTruncation struct {
+	Offset uint32 // Offset of the first discarded byte.
+	Length uint32 // Number of bytes discarded.
+}
+
+// WALFileRecovery lists the ranges discarded while replaying a single memtable WAL file.
+type WALFileRecovery struct {
+	Fid       int
+	Path      string
+	Truncated []WALTruncation
+	LostBytes uint64
+}
+
+// WALRecoveryReport describes the data which was discarded while replaying the memtable WAL files
+// on DB open. Only the files which had some data discarded are part of the report.
+type WALRecoveryReport struct {
+	Mode  options.WALRecoveryMode
+	Files []WALFileRecovery
+}
+
+// LostBytes returns the total number of bytes discarded across all the WAL files.
+func (r WALRecoveryReport) LostBytes() uint64 {
+	var total uint64
+	for _, f := range r.Files {
+		total += f.LostBytes
+	}
+	return total
+}
+
+// WALRecoveryReport returns the report of the data discarded while replaying the memtable WAL
+// files when the DB was opened.
+func (db *DB) WALRecoveryReport() WALRecoveryReport {
+	report := db.walRecovery
+	report.Files = append([]WALFileRecovery{}, db.walRecovery.Files...)
+	return report
+}
+
+// WALCorruptedError is returned by Open when a memtable WAL has corrupt entries and the
+// WALRecoveryMode doesn't allow discarding them. Its cause is ErrWALCorrupted.
+type WALCorruptedError struct {
+	// Report lists the corrupt range which made the replay fail, and the data discarded from the
+	// WAL files replayed before it.
+	Report WALRecoveryReport
+	err    error
+}
+
+func (e *WALCorruptedError) Error() string { return e.err.Error() }
+
+// Cause returns ErrWALCorrupted.
+func (e *WALCorruptedError) Cause() error { return ErrWALCorrupted }
+
+// Unwrap returns ErrWALCorrupted.
+func (e *WALCorruptedError) Unwrap() error { return ErrWALCorrupted }
+
+func (r *WALFileRecovery) add(offset, length uint32) {
+	r.LostBytes += uint64(length)
+	if n := len(r.Truncated); n > 0 {
+		last := &r.Truncated[n-1]
+		if last.Offset+last.Length == offset {
+			last.Length += length
+			return
+		}
+	}
+	r.Truncated = append(r.Truncated, WALTruncation{Offset: offset, Length: length})
+}
+
+// replay iterates over the WAL file and calls fn for every valid entry. The corrupt or incomplete
+// entries are handled as dictated by mode. It returns the offset up to which the file should be
+// kept, along with the ranges that were discarded.
+func (lf *logFile) replay(mode options.WALRecoveryMode, fn logEntry) (
+	uint32, WALFileRecovery, error) {
+
+	rec := WALFileRecovery{Fid: int(lf.fid), Path: lf.path}
+	offset := uint32(vlogHeaderSize)
+	for {
+		endOff, err := lf.iterate(true, offset, fn)
+		if err != nil {
+			return 0, rec, err
+		}
+		if lf.isCleanEnd(endOff) {
+			return endOff, rec, nil
+		}
+
+		// Everything after endOff up to the last written byte would be lost, unless we're asked
+		// to look for valid entries after the corruption.
+		dataEnd := lf.dataEnd(endOff)
+		next := dataEnd
+		if mode == options.SkipCorrupted {
+			next = lf.nextValidRecord(endOff, dataEnd)
+		}
+		rec.add(endOff, next-endOff)
+
+		switch {
+		case mode == options.AbsoluteConsistency:
+			return endOff, rec, errors.Wrapf(ErrWALCorrupted,
+				"file: %s, offset: %d, bytes after offset: %d", lf.path, endOff, next-endOff)
+		case next >= dataEnd:
+			return endOff, rec, nil
+		}
+		offset = next
+	}
+}
+
+// isCleanEnd returns true if there is no data written at the given offset, i.e. the log ends
+// there.
+func (lf *logFile) isCleanEnd(offset uint32) bool {
+	if int(offset) >= len(lf.Data) {
+		return true
+	}
+	end := int(offset) + maxHeaderSize
+	if end > len(lf.Data) {
+		end = len(lf.Data)
+	}
+	var zero [maxHeaderSize]byte
+	return bytes.Equal(lf.Data[offset:end], zero[:end-int(offset)])
+}
+
+// dataEnd returns the offset right after the last non-zero byte of the file. The returned offset
+// is never smaller than from.
+func (lf *logFile) dataEnd(from uint32) uint32 {
+	const chunk = 1 << 16
+	var zero [chunk]byte
+	end := len(lf.Data)
+	for end > int(from) {
+		start := end - chunk
+		if start < int(from) {
+			start = int(from)
+		}
+		if bytes.Equal(lf.Data[start:end], zero[:end-start]) {
+			end = start
+			continue
+		}
+		for end > start && lf.Data[end-1] == 0 {
+			end--
+		}
+		break
+	}
+	if end < int(from) {
+		return from
+	}
+	return uint32(end)
+}
+
+// entryAt checks whether a valid entry starts at the given offset, and returns its header and
+// its total length. The entry must end before the end offset.
+func (lf *logFile) entryAt(offset, end uint32) (header, uint32, bool) {
+	var h header
+	var buf [maxHeaderSize]byte
+	copy(buf[:], lf.Data[offset:end])
+	hlen := h.Decode(buf[:])
+	if h.klen == 0 || h.klen > uint32(1<<16) {
+		return h, 0, false
+	}
+	total := uint64(hlen) + uint64(h.klen) + uint64(h.vlen) + uint64(lf.encryptionOverhead()) +
+		crc32.Size
+	if uint64(offset)+total > uint64(end) {
+		return h, 0, false
+	}
+	sz := uint32(total)
+	data := lf.Data[offset : offset+sz]
+	crc := crc32.Checksum(data[:sz-crc32.Size], y.CastagnoliCrcTable)
+	if crc != y.BytesToU32(data[sz-crc32.Size:]) {
+		return h, 0, false
+	}
+	return h, sz, true
+}
+
+// entryTs returns the version of the valid entry at the given offset.
+func (lf *logFile) entryTs(offset uint32, h header, sz uint32) uint64 {
+	end := offset + sz - crc32.Size
+	kv := lf.Data[end-h.klen-h.vlen-lf.encryptionOverhead() : end]
+	if lf.encryptionEnabled() {
+		var err error
+		if kv, err = lf.decryptKV(kv, h, offset); err != nil {
+			return 0
+		}
+	}
+	return y.ParseTs(kv[:h.klen])
+}
+
+// corruptionAt walks over the entries of the incomplete transaction starting at the given offset,
+// and returns the offset where the transaction got interrupted. It also returns the version of
+// that transaction, or zero if that is unknown.
+func (lf *logFile) corruptionAt(offset, end uint32) (uint32, uint64) {
+	var txnTs uint64
+	for offset < end {
+		h, sz, ok := lf.entryAt(offset, end)
+		if !ok {
+			break
+		}
+		if h.meta&(bitTxn|bitFinTxn) == 0 {
+			if txnTs != 0 {
+				break
+			}
+		} else {
+			ts := lf.entryTs(offset, h, sz)
+			if txnTs != 0 && ts != txnTs {
+				break
+			}
+			txnTs = ts
+		}
+		offset += sz
+	}
+	return offset, txnTs
+}
+
+// nextValidRecord returns the offset of the first valid record after the corruption, from which
+// the replay can be resumed. The remaining entries of the transaction interrupted by the
+// corruption are skipped, so that the transaction isn't partially applied. It returns end if no
+// such record is found.
+func (lf *logFile) nextValidRecord(from, end uint32) uint32 {
+	corrupt, txnTs := lf.corruptionAt(from, end)
+	for off := corrupt; off < end; off++ {
+		h, sz, ok := lf.entryAt(off, end)
+		if !ok {
+			continue
+		}
+		if h.meta&(bitTxn|bitFinTxn) == 0 {
+			return off
+		}
+		// If we don't know which transaction got interrupted, assume it is this one.
+		if txnTs != 0 && lf.entryTs(off, h, sz) != txnTs {
+			return off
+		}
+		for cur := off; ; {
+			cur += sz
+			if h.meta&bitFinTxn > 0 {
+				return cur
+			}
+			if h, sz, ok = lf.entryAt(cur, end); !ok {
+				break
+			}
+		}
+	}
+	return end
+}
+
+// rewriteWAL replaces the WAL of the memtable with a new file holding only the entries of its
+// skiplist. It is called once SkipCorrupted has resumed the replay after a corrupt range, so
+// that a later replay in another mode doesn't stop at that range and drop the entries after it.
+// The new file is written next to the WAL, and then renamed over it.
+func (mt *memTable) rewriteWAL() error {
+	path := mt.wal.path
+	tmpPath := path + ".rewrite"
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return y.Wrapf(err, "while removing %s", tmpPath)
+	}
+	wal := &logFile{
+		fid:      mt.wal.fid,
+		path:     tmpPath,
+		registry: mt.wal.registry,
+		writeAt:  vlogHeaderSize,
+	}
+	if err := wal.open(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, mt.opt); err != z.NewFile {
+		return y.Wrapf(err, "while creating %s", tmpPath)
+	}
+
+	it := mt.sl.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		vs := it.Value()
+		// Only the entries of complete transactions were replayed, so the entries can be written
+		// on their own.
+		e := &Entry{
+			Key:       it.Key(),
+			Value:     vs.Value,
+			meta:      vs.Meta &^ (bitTxn | bitFinTxn),
+			UserMeta:  vs.UserMeta,
+			ExpiresAt: vs.ExpiresAt,
+		}
+		if err := wal.writeEntry(mt.buf, e, mt.opt); err != nil {
+			it.Close()
+			wal.Close(-1)
+			return y.Wrapf(err, "while rewriting %s", path)
+		}
+	}
+	it.Close()
+	if err := wal.Close(int64(wal.writeAt)); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return y.Wrapf(err, "while renaming %s", tmpPath)
+	}
+	if err := syncDir(mt.opt.Dir); err != nil {
+		return y.Wrapf(err, "while syncing %s", mt.opt.Dir)
+	}
+
+	if err := mt.wal.Close(-1); err != nil {
+		return err
+	}
+	mt.wal = &logFile{
+		fid:      wal.fid,
+		path:     path,
+		registry: wal.registry,
+		writeAt:  wal.writeAt,
+	}
+	if err := mt.wal.open(path, os.O_RDWR, mt.opt); err != nil {
+		return y.Wrapf(err, "while opening rewritten WAL: %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"io"
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// DirectIOAlignment is the alignment required for the memory buffers, file offsets and lengths
+// used while reading or writing a file opened with direct I/O.
+const DirectIOAlignment = 4096
+
+// directIOWriteChunk is the size of the aligned buffer used by WriteDirect.
+const directIOWriteChunk = 1 << 20
+
+var (
+	// This is O_DIRECT on platforms that support it -- see directio_linux.go
+	directIOFileFlag = 0x0
+
+	// ErrDirectIONotSupported is returned when direct I/O is requested on a platform which doesn't
+	// support it.
+	ErrDirectIONotSupported = errors.New("Direct I/O is not supported on this platform")
+)
+
+// DirectIOSupported returns true if files can be opened with direct I/O on this platform.
+func DirectIOSupported() bool {
+	return directIOFileFlag != 0
+}
+
+// OpenDirectFile opens the named file with direct I/O, so that reads and writes bypass the page
+// cache of the OS.
+func OpenDirectFile(filename string, flag int) (*os.File, error) {
+	if !DirectIOSupported() {
+		return nil, ErrDirectIONotSupported
+	}
+	return os.OpenFile(filename, flag|directIOFileFlag, 0666)
+}
+
+// AlignedBlock returns a zeroed byte slice of size n, whose address is a multiple of
+// DirectIOAlignment.
+func AlignedBlock(n int) []byte {
+	buf := make([]byte, n+DirectIOAlignment)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (DirectIOAlignment - 1)); rem != 0 {
+		off = DirectIOAlignment - rem
+	}
+	return buf[off : off+n : off+n]
+}
+
+func alignDown(n int) int { return n &^ (DirectIOAlignment - 1) }
+func alignUp(n int) int   { return alignDown(n + DirectIOAlignment - 1) }
+
+// ReadDirect reads sz bytes at offset off from a file opened with direct I/O. The read is widened
+// to the alignment boundaries, and the returned slice points into a newly allocated buffer.
+func ReadDirect(fd *os.File, off, sz int) ([]byte, error) {
+	start, end := alignDown(off), alignUp(off+sz)
+	buf := AlignedBlock(end - start)
+	// The aligned read can go past the end of the file, in which case ReadAt returns io.EOF along
+	// with a short read.
+	n, err := fd.ReadAt(buf, int64(start))
+	if n >= off+sz-start {
+		return buf[off-start : off+sz-start], nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, Wrapf(err, "while reading %d bytes at offset %d from %s", sz, off, fd.Name())
+}
+
+// WriteDirect writes data at the start of a file opened with direct I/O. The data is written in
+// aligned chunks, and the file is then truncated to the length of data.
+func WriteDirect(fd *os.File, data []byte) error {
+	buf := AlignedBlock(directIOWriteChunk)
+	for off := 0; off < len(data); off += directIOWriteChunk {
+		n := copy(buf, data[off:])
+		// Zero out the padding of the last chunk.
+		for i := n; i < alignUp(n); i++ {
+			buf[i] = 0
+		}
+		if _, err := fd.WriteAt(buf[:alignUp(n)], int64(off)); err != nil {
+			return Wrapf(err, "while writing to %s", fd.Name())
+		}
+	}
+	return fd.Truncate(int64(len(data)))
+}
@@ -22,8 +22,22 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// GCMNonceSize is the size of the nonce used to encrypt with AES-GCM.
+	GCMNonceSize = 12
+	// GCMTagSize is the size of the authentication tag appended to the data encrypted with
+	// AES-GCM.
+	GCMTagSize = 16
 )
 
+// ErrDecryptionFailed is returned when the data encrypted with AES-GCM doesn't match its
+// authentication tag, because either the data or the key is wrong.
+var ErrDecryptionFailed = errors.New("decryption failed: data is corrupted or tampered with")
+
 // XORBlock encrypts the given data with AES and XOR's with IV.
 // Can be used for both encryption and decryption. IV is of
 // AES block size.
@@ -65,3 +79,44 @@ func GenerateIV() ([]byte, error) {
 	_, err := rand.Read(iv)
 	return iv, err
 }
+
+// GenerateGCMNonce generates a nonce for AES-GCM.
+func GenerateGCMNonce() ([]byte, error) {
+	nonce := make([]byte, GCMNonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealGCM encrypts src with AES-GCM and appends the ciphertext, followed by its authentication
+// tag, to dst. The nonce must be of GCMNonceSize and never be reused with the same key. The
+// additional data aad is authenticated along with src, but isn't encrypted nor appended.
+func SealGCM(dst, src, key, nonce, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(dst, nonce, src, aad), nil
+}
+
+// OpenGCM authenticates and decrypts src, sealed by SealGCM with the same additional data, and
+// appends the plaintext to dst. It returns ErrDecryptionFailed if src and aad don't match the
+// authentication tag.
+func OpenGCM(dst, src, key, nonce, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	out, err := aead.Open(dst, nonce, src, aad)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return out, nil
+}
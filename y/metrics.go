@@ -50,6 +50,9 @@ var (
 	NumMemtableGets *expvar.Int
 	// NumCompactionTables is the number of tables being compacted
 	NumCompactionTables *expvar.Int
+	// SubscriberLag has the lag of each subscriber, in commit timestamps, keyed by the DB and
+	// the name of the subscriber
+	SubscriberLag *expvar.Map
 )
 
 // These variables are global and have cumulative values for all kv stores.
@@ -68,4 +71,5 @@ func init() {
 	VlogSize = expvar.NewMap("badger_v2_vlog_size_bytes")
 	PendingWrites = expvar.NewMap("badger_v2_pending_writes_total")
 	NumCompactionTables = expvar.NewInt("badger_v2_compactions_current")
+	SubscriberLag = expvar.NewMap("badger_v2_subscriber_lag")
 }
@@ -0,0 +1,194 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// ribbonWidth is the number of coefficients in each row of a ribbon filter.
+const ribbonWidth = 64
+
+// maxRibbonBits is the maximum number of fingerprint bits of a ribbon filter.
+const maxRibbonBits = 32
+
+// RibbonFilter is a ribbon filter, as described in "Ribbon filter: practically smaller than
+// Bloom and Xor" by Peter C. Dillinger and Stefan Walzer.
+//
+// Each key is mapped to a row of a sparse linear system over GF(2): ribbonWidth coefficients
+// starting at a key-dependent slot, and an r-bit fingerprint as the result. The filter stores
+// a solution of this system, so a key is in the filter only if the dot product of its row with
+// the solution is equal to its fingerprint. The false positive rate is 2^-r and the filter
+// takes only slightly more than r bits per key.
+//
+// The encoded filter looks like
+// +----------+-----+------------+-----------------+----------+---------------+
+// | Column 0 | ... | Column r-1 | Slots (4 Bytes) | Seed (1) | r (1 Byte)    |
+// +----------+-----+------------+-----------------+----------+---------------+
+// where each column holds one bit of the solution for each slot.
+type RibbonFilter []byte
+
+// RibbonBitsPerKey returns the number of fingerprint bits required by a ribbon filter for the
+// given false positive rate. The rate can't be lower than 2^-32, which is the rate of the collisions
+// of the 32-bit key hashes anyway.
+func RibbonBitsPerKey(fp float64) int {
+	r := int(math.Ceil(-math.Log2(fp)))
+	if r < 1 {
+		r = 1
+	}
+	if r > maxRibbonBits {
+		r = maxRibbonBits
+	}
+	return r
+}
+
+// NewRibbonFilter returns a new ribbon filter that encodes a set of key hashes with r bits per
+// key. r must be between 1 and 32.
+func NewRibbonFilter(keys []uint32, r int) RibbonFilter {
+	AssertTruef(r >= 1 && r <= maxRibbonBits, "invalid number of bits for ribbon filter: %d", r)
+	// Start with 5% extra slots. If the system can't be solved, retry with another seed, and
+	// add more slots every few attempts.
+	numSlots := len(keys) + len(keys)/20 + ribbonWidth
+	for seed := 0; ; seed++ {
+		if seed > 0 && seed%4 == 0 {
+			numSlots += numSlots / 20
+		}
+		if f, ok := buildRibbon(keys, r, uint8(seed), uint32(numSlots)); ok {
+			return f
+		}
+	}
+}
+
+func buildRibbon(keys []uint32, r int, seed uint8, numSlots uint32) (RibbonFilter, bool) {
+	coeffs := make([]uint64, numSlots)
+	results := make([]uint32, numSlots)
+
+	// Banding: insert the rows one by one, keeping the system in row echelon form.
+	for _, h := range keys {
+		i, c, res := ribbonHash(h, seed, numSlots, r)
+		for {
+			if coeffs[i] == 0 {
+				coeffs[i] = c
+				results[i] = res
+				break
+			}
+			c ^= coeffs[i]
+			res ^= results[i]
+			if c == 0 {
+				if res != 0 {
+					// The new row contradicts the rows inserted before.
+					return nil, false
+				}
+				// Redundant row, likely a duplicate key hash.
+				break
+			}
+			tz := uint32(bits.TrailingZeros64(c))
+			i += tz
+			c >>= tz
+		}
+	}
+
+	// Back substitution: solve the system one column at a time, from the last slot to the
+	// first. The slots with no row are left as zero.
+	numWords := int(numSlots+63)/64 + 1
+	columns := make([][]uint64, r)
+	for j := range columns {
+		columns[j] = make([]uint64, numWords)
+	}
+	for i := int(numSlots) - 1; i >= 0; i-- {
+		c := coeffs[i]
+		if c == 0 {
+			continue
+		}
+		for j := 0; j < r; j++ {
+			bit := uint64(results[i]>>uint(j)) & 1
+			bit ^= uint64(bits.OnesCount64(c&loadWords(columns[j], uint32(i))) & 1)
+			columns[j][i/64] |= bit << uint(i%64)
+		}
+	}
+
+	f := make([]byte, 0, r*numWords*8+6)
+	for _, col := range columns {
+		for _, w := range col {
+			f = append(f, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint64(f[len(f)-8:], w)
+		}
+	}
+	f = append(f, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(f[len(f)-4:], numSlots)
+	f = append(f, seed, uint8(r))
+	return RibbonFilter(f), true
+}
+
+// MayContain returns whether the filter may contain the given key hash. False positives are
+// possible, where it returns true for keys not in the original set.
+func (f RibbonFilter) MayContain(h uint32) bool {
+	if len(f) < 6 {
+		return false
+	}
+	r := int(f[len(f)-1])
+	seed := f[len(f)-2]
+	numSlots := binary.LittleEndian.Uint32(f[len(f)-6:])
+	colLen := (int(numSlots+63)/64 + 1) * 8
+	if r < 1 || r > maxRibbonBits || r*colLen != len(f)-6 {
+		// Unknown encoding. Consider it a match.
+		return true
+	}
+
+	i, c, res := ribbonHash(h, seed, numSlots, r)
+	for j := 0; j < r; j++ {
+		col := f[j*colLen : (j+1)*colLen]
+		if uint32(bits.OnesCount64(c&loadBytes(col, i))&1) != (res>>uint(j))&1 {
+			return false
+		}
+	}
+	return true
+}
+
+// ribbonHash returns the starting slot, the coefficients and the r-bit fingerprint of the row for
+// the given key hash.
+func ribbonHash(h uint32, seed uint8, numSlots uint32, r int) (uint32, uint64, uint32) {
+	x := mix64(uint64(h) ^ uint64(seed)<<32)
+	y := mix64(x + 0x9e3779b97f4a7c15)
+	start := uint32((x >> 32) * uint64(numSlots-ribbonWidth+1) >> 32)
+	// The first coefficient is always set, so the row starts exactly at the start slot.
+	return start, y | 1, uint32(x) & uint32(1<<uint(r)-1)
+}
+
+// mix64 is the finalizer of SplitMix64.
+func mix64(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// loadWords returns the 64 bits of the column starting at bit i.
+func loadWords(col []uint64, i uint32) uint64 {
+	w, off := i/64, i%64
+	if off == 0 {
+		return col[w]
+	}
+	return col[w]>>off | col[w+1]<<(64-off)
+}
+
+// loadBytes is like loadWords, but for a column encoded in little endian bytes.
+func loadBytes(col []byte, i uint32) uint64 {
+	b, off := i/8, i%8
+	return binary.LittleEndian.Uint64(col[b:])>>off | uint64(col[b+8])<<(64-off)
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRibbonFilter(t *testing.T) {
+	for _, n := range []int{1, 10, 100, 1000, 100000} {
+		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
+			keys := make([]uint32, 0, n)
+			for i := 0; i < n; i++ {
+				keys = append(keys, Hash([]byte(fmt.Sprintf("key%d", i))))
+			}
+			// Duplicate hashes should not break the construction.
+			keys = append(keys, keys[0])
+
+			r := RibbonBitsPerKey(0.01)
+			require.Equal(t, 7, r)
+			f := NewRibbonFilter(keys, r)
+			for _, h := range keys {
+				require.True(t, f.MayContain(h))
+			}
+
+			falsePositives := 0
+			for i := 0; i < 100000; i++ {
+				if f.MayContain(Hash([]byte(fmt.Sprintf("absent%d", i)))) {
+					falsePositives++
+				}
+			}
+			// The expected false positive rate is 1/128.
+			require.Less(t, falsePositives, 1200)
+			if n >= 100000 {
+				require.Less(t, float64(len(f)*8)/float64(n), 1.1*float64(r))
+			}
+		})
+	}
+}
+
+func TestRibbonFilterWideFingerprints(t *testing.T) {
+	require.Equal(t, 14, RibbonBitsPerKey(0.0001))
+	require.Equal(t, 32, RibbonBitsPerKey(1e-12))
+
+	keys := make([]uint32, 0, 10000)
+	for i := 0; i < 10000; i++ {
+		keys = append(keys, Hash([]byte(fmt.Sprintf("key%d", i))))
+	}
+	for _, r := range []int{14, 32} {
+		f := NewRibbonFilter(keys, r)
+		for _, h := range keys {
+			require.True(t, f.MayContain(h))
+		}
+		falsePositives := 0
+		for i := 0; i < 100000; i++ {
+			if f.MayContain(Hash([]byte(fmt.Sprintf("absent%d", i)))) {
+				falsePositives++
+			}
+		}
+		// The expected number of false positives is about 6 with 14 bits, and none with 32.
+		require.Less(t, falsePositives, 30, "r=%d", r)
+	}
+}
@@ -81,6 +81,24 @@ func OpenExistingFile(filename string, flags Flags) (*os.File, error) {
 	return os.OpenFile(filename, openFlags, 0)
 }
 
+// DeleteMmapFile unmaps, closes and removes the file. Unlike z.MmapFile.Delete, it doesn't
+// truncate the file first, so that another process reading it through its own memory map, like a
+// DB tailing the directory, keeps a valid mapping until it closes the file.
+func DeleteMmapFile(mf *z.MmapFile) error {
+	// Badger can set mf.Data directly, without setting any Fd. This should be a NOOP then.
+	if mf.Fd == nil {
+		return nil
+	}
+	if err := z.Munmap(mf.Data); err != nil {
+		return errors.Wrapf(err, "while munmap file: %s", mf.Fd.Name())
+	}
+	mf.Data = nil
+	if err := mf.Fd.Close(); err != nil {
+		return errors.Wrapf(err, "while closing file: %s", mf.Fd.Name())
+	}
+	return os.Remove(mf.Fd.Name())
+}
+
 // CreateSyncedFile creates a new file (using O_EXCL), errors if it already existed.
 func CreateSyncedFile(filename string, sync bool) (*os.File, error) {
 	flags := os.O_RDWR | os.O_CREATE | os.O_EXCL
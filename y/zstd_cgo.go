@@ -18,8 +18,51 @@
 
 package y
 
+/*
+#include <stddef.h>
+
+// The ZSTD library is built by the github.com/DataDog/zstd package, which doesn't expose the
+// dictionary training, nor the digested dictionaries. They are declared here, as in zstd.h and
+// zdict.h.
+typedef struct ZSTD_CCtx_s ZSTD_CCtx;
+typedef struct ZSTD_DCtx_s ZSTD_DCtx;
+typedef struct ZSTD_CDict_s ZSTD_CDict;
+typedef struct ZSTD_DDict_s ZSTD_DDict;
+
+#define ZSTD_CONTENTSIZE_UNKNOWN (0ULL - 1)
+#define ZSTD_CONTENTSIZE_ERROR   (0ULL - 2)
+
+unsigned ZSTD_isError(size_t code);
+const char* ZSTD_getErrorName(size_t code);
+unsigned long long ZSTD_getFrameContentSize(const void *src, size_t srcSize);
+
+ZSTD_CCtx* ZSTD_createCCtx(void);
+size_t ZSTD_freeCCtx(ZSTD_CCtx* cctx);
+ZSTD_CDict* ZSTD_createCDict(const void* dictBuffer, size_t dictSize, int compressionLevel);
+size_t ZSTD_freeCDict(ZSTD_CDict* CDict);
+size_t ZSTD_compress_usingCDict(ZSTD_CCtx* cctx, void* dst, size_t dstCapacity,
+	const void* src, size_t srcSize, const ZSTD_CDict* cdict);
+
+ZSTD_DCtx* ZSTD_createDCtx(void);
+size_t ZSTD_freeDCtx(ZSTD_DCtx* dctx);
+ZSTD_DDict* ZSTD_createDDict(const void* dictBuffer, size_t dictSize);
+size_t ZSTD_freeDDict(ZSTD_DDict* ddict);
+size_t ZSTD_decompress_usingDDict(ZSTD_DCtx* dctx, void* dst, size_t dstCapacity,
+	const void* src, size_t srcSize, const ZSTD_DDict* ddict);
+
+size_t ZDICT_trainFromBuffer(void* dictBuffer, size_t dictBufferCapacity,
+	const void* samplesBuffer, const size_t* samplesSizes, unsigned nbSamples);
+unsigned ZDICT_isError(size_t errorCode);
+const char* ZDICT_getErrorName(size_t errorCode);
+*/
+import "C"
+
 import (
+	"runtime"
+	"unsafe"
+
 	"github.com/DataDog/zstd"
+	"github.com/pkg/errors"
 )
 
 // CgoEnabled is used to check if CGO is enabled while building badger.
@@ -39,3 +82,166 @@ func ZSTDCompress(dst, src []byte, compressionLevel int) ([]byte, error) {
 func ZSTDCompressBound(srcSize int) int {
 	return zstd.CompressBound(srcSize)
 }
+
+// ZSTDTrainDict trains a ZSTD dictionary of up to dictSize bytes on the given samples. It fails
+// if there aren't enough samples to train a dictionary of that size.
+func ZSTDTrainDict(samples [][]byte, dictSize int) ([]byte, error) {
+	var buf []byte
+	sizes := make([]C.size_t, 0, len(samples))
+	for _, s := range samples {
+		buf = append(buf, s...)
+		sizes = append(sizes, C.size_t(len(s)))
+	}
+	if len(buf) == 0 || dictSize <= 0 {
+		return nil, errors.New("No samples to train the ZSTD dictionary on")
+	}
+	dict := make([]byte, dictSize)
+	n := C.ZDICT_trainFromBuffer(unsafe.Pointer(&dict[0]), C.size_t(dictSize),
+		unsafe.Pointer(&buf[0]), &sizes[0], C.unsigned(len(sizes)))
+	if C.ZDICT_isError(n) != 0 {
+		return nil, errors.Errorf("while training the ZSTD dictionary: %s",
+			C.GoString(C.ZDICT_getErrorName(n)))
+	}
+	return dict[:n], nil
+}
+
+// zstdError returns the error for the given ZSTD return code, or nil.
+func zstdError(code C.size_t) error {
+	if C.ZSTD_isError(code) == 0 {
+		return nil
+	}
+	return errors.New(C.GoString(C.ZSTD_getErrorName(code)))
+}
+
+// ZSTDEncoder compresses blocks with a ZSTD dictionary. The dictionary is digested once, when the
+// encoder is created. It can be used concurrently, and must be closed to release its memory.
+type ZSTDEncoder struct {
+	cdict *C.ZSTD_CDict
+	// ctxs holds the idle compression contexts. They are created as needed.
+	ctxs chan *C.ZSTD_CCtx
+}
+
+// NewZSTDEncoder returns an encoder compressing with the given dictionary and compression level.
+func NewZSTDEncoder(dict []byte, compressionLevel int) (*ZSTDEncoder, error) {
+	if len(dict) == 0 {
+		return nil, errors.New("Empty ZSTD dictionary")
+	}
+	cdict := C.ZSTD_createCDict(unsafe.Pointer(&dict[0]), C.size_t(len(dict)),
+		C.int(compressionLevel))
+	if cdict == nil {
+		return nil, errors.New("Unable to create the ZSTD compression dictionary")
+	}
+	return &ZSTDEncoder{cdict: cdict, ctxs: make(chan *C.ZSTD_CCtx, runtime.NumCPU())}, nil
+}
+
+// Compress compresses src into dst, which should have a capacity of at least
+// ZSTDCompressBound(len(src)) bytes.
+func (e *ZSTDEncoder) Compress(dst, src []byte) ([]byte, error) {
+	var cctx *C.ZSTD_CCtx
+	select {
+	case cctx = <-e.ctxs:
+	default:
+		if cctx = C.ZSTD_createCCtx(); cctx == nil {
+			return nil, errors.New("Unable to create a ZSTD compression context")
+		}
+	}
+	defer func() {
+		select {
+		case e.ctxs <- cctx:
+		default:
+			C.ZSTD_freeCCtx(cctx)
+		}
+	}()
+
+	if cap(dst) < ZSTDCompressBound(len(src)) {
+		dst = make([]byte, ZSTDCompressBound(len(src)))
+	}
+	dst = dst[:cap(dst)]
+	n := C.ZSTD_compress_usingCDict(cctx, unsafe.Pointer(&dst[0]), C.size_t(len(dst)),
+		bytesPointer(src), C.size_t(len(src)), e.cdict)
+	if err := zstdError(n); err != nil {
+		return nil, err
+	}
+	return dst[:n], nil
+}
+
+// Close releases the memory of the encoder. It must not be used afterwards.
+func (e *ZSTDEncoder) Close() {
+	close(e.ctxs)
+	for cctx := range e.ctxs {
+		C.ZSTD_freeCCtx(cctx)
+	}
+	C.ZSTD_freeCDict(e.cdict)
+}
+
+// ZSTDDecoder decompresses the blocks compressed by a ZSTDEncoder with the same dictionary. The
+// dictionary is digested once, when the decoder is created. It can be used concurrently, and must
+// be closed to release its memory.
+type ZSTDDecoder struct {
+	ddict *C.ZSTD_DDict
+	// ctxs holds the idle decompression contexts. They are created as needed.
+	ctxs chan *C.ZSTD_DCtx
+}
+
+// NewZSTDDecoder returns a decoder decompressing with the given dictionary.
+func NewZSTDDecoder(dict []byte) (*ZSTDDecoder, error) {
+	if len(dict) == 0 {
+		return nil, errors.New("Empty ZSTD dictionary")
+	}
+	ddict := C.ZSTD_createDDict(unsafe.Pointer(&dict[0]), C.size_t(len(dict)))
+	if ddict == nil {
+		return nil, errors.New("Unable to create the ZSTD decompression dictionary")
+	}
+	return &ZSTDDecoder{ddict: ddict, ctxs: make(chan *C.ZSTD_DCtx, runtime.NumCPU())}, nil
+}
+
+// Decompress decompresses src into dst. A new buffer is allocated if dst is too small to hold
+// the decompressed block.
+func (d *ZSTDDecoder) Decompress(dst, src []byte) ([]byte, error) {
+	var dctx *C.ZSTD_DCtx
+	select {
+	case dctx = <-d.ctxs:
+	default:
+		if dctx = C.ZSTD_createDCtx(); dctx == nil {
+			return nil, errors.New("Unable to create a ZSTD decompression context")
+		}
+	}
+	defer func() {
+		select {
+		case d.ctxs <- dctx:
+		default:
+			C.ZSTD_freeDCtx(dctx)
+		}
+	}()
+
+	sz := C.ZSTD_getFrameContentSize(bytesPointer(src), C.size_t(len(src)))
+	if sz == C.ZSTD_CONTENTSIZE_ERROR || sz == C.ZSTD_CONTENTSIZE_UNKNOWN {
+		return nil, errors.New("Invalid ZSTD frame header")
+	}
+	if uint64(cap(dst)) < uint64(sz) {
+		dst = make([]byte, sz)
+	}
+	dst = dst[:cap(dst)]
+	n := C.ZSTD_decompress_usingDDict(dctx, bytesPointer(dst), C.size_t(len(dst)),
+		bytesPointer(src), C.size_t(len(src)), d.ddict)
+	if err := zstdError(n); err != nil {
+		return nil, err
+	}
+	return dst[:n], nil
+}
+
+// Close releases the memory of the decoder. It must not be used afterwards.
+func (d *ZSTDDecoder) Close() {
+	close(d.ctxs)
+	for dctx := range d.ctxs {
+		C.ZSTD_freeDCtx(dctx)
+	}
+	C.ZSTD_freeDDict(d.ddict)
+}
+
+func bytesPointer(b []byte) unsafe.Pointer {
+	if len(b) == 0 {
+		return nil
+	}
+	return unsafe.Pointer(&b[0])
+}
@@ -31,6 +31,43 @@ func ZSTDCompress(dst, src []byte, compressionLevel int) ([]byte, error) {
 	return nil, ErrZstdCgo
 }
 
+// ZSTDTrainDict trains a ZSTD dictionary of up to dictSize bytes on the given samples.
+func ZSTDTrainDict(samples [][]byte, dictSize int) ([]byte, error) {
+	return nil, ErrZstdCgo
+}
+
+// ZSTDEncoder compresses blocks with a ZSTD dictionary.
+type ZSTDEncoder struct{}
+
+// NewZSTDEncoder returns an encoder compressing with the given dictionary and compression level.
+func NewZSTDEncoder(dict []byte, compressionLevel int) (*ZSTDEncoder, error) {
+	return nil, ErrZstdCgo
+}
+
+// Compress compresses src into dst.
+func (e *ZSTDEncoder) Compress(dst, src []byte) ([]byte, error) {
+	return nil, ErrZstdCgo
+}
+
+// Close releases the memory of the encoder.
+func (e *ZSTDEncoder) Close() {}
+
+// ZSTDDecoder decompresses the blocks compressed by a ZSTDEncoder with the same dictionary.
+type ZSTDDecoder struct{}
+
+// NewZSTDDecoder returns a decoder decompressing with the given dictionary.
+func NewZSTDDecoder(dict []byte) (*ZSTDDecoder, error) {
+	return nil, ErrZstdCgo
+}
+
+// Decompress decompresses src into dst.
+func (d *ZSTDDecoder) Decompress(dst, src []byte) ([]byte, error) {
+	return nil, ErrZstdCgo
+}
+
+// Close releases the memory of the decoder.
+func (d *ZSTDDecoder) Close() {}
+
 // ZSTDCompressBound returns the worst case size needed for a destination buffer.
 func ZSTDCompressBound(srcSize int) int {
 	panic("ZSTD only supported in Cgo.")